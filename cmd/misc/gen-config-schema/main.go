@@ -0,0 +1,26 @@
+package main
+
+// Generates config-schema.json from the config types, run with go generate ./proxy/config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mostlygeek/llama-swap/proxy/config"
+)
+
+func main() {
+	output := flag.String("o", "config-schema.json", "file to write the schema to")
+	flag.Parse()
+
+	schema, err := config.GenerateJSONSchema()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error generating schema: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(*output, schema, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing schema: %v\n", err)
+		os.Exit(1)
+	}
+}
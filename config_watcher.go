@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mostlygeek/llama-swap/event"
+	"github.com/mostlygeek/llama-swap/proxy"
+	"github.com/mostlygeek/llama-swap/proxy/config"
+)
+
+// configWatcher emits a ConfigFileChangedEvent when the config file or one
+// of its includes changes. What is watched follows the includes of the
+// config loaded last, see update.
+type configWatcher struct {
+	configPath string
+	watcher    *fsnotify.Watcher
+
+	mu          sync.Mutex
+	files       map[string]bool // the config, its includes and the recipe include
+	includeDirs map[string]bool // any yaml file showing up there may be included
+	missing     []string        // wanted directories that do not exist yet
+	watched     map[string]bool // directories added to watcher
+}
+
+func newConfigWatcher(configPath string) (*configWatcher, error) {
+	absConfigPath, err := filepath.Abs(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("getting absolute path of config file: %w", err)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("creating file watcher: %w", err)
+	}
+	return &configWatcher{
+		configPath: absConfigPath,
+		watcher:    watcher,
+		watched:    make(map[string]bool),
+	}, nil
+}
+
+// update watches the files and include directories of conf. It is called
+// after every reload so new include entries and directories are picked up.
+func (w *configWatcher) update(conf config.Config) {
+	recipePath, err := filepath.Abs(proxy.RecipeConfigPath(w.configPath))
+	if err != nil {
+		recipePath = w.configPath
+	}
+	files := map[string]bool{w.configPath: true, recipePath: true}
+	includeDirs := make(map[string]bool)
+	for _, file := range conf.IncludedFiles {
+		files[file] = true
+		includeDirs[filepath.Dir(file)] = true
+	}
+	for _, dir := range conf.IncludeDirs {
+		includeDirs[dir] = true
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.files = files
+	w.includeDirs = includeDirs
+	w.watchDirs()
+}
+
+// watchDirs adds the directories of the watched files and the include
+// directories to the watcher. One that does not exist yet is watched from
+// its nearest parent until it is created.
+func (w *configWatcher) watchDirs() {
+	wanted := make(map[string]bool, len(w.files)+len(w.includeDirs))
+	for file := range w.files {
+		wanted[filepath.Dir(file)] = true
+	}
+	for dir := range w.includeDirs {
+		wanted[dir] = true
+	}
+
+	w.missing = nil
+	next := make(map[string]bool, len(wanted))
+	for dir := range wanted {
+		watchDir := dir
+		for {
+			if _, err := os.Stat(watchDir); err == nil || filepath.Dir(watchDir) == watchDir {
+				break
+			}
+			watchDir = filepath.Dir(watchDir)
+		}
+		if watchDir != dir {
+			w.missing = append(w.missing, dir)
+		}
+		if next[watchDir] {
+			continue
+		}
+		if !w.watched[watchDir] {
+			if err := w.watcher.Add(watchDir); err != nil {
+				fmt.Printf("Error adding directory (%s) to config watcher: %v\n", watchDir, err)
+				continue
+			}
+		}
+		next[watchDir] = true
+	}
+	for dir := range w.watched {
+		if !next[dir] {
+			w.watcher.Remove(dir)
+		}
+	}
+	w.watched = next
+}
+
+func (w *configWatcher) isConfigFile(name string) bool {
+	if w.files[name] {
+		return true
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	return w.includeDirs[filepath.Dir(name)] && (ext == ".yaml" || ext == ".yml")
+}
+
+// createsMissing returns true when name is a missing directory or one of
+// its parents
+func (w *configWatcher) createsMissing(name string) bool {
+	for _, dir := range w.missing {
+		if dir == name || strings.HasPrefix(dir, name+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// run handles the changes until the watcher is closed
+func (w *configWatcher) run() {
+	defer w.watcher.Close()
+	for {
+		select {
+		case changeEvent, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if w.changed(changeEvent) {
+				event.Emit(proxy.ConfigFileChangedEvent{
+					ReloadingState: proxy.ReloadingStateStart,
+				})
+			}
+
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("File watcher error: %v", err)
+		}
+	}
+}
+
+// changed returns true when changeEvent needs the config to be reloaded
+func (w *configWatcher) changed(changeEvent fsnotify.Event) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if changeEvent.Has(fsnotify.Create) && w.createsMissing(changeEvent.Name) {
+		missing := w.missing
+		w.watchDirs()
+		// files may have been written to a new directory before it was
+		// watched
+		for _, dir := range missing {
+			if !slices.Contains(w.missing, dir) {
+				return true
+			}
+		}
+		return false
+	}
+	if w.isConfigFile(changeEvent.Name) && (changeEvent.Has(fsnotify.Write) || changeEvent.Has(fsnotify.Create) || changeEvent.Has(fsnotify.Remove)) {
+		return true
+	}
+	// the change for k8s configmap
+	return changeEvent.Name == filepath.Join(filepath.Dir(w.configPath), "..data") && changeEvent.Has(fsnotify.Create)
+}
@@ -8,12 +8,10 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
 	"github.com/gin-gonic/gin"
 	"github.com/mostlygeek/llama-swap/event"
 	"github.com/mostlygeek/llama-swap/proxy"
@@ -32,8 +30,11 @@ func main() {
 	listenStr := flag.String("listen", "", "listen ip/port")
 	certFile := flag.String("tls-cert-file", "", "TLS certificate file")
 	keyFile := flag.String("tls-key-file", "", "TLS key file")
+	clientCAFile := flag.String("tls-client-ca-file", "", "CA bundle to verify TLS client certificates against, requires them")
+	clientCertOptional := flag.Bool("tls-client-cert-optional", false, "accept TLS clients without a certificate, requires --tls-client-ca-file")
 	showVersion := flag.Bool("version", false, "show version of build")
 	watchConfig := flag.Bool("watch-config", false, "Automatically reload config file on change")
+	validateConfig := flag.Bool("validate-config", false, "validate the config file and its includes, then exit")
 
 	flag.Parse() // Parse the command-line flags
 
@@ -42,6 +43,10 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *validateConfig {
+		os.Exit(runConfigValidation(*configPath))
+	}
+
 	conf, err := config.LoadConfig(*configPath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -70,6 +75,14 @@ func main() {
 		fmt.Println("Error: Both --tls-cert-file and --tls-key-file must be provided for TLS.")
 		os.Exit(1)
 	}
+	if *clientCAFile != "" && !useTLS {
+		fmt.Println("Error: --tls-client-ca-file requires --tls-cert-file and --tls-key-file.")
+		os.Exit(1)
+	}
+	if *clientCertOptional && *clientCAFile == "" {
+		fmt.Println("Error: --tls-client-cert-optional requires --tls-client-ca-file.")
+		os.Exit(1)
+	}
 
 	// Set default ports (can be overridden with LLAMA_SWAP_LISTEN).
 	if *listenStr == "" {
@@ -93,7 +106,28 @@ func main() {
 		Addr: *listenStr,
 	}
 
+	// the certificate files are reloaded when they change, rotating them
+	// does not restart the models
+	if useTLS {
+		tlsReloader, err := proxy.NewTLSReloader(proxy.TLSOptions{
+			CertFile:           *certFile,
+			KeyFile:            *keyFile,
+			ClientCAFile:       *clientCAFile,
+			ClientCertOptional: *clientCertOptional,
+		}, proxy.NewLogMonitorWriter(os.Stdout))
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if err := tlsReloader.Watch(); err != nil {
+			fmt.Printf("Error watching TLS files: %v. Certificate reloading disabled.\n", err)
+		}
+		defer tlsReloader.Close()
+		srv.TLSConfig = tlsReloader.Config()
+	}
+
 	// Support for watching config and reloading when it changes
+	var configWatch *configWatcher
 	reloadProxyManager := func() {
 		if currentPM, ok := srv.Handler.(*proxy.ProxyManager); ok {
 			conf, err = config.LoadConfig(*configPath)
@@ -101,13 +135,23 @@ func main() {
 				fmt.Printf("Warning, unable to reload configuration: %v\n", err)
 				return
 			}
+			// the includes may have changed
+			if configWatch != nil {
+				configWatch.update(conf)
+			}
 
-			fmt.Println("Configuration Changed")
-			currentPM.Shutdown()
-			newPM := proxy.NewWithConfigPath(conf, *configPath)
-			newPM.SetVersion(date, commit, version)
-			srv.Handler = newPM
-			fmt.Println("Configuration Reloaded")
+			// rate limits and client access rules are applied without
+			// restarting the models
+			if currentPM.UpdateAccessRules(conf) {
+				fmt.Println("Access Rules Reloaded")
+			} else {
+				fmt.Println("Configuration Changed")
+				currentPM.Shutdown()
+				newPM := proxy.NewWithConfigPath(conf, *configPath)
+				newPM.SetVersion(date, commit, version)
+				srv.Handler = newPM
+				fmt.Println("Configuration Reloaded")
+			}
 
 			// wait a few seconds and tell any UI to reload
 			time.AfterFunc(3*time.Second, func() {
@@ -138,45 +182,14 @@ func main() {
 		})()
 
 		fmt.Println("Watching Configuration for changes")
-		go func() {
-			absConfigPath, err := filepath.Abs(*configPath)
-			if err != nil {
-				fmt.Printf("Error getting absolute path for watching config file: %v\n", err)
-				return
-			}
-			watcher, err := fsnotify.NewWatcher()
-			if err != nil {
-				fmt.Printf("Error creating file watcher: %v. File watching disabled.\n", err)
-				return
-			}
-
-			configDir := filepath.Dir(absConfigPath)
-			err = watcher.Add(configDir)
-			if err != nil {
-				fmt.Printf("Error adding config path directory (%s) to watcher: %v. File watching disabled.", configDir, err)
-				return
-			}
-
-			defer watcher.Close()
-			for {
-				select {
-				case changeEvent := <-watcher.Events:
-					if changeEvent.Name == absConfigPath && (changeEvent.Has(fsnotify.Write) || changeEvent.Has(fsnotify.Create) || changeEvent.Has(fsnotify.Remove)) {
-						event.Emit(proxy.ConfigFileChangedEvent{
-							ReloadingState: proxy.ReloadingStateStart,
-						})
-					} else if changeEvent.Name == filepath.Join(configDir, "..data") && changeEvent.Has(fsnotify.Create) {
-						// the change for k8s configmap
-						event.Emit(proxy.ConfigFileChangedEvent{
-							ReloadingState: proxy.ReloadingStateStart,
-						})
-					}
-
-				case err := <-watcher.Errors:
-					log.Printf("File watcher error: %v", err)
-				}
-			}
-		}()
+		watcher, err := newConfigWatcher(*configPath)
+		if err != nil {
+			fmt.Printf("Error: %v. File watching disabled.\n", err)
+		} else {
+			watcher.update(conf)
+			configWatch = watcher
+			go watcher.run()
+		}
 	}
 
 	// shutdown on signal
@@ -203,7 +216,8 @@ func main() {
 		var err error
 		if useTLS {
 			fmt.Printf("llama-swap listening with TLS on https://%s\n", *listenStr)
-			err = srv.ListenAndServeTLS(*certFile, *keyFile)
+			// the certificate comes from srv.TLSConfig
+			err = srv.ListenAndServeTLS("", "")
 		} else {
 			fmt.Printf("llama-swap listening on http://%s\n", *listenStr)
 			err = srv.ListenAndServe()
@@ -226,3 +240,24 @@ func debounce(interval time.Duration, f func()) func() {
 		timer = time.AfterFunc(interval, f)
 	}
 }
+
+// runConfigValidation prints every problem found in the config and returns
+// the exit code, 1 when there are errors
+func runConfigValidation(configPath string) int {
+	results := config.ValidateConfig(configPath, nil)
+	warnings := 0
+	for _, result := range results {
+		fmt.Println(result.String())
+		if result.Severity == config.SeverityWarning {
+			warnings++
+		}
+	}
+
+	errorCount := len(results) - warnings
+	if errorCount > 0 {
+		fmt.Printf("%s: %d error(s), %d warning(s)\n", configPath, errorCount, warnings)
+		return 1
+	}
+	fmt.Printf("%s: OK, %d warning(s)\n", configPath, warnings)
+	return 0
+}
@@ -0,0 +1,504 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	adminSessionCookie = "llama_swap_session"
+	adminCSRFCookie    = "llama_swap_csrf" // readable by the UI, sent back in adminCSRFHeader
+	adminCSRFHeader    = "X-CSRF-Token"
+
+	// adminLoginPath is where signed out browsers are sent, it is also in the
+	// X-Login-URL header of 401 responses so the UI can redirect
+	adminLoginPath = "/auth/login"
+
+	// how long an OIDC sign in can take
+	oidcLoginTTL = 10 * time.Minute
+)
+
+// ginAdminSession is the gin.Context key where the *adminSession of a
+// request signed in with a session cookie is stored
+const ginAdminSession = "adminSession"
+
+// ways to sign in
+const (
+	adminAuthPassword = "password"
+	adminAuthOIDC     = "oidc"
+)
+
+// adminSession is a signed in admin user
+type adminSession struct {
+	id      string
+	user    string
+	role    string // current role of password users is taken from the config
+	method  string // adminAuthPassword or adminAuthOIDC
+	csrf    string
+	expires time.Time
+}
+
+// oidcLogin is an OIDC sign in waiting for the callback, by state
+type oidcLogin struct {
+	nonce    string
+	verifier string // PKCE code verifier
+	next     string
+	expires  time.Time
+}
+
+// adminSessions keeps the sessions of admin users in memory, a restart or a
+// full config reload signs everyone out
+type adminSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*adminSession // by id
+	logins   map[string]*oidcLogin    // by state
+
+	now func() time.Time
+}
+
+func newAdminSessions() *adminSessions {
+	return &adminSessions{
+		sessions: make(map[string]*adminSession),
+		logins:   make(map[string]*oidcLogin),
+		now:      time.Now,
+	}
+}
+
+// randomToken returns 32 random bytes, base64url encoded
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand does not fail on supported platforms
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (s *adminSessions) create(user, role, method string, ttl time.Duration) *adminSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for id, session := range s.sessions {
+		if now.After(session.expires) {
+			delete(s.sessions, id)
+		}
+	}
+	session := &adminSession{
+		id:      randomToken(),
+		user:    user,
+		role:    role,
+		method:  method,
+		csrf:    randomToken(),
+		expires: now.Add(ttl),
+	}
+	s.sessions[session.id] = session
+	return session
+}
+
+// get returns the session with id, nil when it does not exist or expired
+func (s *adminSessions) get(id string) *adminSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, found := s.sessions[id]
+	if !found {
+		return nil
+	}
+	if s.now().After(session.expires) {
+		delete(s.sessions, id)
+		return nil
+	}
+	copied := *session
+	return &copied
+}
+
+func (s *adminSessions) delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+func (s *adminSessions) addLogin(state string, login *oidcLogin) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for state, pending := range s.logins {
+		if now.After(pending.expires) {
+			delete(s.logins, state)
+		}
+	}
+	login.expires = now.Add(oidcLoginTTL)
+	s.logins[state] = login
+}
+
+// takeLogin returns and forgets the sign in of state, a state can only be
+// used once
+func (s *adminSessions) takeLogin(state string) *oidcLogin {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	login, found := s.logins[state]
+	delete(s.logins, state)
+	if !found || s.now().After(login.expires) {
+		return nil
+	}
+	return login
+}
+
+// roleEndpointClass returns the endpoint class a named API key needs to call
+// a route that requires role
+func roleEndpointClass(role string) string {
+	if role == config.AdminRoleViewer {
+		return config.APIKeyEndpointReadOnly
+	}
+	return config.APIKeyEndpointAdmin
+}
+
+// safeMethod returns true for requests that can not change anything, they
+// need no CSRF token
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// adminSessionOf returns the session of the session cookie of the request,
+// nil without one. The role of password users is updated from the config.
+func (pm *ProxyManager) adminSessionOf(c *gin.Context) *adminSession {
+	if !pm.config.AdminAuth.Enabled() {
+		return nil
+	}
+	id, err := c.Cookie(adminSessionCookie)
+	if err != nil || id == "" {
+		return nil
+	}
+	session := pm.adminSessions.get(id)
+	if session == nil {
+		return nil
+	}
+	if session.method == adminAuthPassword {
+		user, found := pm.config.AdminAuth.Users[session.user]
+		if !found {
+			return nil
+		}
+		session.role = user.Role
+	}
+	return session
+}
+
+// checkAdminSession returns the session of the request when it has one and,
+// unless the request is safe, the CSRF token of the session. It sends a 403
+// response and returns false for a session without a matching token.
+func (pm *ProxyManager) checkAdminSession(c *gin.Context) (*adminSession, bool) {
+	session := pm.adminSessionOf(c)
+	if session == nil {
+		return nil, true
+	}
+	if !safeMethod(c.Request.Method) && subtle.ConstantTimeCompare([]byte(c.GetHeader(adminCSRFHeader)), []byte(session.csrf)) != 1 {
+		pm.proxyLogger.Infof("User %s sent %s %s without a valid CSRF token", session.user, c.Request.Method, c.Request.URL.Path)
+		pm.sendErrorResponse(c, http.StatusForbidden, "forbidden: missing or invalid "+adminCSRFHeader+" header")
+		c.Abort()
+		return nil, false
+	}
+	c.Set(ginAdminSession, session)
+	return session, true
+}
+
+// refuseSessionSafeMethod refuses a safe method with a session on a route
+// that changes state. Browsers send the session cookie on top level
+// navigations from other sites and safe methods need no CSRF token, so
+// signed in users have to use POST. API keys can still use the safe method.
+func (pm *ProxyManager) refuseSessionSafeMethod(c *gin.Context) {
+	if session, ok := c.Value(ginAdminSession).(*adminSession); ok && safeMethod(c.Request.Method) {
+		pm.proxyLogger.Infof("User %s sent %s %s, which requires POST with a session", session.user, c.Request.Method, c.Request.URL.Path)
+		pm.sendErrorResponse(c, http.StatusForbidden, "forbidden: use POST with the "+adminCSRFHeader+" header")
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// requireRole authenticates the requests to a route that requires role. With
+// adminAuth the request needs a session of a user with the role, or a named
+// API key with the endpoint class of the role. Without it, the route has the
+// endpoint class of the role.
+func (pm *ProxyManager) requireRole(role string) gin.HandlerFunc {
+	if !pm.config.AdminAuth.Enabled() {
+		return pm.apiKeyAuth(roleEndpointClass(role))
+	}
+
+	return func(c *gin.Context) {
+		if pm.authorizeRole(c, role) {
+			c.Next()
+		}
+	}
+}
+
+// authorizeRole returns true when the request has a session or named API
+// key with role, otherwise it sends the response
+func (pm *ProxyManager) authorizeRole(c *gin.Context, role string) bool {
+	session, ok := pm.checkAdminSession(c)
+	if !ok {
+		return false
+	}
+	if session != nil {
+		if config.AdminRoleRank(session.role) < config.AdminRoleRank(role) {
+			pm.proxyLogger.Infof("User %s (%s) is not allowed to call %s %s", session.user, session.role, c.Request.Method, c.Request.URL.Path)
+			pm.sendErrorResponse(c, http.StatusForbidden, "forbidden: requires the "+role+" role")
+			c.Abort()
+			return false
+		}
+		return true
+	}
+
+	// keys in apiKeys are inference credentials, only named keys with the
+	// endpoint class can be used here
+	if entry, providedKey := pm.requestAPIKeyEntry(c); entry != nil && entry.identity != nil {
+		if !entry.identity.AllowsEndpoint(roleEndpointClass(role)) {
+			pm.proxyLogger.Infof("API key %s is not allowed to call %s %s", entry.name, c.Request.Method, c.Request.URL.Path)
+			c.Set(ginAPIKeyName, entry.name)
+			pm.sendErrorResponse(c, http.StatusForbidden, "forbidden: API key is not allowed to call this endpoint")
+			c.Abort()
+			return false
+		}
+		pm.setAPIKey(c, entry, providedKey)
+		return true
+	}
+
+	if strings.HasPrefix(c.Request.URL.Path, "/ui") {
+		c.Redirect(http.StatusFound, adminLoginPath+"?next="+url.QueryEscape(c.Request.URL.RequestURI()))
+		c.Abort()
+		return false
+	}
+	c.Header("X-Login-URL", adminLoginPath)
+	pm.sendErrorResponse(c, http.StatusUnauthorized, "unauthorized: sign in at "+adminLoginPath)
+	c.Abort()
+	return false
+}
+
+// uiAuth sends signed out browsers to the sign in page when adminAuth is
+// enabled, the UI is public otherwise
+func (pm *ProxyManager) uiAuth(c *gin.Context) bool {
+	return !pm.config.AdminAuth.Enabled() || pm.authorizeRole(c, config.AdminRoleViewer)
+}
+
+// setAdminSessionCookies sends the cookies of a new session
+func (pm *ProxyManager) setAdminSessionCookies(c *gin.Context, session *adminSession) {
+	maxAge := int(time.Until(session.expires).Seconds())
+	secure := c.Request.TLS != nil || strings.EqualFold(c.GetHeader("X-Forwarded-Proto"), "https")
+	http.SetCookie(c.Writer, &http.Cookie{Name: adminSessionCookie, Value: session.id, Path: "/", MaxAge: maxAge, HttpOnly: true, Secure: secure, SameSite: http.SameSiteLaxMode})
+	http.SetCookie(c.Writer, &http.Cookie{Name: adminCSRFCookie, Value: session.csrf, Path: "/", MaxAge: maxAge, Secure: secure, SameSite: http.SameSiteStrictMode})
+}
+
+func clearAdminSessionCookies(c *gin.Context) {
+	for _, name := range []string{adminSessionCookie, adminCSRFCookie} {
+		http.SetCookie(c.Writer, &http.Cookie{Name: name, Value: "", Path: "/", MaxAge: -1})
+	}
+}
+
+// localRedirect returns next when it is a path on this server, otherwise /ui
+func localRedirect(next string) string {
+	if strings.HasPrefix(next, "/") && !strings.HasPrefix(next, "//") && !strings.HasPrefix(next, "/\\") {
+		return next
+	}
+	return "/ui"
+}
+
+// sameOrigin returns false for requests from another site, browsers send
+// Origin with every POST
+func sameOrigin(c *gin.Context) bool {
+	origin := c.GetHeader("Origin")
+	if origin == "" {
+		return true
+	}
+	parsed, err := url.Parse(origin)
+	return err == nil && parsed.Host == c.Request.Host
+}
+
+// dummyPasswordHash is compared when a user does not exist, so a sign in
+// takes as long for unknown users
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("llama-swap"), bcrypt.DefaultCost)
+
+// checkPassword returns the role of the user, empty when the user or the
+// password is wrong
+func (pm *ProxyManager) checkPassword(username, password string) string {
+	user, found := pm.config.AdminAuth.Users[username]
+	hash := []byte(user.PasswordHash)
+	if !found {
+		hash = dummyPasswordHash
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !found {
+		return ""
+	}
+	return user.Role
+}
+
+type adminLoginRequest struct {
+	Username string `json:"username" form:"username"`
+	Password string `json:"password" form:"password"`
+	Next     string `json:"next" form:"next"`
+}
+
+type adminSessionResponse struct {
+	Enabled   bool      `json:"enabled"`
+	User      string    `json:"user,omitempty"`
+	Role      string    `json:"role,omitempty"`
+	Method    string    `json:"method,omitempty"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+	CSRFToken string    `json:"csrf_token,omitempty"`
+}
+
+func newAdminSessionResponse(session *adminSession) adminSessionResponse {
+	return adminSessionResponse{
+		Enabled:   true,
+		User:      session.user,
+		Role:      session.role,
+		Method:    session.method,
+		ExpiresAt: session.expires,
+		CSRFToken: session.csrf,
+	}
+}
+
+// addAdminAuthHandlers adds the routes to sign in and out
+func addAdminAuthHandlers(pm *ProxyManager) {
+	pm.ginEngine.GET(adminLoginPath, pm.adminLoginPage)
+	pm.ginEngine.POST(adminLoginPath, pm.adminLogin)
+	pm.ginEngine.POST("/auth/logout", pm.adminLogout)
+	pm.ginEngine.GET("/auth/session", pm.adminGetSession)
+	pm.ginEngine.GET("/auth/oidc/login", pm.oidcLogin)
+	pm.ginEngine.GET("/auth/oidc/callback", pm.oidcCallback)
+}
+
+func (pm *ProxyManager) adminLoginPage(c *gin.Context) {
+	if !pm.config.AdminAuth.Enabled() {
+		c.Redirect(http.StatusFound, "/ui")
+		return
+	}
+	pm.renderLoginPage(c, http.StatusOK, "")
+}
+
+func (pm *ProxyManager) renderLoginPage(c *gin.Context, status int, message string) {
+	// a failed form sign in keeps the page the user was sent from
+	next := c.PostForm("next")
+	if next == "" {
+		next = c.Query("next")
+	}
+	c.Status(status)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Header("Cache-Control", "no-store")
+	_ = adminLoginTemplate.Execute(c.Writer, map[string]any{
+		"Next":      localRedirect(next),
+		"Message":   message,
+		"Passwords": len(pm.config.AdminAuth.Users) > 0,
+		"OIDC":      pm.config.AdminAuth.OIDC.Issuer != "",
+	})
+}
+
+func (pm *ProxyManager) adminLogin(c *gin.Context) {
+	if !pm.config.AdminAuth.Enabled() || len(pm.config.AdminAuth.Users) == 0 {
+		pm.sendErrorResponse(c, http.StatusNotFound, "password sign in is not enabled")
+		return
+	}
+	if !sameOrigin(c) {
+		pm.sendErrorResponse(c, http.StatusForbidden, "forbidden: cross-origin sign in")
+		return
+	}
+	var req adminLoginRequest
+	if err := c.ShouldBind(&req); err != nil {
+		pm.sendErrorResponse(c, http.StatusBadRequest, "invalid sign in request")
+		return
+	}
+	isForm := c.ContentType() != "application/json"
+
+	role := pm.checkPassword(req.Username, req.Password)
+	if role == "" {
+		pm.proxyLogger.Infof("Failed sign in of user %q from %s", req.Username, c.ClientIP())
+		if isForm {
+			pm.renderLoginPage(c, http.StatusUnauthorized, "Invalid user name or password")
+			return
+		}
+		pm.sendErrorResponse(c, http.StatusUnauthorized, "unauthorized: invalid user name or password")
+		return
+	}
+
+	ttl := time.Duration(pm.config.AdminAuth.SessionTTL) * time.Second
+	session := pm.adminSessions.create(req.Username, role, adminAuthPassword, ttl)
+	pm.setAdminSessionCookies(c, session)
+	pm.proxyLogger.Infof("User %s (%s) signed in from %s", session.user, session.role, c.ClientIP())
+	if isForm {
+		c.Redirect(http.StatusSeeOther, localRedirect(req.Next))
+		return
+	}
+	c.JSON(http.StatusOK, newAdminSessionResponse(session))
+}
+
+func (pm *ProxyManager) adminLogout(c *gin.Context) {
+	session, ok := pm.checkAdminSession(c)
+	if !ok {
+		return
+	}
+	if session != nil {
+		pm.adminSessions.delete(session.id)
+		pm.proxyLogger.Infof("User %s signed out", session.user)
+	}
+	clearAdminSessionCookies(c)
+	c.JSON(http.StatusOK, gin.H{"msg": "ok"})
+}
+
+func (pm *ProxyManager) adminGetSession(c *gin.Context) {
+	if !pm.config.AdminAuth.Enabled() {
+		c.JSON(http.StatusOK, adminSessionResponse{Enabled: false})
+		return
+	}
+	session := pm.adminSessionOf(c)
+	if session == nil {
+		c.Header("X-Login-URL", adminLoginPath)
+		pm.sendErrorResponse(c, http.StatusUnauthorized, "unauthorized: sign in at "+adminLoginPath)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, newAdminSessionResponse(session))
+}
+
+var adminLoginTemplate = template.Must(template.New("login").Parse(`<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>llama-swap sign in</title>
+<style>
+body { font-family: system-ui, sans-serif; background: #f4f4f5; display: flex; justify-content: center; padding-top: 10vh; }
+main { background: #fff; padding: 2rem; border-radius: 8px; width: 20rem; box-shadow: 0 1px 3px rgba(0,0,0,.15); }
+label, input, button, a.button { display: block; width: 100%; box-sizing: border-box; margin-bottom: .75rem; }
+input, button, a.button { padding: .5rem; font-size: 1rem; }
+a.button { text-align: center; border: 1px solid #999; border-radius: 4px; color: inherit; text-decoration: none; }
+p.error { color: #b91c1c; }
+</style>
+</head>
+<body>
+<main>
+<h1>llama-swap</h1>
+{{if .Message}}<p class="error">{{.Message}}</p>{{end}}
+{{if .Passwords}}
+<form method="post" action="/auth/login">
+<input type="hidden" name="next" value="{{.Next}}">
+<label>User name <input name="username" autocomplete="username" required autofocus></label>
+<label>Password <input name="password" type="password" autocomplete="current-password" required></label>
+<button type="submit">Sign in</button>
+</form>
+{{end}}
+{{if .OIDC}}<a class="button" href="/auth/oidc/login?next={{.Next}}">Sign in with single sign-on</a>{{end}}
+</main>
+</body>
+</html>
+`))
@@ -0,0 +1,357 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"html"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func testPasswordHash(t *testing.T, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	require.NoError(t, err)
+	return string(hash)
+}
+
+func TestAPIRouteRoles(t *testing.T) {
+	proxy := New(config.AddDefaultGroupToConfig(config.Config{LogLevel: "error"}))
+	defer proxy.StopProcesses(StopImmediately)
+
+	for _, route := range proxy.ginEngine.Routes() {
+		if strings.HasPrefix(route.Path, "/api/") {
+			assert.Contains(t, proxy.apiRoles, route.Method+" "+route.Path)
+		}
+	}
+	assert.Equal(t, config.AdminRoleViewer, proxy.apiRoles["GET /api/version"])
+	assert.Equal(t, config.AdminRoleOperator, proxy.apiRoles["POST /api/models/unload"])
+	assert.Equal(t, config.AdminRoleAdmin, proxy.apiRoles["POST /api/recipes/backend/action"])
+	assert.Equal(t, config.AdminRoleAdmin, proxy.apiRoles["POST /api/cluster/dgx/update"])
+	assert.Equal(t, config.AdminRoleAdmin, proxy.apiRoles["GET /api/config/editor"])
+}
+
+// adminClient keeps the cookies of an admin user
+type adminClient struct {
+	t       *testing.T
+	proxy   *ProxyManager
+	cookies map[string]*http.Cookie
+}
+
+func (a *adminClient) send(method, path, body string, header map[string]string) *TestResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	for _, cookie := range a.cookies {
+		req.AddCookie(cookie)
+	}
+	w := CreateTestResponseRecorder()
+	a.proxy.ServeHTTP(w, req)
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.MaxAge < 0 {
+			delete(a.cookies, cookie.Name)
+		} else {
+			a.cookies[cookie.Name] = cookie
+		}
+	}
+	return w
+}
+
+func (a *adminClient) csrf() map[string]string {
+	require.Contains(a.t, a.cookies, adminCSRFCookie)
+	return map[string]string{adminCSRFHeader: a.cookies[adminCSRFCookie].Value}
+}
+
+func TestProxyManager_AdminAuthPassword(t *testing.T) {
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"model1": getTestSimpleResponderConfig("model1"),
+		},
+		RequiredAPIKeys: []string{"inference-key"},
+		APIKeyIdentities: map[string]config.APIKeyIdentity{
+			"dashboard": {Key: "dashboard-key", Models: []string{"*"}, Endpoints: []string{config.APIKeyEndpointReadOnly}},
+			"ops":       {Key: "ops-key", Models: []string{"*"}, Endpoints: []string{config.APIKeyEndpointAdmin}},
+		},
+		AdminAuth: config.AdminAuthConfig{
+			Users: map[string]config.AdminUser{
+				"alice":  {PasswordHash: testPasswordHash(t, "alice-password"), Role: config.AdminRoleAdmin},
+				"victor": {PasswordHash: testPasswordHash(t, "victor-password"), Role: config.AdminRoleViewer},
+			},
+			SessionTTL: 3600,
+		},
+		LogLevel: "error",
+	})
+	proxy := New(conf)
+	defer proxy.StopProcesses(StopImmediately)
+	newClient := func() *adminClient {
+		return &adminClient{t: t, proxy: proxy, cookies: map[string]*http.Cookie{}}
+	}
+	login := func(client *adminClient, username, password string) *TestResponseRecorder {
+		body, _ := json.Marshal(adminLoginRequest{Username: username, Password: password})
+		return client.send("POST", "/auth/login", string(body), map[string]string{"Content-Type": "application/json"})
+	}
+
+	t.Run("signed out", func(t *testing.T) {
+		client := newClient()
+		w := client.send("GET", "/api/version", "", nil)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Equal(t, adminLoginPath, w.Header().Get("X-Login-URL"))
+		assert.Empty(t, w.Header().Get("WWW-Authenticate"))
+
+		// inference keys are not admin credentials, named keys with the
+		// endpoint class are
+		w = client.send("GET", "/api/version", "", map[string]string{"Authorization": "Bearer inference-key"})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		w = client.send("GET", "/api/version", "", map[string]string{"Authorization": "Bearer dashboard-key"})
+		assert.Equal(t, http.StatusOK, w.Code)
+		w = client.send("POST", "/api/benchy/unknown/cancel", "", map[string]string{"Authorization": "Bearer dashboard-key"})
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		w = client.send("GET", "/ui/models", "", nil)
+		assert.Equal(t, http.StatusFound, w.Code)
+		assert.Equal(t, "/auth/login?next=%2Fui%2Fmodels", w.Header().Get("Location"))
+
+		w = client.send("GET", "/auth/login", "", nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `name="password"`)
+		assert.NotContains(t, w.Body.String(), "single sign-on")
+
+		assert.Equal(t, http.StatusUnauthorized, login(client, "alice", "wrong").Code)
+		assert.Equal(t, http.StatusUnauthorized, login(client, "nobody", "alice-password").Code)
+		assert.Empty(t, client.cookies)
+	})
+
+	t.Run("roles", func(t *testing.T) {
+		client := newClient()
+		require.Equal(t, http.StatusOK, login(client, "victor", "victor-password").Code)
+		assert.True(t, client.cookies[adminSessionCookie].HttpOnly)
+
+		assert.Equal(t, http.StatusOK, client.send("GET", "/api/version", "", nil).Code)
+		assert.Equal(t, http.StatusOK, client.send("GET", "/running", "", nil).Code)
+		w := client.send("POST", "/api/benchy/unknown/cancel", "", client.csrf())
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Contains(t, w.Body.String(), "requires the operator role")
+		assert.Equal(t, http.StatusForbidden, client.send("GET", "/api/config/editor", "", nil).Code)
+
+		w = client.send("GET", "/auth/session", "", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "victor", gjson.Get(w.Body.String(), "user").String())
+		assert.Equal(t, config.AdminRoleViewer, gjson.Get(w.Body.String(), "role").String())
+		assert.Equal(t, client.cookies[adminCSRFCookie].Value, gjson.Get(w.Body.String(), "csrf_token").String())
+	})
+
+	t.Run("csrf", func(t *testing.T) {
+		client := newClient()
+		require.Equal(t, http.StatusOK, login(client, "alice", "alice-password").Code)
+
+		w := client.send("POST", "/api/benchy/unknown/cancel", "", nil)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Contains(t, w.Body.String(), adminCSRFHeader)
+		assert.Equal(t, http.StatusNotFound, client.send("POST", "/api/benchy/unknown/cancel", "", client.csrf()).Code)
+
+		// signed in users can use the playground
+		body := `{"model":"model1"}`
+		assert.Equal(t, http.StatusForbidden, client.send("POST", "/v1/chat/completions", body, nil).Code)
+		assert.Equal(t, http.StatusOK, client.send("POST", "/v1/chat/completions", body, client.csrf()).Code)
+		assert.Equal(t, http.StatusUnauthorized, newClient().send("POST", "/v1/chat/completions", body, nil).Code)
+
+		// a link from another site must not unload the models, sessions
+		// have to POST with the token while keys can still GET
+		w = client.send("GET", "/unload", "", nil)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Contains(t, w.Body.String(), adminCSRFHeader)
+		assert.Equal(t, http.StatusForbidden, client.send("POST", "/unload", "", nil).Code)
+		assert.Equal(t, http.StatusOK, client.send("POST", "/unload", "", client.csrf()).Code)
+		assert.Equal(t, http.StatusOK, newClient().send("GET", "/unload", "", map[string]string{"Authorization": "Bearer ops-key"}).Code)
+
+		w = client.send("POST", "/auth/logout", "", client.csrf())
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, client.cookies)
+		assert.Equal(t, http.StatusUnauthorized, client.send("GET", "/auth/session", "", nil).Code)
+	})
+
+	t.Run("form sign in", func(t *testing.T) {
+		form := func(next string) url.Values {
+			return url.Values{"username": {"alice"}, "password": {"alice-password"}, "next": {next}}
+		}
+		header := map[string]string{"Content-Type": "application/x-www-form-urlencoded"}
+
+		w := newClient().send("POST", "/auth/login", form("/ui/models").Encode(), header)
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+		assert.Equal(t, "/ui/models", w.Header().Get("Location"))
+
+		w = newClient().send("POST", "/auth/login", form("//example.com").Encode(), header)
+		assert.Equal(t, "/ui", w.Header().Get("Location"))
+
+		// a wrong password keeps next for the next try
+		failed := form("/ui/models")
+		failed.Set("password", "wrong")
+		w = newClient().send("POST", "/auth/login", failed.Encode(), header)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		match := regexp.MustCompile(`name="next" value="([^"]*)"`).FindStringSubmatch(w.Body.String())
+		require.Len(t, match, 2)
+		w = newClient().send("POST", "/auth/login", form(html.UnescapeString(match[1])).Encode(), header)
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+		assert.Equal(t, "/ui/models", w.Header().Get("Location"))
+
+		header["Origin"] = "http://attacker.test"
+		w = newClient().send("POST", "/auth/login", form("/ui").Encode(), header)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("removed users are signed out", func(t *testing.T) {
+		client := newClient()
+		require.Equal(t, http.StatusOK, login(client, "victor", "victor-password").Code)
+		proxy.Lock()
+		delete(proxy.config.AdminAuth.Users, "victor")
+		proxy.Unlock()
+		assert.Equal(t, http.StatusUnauthorized, client.send("GET", "/api/version", "", nil).Code)
+	})
+}
+
+// testOIDCProvider is an OpenID provider that signs in every user with the
+// claims of the test
+type testOIDCProvider struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	challenge string
+	claims    map[string]any
+}
+
+func newTestOIDCProvider(t *testing.T) *testOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	p := &testOIDCProvider{key: key}
+
+	router := gin.New()
+	router.GET("/.well-known/openid-configuration", func(c *gin.Context) {
+		c.JSON(http.StatusOK, oidcDiscovery{
+			Issuer:                p.URL,
+			AuthorizationEndpoint: p.URL + "/authorize",
+			TokenEndpoint:         p.URL + "/token",
+			JWKSURI:               p.URL + "/jwks",
+		})
+	})
+	router.GET("/jwks", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"keys": []jsonWebKey{{
+			Kid: "test",
+			Kty: "RSA",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	router.POST("/token", func(c *gin.Context) {
+		verifier := sha256.Sum256([]byte(c.PostForm("code_verifier")))
+		if c.PostForm("code") != "test-code" || base64.RawURLEncoding.EncodeToString(verifier[:]) != p.challenge {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_grant"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"id_token": p.sign(t, p.claims)})
+	})
+	p.Server = httptest.NewServer(router)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *testOIDCProvider) sign(t *testing.T, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestProxyManager_AdminAuthOIDC(t *testing.T) {
+	provider := newTestOIDCProvider(t)
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		AdminAuth: config.AdminAuthConfig{
+			OIDC: config.OIDCConfig{
+				Issuer:        provider.URL,
+				ClientID:      "llama-swap",
+				Scopes:        []string{"openid"},
+				UsernameClaim: "preferred_username",
+				RoleClaim:     "groups",
+				Roles:         map[string]string{"llm-ops": config.AdminRoleOperator, "llm-admins": config.AdminRoleAdmin},
+			},
+			SessionTTL: 3600,
+		},
+		LogLevel: "error",
+	})
+	proxy := New(conf)
+	defer proxy.StopProcesses(StopImmediately)
+
+	// signIn follows the redirects of a sign in and returns the response of
+	// the callback
+	signIn := func(claims map[string]any) (*adminClient, *TestResponseRecorder) {
+		client := &adminClient{t: t, proxy: proxy, cookies: map[string]*http.Cookie{}}
+		w := client.send("GET", "/auth/oidc/login?next=/ui/models", "", nil)
+		require.Equal(t, http.StatusFound, w.Code)
+		authorize, err := url.Parse(w.Header().Get("Location"))
+		require.NoError(t, err)
+		assert.Equal(t, provider.URL+"/authorize", authorize.Scheme+"://"+authorize.Host+authorize.Path)
+		query := authorize.Query()
+		assert.Equal(t, "llama-swap", query.Get("client_id"))
+		assert.Equal(t, "http://example.com/auth/oidc/callback", query.Get("redirect_uri"))
+		assert.Equal(t, "S256", query.Get("code_challenge_method"))
+
+		provider.challenge = query.Get("code_challenge")
+		provider.claims = map[string]any{
+			"iss":   provider.URL,
+			"aud":   "llama-swap",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": query.Get("nonce"),
+		}
+		for name, value := range claims {
+			provider.claims[name] = value
+		}
+		w = client.send("GET", "/auth/oidc/callback?code=test-code&state="+url.QueryEscape(query.Get("state")), "", nil)
+		return client, w
+	}
+
+	client, w := signIn(map[string]any{"preferred_username": "olivia", "groups": []string{"staff", "llm-ops"}})
+	require.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/ui/models", w.Header().Get("Location"))
+	w = client.send("GET", "/auth/session", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "olivia", gjson.Get(w.Body.String(), "user").String())
+	assert.Equal(t, config.AdminRoleOperator, gjson.Get(w.Body.String(), "role").String())
+	assert.Equal(t, adminAuthOIDC, gjson.Get(w.Body.String(), "method").String())
+
+	// a state can only be used once
+	w = client.send("GET", "/auth/oidc/callback?code=test-code&state=unknown", "", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// users without a mapped group and no default role are rejected
+	_, w = signIn(map[string]any{"preferred_username": "sam", "groups": []string{"staff"}})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// tokens for other clients or with another nonce are rejected
+	_, w = signIn(map[string]any{"preferred_username": "mallory", "groups": "llm-admins", "aud": "other"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	_, w = signIn(map[string]any{"preferred_username": "mallory", "groups": "llm-admins", "nonce": "replayed"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	_, w = signIn(map[string]any{"preferred_username": "mallory", "groups": "llm-admins", "exp": time.Now().Add(-time.Hour).Unix()})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
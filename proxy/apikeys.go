@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mostlygeek/llama-swap/proxy/config"
+)
+
+// ginAPIKeyName is the gin.Context key where apiKeyAuth stores the name of
+// a named API key, or the ID of a key from apiKeys
+const ginAPIKeyName = "apiKeyName"
+
+// ginAPIKeyIdentity is the gin.Context key where apiKeyAuth stores the
+// *config.APIKeyIdentity of a named API key
+const ginAPIKeyIdentity = "apiKeyIdentity"
+
+// apiKeyEntry is an API key accepted by apiKeyAuth
+type apiKeyEntry struct {
+	hash [sha256.Size]byte
+	name string
+
+	// nil for the keys in apiKeys, they can use every model and endpoint
+	identity *config.APIKeyIdentity
+
+	// the identity has no key, only clientCerts
+	certOnly bool
+}
+
+// newAPIKeyEntries returns the keys of apiKeys and apiKeyIdentities, sorted
+// by name so a key listed twice always resolves to the same name
+func newAPIKeyEntries(conf config.Config) []apiKeyEntry {
+	var entries []apiKeyEntry
+	for _, key := range conf.RequiredAPIKeys {
+		entries = append(entries, apiKeyEntry{hash: sha256.Sum256([]byte(key)), name: apiKeyID(key)})
+	}
+
+	names := make([]string, 0, len(conf.APIKeyIdentities))
+	for name := range conf.APIKeyIdentities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		identity := conf.APIKeyIdentities[name]
+		entry := apiKeyEntry{name: name, identity: &identity}
+		switch {
+		case identity.Key != "":
+			entry.hash = sha256.Sum256([]byte(identity.Key))
+		case identity.KeyHash != "":
+			if _, err := hex.Decode(entry.hash[:], []byte(strings.TrimPrefix(identity.KeyHash, config.APIKeyHashPrefix))); err != nil {
+				continue // rejected by the config validation
+			}
+		default:
+			entry.certOnly = true
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// apiKeyEntries returns the keys of the running config
+func (pm *ProxyManager) apiKeyEntries() []apiKeyEntry {
+	pm.accessMu.RLock()
+	defer pm.accessMu.RUnlock()
+	return pm.apiKeys
+}
+
+// findAPIKey returns the entry of the key, nil when it is not valid
+func (pm *ProxyManager) findAPIKey(key string) *apiKeyEntry {
+	hash := sha256.Sum256([]byte(key))
+	entries := pm.apiKeyEntries()
+	var found *apiKeyEntry
+	for i := range entries {
+		// Use constant-time comparison to prevent timing attacks
+		if subtle.ConstantTimeCompare(hash[:], entries[i].hash[:]) == 1 && found == nil && !entries[i].certOnly {
+			found = &entries[i]
+		}
+	}
+	return found
+}
+
+// clientCertNames returns the common name and subject alternative names of
+// the verified client certificate of the request, nil without one
+func clientCertNames(r *http.Request) []string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	var names []string
+	if leaf.Subject.CommonName != "" {
+		names = append(names, leaf.Subject.CommonName)
+	}
+	names = append(names, leaf.DNSNames...)
+	names = append(names, leaf.EmailAddresses...)
+	for _, ip := range leaf.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range leaf.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// findClientCert returns the first named key, by name, with clientCerts
+// matching the client certificate of the request, nil when none matches
+func (pm *ProxyManager) findClientCert(r *http.Request) *apiKeyEntry {
+	names := clientCertNames(r)
+	if len(names) == 0 {
+		return nil
+	}
+	entries := pm.apiKeyEntries()
+	for i := range entries {
+		identity := entries[i].identity
+		if identity != nil && len(identity.ClientCerts) > 0 && matchPatterns(identity.ClientCerts, names...) {
+			return &entries[i]
+		}
+	}
+	return nil
+}
+
+// requestAPIKeyEntry returns the entry of the API key of the request, or
+// for requests without a key the entry of their client certificate, nil
+// when neither is valid
+func (pm *ProxyManager) requestAPIKeyEntry(c *gin.Context) (entry *apiKeyEntry, providedKey string) {
+	providedKey = requestAPIKey(c)
+	if providedKey == "" {
+		return pm.findClientCert(c.Request), ""
+	}
+	return pm.findAPIKey(providedKey), providedKey
+}
+
+// apiKeyID identifies an API key in metrics without revealing it
+func apiKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "key-" + hex.EncodeToString(sum[:4])
+}
+
+// apiKeyIdentityOf returns the named API key of the request, nil without
+// auth or for a key from apiKeys
+func apiKeyIdentityOf(c *gin.Context) *config.APIKeyIdentity {
+	identity, _ := c.Value(ginAPIKeyIdentity).(*config.APIKeyIdentity)
+	return identity
+}
+
+// modelAllowed returns true when the API key of the request can use the
+// model requested by name. The models patterns of a key match the name or
+// the ID the name is an alias of. A split sends the request to any of its
+// variants, so the key has to be allowed to use each of them too.
+func (pm *ProxyManager) modelAllowed(c *gin.Context, requestedModel string) bool {
+	identity := apiKeyIdentityOf(c)
+	if identity == nil {
+		return true
+	}
+	if !pm.identityAllowsModel(identity, requestedModel) {
+		return false
+	}
+	for _, variant := range pm.splitRouter().variants(requestedModel) {
+		if !pm.identityAllowsModel(identity, variant) {
+			return false
+		}
+	}
+	return true
+}
+
+func (pm *ProxyManager) identityAllowsModel(identity *config.APIKeyIdentity, requestedModel string) bool {
+	if identity.AllowsModel(requestedModel) {
+		return true
+	}
+	if modelID, found := pm.config.RealModelName(requestedModel); found {
+		return identity.AllowsModel(modelID)
+	}
+	return false
+}
+
+// checkModelAccess sends a 403 response when the API key of the request can
+// not use the model, before it is loaded
+func (pm *ProxyManager) checkModelAccess(c *gin.Context, requestedModel string) bool {
+	if pm.modelAllowed(c, requestedModel) {
+		return true
+	}
+	pm.proxyLogger.Infof("API key %s is not allowed to use model %s", c.GetString(ginAPIKeyName), requestedModel)
+	pm.sendErrorResponse(c, http.StatusForbidden, "forbidden: API key is not allowed to use model "+requestedModel)
+	return false
+}
+
+// inferenceAPIKey returns a key for internal requests to the inference routes
+// made for a signed in admin user, empty when no key in the config can call them
+func (pm *ProxyManager) inferenceAPIKey() string {
+	if len(pm.config.RequiredAPIKeys) > 0 {
+		return pm.config.RequiredAPIKeys[0]
+	}
+	for _, entry := range pm.apiKeyEntries() {
+		if identity := entry.identity; identity != nil && identity.Key != "" && identity.AllowsEndpoint(config.APIKeyEndpointInference) {
+			return identity.Key
+		}
+	}
+	return ""
+}
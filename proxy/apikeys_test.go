@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+)
+
+func TestProxyManager_APIKeyIdentities(t *testing.T) {
+	opsHash := sha256.Sum256([]byte("ops-key"))
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"model1": getTestSimpleResponderConfig("model1"),
+			"model2": getTestSimpleResponderConfig("model2"),
+		},
+		RequiredAPIKeys: []string{"full-key"},
+		APIKeyIdentities: map[string]config.APIKeyIdentity{
+			"batch": {
+				Key:       "batch-key",
+				Models:    []string{"model1"},
+				Endpoints: []string{config.APIKeyEndpointInference},
+			},
+			"ops": {
+				KeyHash:   config.APIKeyHashPrefix + hex.EncodeToString(opsHash[:]),
+				Models:    []string{"*"},
+				Endpoints: []string{config.APIKeyEndpointReadOnly},
+			},
+		},
+		LogLevel: "error",
+	})
+	proxy := New(conf)
+	defer proxy.StopProcesses(StopImmediately)
+
+	send := func(method, path, key, body string) *TestResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := CreateTestResponseRecorder()
+		proxy.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("model patterns", func(t *testing.T) {
+		w := send("POST", "/v1/chat/completions", "batch-key", `{"model":"model1"}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		metrics := proxy.metricsMonitor.getMetrics()
+		assert.Equal(t, "batch", metrics[len(metrics)-1].APIKey)
+
+		// denied before the model is loaded
+		w = send("POST", "/v1/chat/completions", "batch-key", `{"model":"model2"}`)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		w = send("GET", "/upstream/model2/health", "batch-key", "")
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Equal(t, StateStopped, proxy.findGroupByModelName("model2").processes["model2"].CurrentState())
+
+		w = send("GET", "/v1/models", "batch-key", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		var ids []string
+		for _, id := range gjson.Get(w.Body.String(), "data.#.id").Array() {
+			ids = append(ids, id.String())
+		}
+		assert.Equal(t, []string{"model1"}, ids)
+
+		w = send("GET", "/v1/models", "full-key", "")
+		assert.Len(t, gjson.Get(w.Body.String(), "data").Array(), 2)
+	})
+
+	t.Run("endpoint classes", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, send("GET", "/api/version", "batch-key", "").Code)
+		assert.Equal(t, http.StatusForbidden, send("GET", "/running", "batch-key", "").Code)
+
+		assert.Equal(t, http.StatusOK, send("GET", "/api/version", "ops-key", "").Code)
+		assert.Equal(t, http.StatusOK, send("GET", "/running", "ops-key", "").Code)
+		assert.Equal(t, http.StatusForbidden, send("POST", "/api/models/unload", "ops-key", "").Code)
+		assert.Equal(t, http.StatusForbidden, send("GET", "/api/config/editor", "ops-key", "").Code)
+		assert.Equal(t, http.StatusForbidden, send("GET", "/unload", "ops-key", "").Code)
+		assert.Equal(t, http.StatusForbidden, send("POST", "/v1/chat/completions", "ops-key", `{"model":"model1"}`).Code)
+
+		// keys in apiKeys can call everything
+		assert.Equal(t, http.StatusNotFound, send("POST", "/api/benchy/unknown/cancel", "full-key", "").Code)
+		assert.Equal(t, http.StatusUnauthorized, send("GET", "/api/version", "wrong-key", "").Code)
+	})
+}
+
+func TestProxyManager_APIKeySplitVariants(t *testing.T) {
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"public":  getTestSimpleResponderConfig("public"),
+			"private": getTestSimpleResponderConfig("private"),
+		},
+		Splits: map[string]config.SplitConfig{
+			"ab-chat": {
+				StickyBy: config.SplitStickyNone,
+				Variants: []config.SplitVariant{{Model: "public", Weight: 1}, {Model: "private", Weight: 1}},
+			},
+			"ab-public": {
+				StickyBy: config.SplitStickyNone,
+				Variants: []config.SplitVariant{{Model: "public", Weight: 1}},
+			},
+		},
+		APIKeyIdentities: map[string]config.APIKeyIdentity{
+			"split-only": {Key: "split-key", Models: []string{"ab-*"}, Endpoints: []string{config.APIKeyEndpointInference}},
+			"public":     {Key: "public-key", Models: []string{"ab-*", "public"}, Endpoints: []string{config.APIKeyEndpointInference}},
+		},
+		LogLevel: "error",
+	})
+	proxy := New(conf)
+	defer proxy.StopProcesses(StopImmediately)
+
+	chat := func(key, model string) int {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"`+model+`"}`))
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := CreateTestResponseRecorder()
+		proxy.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// the split name alone does not grant its variants
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, http.StatusForbidden, chat("split-key", "ab-chat"))
+		assert.Equal(t, http.StatusForbidden, chat("public-key", "ab-chat"))
+	}
+	assert.Equal(t, StateStopped, proxy.findGroupByModelName("private").processes["private"].CurrentState())
+	assert.Equal(t, http.StatusOK, chat("public-key", "ab-public"))
+
+	req := httptest.NewRequest("GET", "/v1/models", nil)
+	req.Header.Set("Authorization", "Bearer public-key")
+	w := CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	var ids []string
+	for _, id := range gjson.Get(w.Body.String(), "data.#.id").Array() {
+		ids = append(ids, id.String())
+	}
+	assert.Equal(t, []string{"ab-public", "public"}, ids)
+}
+
+func TestProxyManager_APIKeysFollowConfigEdits(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	content := `
+apiKeyIdentities:
+  ops:
+    key: ops-key
+    endpoints: [admin]
+  batch:
+    key: old-batch-key
+`
+	require.NoError(t, os.WriteFile(configPath, []byte(content), 0644))
+	conf, err := config.LoadConfig(configPath)
+	require.NoError(t, err)
+	proxy := NewWithConfigPath(conf, configPath)
+	defer proxy.StopProcesses(StopImmediately)
+
+	send := func(method, path, key, body string) *TestResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := CreateTestResponseRecorder()
+		proxy.ServeHTTP(w, req)
+		return w
+	}
+	require.Equal(t, http.StatusOK, send("GET", "/v1/models", "old-batch-key", "").Code)
+
+	// rotate the batch key from the config editor
+	edited, err := json.Marshal(map[string]string{"content": strings.Replace(content, "old-batch-key", "new-batch-key", 1)})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, send("PUT", "/api/config/editor", "ops-key", string(edited)).Code)
+
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "/v1/models", "old-batch-key", "").Code)
+	assert.Equal(t, http.StatusOK, send("GET", "/v1/models", "new-batch-key", "").Code)
+
+	// removing every key turns auth off
+	edited, err = json.Marshal(map[string]string{"content": "models: {}\n"})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, send("PUT", "/api/config/editor", "ops-key", string(edited)).Code)
+	assert.Equal(t, http.StatusOK, send("GET", "/v1/models", "", "").Code)
+}
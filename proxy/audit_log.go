@@ -0,0 +1,500 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mostlygeek/llama-swap/event"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// the active file, rotated files are named by the time of their rotation,
+	// e.g. audit-20250131T120000.000000000Z.jsonl
+	auditFileName      = "audit.jsonl"
+	auditRotatedPrefix = "audit-"
+	auditRotatedSuffix = ".jsonl"
+	auditRotatedTime   = "20060102T150405.000000000Z"
+
+	auditInMemory   = 1000      // entries kept without auditLog.path
+	auditMaxPayload = 64 * 1024 // request bytes read for the payload
+	auditMaxString  = 256       // longer strings are replaced by their size and hash
+	auditMaxError   = 4096      // response bytes read for the error message
+
+	auditResultOK    = "ok"
+	auditResultError = "error"
+
+	// gin.Context keys of the nodes and failures handlers add to their entry
+	ginAuditNodes = "auditNodes"
+	ginAuditError = "auditError"
+)
+
+// AuditEntry is an administrative action: a request to a route of /api that
+// changes something, or /unload
+type AuditEntry struct {
+	ID         string    `json:"id"` // request ID
+	Timestamp  time.Time `json:"timestamp"`
+	User       string    `json:"user,omitempty"` // signed in admin user
+	Role       string    `json:"role,omitempty"`
+	APIKey     string    `json:"api_key,omitempty"` // name of the API key
+	Client     string    `json:"client"`
+	Method     string    `json:"method"`
+	Route      string    `json:"route"` // e.g. /api/config/models/*name
+	Path       string    `json:"path"`
+	Payload    any       `json:"payload,omitempty"` // the request body, sanitized
+	Nodes      []string  `json:"nodes,omitempty"`   // cluster nodes the action ran on
+	Status     int       `json:"status"`
+	Result     string    `json:"result"` // ok or error
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+// auditLog records administrative actions in append-only JSONL files in dir.
+// The active file is rotated once it reaches maxSize, the oldest rotated
+// files beyond maxFiles are deleted. Without a dir the latest entries are
+// kept in memory.
+type auditLog struct {
+	mu       sync.Mutex
+	dir      string
+	maxSize  int64
+	maxFiles int // 0 keeps all
+	entries  []AuditEntry
+	logger   *LogMonitor
+
+	now func() time.Time
+}
+
+func newAuditLog(logger *LogMonitor) *auditLog {
+	return &auditLog{logger: logger, now: time.Now}
+}
+
+// persist writes the entries recorded from now on to dir
+func (l *auditLog) persist(dir string, maxSize int64, maxFiles int) error {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.dir = dir
+	l.maxSize = maxSize
+	l.maxFiles = maxFiles
+	l.entries = nil
+	return nil
+}
+
+// record appends entry to the log and emits it as an AuditEvent
+func (l *auditLog) record(entry AuditEntry) {
+	l.mu.Lock()
+	if l.dir == "" {
+		l.entries = append(l.entries, entry)
+		if len(l.entries) > auditInMemory {
+			l.entries = l.entries[1:]
+		}
+	} else {
+		l.write(entry)
+	}
+	l.mu.Unlock()
+
+	event.Emit(AuditEvent{Entry: entry})
+}
+
+// write appends entry to the active file, rotating it first when it would
+// grow beyond maxSize. l.mu must be held.
+func (l *auditLog) write(entry AuditEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		l.logger.Errorf("audit log: failed to encode entry: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	active := filepath.Join(l.dir, auditFileName)
+	if stat, err := os.Stat(active); err == nil && stat.Size() > 0 && stat.Size()+int64(len(line)) > l.maxSize {
+		l.rotate(active)
+	}
+
+	file, err := os.OpenFile(active, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		l.logger.Errorf("audit log: %v", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(line); err != nil {
+		l.logger.Errorf("audit log: failed to write entry: %v", err)
+	}
+}
+
+// rotate renames the active file and deletes the oldest rotated files beyond
+// maxFiles. l.mu must be held.
+func (l *auditLog) rotate(active string) {
+	rotated := auditRotatedPrefix + l.now().UTC().Format(auditRotatedTime) + auditRotatedSuffix
+	if err := os.Rename(active, filepath.Join(l.dir, rotated)); err != nil {
+		l.logger.Errorf("audit log: failed to rotate: %v", err)
+		return
+	}
+	if l.maxFiles == 0 {
+		return
+	}
+	files, err := l.rotatedFiles()
+	if err != nil {
+		l.logger.Errorf("audit log: %v", err)
+		return
+	}
+	for len(files) > l.maxFiles {
+		if err := os.Remove(filepath.Join(l.dir, files[0])); err != nil {
+			l.logger.Errorf("audit log: failed to remove rotated file: %v", err)
+		}
+		files = files[1:]
+	}
+}
+
+// rotatedFiles returns the names of the rotated files, oldest first
+func (l *auditLog) rotatedFiles() ([]string, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(name, auditRotatedPrefix) && strings.HasSuffix(name, auditRotatedSuffix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// find returns the entries matching q, oldest first. Lines that can not be
+// decoded, like one cut short by a crash, are skipped.
+func (l *auditLog) find(q auditQuery) ([]AuditEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var found []AuditEntry
+	if l.dir == "" {
+		for _, entry := range l.entries {
+			if q.matches(entry) {
+				found = append(found, entry)
+			}
+		}
+		return found, nil
+	}
+
+	files, err := l.rotatedFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range append(files, auditFileName) {
+		// rotated files only have entries from before their rotation
+		rotatedAt := strings.TrimSuffix(strings.TrimPrefix(name, auditRotatedPrefix), auditRotatedSuffix)
+		if t, err := time.Parse(auditRotatedTime, rotatedAt); err == nil && t.Before(q.From) {
+			continue
+		}
+		file, err := os.Open(filepath.Join(l.dir, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 0, 64*1024), 4*auditMaxPayload)
+		for scanner.Scan() {
+			var entry AuditEntry
+			if json.Unmarshal(scanner.Bytes(), &entry) == nil && q.matches(entry) {
+				found = append(found, entry)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+	}
+	return found, nil
+}
+
+// auditQuery selects entries by time, who made them, route, node and result
+type auditQuery struct {
+	From, To time.Time
+	User     string
+	APIKey   string
+	Route    string // pattern matched against the route and the path
+	Node     string
+	Result   string
+	Limit    int
+}
+
+// parseAuditQuery reads from, to (as in /api/metrics/query), user, api_key,
+// route, node, result and limit
+func parseAuditQuery(c *gin.Context, now time.Time) (auditQuery, error) {
+	q := auditQuery{
+		To:     now,
+		User:   c.Query("user"),
+		APIKey: c.Query("api_key"),
+		Route:  c.Query("route"),
+		Node:   c.Query("node"),
+		Result: c.Query("result"),
+		Limit:  100,
+	}
+	if to := c.Query("to"); to != "" {
+		t, err := parseQueryTime(to, now)
+		if err != nil {
+			return q, fmt.Errorf("invalid to: %w", err)
+		}
+		q.To = t
+	}
+	q.From = q.To.Add(-7 * 24 * time.Hour)
+	if from := c.Query("from"); from != "" {
+		t, err := parseQueryTime(from, now)
+		if err != nil {
+			return q, fmt.Errorf("invalid from: %w", err)
+		}
+		q.From = t
+	}
+	if !q.From.Before(q.To) {
+		return q, fmt.Errorf("from must be before to")
+	}
+	if q.Route != "" {
+		if _, err := path.Match(q.Route, ""); err != nil {
+			return q, fmt.Errorf("invalid route pattern %q", q.Route)
+		}
+	}
+	if q.Result != "" && q.Result != auditResultOK && q.Result != auditResultError {
+		return q, fmt.Errorf("result must be one of: ok, error")
+	}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return q, fmt.Errorf("invalid limit %q", limit)
+		}
+		q.Limit = n
+	}
+	return q, nil
+}
+
+func (q auditQuery) matches(entry AuditEntry) bool {
+	if entry.Timestamp.Before(q.From) || !entry.Timestamp.Before(q.To) ||
+		(q.User != "" && entry.User != q.User) ||
+		(q.APIKey != "" && entry.APIKey != q.APIKey) ||
+		(q.Result != "" && entry.Result != q.Result) ||
+		(q.Node != "" && !slices.Contains(entry.Nodes, q.Node)) {
+		return false
+	}
+	if q.Route != "" {
+		routeMatch, _ := path.Match(q.Route, entry.Route)
+		pathMatch, _ := path.Match(q.Route, entry.Path)
+		return routeMatch || pathMatch
+	}
+	return true
+}
+
+// apiGetAudit lists the newest audit entries first
+func (pm *ProxyManager) apiGetAudit(c *gin.Context) {
+	q, err := parseAuditQuery(c, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	entries, err := pm.auditLog.find(q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to read the audit log: %v", err)})
+		return
+	}
+	slices.Reverse(entries)
+	if len(entries) > q.Limit {
+		entries = entries[:q.Limit]
+	}
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+	c.JSON(http.StatusOK, gin.H{"from": q.From, "to": q.To, "entries": entries})
+}
+
+// audit records the request in the audit log once its handler is done
+func (pm *ProxyManager) audit(c *gin.Context) {
+	start := time.Now()
+	payload := auditPayload(c)
+
+	recorder := &auditResponseRecorder{ResponseWriter: c.Writer}
+	c.Writer = recorder
+	c.Next()
+	c.Writer = recorder.ResponseWriter
+
+	entry := AuditEntry{
+		ID:         requestIDOf(c.Request),
+		Timestamp:  start,
+		APIKey:     c.GetString(ginAPIKeyName),
+		Client:     c.ClientIP(),
+		Method:     c.Request.Method,
+		Route:      c.FullPath(),
+		Path:       c.Request.URL.Path,
+		Payload:    payload,
+		Nodes:      c.GetStringSlice(ginAuditNodes),
+		Status:     c.Writer.Status(),
+		Result:     auditResultOK,
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+	if session, ok := c.Value(ginAdminSession).(*adminSession); ok {
+		entry.User = session.user
+		entry.Role = session.role
+	}
+	if entry.Status >= http.StatusBadRequest {
+		entry.Result = auditResultError
+		entry.Error = auditErrorMessage(recorder.body.Bytes())
+	} else if message := c.GetString(ginAuditError); message != "" {
+		entry.Result = auditResultError
+		entry.Error = message
+	}
+	pm.auditLog.record(entry)
+}
+
+// auditNodes adds the cluster nodes an action ran on to its audit entry
+func auditNodes(c *gin.Context, nodes ...string) {
+	c.Set(ginAuditNodes, append(c.GetStringSlice(ginAuditNodes), nodes...))
+}
+
+// auditClusterNodes adds the nodes of the cluster to the audit entry of an
+// action that runs on all of them, the local node when they are not found
+func auditClusterNodes(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 15*time.Second)
+	defer cancel()
+	nodes, _, err := discoverClusterNodeIPs(ctx)
+	if err != nil {
+		nodes = []string{dockerActionNodeLabel("", true)}
+	}
+	auditNodes(c, nodes...)
+}
+
+// auditError records the failure of an action that still answers with a
+// success status, e.g. one that failed on some of its nodes
+func auditError(c *gin.Context, message string) {
+	c.Set(ginAuditError, message)
+}
+
+// auditResponseRecorder keeps the start of error responses for the error
+// message of the audit entry
+type auditResponseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *auditResponseRecorder) Write(data []byte) (int, error) {
+	if w.Status() >= http.StatusBadRequest && w.body.Len() < auditMaxError {
+		w.body.Write(data[:min(len(data), auditMaxError-w.body.Len())])
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *auditResponseRecorder) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// auditErrorMessage returns the error field of a JSON error response, or the
+// text of other responses
+func auditErrorMessage(body []byte) string {
+	if message := gjson.GetBytes(body, "error").String(); message != "" {
+		return message
+	}
+	message := strings.TrimSpace(string(body))
+	if len(message) > auditMaxString {
+		message = message[:auditMaxString] + "..."
+	}
+	return message
+}
+
+// auditPayload reads the JSON body of the request for its audit entry and
+// leaves it in place for the handler. Secrets are redacted and long strings,
+// like config files, are replaced by their size and hash.
+func auditPayload(c *gin.Context) any {
+	if c.Request.Body == nil {
+		return nil
+	}
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, auditMaxPayload+1))
+	c.Request.Body = io.NopCloser(io.MultiReader(bytes.NewReader(data), c.Request.Body))
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	if len(data) > auditMaxPayload {
+		return fmt.Sprintf("[more than %d bytes]", auditMaxPayload)
+	}
+
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return auditDigest(data)
+	}
+	if _, isString := value.(string); isString {
+		// a bare string is the value of a config entry, e.g. a macro
+		return auditDigest(data)
+	}
+	return sanitizeAuditValue("", value)
+}
+
+// auditSecretNames are parts of the names of fields and arguments with secrets
+var auditSecretNames = []string{"password", "secret", "token", "apikey", "api_key", "api-key", "authorization", "keyhash", "credential"}
+
+// auditSecretArgs finds secrets in command lines and environment variables,
+// e.g. --api-key abc or HF_TOKEN=abc
+var auditSecretArgs = regexp.MustCompile(`(?i)((?:^|\s)--?[\w-]*(?:key|token|secret|password)[\w-]*(?:=|\s+)|\b[\w.-]*(?:key|token|secret|password)[\w.-]*=)(\S+)`)
+
+func isAuditSecretName(name string) bool {
+	name = strings.ToLower(name)
+	if name == "key" {
+		return true
+	}
+	for _, secret := range auditSecretNames {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeAuditValue redacts the secrets in a decoded JSON value of the
+// field name
+func sanitizeAuditValue(name string, value any) any {
+	if name != "" && isAuditSecretName(name) {
+		return "[redacted]"
+	}
+	switch v := value.(type) {
+	case map[string]any:
+		for field, item := range v {
+			v[field] = sanitizeAuditValue(field, item)
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = sanitizeAuditValue("", item)
+		}
+	case string:
+		if name == "content" || len(v) > auditMaxString {
+			return auditDigest([]byte(v))
+		}
+		return auditSecretArgs.ReplaceAllString(v, "${1}[redacted]")
+	}
+	return value
+}
+
+// auditDigest describes data by its size and hash, so changes can be told
+// apart without recording them
+func auditDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("[%d bytes sha256:%s]", len(data), hex.EncodeToString(sum[:])[:16])
+}
@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mostlygeek/llama-swap/event"
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+)
+
+func TestAuditLog_Rotation(t *testing.T) {
+	dir := t.TempDir()
+	log := newAuditLog(testLogger)
+	require.NoError(t, log.persist(dir, 400, 2))
+	now := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+	log.now = func() time.Time { return now }
+
+	for i := 0; i < 12; i++ {
+		now = now.Add(time.Minute)
+		log.record(AuditEntry{ID: string(rune('a' + i)), Timestamp: now, Method: "POST", Route: "/api/cluster/stop", Result: auditResultOK})
+	}
+
+	rotated, err := log.rotatedFiles()
+	require.NoError(t, err)
+	assert.Len(t, rotated, 2)
+	_, err = os.Stat(filepath.Join(dir, auditFileName))
+	require.NoError(t, err)
+
+	// the entries of deleted files are gone, the others are read oldest first
+	entries, err := log.find(auditQuery{From: now.Add(-time.Hour), To: now.Add(time.Minute)})
+	require.NoError(t, err)
+	require.NotEmpty(t, entries)
+	assert.Less(t, len(entries), 12)
+	assert.Equal(t, "l", entries[len(entries)-1].ID)
+	for i := 1; i < len(entries); i++ {
+		assert.True(t, entries[i-1].Timestamp.Before(entries[i].Timestamp))
+	}
+
+	entries, err = log.find(auditQuery{From: now.Add(-90 * time.Second), To: now.Add(time.Minute)})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "k", entries[0].ID)
+
+	// lines cut short are skipped
+	file, err := os.OpenFile(filepath.Join(dir, auditFileName), os.O_APPEND|os.O_WRONLY, 0640)
+	require.NoError(t, err)
+	file.WriteString(`{"id":"m","timest`)
+	file.Close()
+	entries, err = log.find(auditQuery{From: now.Add(-90 * time.Second), To: now.Add(time.Minute)})
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+// auditContext returns a gin.Context for req
+func auditContext(req *http.Request) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = req
+	return c
+}
+
+func TestSanitizeAuditValue(t *testing.T) {
+	longNotes := strings.Repeat("x", auditMaxString+1)
+	req := httptest.NewRequest("POST", "/api/config/peers/remote", bytes.NewBufferString(`{
+		"apiKey": "sk-123",
+		"proxy": "http://10.0.0.2:8080",
+		"cmd": "llama-server --api-key abc -m /models/qwen.gguf",
+		"env": ["HF_TOKEN=hf_abc", "CUDA_VISIBLE_DEVICES=0"],
+		"nested": {"password": "hunter2", "names": ["a", "b"]},
+		"content": "models: {}",
+		"notes": "`+longNotes+`"
+	}`))
+	c := auditContext(req)
+
+	payload := auditPayload(c)
+	assert.Equal(t, map[string]any{
+		"apiKey":  "[redacted]",
+		"proxy":   "http://10.0.0.2:8080",
+		"cmd":     "llama-server --api-key [redacted] -m /models/qwen.gguf",
+		"env":     []any{"HF_TOKEN=[redacted]", "CUDA_VISIBLE_DEVICES=0"},
+		"nested":  map[string]any{"password": "[redacted]", "names": []any{"a", "b"}},
+		"content": auditDigest([]byte("models: {}")),
+		"notes":   auditDigest([]byte(longNotes)),
+	}, payload)
+
+	// the handler still gets the whole body
+	body, err := c.GetRawData()
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "sk-123")
+
+	c = auditContext(httptest.NewRequest("PUT", "/api/config/macros/token", bytes.NewBufferString(`"secret"`)))
+	assert.Equal(t, auditDigest([]byte(`"secret"`)), auditPayload(c))
+	c = auditContext(httptest.NewRequest("POST", "/api/cluster/stop", nil))
+	assert.Nil(t, auditPayload(c))
+}
+
+func TestProxyManager_Audit(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte("models: {}\n"), 0644))
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		APIKeyIdentities: map[string]config.APIKeyIdentity{
+			"ops": {Key: "ops-key", Models: []string{"*"}, Endpoints: []string{config.APIKeyEndpointAdmin}},
+		},
+		AuditLog: config.AuditLogConfig{Path: filepath.Join(t.TempDir(), "audit"), MaxSizeMB: 1},
+		LogLevel: "error",
+	})
+	proxy := NewWithConfigPath(conf, configPath)
+	defer proxy.StopProcesses(StopImmediately)
+
+	events := make(chan AuditEntry, 10)
+	defer event.On(func(e AuditEvent) {
+		events <- e.Entry
+	})()
+
+	send := func(method, path, body string) *TestResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer ops-key")
+		w := CreateTestResponseRecorder()
+		proxy.ServeHTTP(w, req)
+		return w
+	}
+	nextEntry := func() AuditEntry {
+		select {
+		case entry := <-events:
+			return entry
+		case <-time.After(time.Second):
+			t.Fatal("no audit event")
+			return AuditEntry{}
+		}
+	}
+
+	w := send("POST", "/api/config/validate", `{"content":"models: {}\n"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	entry := nextEntry()
+	assert.Equal(t, w.Header().Get(requestIDHeader), entry.ID)
+	assert.Equal(t, "ops", entry.APIKey)
+	assert.Equal(t, "/api/config/validate", entry.Route)
+	assert.Equal(t, http.StatusOK, entry.Status)
+	assert.Equal(t, auditResultOK, entry.Result)
+	assert.Equal(t, map[string]any{"content": auditDigest([]byte("models: {}\n"))}, entry.Payload)
+
+	require.Equal(t, http.StatusNotFound, send("POST", "/api/benchy/unknown/cancel", "").Code)
+	entry = nextEntry()
+	assert.Equal(t, "/api/benchy/:id/cancel", entry.Route)
+	assert.Equal(t, "/api/benchy/unknown/cancel", entry.Path)
+	assert.Equal(t, auditResultError, entry.Result)
+	assert.Equal(t, "job not found", entry.Error)
+
+	// reads are not recorded
+	require.Equal(t, http.StatusOK, send("GET", "/api/version", "").Code)
+	select {
+	case entry := <-events:
+		t.Fatalf("unexpected audit entry for %s", entry.Path)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	w = send("GET", "/api/audit", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	entries := gjson.Get(w.Body.String(), "entries").Array()
+	require.Len(t, entries, 2)
+	assert.Equal(t, "/api/benchy/unknown/cancel", entries[0].Get("path").String())
+	assert.Equal(t, "/api/config/validate", entries[1].Get("path").String())
+
+	w = send("GET", "/api/audit?route=/api/config/*&result=ok", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, gjson.Get(w.Body.String(), "entries").Array(), 1)
+	w = send("GET", "/api/audit?result=failed", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestProxyManager_AuditDenied(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte("models: {}\n"), 0644))
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		APIKeyIdentities: map[string]config.APIKeyIdentity{
+			"ops":    {Key: "ops-key", Models: []string{"*"}, Endpoints: []string{config.APIKeyEndpointAdmin}},
+			"viewer": {Key: "viewer-key", Models: []string{"*"}, Endpoints: []string{config.APIKeyEndpointReadOnly}},
+		},
+		AuditLog: config.AuditLogConfig{Path: filepath.Join(t.TempDir(), "audit"), MaxSizeMB: 1},
+		LogLevel: "error",
+	})
+	proxy := NewWithConfigPath(conf, configPath)
+	defer proxy.StopProcesses(StopImmediately)
+
+	events := make(chan AuditEntry, 10)
+	defer event.On(func(e AuditEvent) {
+		events <- e.Entry
+	})()
+	nextEntry := func() AuditEntry {
+		select {
+		case entry := <-events:
+			return entry
+		case <-time.After(time.Second):
+			t.Fatal("no audit event")
+			return AuditEntry{}
+		}
+	}
+	send := func(key string) int {
+		req := httptest.NewRequest("POST", "/api/config/validate", bytes.NewBufferString(`{"content":"models: {}\n"}`))
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := CreateTestResponseRecorder()
+		proxy.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// refused attempts are recorded as well
+	require.Equal(t, http.StatusUnauthorized, send(""))
+	entry := nextEntry()
+	assert.Equal(t, http.StatusUnauthorized, entry.Status)
+	assert.Equal(t, auditResultError, entry.Result)
+	assert.Empty(t, entry.APIKey)
+	assert.Equal(t, "/api/config/validate", entry.Route)
+
+	require.Equal(t, http.StatusForbidden, send("viewer-key"))
+	entry = nextEntry()
+	assert.Equal(t, http.StatusForbidden, entry.Status)
+	assert.Equal(t, "viewer", entry.APIKey)
+	assert.Contains(t, entry.Error, "forbidden")
+
+	require.Equal(t, http.StatusOK, send("ops-key"))
+	assert.Equal(t, "ops", nextEntry().APIKey)
+}
+
+func TestProxyManager_AuditClusterNodes(t *testing.T) {
+	dir := t.TempDir()
+	autodiscover := filepath.Join(dir, "autodiscover.sh")
+	require.NoError(t, os.WriteFile(autodiscover, []byte(strings.Join([]string{
+		"detect_interfaces() { return 0; }",
+		"detect_local_ip() { LOCAL_IP=10.0.0.5; }",
+		"detect_nodes() { NODES_ARG=10.0.0.5,10.0.0.6; }",
+	}, "\n")), 0755))
+	backendDir := filepath.Join(dir, "backend")
+	require.NoError(t, os.Mkdir(backendDir, 0755))
+	for _, script := range []string{"stop-cluster-containers.sh", "build-and-copy.sh"} {
+		require.NoError(t, os.WriteFile(filepath.Join(backendDir, script), []byte("#!/bin/bash\nexit 0\n"), 0755))
+	}
+	t.Setenv(clusterAutodiscoverPathEnv, autodiscover)
+	t.Setenv(recipesBackendDirEnv, backendDir)
+
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		AuditLog: config.AuditLogConfig{Path: filepath.Join(dir, "audit"), MaxSizeMB: 1},
+		LogLevel: "error",
+	})
+	proxy := New(conf)
+	defer proxy.StopProcesses(StopImmediately)
+
+	events := make(chan AuditEntry, 10)
+	defer event.On(func(e AuditEvent) {
+		events <- e.Entry
+	})()
+	send := func(path, body string) AuditEntry {
+		req := httptest.NewRequest("POST", path, bytes.NewBufferString(body))
+		w := CreateTestResponseRecorder()
+		proxy.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		select {
+		case entry := <-events:
+			return entry
+		case <-time.After(5 * time.Second):
+			t.Fatal("no audit event")
+			return AuditEntry{}
+		}
+	}
+
+	// actions on the whole cluster name its nodes
+	assert.Equal(t, []string{"10.0.0.5", "10.0.0.6"}, send("/api/cluster/stop", "").Nodes)
+	assert.Equal(t, []string{"10.0.0.5", "10.0.0.6"}, send("/api/recipes/backend/action", `{"action":"build_vllm"}`).Nodes)
+}
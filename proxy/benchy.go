@@ -339,12 +339,17 @@ func (pm *ProxyManager) apiStartBenchy(c *gin.Context) {
 
 	// If auth is enabled, reuse the validated key from the incoming request.
 	apiKey := ""
-	if len(pm.config.RequiredAPIKeys) > 0 {
+	if len(pm.apiKeyEntries()) > 0 {
 		if v, ok := c.Get(ctxKeyAPIKey); ok {
 			if s, ok := v.(string); ok {
 				apiKey = s
 			}
 		}
+		// signed in users and client certificates have no key to reuse
+		_, signedIn := c.Value(ginAdminSession).(*adminSession)
+		if apiKey == "" && (signedIn || clientCertNames(c.Request) != nil) {
+			apiKey = pm.inferenceAPIKey()
+		}
 		if apiKey == "" {
 			// This should be impossible because apiKeyAuth() already validated the request.
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing API key in request context"})
@@ -804,7 +809,7 @@ func normalizeBenchyQueueModels(primary string, queue []string) ([]string, error
 }
 
 func (pm *ProxyManager) ensureBenchyModelReady(ctx context.Context, realModelName string) error {
-	processGroup, err := pm.swapProcessGroup(realModelName)
+	processGroup, err := pm.swapProcessGroup(ctx, realModelName)
 	if err != nil {
 		return err
 	}
@@ -824,7 +829,7 @@ func (pm *ProxyManager) ensureBenchyModelReady(ctx context.Context, realModelNam
 	discardWriter := &DiscardWriter{}
 	proxyDone := make(chan error, 1)
 	go func() {
-		proxyDone <- processGroup.ProxyRequest(realModelName, discardWriter, req)
+		proxyDone <- processGroup.ProxyRequest(realModelName, discardWriter, withStartTrigger(req, startTriggerBenchy))
 	}()
 
 	select {
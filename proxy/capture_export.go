@@ -0,0 +1,508 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// captureFilter selects the captures of an export
+type captureFilter struct {
+	From   time.Time
+	To     time.Time
+	Model  string
+	Path   string
+	Status int // 0 for any
+}
+
+// parseCaptureFilter reads a filter from the URL parameters:
+//
+//   - from, to: RFC 3339 times or how long ago, e.g. 7d or 90m. Defaults to
+//     all captures.
+//   - model: only captures of this model
+//   - path: only captures of this request path, e.g. /v1/chat/completions
+//   - status: only captures with this HTTP status
+func parseCaptureFilter(values url.Values, now time.Time) (captureFilter, error) {
+	f := captureFilter{
+		To:    now.Add(time.Hour), // captures written while the export runs
+		Model: strings.TrimSpace(values.Get("model")),
+		Path:  strings.TrimSpace(values.Get("path")),
+	}
+	if from := strings.TrimSpace(values.Get("from")); from != "" {
+		t, err := parseQueryTime(from, now)
+		if err != nil {
+			return f, fmt.Errorf("invalid from: %w", err)
+		}
+		f.From = t
+	}
+	if to := strings.TrimSpace(values.Get("to")); to != "" {
+		t, err := parseQueryTime(to, now)
+		if err != nil {
+			return f, fmt.Errorf("invalid to: %w", err)
+		}
+		f.To = t
+	}
+	if !f.From.Before(f.To) {
+		return f, fmt.Errorf("from must be before to")
+	}
+	if status := strings.TrimSpace(values.Get("status")); status != "" {
+		code, err := strconv.Atoi(status)
+		if err != nil || code < 100 || code > 599 {
+			return f, fmt.Errorf("invalid status %q", status)
+		}
+		f.Status = code
+	}
+	return f, nil
+}
+
+func (f captureFilter) match(capture *ReqRespCapture) bool {
+	switch {
+	case capture.Timestamp.Before(f.From) || !capture.Timestamp.Before(f.To):
+		return false
+	case f.Model != "" && capture.Model != f.Model:
+		return false
+	case f.Path != "" && capture.ReqPath != f.Path:
+		return false
+	case f.Status != 0 && capture.Status != f.Status:
+		return false
+	}
+	return true
+}
+
+// eachCapture calls fn for the captures matching f, oldest first, until it
+// returns false. They are read from the capture store when it is enabled,
+// otherwise from memory.
+func (mp *metricsMonitor) eachCapture(f captureFilter, fn func(ReqRespCapture) bool) error {
+	if mp.captureStore != nil {
+		return mp.captureStore.read(f.From, f.To, func(capture ReqRespCapture) bool {
+			if !f.match(&capture) {
+				return true
+			}
+			return fn(capture)
+		})
+	}
+	for _, capture := range mp.getCaptures() {
+		if f.match(&capture) && !fn(capture) {
+			break
+		}
+	}
+	return nil
+}
+
+// apiExportCaptures writes the captures matching the filter of the URL
+// parameters as HAR (format=har, the default) or as OpenAI style JSONL
+// (format=jsonl) for eval and fine-tuning datasets
+func (pm *ProxyManager) apiExportCaptures(c *gin.Context) {
+	format := c.DefaultQuery("format", "har")
+	if format != "har" && format != "jsonl" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid format, must be one of: har, jsonl"})
+		return
+	}
+	if !pm.metricsMonitor.capturing() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "captures are disabled, set captureBuffer or captureStore.path in the config"})
+		return
+	}
+	now := time.Now()
+	f, err := parseCaptureFilter(c.Request.URL.Query(), now)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	filename := "captures-" + now.UTC().Format("20060102-150405") + "." + format
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	if format == "har" {
+		c.Header("Content-Type", "application/json")
+	} else {
+		c.Header("Content-Type", "application/x-ndjson")
+	}
+	c.Status(http.StatusOK)
+
+	w := bufio.NewWriter(c.Writer)
+	if format == "har" {
+		scheme := "http"
+		if c.Request.TLS != nil {
+			scheme = "https"
+		}
+		err = pm.writeHAR(w, f, scheme+"://"+c.Request.Host)
+	} else {
+		err = pm.writeCaptureJSONL(w, f)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		// the status was sent already, the client gets a truncated file
+		pm.proxyLogger.Errorf("capture export failed: %v", err)
+	}
+}
+
+// HAR 1.2, see http://www.softwareishard.com/blog/har-12-spec/
+type harEntry struct {
+	StartedDateTime time.Time    `json:"startedDateTime"`
+	Time            int          `json:"time"`
+	Request         harRequest   `json:"request"`
+	Response        harResponse  `json:"response"`
+	Cache           struct{}     `json:"cache"`
+	Timings         harTimings   `json:"timings"`
+	Comment         string       `json:"comment,omitempty"`
+	LlamaSwap       harLlamaSwap `json:"_llamaSwap"`
+}
+
+type harRequest struct {
+	Method      string       `json:"method"`
+	URL         string       `json:"url"`
+	HTTPVersion string       `json:"httpVersion"`
+	Cookies     []struct{}   `json:"cookies"`
+	Headers     []harNameVal `json:"headers"`
+	QueryString []harNameVal `json:"queryString"`
+	PostData    *harPostData `json:"postData,omitempty"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int          `json:"status"`
+	StatusText  string       `json:"statusText"`
+	HTTPVersion string       `json:"httpVersion"`
+	Cookies     []struct{}   `json:"cookies"`
+	Headers     []harNameVal `json:"headers"`
+	Content     harContent   `json:"content"`
+	RedirectURL string       `json:"redirectURL"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int          `json:"bodySize"`
+}
+
+type harNameVal struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    int `json:"send"`
+	Wait    int `json:"wait"`
+	Receive int `json:"receive"`
+}
+
+// harLlamaSwap keeps what llama-swap knows about an entry, custom fields
+// start with an underscore
+type harLlamaSwap struct {
+	CaptureID int    `json:"captureId"`
+	RequestID string `json:"requestId,omitempty"`
+	Model     string `json:"model"`
+}
+
+// writeHAR writes the captures matching f as a HAR log. baseURL is prefixed
+// to the request paths.
+func (pm *ProxyManager) writeHAR(w io.Writer, f captureFilter, baseURL string) error {
+	creator, _ := json.Marshal(map[string]string{"name": "llama-swap", "version": pm.version})
+	if _, err := fmt.Fprintf(w, `{"log":{"version":"1.2","creator":%s,"entries":[`, creator); err != nil {
+		return err
+	}
+	first := true
+	var writeErr error
+	err := pm.metricsMonitor.eachCapture(f, func(capture ReqRespCapture) bool {
+		entry, err := json.Marshal(newHAREntry(capture, baseURL))
+		if err != nil {
+			writeErr = err
+			return false
+		}
+		if !first {
+			entry = append([]byte{','}, entry...)
+		}
+		first = false
+		_, writeErr = w.Write(entry)
+		return writeErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	_, err = io.WriteString(w, "]}}\n")
+	return err
+}
+
+func newHAREntry(capture ReqRespCapture, baseURL string) harEntry {
+	method := capture.ReqMethod
+	if method == "" {
+		method = http.MethodPost
+	}
+	status := capture.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	entry := harEntry{
+		StartedDateTime: capture.Timestamp,
+		Time:            capture.DurationMs,
+		Request: harRequest{
+			Method:      method,
+			URL:         baseURL + capture.ReqPath,
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []struct{}{},
+			Headers:     harHeaders(capture.ReqHeaders),
+			QueryString: []harNameVal{},
+			HeadersSize: -1,
+			BodySize:    len(capture.ReqBody),
+		},
+		Response: harResponse{
+			Status:      status,
+			StatusText:  http.StatusText(status),
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []struct{}{},
+			Headers:     harHeaders(capture.RespHeaders),
+			RedirectURL: "",
+			HeadersSize: -1,
+			BodySize:    len(capture.RespBody),
+		},
+		Timings:   harTimings{Send: 0, Wait: capture.DurationMs, Receive: 0},
+		LlamaSwap: harLlamaSwap{CaptureID: capture.ID, RequestID: capture.RequestID, Model: capture.Model},
+	}
+	if len(capture.ReqBody) > 0 {
+		text, encoding := harText(capture.ReqBody)
+		entry.Request.PostData = &harPostData{MimeType: headerValue(capture.ReqHeaders, "Content-Type"), Text: text}
+		if encoding != "" {
+			entry.Comment = "request body is base64 encoded"
+		}
+	}
+	text, encoding := harText(capture.RespBody)
+	entry.Response.Content = harContent{
+		Size:     len(capture.RespBody),
+		MimeType: headerValue(capture.RespHeaders, "Content-Type"),
+		Text:     text,
+		Encoding: encoding,
+	}
+	return entry
+}
+
+// harHeaders returns headers sorted by name
+func harHeaders(headers map[string]string) []harNameVal {
+	list := make([]harNameVal, 0, len(headers))
+	for name, value := range headers {
+		list = append(list, harNameVal{Name: name, Value: value})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// harText returns body as text, base64 encoded when it is not valid UTF-8
+func harText(body []byte) (text, encoding string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+// headerValue looks up a header of a capture case insensitively
+func headerValue(headers map[string]string, name string) string {
+	if value, ok := headers[http.CanonicalHeaderKey(name)]; ok {
+		return value
+	}
+	for key, value := range headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// jsonlExample is a line of a JSONL export: the conversation of a chat
+// completion with the reply of the model, or the prompt and completion of a
+// text completion
+type jsonlExample struct {
+	Messages   []json.RawMessage `json:"messages,omitempty"`
+	Tools      json.RawMessage   `json:"tools,omitempty"`
+	Prompt     json.RawMessage   `json:"prompt,omitempty"`
+	Completion *string           `json:"completion,omitempty"`
+}
+
+// writeCaptureJSONL writes the chat and text completions among the captures
+// matching f, one example per line. Other captures are left out.
+func (pm *ProxyManager) writeCaptureJSONL(w io.Writer, f captureFilter) error {
+	var writeErr error
+	err := pm.metricsMonitor.eachCapture(f, func(capture ReqRespCapture) bool {
+		example, ok := newJSONLExample(capture)
+		if !ok {
+			return true
+		}
+		line, err := json.Marshal(example)
+		if err != nil {
+			writeErr = err
+			return false
+		}
+		_, writeErr = w.Write(append(line, '\n'))
+		return writeErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	return writeErr
+}
+
+// newJSONLExample turns a capture into an example, ok is false for captures
+// that are not a successful chat or text completion
+func newJSONLExample(capture ReqRespCapture) (example jsonlExample, ok bool) {
+	if capture.Status != 0 && capture.Status != http.StatusOK {
+		return example, false
+	}
+	if !gjson.ValidBytes(capture.ReqBody) {
+		return example, false
+	}
+	req := gjson.ParseBytes(capture.ReqBody)
+	streamed := strings.Contains(headerValue(capture.RespHeaders, "Content-Type"), "text/event-stream")
+
+	if messages := req.Get("messages"); messages.IsArray() {
+		var reply json.RawMessage
+		if streamed {
+			message := assembleStreamedMessage(capture.RespBody)
+			if !message.openAI {
+				return example, false
+			}
+			reply, _ = json.Marshal(message)
+		} else if message := gjson.GetBytes(capture.RespBody, "choices.0.message"); message.IsObject() {
+			reply = json.RawMessage(message.Raw)
+		} else {
+			return example, false
+		}
+		for _, message := range messages.Array() {
+			example.Messages = append(example.Messages, json.RawMessage(message.Raw))
+		}
+		example.Messages = append(example.Messages, reply)
+		if tools := req.Get("tools"); tools.IsArray() {
+			example.Tools = json.RawMessage(tools.Raw)
+		}
+		return example, true
+	}
+
+	if prompt := req.Get("prompt"); prompt.Exists() {
+		var completion string
+		if streamed {
+			completion = assembleStreamedMessage(capture.RespBody).Content
+		} else if text := gjson.GetBytes(capture.RespBody, "choices.0.text"); text.Exists() {
+			completion = text.String()
+		} else {
+			return example, false
+		}
+		example.Prompt = json.RawMessage(prompt.Raw)
+		example.Completion = &completion
+		return example, true
+	}
+	return example, false
+}
+
+// assembledMessage is the chat completion message put together from the
+// chunks of a streamed response
+type assembledMessage struct {
+	Role             string              `json:"role"`
+	Content          string              `json:"content"`
+	ReasoningContent string              `json:"reasoning_content,omitempty"`
+	ToolCalls        []assembledToolCall `json:"tool_calls,omitempty"`
+
+	openAI bool // put together from chat or text completion chunks
+}
+
+type assembledToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// assembleStreamedMessage concatenates the deltas of the first choice of a
+// streamed chat or text completion, or the content blocks of a streamed
+// Anthropic message. Role is empty when body has no chunks.
+func assembleStreamedMessage(body []byte) assembledMessage {
+	var message assembledMessage
+	toolBlocks := make(map[int64]int) // Anthropic content block index to tool call
+	eachSSEData(body, func(data gjson.Result) {
+		if choice := data.Get("choices.0"); choice.Exists() {
+			message.Role = "assistant"
+			message.openAI = true
+			message.Content += choice.Get("text").String()
+			delta := choice.Get("delta")
+			message.Content += delta.Get("content").String()
+			message.ReasoningContent += delta.Get("reasoning_content").String()
+			for _, call := range delta.Get("tool_calls").Array() {
+				index := int(call.Get("index").Int())
+				for len(message.ToolCalls) <= index {
+					message.ToolCalls = append(message.ToolCalls, assembledToolCall{Type: "function"})
+				}
+				toolCall := &message.ToolCalls[index]
+				if id := call.Get("id").String(); id != "" {
+					toolCall.ID = id
+				}
+				if callType := call.Get("type").String(); callType != "" {
+					toolCall.Type = callType
+				}
+				toolCall.Function.Name += call.Get("function.name").String()
+				toolCall.Function.Arguments += call.Get("function.arguments").String()
+			}
+			return
+		}
+
+		switch data.Get("type").String() {
+		case "message_start":
+			message.Role = "assistant"
+		case "content_block_start":
+			message.Role = "assistant"
+			if block := data.Get("content_block"); block.Get("type").String() == "tool_use" {
+				toolBlocks[data.Get("index").Int()] = len(message.ToolCalls)
+				toolCall := assembledToolCall{ID: block.Get("id").String(), Type: "function"}
+				toolCall.Function.Name = block.Get("name").String()
+				message.ToolCalls = append(message.ToolCalls, toolCall)
+			}
+		case "content_block_delta":
+			message.Role = "assistant"
+			delta := data.Get("delta")
+			message.Content += delta.Get("text").String()
+			message.ReasoningContent += delta.Get("thinking").String()
+			if i, ok := toolBlocks[data.Get("index").Int()]; ok {
+				message.ToolCalls[i].Function.Arguments += delta.Get("partial_json").String()
+			}
+		}
+	})
+	return message
+}
+
+// eachSSEData calls fn for the JSON payload of every data line of an SSE body
+func eachSSEData(body []byte, fn func(gjson.Result)) {
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		data, found := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+		if !found {
+			continue
+		}
+		data = bytes.TrimSpace(data)
+		if len(data) > 0 && data[0] == '{' && gjson.ValidBytes(data) {
+			fn(gjson.ParseBytes(data))
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCaptureFilter(t *testing.T) {
+	now := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	f, err := parseCaptureFilter(url.Values{}, now)
+	require.NoError(t, err)
+	assert.True(t, f.From.IsZero())
+	assert.Equal(t, 0, f.Status)
+
+	f, err = parseCaptureFilter(url.Values{"from": {"2d"}, "to": {"1h"}, "model": {"m"}, "path": {"/v1/chat/completions"}, "status": {"200"}}, now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(-48*time.Hour), f.From)
+	assert.Equal(t, now.Add(-time.Hour), f.To)
+	assert.True(t, f.match(&ReqRespCapture{Timestamp: now.Add(-2 * time.Hour), Model: "m", ReqPath: "/v1/chat/completions", Status: 200}))
+	assert.False(t, f.match(&ReqRespCapture{Timestamp: now.Add(-2 * time.Hour), Model: "other", ReqPath: "/v1/chat/completions", Status: 200}))
+	assert.False(t, f.match(&ReqRespCapture{Timestamp: now.Add(-2 * time.Hour), Model: "m", ReqPath: "/v1/completions", Status: 200}))
+	assert.False(t, f.match(&ReqRespCapture{Timestamp: now.Add(-2 * time.Hour), Model: "m", ReqPath: "/v1/chat/completions", Status: 500}))
+	assert.False(t, f.match(&ReqRespCapture{Timestamp: now, Model: "m", ReqPath: "/v1/chat/completions", Status: 200}))
+
+	for _, invalid := range []url.Values{
+		{"from": {"yesterday"}},
+		{"from": {"1h"}, "to": {"2h"}},
+		{"status": {"ok"}},
+		{"status": {"999"}},
+	} {
+		_, err := parseCaptureFilter(invalid, now)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestNewJSONLExample(t *testing.T) {
+	jsonHeaders := map[string]string{"Content-Type": "application/json"}
+	sseHeaders := map[string]string{"Content-Type": "text/event-stream"}
+
+	t.Run("chat completion", func(t *testing.T) {
+		example, ok := newJSONLExample(ReqRespCapture{
+			Status:      200,
+			ReqBody:     []byte(`{"model":"m","messages":[{"role":"user","content":"hi"}],"tools":[{"type":"function","function":{"name":"f"}}]}`),
+			RespHeaders: jsonHeaders,
+			RespBody:    []byte(`{"choices":[{"message":{"role":"assistant","content":"hello"}}]}`),
+		})
+		require.True(t, ok)
+		line, err := json.Marshal(example)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{
+			"messages":[{"role":"user","content":"hi"},{"role":"assistant","content":"hello"}],
+			"tools":[{"type":"function","function":{"name":"f"}}]
+		}`, string(line))
+	})
+
+	t.Run("streamed chat completion", func(t *testing.T) {
+		body := "data: {\"choices\":[{\"delta\":{\"role\":\"assistant\",\"reasoning_content\":\"thinking\"}}]}\n\n" +
+			"data: {\"choices\":[{\"delta\":{\"content\":\"Let me \"}}]}\n\n" +
+			"data: {\"choices\":[{\"delta\":{\"content\":\"check\"}}]}\n\n" +
+			"data: {\"choices\":[{\"delta\":{\"tool_calls\":[{\"index\":0,\"id\":\"call_1\",\"type\":\"function\",\"function\":{\"name\":\"get_weather\",\"arguments\":\"\"}}]}}]}\n\n" +
+			"data: {\"choices\":[{\"delta\":{\"tool_calls\":[{\"index\":0,\"function\":{\"arguments\":\"{\\\"city\\\":\"}}]}}]}\n\n" +
+			"data: {\"choices\":[{\"delta\":{\"tool_calls\":[{\"index\":0,\"function\":{\"arguments\":\"\\\"Paris\\\"}\"}}]}}]}\n\n" +
+			"data: {\"usage\":{\"completion_tokens\":5}}\n\n" +
+			"data: [DONE]\n\n"
+		example, ok := newJSONLExample(ReqRespCapture{
+			ReqBody:     []byte(`{"messages":[{"role":"user","content":"weather?"}],"stream":true}`),
+			RespHeaders: sseHeaders,
+			RespBody:    []byte(body),
+		})
+		require.True(t, ok)
+		require.Len(t, example.Messages, 2)
+		assert.JSONEq(t, `{
+			"role":"assistant",
+			"content":"Let me check",
+			"reasoning_content":"thinking",
+			"tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}}]
+		}`, string(example.Messages[1]))
+	})
+
+	t.Run("text completion", func(t *testing.T) {
+		example, ok := newJSONLExample(ReqRespCapture{
+			ReqBody:     []byte(`{"prompt":"Once upon"}`),
+			RespHeaders: sseHeaders,
+			RespBody:    []byte("data: {\"choices\":[{\"text\":\" a\"}]}\n\ndata: {\"choices\":[{\"text\":\" time\"}]}\n\n"),
+		})
+		require.True(t, ok)
+		line, err := json.Marshal(example)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"prompt":"Once upon","completion":" a time"}`, string(line))
+	})
+
+	t.Run("skipped", func(t *testing.T) {
+		for name, capture := range map[string]ReqRespCapture{
+			"embedding":   {ReqBody: []byte(`{"input":"text"}`), RespHeaders: jsonHeaders, RespBody: []byte(`{"data":[]}`)},
+			"failed":      {Status: 500, ReqBody: []byte(`{"messages":[]}`), RespHeaders: jsonHeaders, RespBody: []byte(`{"error":"boom"}`)},
+			"no choices":  {ReqBody: []byte(`{"messages":[]}`), RespHeaders: jsonHeaders, RespBody: []byte(`{"usage":{}}`)},
+			"not json":    {ReqBody: []byte(`messages`)},
+			"empty event": {ReqBody: []byte(`{"messages":[]}`), RespHeaders: sseHeaders, RespBody: []byte("data: [DONE]\n\n")},
+		} {
+			_, ok := newJSONLExample(capture)
+			assert.False(t, ok, name)
+		}
+	})
+}
+
+func TestProxyManager_CaptureExport(t *testing.T) {
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"export-model": getTestSimpleResponderConfig("export-model"),
+		},
+		CaptureStore: config.CaptureStoreConfig{Path: t.TempDir(), RetentionDays: 7, MaxSizeMB: 10, Compression: config.CaptureCompressionGzip},
+		LogLevel:     "error",
+	})
+
+	proxy := New(conf)
+	req := httptest.NewRequest("POST", "/v1/chat/completions?stream=true", bytes.NewBufferString(`{"model":"export-model","messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set(requestIDHeader, "export-stream")
+	w := CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	req = httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"export-model","messages":[{"role":"user","content":"hello"}]}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	w = CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	proxy.StopProcesses(StopImmediately)
+	proxy.Shutdown()
+
+	// captures are persisted without a capture buffer and survive a restart
+	proxy = New(conf)
+	defer proxy.Shutdown()
+
+	req = httptest.NewRequest("GET", "/api/captures/export?format=har&model=export-model", nil)
+	w = CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Header().Get("Content-Disposition"), ".har")
+
+	var har struct {
+		Log struct {
+			Version string     `json:"version"`
+			Entries []harEntry `json:"entries"`
+		} `json:"log"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &har))
+	assert.Equal(t, "1.2", har.Log.Version)
+	require.Len(t, har.Log.Entries, 2)
+	streamed := har.Log.Entries[0]
+	assert.Equal(t, "POST", streamed.Request.Method)
+	assert.Equal(t, "http://example.com/v1/chat/completions", streamed.Request.URL)
+	assert.Equal(t, 200, streamed.Response.Status)
+	assert.Contains(t, streamed.Response.Content.MimeType, "text/event-stream")
+	assert.Contains(t, streamed.Response.Content.Text, "asdf")
+	assert.Equal(t, "export-stream", streamed.LlamaSwap.RequestID)
+	assert.Equal(t, "export-model", streamed.LlamaSwap.Model)
+	for _, header := range har.Log.Entries[1].Request.Headers {
+		if header.Name == "Authorization" {
+			assert.NotContains(t, header.Value, "secret")
+		}
+	}
+
+	// only the chat with a reply in the OpenAI format becomes an example
+	req = httptest.NewRequest("GET", "/api/captures/export?format=jsonl", nil)
+	w = CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	var lines []string
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	require.Len(t, lines, 1)
+	assert.JSONEq(t, `{"messages":[{"role":"user","content":"hi"},{"role":"assistant","content":"asdfasdfasdfasdfasdfasdfasdfasdfasdfasdf"}]}`, lines[0])
+
+	// filters
+	req = httptest.NewRequest("GET", "/api/captures/export?model=other", nil)
+	w = CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &har))
+	assert.Empty(t, har.Log.Entries)
+
+	req = httptest.NewRequest("GET", "/api/captures/export?format=xml", nil)
+	w = CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// the request API finds the stored captures
+	req = httptest.NewRequest("GET", "/api/requests/export-stream", nil)
+	w = CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var found struct {
+		Captures []ReqRespCapture `json:"captures"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &found))
+	require.Len(t, found.Captures, 1)
+	assert.Equal(t, "export-model", found.Captures[0].Model)
+}
+
+func TestProxyManager_CaptureExportDisabled(t *testing.T) {
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models:             map[string]config.ModelConfig{},
+		LogLevel:           "error",
+	})
+	proxy := New(conf)
+	defer proxy.Shutdown()
+
+	req := httptest.NewRequest("GET", "/api/captures/export", nil)
+	w := CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,424 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// maxDiffCells limits the size of the table used to diff two outputs, larger
+// outputs are shown as fully replaced
+const maxDiffCells = 4_000_000
+
+var errReplayNotJSON = errors.New("only captures with a JSON object request body can be replayed")
+
+// replayRequest is the body of POST /api/captures/:id/replay
+type replayRequest struct {
+	// model or peer model to send the request to, the model of the capture
+	// when empty
+	Model string `json:"model"`
+
+	// top level fields of the request body to replace, null removes a field
+	Overrides map[string]json.RawMessage `json:"overrides"`
+}
+
+// replaySide describes one of the two responses of a replay
+type replaySide struct {
+	CaptureID       *int    `json:"capture_id"` // nil when the response was not captured
+	RequestID       string  `json:"request_id"`
+	Model           string  `json:"model"`
+	Status          int     `json:"status"`
+	InputTokens     int     `json:"input_tokens"`
+	OutputTokens    int     `json:"output_tokens"`
+	DurationMs      int     `json:"duration_ms"`
+	TTFTMs          int     `json:"ttft_ms"`           // -1 when unknown or not streamed
+	TokensPerSecond float64 `json:"tokens_per_second"` // -1 when unknown
+	Output          string  `json:"output"`            // text of the assistant reply
+}
+
+// replayComparison compares the replay with the original
+type replayComparison struct {
+	InputTokensDelta  int     `json:"input_tokens_delta"`
+	OutputTokensDelta int     `json:"output_tokens_delta"`
+	DurationMsDelta   int     `json:"duration_ms_delta"`
+	Identical         bool    `json:"identical"`
+	Similarity        float64 `json:"similarity"` // share of words in common, from 0 to 1
+	Diff              string  `json:"diff"`       // line diff of the outputs, - original, + replay
+}
+
+type replayResult struct {
+	Original   replaySide       `json:"original"`
+	Replay     replaySide       `json:"replay"`
+	Comparison replayComparison `json:"comparison"`
+}
+
+// replayResponseWriter keeps the response of a replayed request in memory
+type replayResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	closed chan bool
+}
+
+func newReplayResponseWriter() *replayResponseWriter {
+	return &replayResponseWriter{header: make(http.Header), closed: make(chan bool, 1)}
+}
+
+func (w *replayResponseWriter) Header() http.Header { return w.header }
+
+func (w *replayResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *replayResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+func (w *replayResponseWriter) Flush() {}
+
+// CloseNotify is needed by gin for streamed responses. The replay is
+// canceled through the request context instead.
+func (w *replayResponseWriter) CloseNotify() <-chan bool { return w.closed }
+
+// findCapture returns the capture with the capture ID id from memory or,
+// with the capture store enabled, the newest stored capture of the request
+// with the request ID id
+func (pm *ProxyManager) findCapture(id string) (*ReqRespCapture, error) {
+	if captureID, err := strconv.Atoi(id); err == nil {
+		if capture := pm.metricsMonitor.getCaptureByID(captureID); capture != nil {
+			return capture, nil
+		}
+	}
+	if pm.metricsMonitor.captureStore == nil || !validRequestID(id) {
+		return nil, nil
+	}
+	found, err := pm.metricsMonitor.captureStore.findByRequestID(id)
+	if err != nil || len(found) == 0 {
+		return nil, err
+	}
+	return &found[len(found)-1], nil
+}
+
+// apiReplayCapture sends the request of a capture again, to the same or
+// another model, and compares the two responses. The replay goes through
+// the whole proxy with the credentials of the caller, so it is recorded and
+// captured like any other request, linked to the original by replay_of.
+func (pm *ProxyManager) apiReplayCapture(c *gin.Context) {
+	original, err := pm.findCapture(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read capture store: " + err.Error()})
+		return
+	}
+	if original == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "capture not found"})
+		return
+	}
+
+	var req replayRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON body"})
+			return
+		}
+	}
+	body, model, err := replayBody(*original, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, found := pm.config.RealModelName(model); !found && (pm.peerProxy == nil || !pm.peerProxy.HasPeerModel(model)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown model: " + model})
+		return
+	}
+
+	method := original.ReqMethod
+	if method == "" {
+		method = http.MethodPost
+	}
+	replayID := newRequestID()
+	ctx := context.WithValue(c.Request.Context(), proxyCtxKey("replayOf"), original.RequestID)
+	target := original.ReqPath
+	if original.ReqQuery != "" {
+		target += "?" + original.ReqQuery
+	}
+	r, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	r.RemoteAddr = c.Request.RemoteAddr
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(requestIDHeader, replayID)
+	for _, name := range []string{"Authorization", "X-Api-Key"} {
+		if value := c.GetHeader(name); value != "" {
+			r.Header.Set(name, value)
+		}
+	}
+	// signed in operators replay with their session, like the playground
+	if session, ok := c.Value(ginAdminSession).(*adminSession); ok {
+		r.AddCookie(&http.Cookie{Name: adminSessionCookie, Value: session.id})
+		r.Header.Set(adminCSRFHeader, session.csrf)
+	}
+	r.TLS = c.Request.TLS
+
+	w := newReplayResponseWriter()
+	pm.ServeHTTP(w, r)
+
+	replay := pm.replayCaptureOf(replayID)
+	if replay == nil {
+		// not captured, e.g. larger than the capture buffer
+		replay = &ReqRespCapture{
+			ID:          -1,
+			RequestID:   replayID,
+			Model:       model,
+			Status:      w.status,
+			RespHeaders: map[string]string{"Content-Type": w.header.Get("Content-Type")},
+			RespBody:    w.body.Bytes(),
+		}
+	}
+
+	result := replayResult{
+		Original: pm.replaySideOf(*original),
+		Replay:   pm.replaySideOf(*replay),
+	}
+	result.Comparison = compareReplay(result.Original, result.Replay)
+	c.JSON(http.StatusOK, result)
+}
+
+// replayBody applies req to the request body of capture and returns it with
+// the model it is sent to
+func replayBody(capture ReqRespCapture, req replayRequest) ([]byte, string, error) {
+	if !gjson.ValidBytes(capture.ReqBody) || !gjson.ParseBytes(capture.ReqBody).IsObject() {
+		return nil, "", errReplayNotJSON
+	}
+	body := bytes.Clone(capture.ReqBody)
+	var err error
+	for key, value := range req.Overrides {
+		path := escapeJSONPath(key)
+		if trimmed := bytes.TrimSpace(value); len(trimmed) == 0 || string(trimmed) == "null" {
+			body, err = sjson.DeleteBytes(body, path)
+		} else {
+			body, err = sjson.SetRawBytes(body, path, value)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	model := strings.TrimSpace(req.Model)
+	if model == "" {
+		model = gjson.GetBytes(body, "model").String()
+	}
+	if model == "" {
+		model = capture.Model
+	}
+	body, err = sjson.SetBytes(body, "model", model)
+	return body, model, err
+}
+
+// escapeJSONPath escapes the characters of a top level key that gjson and
+// sjson treat as path syntax
+func escapeJSONPath(key string) string {
+	var b strings.Builder
+	for _, r := range key {
+		if strings.ContainsRune(`.*?|#@\!=<>%`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// replayCaptureOf returns the capture of the replay with the request ID id
+func (pm *ProxyManager) replayCaptureOf(id string) *ReqRespCapture {
+	metrics := pm.metricsMonitor.getMetrics()
+	for i := len(metrics) - 1; i >= 0; i-- {
+		if metrics[i].RequestID == id && metrics[i].HasCapture {
+			return pm.metricsMonitor.getCaptureByID(metrics[i].ID)
+		}
+	}
+	if pm.metricsMonitor.captureStore != nil {
+		if found, err := pm.metricsMonitor.captureStore.findByRequestID(id); err == nil && len(found) > 0 {
+			capture := found[len(found)-1]
+			capture.ID = -1 // not in memory, can not be fetched by its ID
+			return &capture
+		}
+	}
+	return nil
+}
+
+// replaySideOf describes the response of capture, with the tokens and latency
+// of its metrics when they are still kept in memory
+func (pm *ProxyManager) replaySideOf(capture ReqRespCapture) replaySide {
+	side := replaySide{
+		RequestID:       capture.RequestID,
+		Model:           capture.Model,
+		Status:          capture.Status,
+		DurationMs:      capture.DurationMs,
+		TTFTMs:          -1,
+		TokensPerSecond: -1,
+		Output:          captureOutput(capture),
+	}
+	if capture.ID >= 0 {
+		id := capture.ID
+		side.CaptureID = &id
+	}
+	if side.Status == 0 {
+		side.Status = http.StatusOK
+	}
+
+	metrics := pm.metricsMonitor.getMetrics()
+	for i := len(metrics) - 1; i >= 0; i-- {
+		tm := metrics[i]
+		if capture.RequestID == "" || tm.RequestID != capture.RequestID {
+			continue
+		}
+		side.InputTokens = tm.InputTokens
+		side.OutputTokens = tm.OutputTokens
+		side.DurationMs = tm.DurationMs
+		side.TTFTMs = tm.TTFTMs
+		side.TokensPerSecond = tm.TokensPerSecond
+		break
+	}
+	return side
+}
+
+// captureOutput returns the text of the reply in the response of capture:
+// the content and tool calls of a chat completion, or the text of a text
+// completion or Anthropic message
+func captureOutput(capture ReqRespCapture) string {
+	body := capture.RespBody
+	if strings.Contains(headerValue(capture.RespHeaders, "Content-Type"), "text/event-stream") {
+		message := assembleStreamedMessage(body)
+		var text strings.Builder
+		text.WriteString(message.Content)
+		for _, call := range message.ToolCalls {
+			writeToolCall(&text, call.Function.Name, call.Function.Arguments)
+		}
+		return text.String()
+	}
+
+	parsed := gjson.ParseBytes(body)
+	if message := parsed.Get("choices.0.message"); message.Exists() {
+		var text strings.Builder
+		text.WriteString(message.Get("content").String())
+		for _, call := range message.Get("tool_calls").Array() {
+			writeToolCall(&text, call.Get("function.name").String(), call.Get("function.arguments").String())
+		}
+		return text.String()
+	}
+	if completion := parsed.Get("choices.0.text"); completion.Exists() {
+		return completion.String()
+	}
+	if blocks := parsed.Get("content"); blocks.IsArray() {
+		var text strings.Builder
+		for _, block := range blocks.Array() {
+			text.WriteString(block.Get("text").String())
+		}
+		return text.String()
+	}
+	return string(body)
+}
+
+func writeToolCall(text *strings.Builder, name, arguments string) {
+	if text.Len() > 0 {
+		text.WriteByte('\n')
+	}
+	text.WriteString("tool call: " + name + "(" + arguments + ")")
+}
+
+func compareReplay(original, replay replaySide) replayComparison {
+	return replayComparison{
+		InputTokensDelta:  replay.InputTokens - original.InputTokens,
+		OutputTokensDelta: replay.OutputTokens - original.OutputTokens,
+		DurationMsDelta:   replay.DurationMs - original.DurationMs,
+		Identical:         original.Output == replay.Output,
+		Similarity:        wordSimilarity(original.Output, replay.Output),
+		Diff:              lineDiff(original.Output, replay.Output),
+	}
+}
+
+// lcsTable returns the lengths of the longest common subsequences of the
+// suffixes of a and b, nil when it would be larger than maxDiffCells
+func lcsTable(a, b []string) [][]int {
+	if (len(a)+1)*(len(b)+1) > maxDiffCells {
+		return nil
+	}
+	table := make([][]int, len(a)+1)
+	for i := range table {
+		table[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				table[i][j] = table[i+1][j+1] + 1
+			} else {
+				table[i][j] = max(table[i+1][j], table[i][j+1])
+			}
+		}
+	}
+	return table
+}
+
+// lineDiff returns the lines of a and b prefixed with a space when they are
+// in both, - when they are only in a and + when they are only in b
+func lineDiff(a, b string) string {
+	if a == b {
+		return ""
+	}
+	linesA, linesB := strings.Split(a, "\n"), strings.Split(b, "\n")
+	var diff strings.Builder
+	table := lcsTable(linesA, linesB)
+	if table == nil {
+		for _, line := range linesA {
+			diff.WriteString("-" + line + "\n")
+		}
+		for _, line := range linesB {
+			diff.WriteString("+" + line + "\n")
+		}
+		return diff.String()
+	}
+
+	i, j := 0, 0
+	for i < len(linesA) || j < len(linesB) {
+		switch {
+		case i < len(linesA) && j < len(linesB) && linesA[i] == linesB[j]:
+			diff.WriteString(" " + linesA[i] + "\n")
+			i++
+			j++
+		case i < len(linesA) && (j == len(linesB) || table[i+1][j] >= table[i][j+1]):
+			diff.WriteString("-" + linesA[i] + "\n")
+			i++
+		default:
+			diff.WriteString("+" + linesB[j] + "\n")
+			j++
+		}
+	}
+	return diff.String()
+}
+
+// wordSimilarity returns twice the number of words in the longest common
+// subsequence of a and b divided by the number of words in both, 1 when both
+// are empty
+func wordSimilarity(a, b string) float64 {
+	wordsA, wordsB := strings.Fields(a), strings.Fields(b)
+	if len(wordsA)+len(wordsB) == 0 {
+		return 1
+	}
+	table := lcsTable(wordsA, wordsB)
+	if table == nil {
+		return 0
+	}
+	return 2 * float64(table[0][0]) / float64(len(wordsA)+len(wordsB))
+}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+)
+
+func TestLineDiff(t *testing.T) {
+	assert.Equal(t, "", lineDiff("same\ntext", "same\ntext"))
+	assert.Equal(t, " a\n-b\n+B\n c\n+d\n", lineDiff("a\nb\nc", "a\nB\nc\nd"))
+	assert.Equal(t, "-old\n+new\n", lineDiff("old", "new"))
+}
+
+func TestWordSimilarity(t *testing.T) {
+	assert.Equal(t, 1.0, wordSimilarity("", ""))
+	assert.Equal(t, 1.0, wordSimilarity("the quick fox", "the  quick\nfox"))
+	assert.Equal(t, 0.0, wordSimilarity("abc", ""))
+	assert.InDelta(t, 0.75, wordSimilarity("the quick brown fox", "the slow brown fox"), 0.001)
+}
+
+func TestReplayBody(t *testing.T) {
+	capture := ReqRespCapture{
+		Model:   "llama",
+		ReqBody: []byte(`{"model":"alias","temperature":0.7,"tools":[],"messages":[]}`),
+	}
+
+	body, model, err := replayBody(capture, replayRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, "alias", model)
+	assert.JSONEq(t, string(capture.ReqBody), string(body))
+
+	body, model, err = replayBody(capture, replayRequest{
+		Model: "qwen",
+		Overrides: map[string]json.RawMessage{
+			"temperature": json.RawMessage(`0`),
+			"tools":       json.RawMessage(`null`),
+			"top.k":       json.RawMessage(`20`),
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "qwen", model)
+	assert.JSONEq(t, `{"model":"qwen","temperature":0,"messages":[],"top.k":20}`, string(body))
+
+	_, _, err = replayBody(ReqRespCapture{ReqBody: []byte("multipart")}, replayRequest{})
+	assert.Error(t, err)
+}
+
+func TestCaptureOutput(t *testing.T) {
+	jsonHeaders := map[string]string{"Content-Type": "application/json"}
+	assert.Equal(t, "hello\ntool call: f({\"a\":1})", captureOutput(ReqRespCapture{
+		RespHeaders: jsonHeaders,
+		RespBody:    []byte(`{"choices":[{"message":{"content":"hello","tool_calls":[{"function":{"name":"f","arguments":"{\"a\":1}"}}]}}]}`),
+	}))
+	assert.Equal(t, "hi there", captureOutput(ReqRespCapture{
+		RespHeaders: jsonHeaders,
+		RespBody:    []byte(`{"content":[{"type":"text","text":"hi "},{"type":"text","text":"there"}]}`),
+	}))
+	assert.Equal(t, "ab", captureOutput(ReqRespCapture{
+		RespHeaders: map[string]string{"Content-Type": "text/event-stream"},
+		RespBody:    []byte("data: {\"choices\":[{\"delta\":{\"content\":\"a\"}}]}\n\ndata: {\"choices\":[{\"delta\":{\"content\":\"b\"}}]}\n\n"),
+	}))
+}
+
+func TestProxyManager_CaptureReplay(t *testing.T) {
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"replay-a": getTestSimpleResponderConfig("replay-a"),
+			"replay-b": getTestSimpleResponderConfig("replay-b"),
+		},
+		CaptureBuffer: 5,
+		LogLevel:      "error",
+	})
+	proxy := New(conf)
+	defer proxy.StopProcesses(StopImmediately)
+
+	send := func(path, body string) *TestResponseRecorder {
+		req := httptest.NewRequest("POST", path, bytes.NewBufferString(body))
+		w := CreateTestResponseRecorder()
+		proxy.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("/v1/chat/completions", `{"model":"replay-a","messages":[{"role":"user","content":"hi"}]}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	originalRequestID := w.Header().Get(requestIDHeader)
+	metrics := proxy.metricsMonitor.getMetrics()
+	require.Len(t, metrics, 1)
+	originalID := metrics[0].ID
+
+	w = send("/api/captures/"+strconv.Itoa(originalID)+"/replay", `{"model":"replay-b","overrides":{"temperature":0}}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var result replayResult
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, originalID, *result.Original.CaptureID)
+	assert.Equal(t, "replay-a", result.Original.Model)
+	assert.Equal(t, 25, result.Original.InputTokens)
+	assert.Equal(t, "replay-b", result.Replay.Model)
+	assert.Equal(t, http.StatusOK, result.Replay.Status)
+	assert.Equal(t, 10, result.Replay.OutputTokens)
+	assert.False(t, result.Comparison.Identical)
+	assert.Contains(t, result.Comparison.Diff, "replay-a")
+	assert.Contains(t, result.Comparison.Diff, "replay-b")
+	assert.Equal(t, 0, result.Comparison.OutputTokensDelta)
+
+	// the replay is captured and linked to the original
+	require.NotNil(t, result.Replay.CaptureID)
+	replay := proxy.metricsMonitor.getCaptureByID(*result.Replay.CaptureID)
+	require.NotNil(t, replay)
+	assert.Equal(t, originalRequestID, replay.ReplayOf)
+	assert.Equal(t, result.Replay.RequestID, replay.RequestID)
+	assert.Equal(t, "replay-b", gjson.GetBytes(replay.ReqBody, "model").String())
+	assert.Equal(t, int64(0), gjson.GetBytes(replay.ReqBody, "temperature").Int())
+	assert.True(t, gjson.GetBytes(replay.ReqBody, "temperature").Exists())
+
+	// streamed replies of the same text are identical
+	w = send("/v1/chat/completions?stream=true", `{"model":"replay-a","stream":true,"messages":[]}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	metrics = proxy.metricsMonitor.getMetrics()
+	streamedID := metrics[len(metrics)-1].ID
+	w = send("/api/captures/"+strconv.Itoa(streamedID)+"/replay", ``)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.True(t, result.Comparison.Identical)
+	assert.Equal(t, 1.0, result.Comparison.Similarity)
+	assert.Equal(t, "asdfasdfasdfasdfasdfasdfasdfasdfasdfasdf", result.Replay.Output)
+
+	w = send("/api/captures/9999/replay", `{}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = send("/api/captures/"+strconv.Itoa(originalID)+"/replay", `{"model":"unknown"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = send("/api/captures/"+strconv.Itoa(originalID)+"/replay", `{"overrides":[1]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestProxyManager_CaptureReplaySession(t *testing.T) {
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"replay-a": getTestSimpleResponderConfig("replay-a"),
+		},
+		RequiredAPIKeys: []string{"inference-key"},
+		AdminAuth: config.AdminAuthConfig{
+			Users: map[string]config.AdminUser{
+				"olga": {PasswordHash: testPasswordHash(t, "olga-password"), Role: config.AdminRoleOperator},
+			},
+			SessionTTL: 3600,
+		},
+		CaptureBuffer: 5,
+		LogLevel:      "error",
+	})
+	proxy := New(conf)
+	defer proxy.StopProcesses(StopImmediately)
+
+	client := &adminClient{t: t, proxy: proxy, cookies: map[string]*http.Cookie{}}
+	body, _ := json.Marshal(adminLoginRequest{Username: "olga", Password: "olga-password"})
+	require.Equal(t, http.StatusOK, client.send("POST", "/auth/login", string(body), map[string]string{"Content-Type": "application/json"}).Code)
+
+	w := client.send("POST", "/v1/chat/completions", `{"model":"replay-a","messages":[]}`, client.csrf())
+	require.Equal(t, http.StatusOK, w.Code)
+	metrics := proxy.metricsMonitor.getMetrics()
+	require.Len(t, metrics, 1)
+
+	// the operator has no API key, the replay uses the session
+	w = client.send("POST", "/api/captures/"+strconv.Itoa(metrics[0].ID)+"/replay", ``, client.csrf())
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var result replayResult
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, http.StatusOK, result.Replay.Status)
+	assert.True(t, result.Comparison.Identical)
+}
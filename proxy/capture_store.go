@@ -0,0 +1,327 @@
+package proxy
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// segments are named by the UTC day of their captures and a sequence
+	// number, e.g. captures-2025-01-31-0001.jsonl.gz
+	captureSegmentPrefix = "captures-"
+	captureSegmentSuffix = ".jsonl"
+	captureSegmentGzip   = ".gz"
+
+	// a segment is closed when it reaches 1/captureSegmentsPerStore of the
+	// maximum size, so pruning by size deletes captures in small steps
+	captureSegmentsPerStore = 16
+)
+
+// captureSegment is a file of the capture store
+type captureSegment struct {
+	name string
+	day  string
+	seq  int
+	size int64
+}
+
+// captureStore persists captures to append-only JSONL files in dir. Files
+// older than the retention are deleted, and the oldest files when all of
+// them together grow larger than maxSize.
+//
+// With compression every capture is written as a gzip member of its own.
+// Concatenated members are a valid gzip file, so segments can be appended to
+// without rewriting them.
+type captureStore struct {
+	mu        sync.Mutex
+	dir       string
+	retention int   // days
+	maxSize   int64 // bytes
+	compress  bool
+	logger    *LogMonitor
+
+	current     string // name of the segment captures are appended to
+	currentSize int64
+
+	now func() time.Time
+}
+
+// openCaptureStore creates dir if needed and removes expired segments
+func openCaptureStore(dir string, retentionDays int, maxSize int64, compress bool, logger *LogMonitor) (*captureStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create capture store directory: %w", err)
+	}
+	s := &captureStore{
+		dir:       dir,
+		retention: retentionDays,
+		maxSize:   maxSize,
+		compress:  compress,
+		logger:    logger,
+		now:       time.Now,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune()
+	return s, nil
+}
+
+// segmentSize is the size at which a new segment is started
+func (s *captureStore) segmentSize() int64 {
+	return max(s.maxSize/captureSegmentsPerStore, 1)
+}
+
+// append writes capture to the current segment
+func (s *captureStore) append(capture ReqRespCapture) {
+	if capture.Timestamp.IsZero() {
+		capture.Timestamp = s.now()
+	}
+	line, err := json.Marshal(capture)
+	if err != nil {
+		s.logger.Errorf("capture store: failed to encode capture: %v", err)
+		return
+	}
+	line = append(line, '\n')
+	if int64(len(line)) > s.maxSize {
+		s.logger.Warnf("capture store: capture size %d exceeds max %d, skipping", len(line), s.maxSize)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	day := capture.Timestamp.UTC().Format(metricsSegmentDay)
+	if !strings.HasPrefix(s.current, captureSegmentPrefix+day+"-") || s.currentSize >= s.segmentSize() {
+		s.rotate(day)
+	}
+
+	file, err := os.OpenFile(filepath.Join(s.dir, s.current), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		s.logger.Errorf("capture store: %v", err)
+		return
+	}
+	defer file.Close()
+
+	if s.compress {
+		gz := gzip.NewWriter(file)
+		if _, err = gz.Write(line); err == nil {
+			err = gz.Close()
+		}
+	} else {
+		_, err = file.Write(line)
+	}
+	if err != nil {
+		s.logger.Errorf("capture store: failed to write capture: %v", err)
+	}
+	if info, err := file.Stat(); err == nil {
+		s.currentSize = info.Size()
+	}
+}
+
+// rotate picks the segment of day to append to: the newest one when it has
+// room left and the configured compression, otherwise a new one. Segments
+// are pruned when a new one is started. s.mu must be held.
+func (s *captureStore) rotate(day string) {
+	segments, err := s.segments()
+	if err != nil {
+		s.logger.Errorf("capture store: %v", err)
+	}
+
+	seq := 1
+	for i := len(segments) - 1; i >= 0; i-- {
+		if segments[i].day != day {
+			continue
+		}
+		latest := segments[i]
+		if strings.HasSuffix(latest.name, captureSegmentGzip) == s.compress && latest.size < s.segmentSize() {
+			s.current, s.currentSize = latest.name, latest.size
+			return
+		}
+		seq = latest.seq + 1
+		break
+	}
+
+	s.current = fmt.Sprintf("%s%s-%04d%s", captureSegmentPrefix, day, seq, captureSegmentSuffix)
+	if s.compress {
+		s.current += captureSegmentGzip
+	}
+	s.currentSize = 0
+	s.prune()
+}
+
+// segments returns the segment files, oldest first
+func (s *captureStore) segments() ([]captureSegment, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []captureSegment
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		segment, ok := parseCaptureSegmentName(entry.Name())
+		if !ok {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			segment.size = info.Size()
+		}
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		if segments[i].day != segments[j].day {
+			return segments[i].day < segments[j].day
+		}
+		return segments[i].seq < segments[j].seq
+	})
+	return segments, nil
+}
+
+// parseCaptureSegmentName reads the day and sequence number from the name of
+// a segment file
+func parseCaptureSegmentName(name string) (captureSegment, bool) {
+	rest, found := strings.CutPrefix(name, captureSegmentPrefix)
+	if !found {
+		return captureSegment{}, false
+	}
+	rest = strings.TrimSuffix(rest, captureSegmentGzip)
+	if rest, found = strings.CutSuffix(rest, captureSegmentSuffix); !found {
+		return captureSegment{}, false
+	}
+	// day and sequence number are separated by a dash, e.g. 2025-01-31-0001
+	n := len(metricsSegmentDay)
+	if len(rest) < n+2 || rest[n] != '-' {
+		return captureSegment{}, false
+	}
+	day := rest[:n]
+	if _, err := time.Parse(metricsSegmentDay, day); err != nil {
+		return captureSegment{}, false
+	}
+	seq, err := strconv.Atoi(rest[n+1:])
+	if err != nil || seq < 1 {
+		return captureSegment{}, false
+	}
+	return captureSegment{name: name, day: day, seq: seq}, true
+}
+
+// prune deletes segments older than the retention, then the oldest segments
+// until all of them fit into maxSize. The current segment is kept. s.mu must
+// be held.
+func (s *captureStore) prune() {
+	oldest := s.now().UTC().AddDate(0, 0, -s.retention).Format(metricsSegmentDay)
+
+	segments, err := s.segments()
+	if err != nil {
+		s.logger.Errorf("capture store: %v", err)
+		return
+	}
+	var total int64
+	for _, segment := range segments {
+		total += segment.size
+	}
+	for _, segment := range segments {
+		if segment.name == s.current || (segment.day > oldest && total <= s.maxSize) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, segment.name)); err != nil {
+			s.logger.Errorf("capture store: failed to remove segment: %v", err)
+			continue
+		}
+		total -= segment.size
+		s.logger.Debugf("capture store: removed segment %s", segment.name)
+	}
+}
+
+// read calls fn for every capture with a timestamp in [from, to), oldest
+// segment first, until fn returns false. Captures that can not be decoded,
+// like one cut short by a crash, are skipped.
+func (s *captureStore) read(from, to time.Time, fn func(ReqRespCapture) bool) error {
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+	fromDay := from.UTC().Format(metricsSegmentDay)
+	toDay := to.UTC().Format(metricsSegmentDay)
+	for _, segment := range segments {
+		if segment.day < fromDay || segment.day > toDay {
+			continue
+		}
+		more, err := s.readSegment(segment.name, func(capture ReqRespCapture) bool {
+			if capture.Timestamp.Before(from) || !capture.Timestamp.Before(to) {
+				return true
+			}
+			return fn(capture)
+		})
+		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+	}
+	return nil
+}
+
+// readSegment calls fn for the captures of a segment until it returns false,
+// and reports whether it never did
+func (s *captureStore) readSegment(name string, fn func(ReqRespCapture) bool) (bool, error) {
+	file, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil // removed by prune
+		}
+		return false, err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if strings.HasSuffix(name, captureSegmentGzip) {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			if err == io.EOF {
+				return true, nil // empty
+			}
+			return false, fmt.Errorf("capture store: %s: %w", name, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	// captures can be large, bufio.Reader has no limit on the line length
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var capture ReqRespCapture
+			if json.Unmarshal(line, &capture) == nil && !fn(capture) {
+				return false, nil
+			}
+		}
+		if err != nil {
+			// a write cut short leaves a truncated gzip member at the end
+			return true, nil
+		}
+	}
+}
+
+// findByRequestID returns the captures of the request with the request ID id
+func (s *captureStore) findByRequestID(id string) ([]ReqRespCapture, error) {
+	var found []ReqRespCapture
+	err := s.read(time.Time{}, s.now().Add(time.Hour), func(capture ReqRespCapture) bool {
+		if capture.RequestID == id {
+			found = append(found, capture)
+		}
+		return true
+	})
+	return found, err
+}
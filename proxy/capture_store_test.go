@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaptureStore_AppendAndRead(t *testing.T) {
+	for _, compress := range []bool{true, false} {
+		t.Run(fmt.Sprintf("compress=%v", compress), func(t *testing.T) {
+			dir := t.TempDir()
+			now := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+
+			store, err := openCaptureStore(dir, 7, 1024*1024, compress, testLogger)
+			require.NoError(t, err)
+			store.now = func() time.Time { return now }
+
+			store.append(ReqRespCapture{ID: 1, RequestID: "req-a", Timestamp: now.Add(-24 * time.Hour), Model: "a", ReqBody: []byte(`{"model":"a"}`)})
+			store.append(ReqRespCapture{ID: 2, RequestID: "req-b", Timestamp: now.Add(-time.Hour), Model: "b", RespBody: []byte{0xff, 0x00}})
+			store.append(ReqRespCapture{ID: 3, RequestID: "req-a", Timestamp: now, Model: "c"})
+
+			segments, err := store.segments()
+			require.NoError(t, err)
+			require.Len(t, segments, 2)
+			assert.Equal(t, "2025-03-09", segments[0].day)
+			assert.Equal(t, compress, strings.HasSuffix(segments[1].name, ".gz"))
+
+			// a capture cut short by a crash is skipped
+			file, err := os.OpenFile(filepath.Join(dir, segments[1].name), os.O_APPEND|os.O_WRONLY, 0644)
+			require.NoError(t, err)
+			file.Write([]byte{0x1f, 0x8b, 0x08, 0x00, '{', '"', 'i', 'd'})
+			file.Close()
+
+			var captures []ReqRespCapture
+			require.NoError(t, store.read(now.Add(-2*time.Hour), now.Add(time.Second), func(c ReqRespCapture) bool {
+				captures = append(captures, c)
+				return true
+			}))
+			require.Len(t, captures, 2)
+			assert.Equal(t, "b", captures[0].Model)
+			assert.Equal(t, []byte{0xff, 0x00}, captures[0].RespBody)
+			assert.Equal(t, "c", captures[1].Model)
+
+			found, err := store.findByRequestID("req-a")
+			require.NoError(t, err)
+			require.Len(t, found, 2)
+			assert.Equal(t, 1, found[0].ID)
+			assert.Equal(t, []byte(`{"model":"a"}`), found[0].ReqBody)
+			assert.Equal(t, 3, found[1].ID)
+
+			// reading stops when fn returns false
+			count := 0
+			require.NoError(t, store.read(time.Time{}, now.Add(time.Second), func(ReqRespCapture) bool {
+				count++
+				return false
+			}))
+			assert.Equal(t, 1, count)
+		})
+	}
+}
+
+func TestCaptureStore_Prune(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	store, err := openCaptureStore(dir, 7, 16*1024, false, testLogger)
+	require.NoError(t, err)
+	store.now = func() time.Time { return now }
+
+	// captures of the last 7 days are kept
+	for _, name := range []string{"captures-2025-03-03-0001.jsonl.gz", "captures-2025-03-04-0001.jsonl.gz", "captures-2025-03-04-0002.jsonl", "other.txt"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0644))
+	}
+	store.mu.Lock()
+	store.prune()
+	store.mu.Unlock()
+
+	segments, err := store.segments()
+	require.NoError(t, err)
+	require.Len(t, segments, 2)
+	assert.Equal(t, "captures-2025-03-04-0001.jsonl.gz", segments[0].name)
+	assert.Equal(t, "captures-2025-03-04-0002.jsonl", segments[1].name)
+	assert.FileExists(t, filepath.Join(dir, "other.txt"))
+
+	// the oldest segments are deleted to stay within maxSize
+	body := []byte(strings.Repeat("x", 1000))
+	for i := 0; i < 100; i++ {
+		store.append(ReqRespCapture{ID: i, Timestamp: now, RespBody: body})
+	}
+	segments, err = store.segments()
+	require.NoError(t, err)
+	var total int64
+	for _, segment := range segments {
+		assert.Equal(t, "2025-03-10", segment.day)
+		total += segment.size
+	}
+	assert.LessOrEqual(t, total, store.maxSize+store.segmentSize()+2000)
+	assert.Greater(t, segments[0].seq, 1)
+
+	var ids []int
+	require.NoError(t, store.read(time.Time{}, now.Add(time.Second), func(c ReqRespCapture) bool {
+		ids = append(ids, c.ID)
+		return true
+	}))
+	require.NotEmpty(t, ids)
+	assert.Equal(t, 99, ids[len(ids)-1])
+
+	// captures larger than the store are not written
+	store.append(ReqRespCapture{ID: 100, Timestamp: now, RespBody: make([]byte, 16*1024)})
+	found, err := store.findByRequestID("")
+	require.NoError(t, err)
+	assert.Equal(t, 99, found[len(found)-1].ID)
+}
+
+func TestParseCaptureSegmentName(t *testing.T) {
+	segment, ok := parseCaptureSegmentName("captures-2025-01-31-0012.jsonl.gz")
+	require.True(t, ok)
+	assert.Equal(t, "2025-01-31", segment.day)
+	assert.Equal(t, 12, segment.seq)
+
+	segment, ok = parseCaptureSegmentName("captures-2025-01-31-0001.jsonl")
+	require.True(t, ok)
+	assert.Equal(t, 1, segment.seq)
+
+	for _, invalid := range []string{
+		"metrics-2025-01-31.jsonl",
+		"captures-2025-01-31.jsonl",
+		"captures-2025-01-31-0000.jsonl",
+		"captures-2025-13-31-0001.jsonl",
+		"captures-2025-01-31-abc.jsonl.gz",
+		"captures-2025-01-31-0001.txt",
+	} {
+		_, ok := parseCaptureSegmentName(invalid)
+		assert.False(t, ok, invalid)
+	}
+}
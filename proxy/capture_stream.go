@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// streamTiming marks when the SSE event ending at byte End of the response
+// body of a capture was written
+type streamTiming struct {
+	OffsetMs float64 `json:"offset_ms"` // since the request was received
+	End      int     `json:"end"`
+}
+
+// streamTimings converts the event times of a response of bodySize bytes to
+// offsets from received. It returns nil when the events do not describe the
+// body, e.g. for a compressed response.
+func streamTimings(received time.Time, events []sseEventTime, bodySize int) []streamTiming {
+	if len(events) == 0 || events[len(events)-1].end > bodySize {
+		return nil
+	}
+	timings := make([]streamTiming, len(events))
+	for i, event := range events {
+		timings[i] = streamTiming{
+			OffsetMs: math.Round(float64(event.at.Sub(received).Microseconds())) / 1000,
+			End:      event.end,
+		}
+	}
+	return timings
+}
+
+// streamChunk is one event of a streamed response
+type streamChunk struct {
+	OffsetMs float64 `json:"offset_ms"` // since the request was received
+	Event    string  `json:"event,omitempty"`
+
+	// the JSON payload of the event, or a string for other payloads such as
+	// [DONE] and for events without data, e.g. comments sent as keep alive
+	Data json.RawMessage `json:"data"`
+}
+
+// captureView is a capture as returned by the API. A streamed response is
+// also split into its chunks and put together into the final message.
+type captureView struct {
+	ReqRespCapture
+	Chunks    []streamChunk     `json:"chunks,omitempty"`
+	Assembled *assembledMessage `json:"assembled,omitempty"`
+}
+
+func newCaptureView(capture ReqRespCapture) captureView {
+	view := captureView{ReqRespCapture: capture}
+	view.StreamTimings = nil
+	if !strings.Contains(headerValue(capture.RespHeaders, "Content-Type"), "text/event-stream") {
+		return view
+	}
+
+	start := 0
+	for _, timing := range capture.StreamTimings {
+		if timing.End < start || timing.End > len(capture.RespBody) {
+			break
+		}
+		view.Chunks = append(view.Chunks, parseStreamChunk(timing.OffsetMs, capture.RespBody[start:timing.End]))
+		start = timing.End
+	}
+	if message := assembleStreamedMessage(capture.RespBody); message.Role != "" {
+		view.Assembled = &message
+	}
+	return view
+}
+
+// parseStreamChunk parses the lines of one SSE event
+func parseStreamChunk(offsetMs float64, event []byte) streamChunk {
+	chunk := streamChunk{OffsetMs: offsetMs}
+	var data [][]byte
+	for _, line := range bytes.Split(event, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
+		if value, found := bytes.CutPrefix(line, []byte("data:")); found {
+			data = append(data, bytes.TrimPrefix(value, []byte(" ")))
+		} else if value, found := bytes.CutPrefix(line, []byte("event:")); found {
+			chunk.Event = string(bytes.TrimSpace(value))
+		}
+	}
+
+	payload := bytes.Join(data, []byte("\n"))
+	if data == nil {
+		payload = bytes.TrimSpace(event)
+	}
+	if trimmed := bytes.TrimSpace(payload); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && gjson.ValidBytes(trimmed) {
+		chunk.Data = json.RawMessage(trimmed)
+	} else {
+		chunk.Data, _ = json.Marshal(string(payload))
+	}
+	return chunk
+}
+
+func newCaptureViews(captures []ReqRespCapture) []captureView {
+	views := make([]captureView, len(captures))
+	for i, capture := range captures {
+		views[i] = newCaptureView(capture)
+	}
+	return views
+}
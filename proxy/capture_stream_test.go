@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseBodyCopier_Events(t *testing.T) {
+	rec := httptest.NewRecorder()
+	ginCtx, _ := gin.CreateTestContext(rec)
+	copier := newBodyCopier(ginCtx.Writer)
+	copier.Header().Set("Content-Type", "text/event-stream")
+
+	// events may be split across writes and end with \r\n
+	copier.Write([]byte("data: {\"a\":1}\n\nevent: ping\r\n"))
+	copier.Write([]byte("data: {}\r\n\r\n: keep alive\n\n"))
+	copier.Write([]byte("data: [DONE]"))
+
+	events := copier.Events()
+	body := copier.body.Bytes()
+	require.Len(t, events, 4)
+	assert.Equal(t, "data: {\"a\":1}\n\n", string(body[:events[0].end]))
+	assert.Equal(t, "event: ping\r\ndata: {}\r\n\r\n", string(body[events[0].end:events[1].end]))
+	assert.Equal(t, ": keep alive\n\n", string(body[events[1].end:events[2].end]))
+	assert.Equal(t, len(body), events[3].end)
+	assert.False(t, events[1].at.Before(events[0].at))
+
+	// other responses have no events
+	rec = httptest.NewRecorder()
+	ginCtx, _ = gin.CreateTestContext(rec)
+	copier = newBodyCopier(ginCtx.Writer)
+	copier.Header().Set("Content-Type", "application/json")
+	copier.Write([]byte("{}\n\n"))
+	assert.Empty(t, copier.Events())
+}
+
+func TestStreamTimings(t *testing.T) {
+	received := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+	events := []sseEventTime{
+		{at: received.Add(1500 * time.Microsecond), end: 10},
+		{at: received.Add(40 * time.Millisecond), end: 20},
+	}
+	assert.Equal(t, []streamTiming{{OffsetMs: 1.5, End: 10}, {OffsetMs: 40, End: 20}}, streamTimings(received, events, 20))
+	assert.Nil(t, streamTimings(received, events, 15))
+	assert.Nil(t, streamTimings(received, nil, 15))
+}
+
+func TestNewCaptureView(t *testing.T) {
+	body := "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"role\":\"assistant\"}}\n\n" +
+		"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"thinking_delta\",\"thinking\":\"hmm\"}}\n\n" +
+		"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":1,\"delta\":{\"type\":\"text_delta\",\"text\":\"Checking\"}}\n\n" +
+		"event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":2,\"content_block\":{\"type\":\"tool_use\",\"id\":\"toolu_1\",\"name\":\"get_weather\"}}\n\n" +
+		"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":2,\"delta\":{\"type\":\"input_json_delta\",\"partial_json\":\"{\\\"city\\\":\"}}\n\n" +
+		"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":2,\"delta\":{\"type\":\"input_json_delta\",\"partial_json\":\"\\\"Paris\\\"}\"}}\n\n" +
+		"data: [DONE]\n\n"
+
+	var timings []streamTiming
+	end := 0
+	for i, event := range bytes.SplitAfter([]byte(body), []byte("\n\n")) {
+		if len(event) == 0 {
+			continue
+		}
+		end += len(event)
+		timings = append(timings, streamTiming{OffsetMs: float64(10 * i), End: end})
+	}
+
+	view := newCaptureView(ReqRespCapture{
+		RespHeaders:   map[string]string{"Content-Type": "text/event-stream"},
+		RespBody:      []byte(body),
+		StreamTimings: timings,
+	})
+	assert.Nil(t, view.StreamTimings)
+	require.Len(t, view.Chunks, 7)
+	assert.Equal(t, 0.0, view.Chunks[0].OffsetMs)
+	assert.Equal(t, "message_start", view.Chunks[0].Event)
+	assert.JSONEq(t, `{"type":"message_start","message":{"role":"assistant"}}`, string(view.Chunks[0].Data))
+	assert.Equal(t, 60.0, view.Chunks[6].OffsetMs)
+	assert.Equal(t, `"[DONE]"`, string(view.Chunks[6].Data))
+
+	require.NotNil(t, view.Assembled)
+	assembled, err := json.Marshal(view.Assembled)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"role":"assistant",
+		"content":"Checking",
+		"reasoning_content":"hmm",
+		"tool_calls":[{"id":"toolu_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}}]
+	}`, string(assembled))
+
+	// the raw body is kept
+	data, err := json.Marshal(view)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"resp_body":`)
+	assert.NotContains(t, string(data), `"stream_timings"`)
+
+	// other responses are not split
+	view = newCaptureView(ReqRespCapture{
+		RespHeaders: map[string]string{"Content-Type": "application/json"},
+		RespBody:    []byte(`{}`),
+	})
+	assert.Nil(t, view.Chunks)
+	assert.Nil(t, view.Assembled)
+}
+
+func TestProxyManager_StreamingCapture(t *testing.T) {
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"stream-model": getTestSimpleResponderConfig("stream-model"),
+		},
+		CaptureBuffer: 5,
+		LogLevel:      "error",
+	})
+	proxy := New(conf)
+	defer proxy.StopProcesses(StopImmediately)
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions?stream=true", bytes.NewBufferString(`{"model":"stream-model","messages":[]}`))
+	w := CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	metrics := proxy.metricsMonitor.getMetrics()
+	require.Len(t, metrics, 1)
+	req = httptest.NewRequest("GET", "/api/captures/"+strconv.Itoa(metrics[0].ID), nil)
+	w = CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var view struct {
+		RespBody  []byte           `json:"resp_body"`
+		Chunks    []streamChunk    `json:"chunks"`
+		Assembled assembledMessage `json:"assembled"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &view))
+	assert.Contains(t, string(view.RespBody), "asdf")
+
+	// 10 content chunks, usage and [DONE]
+	require.Len(t, view.Chunks, 12)
+	assert.Equal(t, "message", view.Chunks[0].Event)
+	assert.Contains(t, string(view.Chunks[0].Data), `"content":"asdf"`)
+	assert.Contains(t, string(view.Chunks[10].Data), `"usage"`)
+	assert.Equal(t, `"[DONE]"`, string(view.Chunks[11].Data))
+	for i := 1; i < len(view.Chunks); i++ {
+		assert.GreaterOrEqual(t, view.Chunks[i].OffsetMs, view.Chunks[i-1].OffsetMs)
+	}
+	assert.Greater(t, view.Chunks[0].OffsetMs, 0.0)
+	assert.Equal(t, "asdfasdfasdfasdfasdfasdfasdfasdfasdfasdf", view.Assembled.Content)
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mostlygeek/llama-swap/event"
+	"github.com/mostlygeek/llama-swap/proxy/config"
+)
+
+// ginClientAccessRoute is the gin.Context key where clientAccessCheck stores
+// the route class of the request
+const ginClientAccessRoute = "clientAccessRoute"
+
+const clientAccessDeniedMessage = "client address not allowed"
+
+// clientAccessRouteClass returns the route class of a request path for the
+// clientAccess rules, empty for the routes that are never checked
+func clientAccessRouteClass(urlPath string) string {
+	hasPrefix := func(prefix string) bool {
+		return urlPath == prefix || strings.HasPrefix(urlPath, prefix+"/")
+	}
+	switch {
+	case urlPath == "/health" || urlPath == "/wol-health":
+		return ""
+	case hasPrefix("/api") || urlPath == "/metrics" || urlPath == "/running" || urlPath == "/unload":
+		return config.ClientAccessRouteAPI
+	case hasPrefix("/ui") || hasPrefix("/auth") || urlPath == "/" || urlPath == "/favicon.ico":
+		return config.ClientAccessRouteUI
+	case hasPrefix("/logs"):
+		return config.ClientAccessRouteLogs
+	case hasPrefix("/upstream"):
+		return config.ClientAccessRouteUpstream
+	}
+	return config.ClientAccessRouteInference
+}
+
+// clientAccessRule is a configured client access rule with its parsed CIDRs
+type clientAccessRule struct {
+	config config.ClientAccessRule
+	allow  []*net.IPNet
+	deny   []*net.IPNet
+}
+
+func newClientAccessRule(conf config.ClientAccessRule) *clientAccessRule {
+	rule := &clientAccessRule{config: conf}
+	for _, client := range conf.Allow {
+		if cidr, err := config.ParseCIDR(client); err == nil {
+			rule.allow = append(rule.allow, cidr)
+		}
+	}
+	for _, client := range conf.Deny {
+		if cidr, err := config.ParseCIDR(client); err == nil {
+			rule.deny = append(rule.deny, cidr)
+		}
+	}
+	return rule
+}
+
+func containsIP(cidrs []*net.IPNet, ip net.IP) bool {
+	for _, cidr := range cidrs {
+		if ip != nil && cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows returns true when ip is not in deny and, when the rule has an
+// allow list, is in allow. A nil ip is only allowed by rules without allow.
+func (r *clientAccessRule) allows(ip net.IP) bool {
+	if containsIP(r.deny, ip) {
+		return false
+	}
+	return len(r.allow) == 0 || containsIP(r.allow, ip)
+}
+
+// clientAccess enforces the clientAccess rules
+type clientAccess struct {
+	mu    sync.RWMutex
+	rules []*clientAccessRule
+}
+
+func newClientAccess(rules []config.ClientAccessRule) *clientAccess {
+	a := &clientAccess{}
+	a.update(rules)
+	return a
+}
+
+// update replaces the rules
+func (a *clientAccess) update(configs []config.ClientAccessRule) {
+	rules := make([]*clientAccessRule, 0, len(configs))
+	for _, conf := range configs {
+		rules = append(rules, newClientAccessRule(conf))
+	}
+
+	a.mu.Lock()
+	a.rules = rules
+	a.mu.Unlock()
+}
+
+// denied returns the name of the first rule for the route class that does
+// not allow client, empty when every rule allows it. Without models only
+// the rules without models are checked, with models only the rules with a
+// pattern matching one of them.
+func (a *clientAccess) denied(class, client string, models ...string) string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	ip := net.ParseIP(client)
+	for _, rule := range a.rules {
+		if !rule.config.AppliesToRoute(class) {
+			continue
+		}
+		if len(models) == 0 {
+			if len(rule.config.Models) > 0 {
+				continue
+			}
+		} else if len(rule.config.Models) == 0 || !matchPatterns(rule.config.Models, models...) {
+			continue
+		}
+		if !rule.allows(ip) {
+			return rule.config.Name
+		}
+	}
+	return ""
+}
+
+// clientAccessCheck is the middleware that sends a 403 response when a
+// clientAccess rule without models does not allow the client of the request
+func (pm *ProxyManager) clientAccessCheck(c *gin.Context) {
+	class := clientAccessRouteClass(c.Request.URL.Path)
+	if class == "" {
+		return
+	}
+	c.Set(ginClientAccessRoute, class)
+	if rule := pm.clientAccess.denied(class, c.ClientIP()); rule != "" {
+		pm.denyClientAccess(c, "", rule)
+	}
+}
+
+// checkClientAccess sends a 403 response when a clientAccess rule with
+// models matching requestedModel, or one of the variants when it is a split,
+// does not allow the client of the request
+func (pm *ProxyManager) checkClientAccess(c *gin.Context, requestedModel string) bool {
+	class := c.GetString(ginClientAccessRoute)
+	if class == "" {
+		return true
+	}
+	models := []string{requestedModel, pm.quotaModel(requestedModel)}
+	for _, variant := range pm.splitRouter().variants(requestedModel) {
+		models = append(models, variant, pm.quotaModel(variant))
+	}
+	rule := pm.clientAccess.denied(class, c.ClientIP(), models...)
+	if rule == "" {
+		return true
+	}
+	pm.denyClientAccess(c, requestedModel, rule)
+	return false
+}
+
+func (pm *ProxyManager) denyClientAccess(c *gin.Context, requestedModel, rule string) {
+	target := c.Request.URL.Path
+	if requestedModel != "" {
+		target += " (model " + requestedModel + ")"
+	}
+	pm.proxyLogger.Warnf("Request %s from %s to %s denied by client access rule %s", requestIDOf(c.Request), c.ClientIP(), target, rule)
+	event.Emit(RequestRejectedEvent{Model: requestedModel, Reason: "client_access"})
+	pm.sendErrorResponse(c, http.StatusForbidden, clientAccessDeniedMessage)
+	c.Abort()
+}
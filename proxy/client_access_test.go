@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientAccessRouteClass(t *testing.T) {
+	for urlPath, expected := range map[string]string{
+		"/v1/chat/completions":      config.ClientAccessRouteInference,
+		"/completion":               config.ClientAccessRouteInference,
+		"/api/models":               config.ClientAccessRouteAPI,
+		"/metrics":                  config.ClientAccessRouteAPI,
+		"/unload":                   config.ClientAccessRouteAPI,
+		"/":                         config.ClientAccessRouteUI,
+		"/ui/models":                config.ClientAccessRouteUI,
+		"/auth/login":               config.ClientAccessRouteUI,
+		"/logs/stream":              config.ClientAccessRouteLogs,
+		"/upstream/model1/v1/props": config.ClientAccessRouteUpstream,
+		"/apifoo":                   config.ClientAccessRouteInference,
+		"/health":                   "",
+		"/wol-health":               "",
+	} {
+		assert.Equal(t, expected, clientAccessRouteClass(urlPath), urlPath)
+	}
+}
+
+func TestProxyManager_ClientAccess(t *testing.T) {
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"model1": getTestSimpleResponderConfig("model1"),
+			"model2": getTestSimpleResponderConfig("model2"),
+		},
+		Splits: map[string]config.SplitConfig{
+			"split12": {
+				StickyBy: config.SplitStickyNone,
+				Variants: []config.SplitVariant{{Model: "model1", Weight: 1}, {Model: "model2", Weight: 1}},
+			},
+		},
+		TrustedProxies: []string{"10.0.0.1/32"},
+		ClientAccess: []config.ClientAccessRule{
+			{Name: "management", Routes: []string{config.ClientAccessRouteAPI, config.ClientAccessRouteLogs}, Allow: []string{"192.168.10.0/24"}},
+			{Name: "model2 hosts", Models: []string{"model2"}, Allow: []string{"192.168.20.0/24"}, Deny: []string{"192.168.20.9/32"}},
+		},
+		LogLevel: "error",
+	})
+	proxy := New(conf)
+	defer proxy.StopProcesses(StopImmediately)
+
+	send := func(method, path, body, remoteAddr, forwardedFor string) *TestResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		w := CreateTestResponseRecorder()
+		proxy.ServeHTTP(w, req)
+		return w
+	}
+	chat := func(model, remoteAddr string) int {
+		return send("POST", "/v1/chat/completions", `{"model":"`+model+`"}`, remoteAddr, "").Code
+	}
+
+	// the management routes only from the management subnet
+	assert.Equal(t, http.StatusOK, send("GET", "/api/version", "", "192.168.10.4:5000", "").Code)
+	w := send("GET", "/api/version", "", "192.168.30.4:5000", "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, clientAccessDeniedMessage, w.Body.String())
+	assert.Equal(t, http.StatusForbidden, send("GET", "/logs", "", "192.168.30.4:5000", "").Code)
+	assert.Equal(t, http.StatusOK, send("GET", "/health", "", "192.168.30.4:5000", "").Code)
+
+	// X-Forwarded-For is only used from a trusted proxy
+	assert.Equal(t, http.StatusForbidden, send("GET", "/api/version", "", "192.168.30.4:5000", "192.168.10.4").Code)
+	assert.Equal(t, http.StatusOK, send("GET", "/api/version", "", "10.0.0.1:5000", "192.168.10.4").Code)
+	assert.Equal(t, http.StatusForbidden, send("GET", "/api/version", "", "10.0.0.1:5000", "192.168.30.4").Code)
+
+	// model rules only apply to their models, deny wins over allow
+	assert.Equal(t, http.StatusOK, chat("model1", "192.168.30.4:5000"))
+	assert.Equal(t, http.StatusForbidden, chat("model2", "192.168.30.4:5000"))
+	assert.Equal(t, http.StatusForbidden, chat("model2", "192.168.20.9:5000"))
+	assert.Equal(t, http.StatusForbidden, send("GET", "/upstream/model2/test", "", "192.168.30.4:5000", "").Code)
+	assert.Equal(t, StateStopped, proxy.findGroupByModelName("model2").processes["model2"].CurrentState(), "a denied request must not load the model")
+	assert.Equal(t, http.StatusOK, chat("model2", "192.168.20.4:5000"))
+
+	// a split can not be used to reach a variant the client is denied
+	assert.Equal(t, http.StatusForbidden, chat("split12", "192.168.30.4:5000"))
+	assert.Equal(t, http.StatusOK, chat("split12", "192.168.20.4:5000"))
+
+	// rules are applied without a restart
+	updated := conf
+	updated.ClientAccess = conf.ClientAccess[1:]
+	require.True(t, proxy.UpdateAccessRules(updated))
+	assert.Equal(t, http.StatusOK, send("GET", "/api/version", "", "192.168.30.4:5000", "").Code)
+}
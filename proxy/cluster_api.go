@@ -28,6 +28,7 @@ func (pm *ProxyManager) apiStopCluster(c *gin.Context) {
 
 	scriptPath, scriptArgs := clusterStopScriptAndArgs()
 	if _, err := os.Stat(scriptPath); err != nil {
+		auditNodes(c, dockerActionNodeLabel("", true))
 		c.JSON(http.StatusOK, gin.H{
 			"message": "llama-swap processes unloaded; cluster stop script not found, skipped container stop",
 			"script":  scriptPath,
@@ -35,6 +36,7 @@ func (pm *ProxyManager) apiStopCluster(c *gin.Context) {
 		return
 	}
 
+	auditClusterNodes(c)
 	timeout := clusterStopTimeout()
 	baseCtx := context.WithoutCancel(c.Request.Context())
 	ctx, cancel := context.WithTimeout(baseCtx, timeout)
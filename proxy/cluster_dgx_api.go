@@ -99,6 +99,7 @@ func (pm *ProxyManager) apiRunClusterDGXUpdate(c *gin.Context) {
 		})
 		return
 	}
+	auditNodes(c, targets...)
 	localIPs := localIPv4AddressSet()
 
 	startedAt := time.Now().UTC()
@@ -140,6 +141,10 @@ func (pm *ProxyManager) apiRunClusterDGXUpdate(c *gin.Context) {
 		}
 	}
 
+	if failed := len(results) - success; failed > 0 {
+		auditError(c, fmt.Sprintf("update failed on %d of %d nodes", failed, len(results)))
+	}
+
 	c.JSON(http.StatusOK, clusterDGXUpdateResponse{
 		Action:      "update_and_reboot",
 		StartedAt:   startedAt.Format(time.RFC3339),
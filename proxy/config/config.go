@@ -1,16 +1,26 @@
 package config
 
 import (
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/billziss-gh/golib/shlex"
+	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/yaml.v3"
 )
 
@@ -82,22 +92,36 @@ type GroupConfig struct {
 	Exclusive  bool     `yaml:"exclusive"`
 	Persistent bool     `yaml:"persistent"`
 	Members    []string `yaml:"members"`
+
+	// swap hysteresis: a model that was loaded stays resident for at least
+	// MinResidency seconds or MinResidencyRequests requests, whichever comes
+	// first, before a swap can unload it
+	MinResidency         int `yaml:"minResidency"`
+	MinResidencyRequests int `yaml:"minResidencyRequests"`
+	MaxSwapWait          int `yaml:"maxSwapWait"` // seconds
+
+	// warn when more than ThrashThreshold swaps happen within ThrashWindow seconds
+	ThrashThreshold int `yaml:"thrashThreshold"`
+	ThrashWindow    int `yaml:"thrashWindow"`
 }
 
 var (
 	macroNameRegex    = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
 	macroPatternRegex = regexp.MustCompile(`\$\{([a-zA-Z0-9_-]+)\}`)
-	envMacroRegex     = regexp.MustCompile(`\$\{env\.([a-zA-Z_][a-zA-Z0-9_]*)\}`)
+	envMacroRegex     = regexp.MustCompile(`\$\{env\.([a-zA-Z_][a-zA-Z0-9_]*)(:-[^}]*)?\}`)
+	fileMacroRegex    = regexp.MustCompile(`\$\{file:([^}]+)\}`)
 )
 
 // set default values for GroupConfig
 func (c *GroupConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	type rawGroupConfig GroupConfig
 	defaults := rawGroupConfig{
-		Swap:       true,
-		Exclusive:  true,
-		Persistent: false,
-		Members:    []string{},
+		Swap:         true,
+		Exclusive:    true,
+		Persistent:   false,
+		Members:      []string{},
+		MaxSwapWait:  60,
+		ThrashWindow: 300,
 	}
 
 	if err := unmarshal(&defaults); err != nil {
@@ -116,6 +140,467 @@ type HookOnStartup struct {
 	Preload []string `yaml:"preload"`
 }
 
+// MetricsStoreConfig controls where request metrics are persisted
+type MetricsStoreConfig struct {
+	Path          string `yaml:"path"`
+	RetentionDays int    `yaml:"retentionDays"`
+}
+
+// set default values for MetricsStoreConfig
+func (c *MetricsStoreConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawMetricsStoreConfig MetricsStoreConfig
+	defaults := rawMetricsStoreConfig{
+		RetentionDays: 30,
+	}
+
+	if err := unmarshal(&defaults); err != nil {
+		return err
+	}
+
+	*c = MetricsStoreConfig(defaults)
+	return nil
+}
+
+// CaptureStoreConfig controls where request and response captures are persisted
+type CaptureStoreConfig struct {
+	Path          string `yaml:"path"`
+	RetentionDays int    `yaml:"retentionDays"`
+	MaxSizeMB     int    `yaml:"maxSizeMB"`
+	Compression   string `yaml:"compression"`
+}
+
+const (
+	CaptureCompressionGzip = "gzip"
+	CaptureCompressionNone = "none"
+)
+
+// set default values for CaptureStoreConfig
+func (c *CaptureStoreConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawCaptureStoreConfig CaptureStoreConfig
+	defaults := rawCaptureStoreConfig{
+		RetentionDays: 7,
+		MaxSizeMB:     1024,
+		Compression:   CaptureCompressionGzip,
+	}
+
+	if err := unmarshal(&defaults); err != nil {
+		return err
+	}
+
+	*c = CaptureStoreConfig(defaults)
+	return nil
+}
+
+// AuditLogConfig controls where the audit log of administrative actions is
+// written
+type AuditLogConfig struct {
+	Path      string `yaml:"path"`
+	MaxSizeMB int    `yaml:"maxSizeMB"` // size of the active file before it is rotated
+	MaxFiles  int    `yaml:"maxFiles"`  // rotated files to keep, 0 keeps all
+}
+
+// set default values for AuditLogConfig
+func (c *AuditLogConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawAuditLogConfig AuditLogConfig
+	defaults := rawAuditLogConfig{
+		MaxSizeMB: 100,
+		MaxFiles:  10,
+	}
+
+	if err := unmarshal(&defaults); err != nil {
+		return err
+	}
+
+	*c = AuditLogConfig(defaults)
+	return nil
+}
+
+// TracingConfig controls the export of OpenTelemetry traces
+type TracingConfig struct {
+	Endpoint    string            `yaml:"endpoint"`
+	ServiceName string            `yaml:"serviceName"`
+	SampleRatio float64           `yaml:"sampleRatio"`
+	Headers     map[string]string `yaml:"headers"`
+}
+
+// set default values for TracingConfig
+func (c *TracingConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawTracingConfig TracingConfig
+	defaults := rawTracingConfig{
+		ServiceName: "llama-swap",
+		SampleRatio: 1,
+	}
+
+	if err := unmarshal(&defaults); err != nil {
+		return err
+	}
+
+	*c = TracingConfig(defaults)
+	return nil
+}
+
+// MirrorConfig sends a share of the requests for a model to a shadow model
+// as well. Clients only get the response of the primary model.
+type MirrorConfig struct {
+	Model      string  `yaml:"model"`
+	Shadow     string  `yaml:"shadow"`
+	Percent    float64 `yaml:"percent"`
+	LoadShadow bool    `yaml:"loadShadow"`
+}
+
+// how a split assigns a client to a variant
+const (
+	SplitStickyAPIKey = "apiKey" // by API key, by client address without one
+	SplitStickyHeader = "header" // by the value of stickyHeader
+	SplitStickyNone   = "none"   // every request is assigned by weight
+)
+
+// SplitConfig is a virtual model that splits its requests between variants
+// by weight
+type SplitConfig struct {
+	Variants     []SplitVariant `yaml:"variants"`
+	StickyBy     string         `yaml:"stickyBy"`
+	StickyHeader string         `yaml:"stickyHeader"`
+}
+
+// SplitVariant is a model or peer model that serves a share of the requests
+// of a split
+type SplitVariant struct {
+	Model  string `yaml:"model"`
+	Weight int    `yaml:"weight"`
+}
+
+// set default values for SplitConfig
+func (c *SplitConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawSplitConfig SplitConfig
+	defaults := rawSplitConfig{
+		StickyBy: SplitStickyAPIKey,
+	}
+
+	if err := unmarshal(&defaults); err != nil {
+		return err
+	}
+
+	*c = SplitConfig(defaults)
+	return nil
+}
+
+// set default values for SplitVariant
+func (v *SplitVariant) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawSplitVariant SplitVariant
+	defaults := rawSplitVariant{
+		Weight: 1,
+	}
+
+	if err := unmarshal(&defaults); err != nil {
+		return err
+	}
+
+	*v = SplitVariant(defaults)
+	return nil
+}
+
+// endpoint classes an API key can be allowed to call
+const (
+	APIKeyEndpointInference = "inference" // inference routes, /v1/models and /upstream
+	APIKeyEndpointReadOnly  = "readonly"  // reading /api, /logs, /metrics and /running
+	APIKeyEndpointAdmin     = "admin"     // every route
+)
+
+// APIKeyHashPrefix starts a keyHash, followed by the hex encoded SHA-256 of
+// the key
+const APIKeyHashPrefix = "sha256:"
+
+// APIKeyIdentity is a named API key with the models and endpoints it can use.
+// Requests without a key can use it with a client certificate matching
+// ClientCerts.
+type APIKeyIdentity struct {
+	Key         string        `yaml:"key"`
+	KeyHash     string        `yaml:"keyHash"`
+	ClientCerts []string      `yaml:"clientCerts"` // patterns of the CN or SANs of client certificates
+	Owner       string        `yaml:"owner"`
+	Models      []string      `yaml:"models"`
+	Endpoints   []string      `yaml:"endpoints"`
+	Quotas      []QuotaConfig `yaml:"quotas"`
+}
+
+// periods of a quota, usage is counted in windows aligned to UTC
+const (
+	QuotaPeriodMinute = "minute"
+	QuotaPeriodHour   = "hour"
+	QuotaPeriodDay    = "day"
+)
+
+// QuotaConfig limits the usage of the models matching Models by an API key
+// within each period. A limit of 0 is not enforced.
+type QuotaConfig struct {
+	Models       []string `yaml:"models"`
+	Period       string   `yaml:"period"`
+	Requests     int      `yaml:"requests"`
+	InputTokens  int      `yaml:"inputTokens"`
+	OutputTokens int      `yaml:"outputTokens"`
+}
+
+// set default values for QuotaConfig
+func (q *QuotaConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawQuotaConfig QuotaConfig
+	defaults := rawQuotaConfig{
+		Models: []string{"*"},
+	}
+
+	if err := unmarshal(&defaults); err != nil {
+		return err
+	}
+
+	*q = QuotaConfig(defaults)
+	return nil
+}
+
+// PeriodDuration returns the length of the period, 0 when it is not valid
+func (q QuotaConfig) PeriodDuration() time.Duration {
+	switch q.Period {
+	case QuotaPeriodMinute:
+		return time.Minute
+	case QuotaPeriodHour:
+		return time.Hour
+	case QuotaPeriodDay:
+		return 24 * time.Hour
+	}
+	return 0
+}
+
+// AppliesTo returns true when model matches one of the model patterns of the
+// quota
+func (q QuotaConfig) AppliesTo(model string) bool {
+	return matchModelPatterns(q.Models, model)
+}
+
+// set default values for APIKeyIdentity
+func (k *APIKeyIdentity) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawAPIKeyIdentity APIKeyIdentity
+	defaults := rawAPIKeyIdentity{
+		Models:    []string{"*"},
+		Endpoints: []string{APIKeyEndpointInference},
+	}
+
+	if err := unmarshal(&defaults); err != nil {
+		return err
+	}
+
+	*k = APIKeyIdentity(defaults)
+	return nil
+}
+
+// AllowsModel returns true when model matches one of the model patterns of
+// the key
+func (k APIKeyIdentity) AllowsModel(model string) bool {
+	return matchModelPatterns(k.Models, model)
+}
+
+// ParseCIDR parses a CIDR, or an IP address as the CIDR of only that address
+func ParseCIDR(value string) (*net.IPNet, error) {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", value)
+		}
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, cidr, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR %q", value)
+	}
+	return cidr, nil
+}
+
+func matchModelPatterns(patterns []string, model string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, model); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsEndpoint returns true when the key can call routes of the endpoint
+// class, admin keys can call every route
+func (k APIKeyIdentity) AllowsEndpoint(class string) bool {
+	for _, allowed := range k.Endpoints {
+		if allowed == class || allowed == APIKeyEndpointAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// what a rate limit keeps a separate budget for
+const (
+	RateLimitPerAPIKey = "apiKey"
+	RateLimitPerClient = "client"
+	RateLimitPerModel  = "model"
+)
+
+// RateLimitConfig limits the rate of the inference requests matching all of
+// its match lists, an empty list matches every request
+type RateLimitConfig struct {
+	Name string `yaml:"name"`
+
+	// match lists
+	APIKeys   []string `yaml:"apiKeys"`   // patterns of API key names
+	Models    []string `yaml:"models"`    // patterns of model names or IDs
+	Clients   []string `yaml:"clients"`   // CIDRs or addresses
+	Endpoints []string `yaml:"endpoints"` // patterns of request paths
+
+	Per []string `yaml:"per"`
+
+	RequestsPerMinute float64 `yaml:"requestsPerMinute"`
+	Burst             int     `yaml:"burst"`
+	TokensPerMinute   float64 `yaml:"tokensPerMinute"`
+	TokenBurst        int     `yaml:"tokenBurst"`
+	TokenEstimate     int     `yaml:"tokenEstimate"`
+}
+
+// set default values for RateLimitConfig
+func (r *RateLimitConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRateLimitConfig RateLimitConfig
+	defaults := rawRateLimitConfig{
+		Burst:         5,
+		TokenEstimate: 1024,
+	}
+
+	if err := unmarshal(&defaults); err != nil {
+		return err
+	}
+
+	*r = RateLimitConfig(defaults)
+	return nil
+}
+
+// route classes of the client access rules
+const (
+	ClientAccessRouteInference = "inference"
+	ClientAccessRouteAPI       = "api"
+	ClientAccessRouteUI        = "ui"
+	ClientAccessRouteLogs      = "logs"
+	ClientAccessRouteUpstream  = "upstream"
+)
+
+// ClientAccessRule allows or denies client addresses on the routes of its
+// route classes, an empty list of routes matches every class. Rules with
+// models only apply to the inference and upstream routes of those models.
+type ClientAccessRule struct {
+	Name   string   `yaml:"name"`
+	Routes []string `yaml:"routes"` // route classes
+	Models []string `yaml:"models"` // patterns of model names or IDs
+	Allow  []string `yaml:"allow"`  // CIDRs or addresses, empty allows all
+	Deny   []string `yaml:"deny"`   // CIDRs or addresses
+}
+
+// AppliesToRoute returns true when the rule applies to the route class
+func (r ClientAccessRule) AppliesToRoute(class string) bool {
+	if len(r.Models) > 0 && class != ClientAccessRouteInference && class != ClientAccessRouteUpstream {
+		return false
+	}
+	if len(r.Routes) == 0 {
+		return true
+	}
+	for _, route := range r.Routes {
+		if route == class {
+			return true
+		}
+	}
+	return false
+}
+
+// roles of the admin users, each role can do what the roles before it can
+const (
+	AdminRoleViewer   = "viewer"
+	AdminRoleOperator = "operator"
+	AdminRoleAdmin    = "admin"
+)
+
+// AdminRoleRank orders the admin roles, 0 is not a role
+func AdminRoleRank(role string) int {
+	switch role {
+	case AdminRoleViewer:
+		return 1
+	case AdminRoleOperator:
+		return 2
+	case AdminRoleAdmin:
+		return 3
+	}
+	return 0
+}
+
+// AdminUser is a user that signs in to the UI and /api with a password
+type AdminUser struct {
+	PasswordHash string `yaml:"passwordHash"` // bcrypt
+	Role         string `yaml:"role"`
+}
+
+// OIDCConfig lets users sign in with an OpenID Connect provider
+type OIDCConfig struct {
+	Issuer        string            `yaml:"issuer"`
+	ClientID      string            `yaml:"clientID"`
+	ClientSecret  string            `yaml:"clientSecret"`
+	RedirectURL   string            `yaml:"redirectURL"`
+	Scopes        []string          `yaml:"scopes"`
+	UsernameClaim string            `yaml:"usernameClaim"`
+	RoleClaim     string            `yaml:"roleClaim"`
+	Roles         map[string]string `yaml:"roles"` // claim value to role
+	DefaultRole   string            `yaml:"defaultRole"`
+}
+
+// set default values for OIDCConfig
+func (c *OIDCConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawOIDCConfig OIDCConfig
+	defaults := rawOIDCConfig{
+		Scopes:        []string{"openid", "profile", "email"},
+		UsernameClaim: "preferred_username",
+		RoleClaim:     "groups",
+	}
+
+	if err := unmarshal(&defaults); err != nil {
+		return err
+	}
+
+	*c = OIDCConfig(defaults)
+	return nil
+}
+
+// AdminAuthConfig separates the credentials of the UI and /api from the
+// inference API keys
+type AdminAuthConfig struct {
+	Users      map[string]AdminUser `yaml:"users"`
+	OIDC       OIDCConfig           `yaml:"oidc"`
+	SessionTTL int                  `yaml:"sessionTTL"` // seconds
+}
+
+// set default values for AdminAuthConfig
+func (c *AdminAuthConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawAdminAuthConfig AdminAuthConfig
+	defaults := rawAdminAuthConfig{
+		SessionTTL: 12 * 60 * 60,
+	}
+
+	if err := unmarshal(&defaults); err != nil {
+		return err
+	}
+
+	*c = AdminAuthConfig(defaults)
+	return nil
+}
+
+// Enabled returns true when admin users or OIDC are configured
+func (c AdminAuthConfig) Enabled() bool {
+	return len(c.Users) > 0 || c.OIDC.Issuer != ""
+}
+
 type Config struct {
 	HealthCheckTimeout int                    `yaml:"healthCheckTimeout"`
 	LogRequests        bool                   `yaml:"logRequests"`
@@ -124,6 +609,13 @@ type Config struct {
 	LogToStdout        string                 `yaml:"logToStdout"`
 	MetricsMaxInMemory int                    `yaml:"metricsMaxInMemory"`
 	CaptureBuffer      int                    `yaml:"captureBuffer"`
+	MetricsStore       MetricsStoreConfig     `yaml:"metricsStore"`
+	CaptureStore       CaptureStoreConfig     `yaml:"captureStore"`
+	AuditLog           AuditLogConfig         `yaml:"auditLog"`
+	Tracing            TracingConfig          `yaml:"tracing"`
+	Mirrors            []MirrorConfig         `yaml:"mirrors"`
+	Splits             map[string]SplitConfig `yaml:"splits"` /* key is the virtual model name */
+	RateLimits         []RateLimitConfig      `yaml:"rateLimits"`
 	Models             map[string]ModelConfig `yaml:"models"` /* key is model ID */
 	Profiles           map[string][]string    `yaml:"profiles"`
 	Groups             map[string]GroupConfig `yaml:"groups"` /* key is group ID */
@@ -131,9 +623,15 @@ type Config struct {
 	// for key/value replacements in model's cmd, cmdStop, proxy, checkEndPoint
 	Macros MacroList `yaml:"macros"`
 
+	// macros that override Macros on the host with a matching hostname
+	HostMacros map[string]MacroList `yaml:"hostMacros"`
+
 	// map aliases to actual model IDs
 	aliases map[string]string
 
+	// the modelTemplates each model extends, see applyModelTemplates
+	templateChains map[string][]string
+
 	// automatic port assignments
 	StartPort int `yaml:"startPort"`
 
@@ -149,11 +647,37 @@ type Config struct {
 	// support API keys, see issue #433, #50, #251
 	RequiredAPIKeys []string `yaml:"apiKeys"`
 
+	// named API keys limited to some models and endpoints, key is the name
+	APIKeyIdentities map[string]APIKeyIdentity `yaml:"apiKeyIdentities"`
+
+	// admin users of the UI and /api
+	AdminAuth AdminAuthConfig `yaml:"adminAuth"`
+
 	// support remote peers, see issue #433, #296
 	Peers PeerDictionaryConfig `yaml:"peers"`
 
 	// allowed CORS origins for security
 	AllowedOrigins []string `yaml:"allowedOrigins"`
+
+	// CIDRs of the reverse proxies whose X-Forwarded-For header is trusted
+	TrustedProxies []string `yaml:"trustedProxies"`
+
+	// client address allow/deny rules per route class
+	ClientAccess []ClientAccessRule `yaml:"clientAccess"`
+
+	// reusable model settings, models inherit them with extends
+	ModelTemplates map[string]ModelConfig `yaml:"modelTemplates"`
+
+	// additional config files (or globs) merged into this one, relative
+	// to the including file
+	Include []string `yaml:"include"`
+
+	// resolved paths of the files merged in via include, in merge order
+	IncludedFiles []string `yaml:"-"`
+
+	// directories the include patterns look for files in, they may not
+	// exist yet or not contain a matching file
+	IncludeDirs []string `yaml:"-"`
 }
 
 func (c *Config) RealModelName(search string) (string, bool) {
@@ -174,31 +698,24 @@ func (c *Config) FindConfig(modelName string) (ModelConfig, string, bool) {
 	}
 }
 
+// LoadConfig loads the config file at path along with any files it includes
 func LoadConfig(path string) (Config, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return Config{}, err
-	}
-	defer file.Close()
-	return LoadConfigFromReader(file)
+	return LoadConfigWithOverlay(path, nil)
 }
 
+// LoadConfigFromReader loads a config from r. Includes are resolved relative
+// to the working directory.
 func LoadConfigFromReader(r io.Reader) (Config, error) {
 	data, err := io.ReadAll(r)
 	if err != nil {
 		return Config{}, err
 	}
-	yamlStr := string(data)
-
-	// Phase 1: Substitute all ${env.VAR} macros at string level
-	// This is safe because env values are simple strings without YAML formatting
-	yamlStr, err = substituteEnvMacros(yamlStr)
-	if err != nil {
-		return Config{}, err
-	}
+	return loadConfigWithIncludes("", data, nil)
+}
 
-	// Unmarshal into full Config with defaults
-	config := Config{
+// defaultConfig returns the settings used for anything not set in the config
+func defaultConfig() Config {
+	return Config{
 		HealthCheckTimeout: 120,
 		StartPort:          5800,
 		LogLevel:           "info",
@@ -206,23 +723,86 @@ func LoadConfigFromReader(r io.Reader) (Config, error) {
 		LogToStdout:        LogToStdoutProxy,
 		MetricsMaxInMemory: 1000,
 		CaptureBuffer:      5,
+		MetricsStore:       MetricsStoreConfig{RetentionDays: 30},
+		CaptureStore:       CaptureStoreConfig{RetentionDays: 7, MaxSizeMB: 1024, Compression: CaptureCompressionGzip},
+		AuditLog:           AuditLogConfig{MaxSizeMB: 100, MaxFiles: 10},
+		Tracing:            TracingConfig{ServiceName: "llama-swap", SampleRatio: 1},
 	}
-	if err = yaml.Unmarshal([]byte(yamlStr), &config); err != nil {
+}
+
+// loadConfigFromYAML decodes and validates a config document. All ${env.VAR}
+// macros must already be substituted at string level, which is safe because
+// env values are simple strings without YAML formatting.
+func loadConfigFromYAML(yamlStr string) (Config, error) {
+	var err error
+
+	// Unmarshal into full Config with defaults
+	config := defaultConfig()
+	var doc yaml.Node
+	if err = yaml.Unmarshal([]byte(yamlStr), &doc); err != nil {
 		return Config{}, err
 	}
+	var templateChains map[string][]string
+	if len(doc.Content) > 0 {
+		if templateChains, err = applyModelTemplates(doc.Content[0]); err != nil {
+			return Config{}, err
+		}
+		if err = doc.Decode(&config); err != nil {
+			return Config{}, err
+		}
+		if len(templateChains) > 0 {
+			config.templateChains = templateChains
+		}
+	}
+
+	// Validation continues after an error so that every problem is reported,
+	// see ValidateConfig
+	var errs []error
 
 	if config.HealthCheckTimeout < 15 {
-		return Config{}, fmt.Errorf("healthCheckTimeout must be greater than or equal to 15")
+		errs = append(errs, errorAt(fmt.Errorf("healthCheckTimeout must be greater than or equal to 15"), "healthCheckTimeout"))
 	}
 
 	if config.StartPort < 1 {
-		return Config{}, fmt.Errorf("startPort must be greater than 1")
+		errs = append(errs, errorAt(fmt.Errorf("startPort must be greater than 1"), "startPort"))
+	}
+
+	if config.MetricsStore.RetentionDays < 1 {
+		errs = append(errs, errorAt(fmt.Errorf("metricsStore.retentionDays must be greater than or equal to 1"), "metricsStore", "retentionDays"))
+	}
+
+	if config.CaptureStore.RetentionDays < 1 {
+		errs = append(errs, errorAt(fmt.Errorf("captureStore.retentionDays must be greater than or equal to 1"), "captureStore", "retentionDays"))
+	}
+	if config.CaptureStore.MaxSizeMB < 1 {
+		errs = append(errs, errorAt(fmt.Errorf("captureStore.maxSizeMB must be greater than or equal to 1"), "captureStore", "maxSizeMB"))
+	}
+	switch config.CaptureStore.Compression {
+	case CaptureCompressionGzip, CaptureCompressionNone:
+	default:
+		errs = append(errs, errorAt(fmt.Errorf("captureStore.compression must be one of: gzip, none"), "captureStore", "compression"))
+	}
+
+	if config.AuditLog.MaxSizeMB < 1 {
+		errs = append(errs, errorAt(fmt.Errorf("auditLog.maxSizeMB must be greater than or equal to 1"), "auditLog", "maxSizeMB"))
+	}
+	if config.AuditLog.MaxFiles < 0 {
+		errs = append(errs, errorAt(fmt.Errorf("auditLog.maxFiles must be greater than or equal to 0"), "auditLog", "maxFiles"))
+	}
+
+	if endpoint := strings.TrimSpace(config.Tracing.Endpoint); endpoint != "" {
+		if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, errorAt(fmt.Errorf("tracing.endpoint must be an http or https URL"), "tracing", "endpoint"))
+		}
+	}
+	if config.Tracing.SampleRatio < 0 || config.Tracing.SampleRatio > 1 {
+		errs = append(errs, errorAt(fmt.Errorf("tracing.sampleRatio must be between 0 and 1"), "tracing", "sampleRatio"))
 	}
 
 	switch config.LogToStdout {
 	case LogToStdoutProxy, LogToStdoutUpstream, LogToStdoutBoth, LogToStdoutNone:
 	default:
-		return Config{}, fmt.Errorf("logToStdout must be one of: proxy, upstream, both, none")
+		errs = append(errs, errorAt(fmt.Errorf("logToStdout must be one of: proxy, upstream, both, none"), "logToStdout"))
 	}
 
 	// Populate the aliases map
@@ -230,16 +810,31 @@ func LoadConfigFromReader(r io.Reader) (Config, error) {
 	for modelName, modelConfig := range config.Models {
 		for _, alias := range modelConfig.Aliases {
 			if _, found := config.aliases[alias]; found {
-				return Config{}, fmt.Errorf("duplicate alias %s found in model: %s", alias, modelName)
+				errs = append(errs, errorAt(fmt.Errorf("duplicate alias %s found in model: %s", alias, modelName), "models", modelName, "aliases"))
+				continue
 			}
 			config.aliases[alias] = modelName
 		}
 	}
 
+	// Validate host macro overlays and apply the one for this host
+	for host, macros := range config.HostMacros {
+		for _, macro := range macros {
+			if err = validateMacro(macro.Name, macro.Value); err != nil {
+				errs = append(errs, errorAt(fmt.Errorf("hostMacros.%s: %w", host, err), "hostMacros", host, macro.Name))
+			}
+		}
+	}
+	if len(config.HostMacros) > 0 {
+		if host, err := hostname(); err == nil {
+			config.Macros = applyHostMacros(config.Macros, config.HostMacros, host)
+		}
+	}
+
 	// Validate global macros
 	for _, macro := range config.Macros {
 		if err = validateMacro(macro.Name, macro.Value); err != nil {
-			return Config{}, err
+			errs = append(errs, errorAt(err, "macros", macro.Name))
 		}
 	}
 
@@ -252,210 +847,594 @@ func LoadConfigFromReader(r io.Reader) (Config, error) {
 
 	nextPort := config.StartPort
 	for _, modelId := range modelIds {
-		modelConfig := config.Models[modelId]
+		modelConfig, err := expandModelConfig(&config, modelId, config.Models[modelId], &nextPort)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		config.Models[modelId] = modelConfig
+	}
 
-		// Strip comments from command fields
-		modelConfig.Cmd = StripComments(modelConfig.Cmd)
-		modelConfig.CmdStop = StripComments(modelConfig.CmdStop)
+	config = AddDefaultGroupToConfig(config)
 
-		// Validate model macros
-		for _, macro := range modelConfig.Macros {
-			if err = validateMacro(macro.Name, macro.Value); err != nil {
-				return Config{}, fmt.Errorf("model %s: %s", modelId, err.Error())
+	// Validate group members
+	memberUsage := make(map[string]string)
+	for groupID, groupConfig := range config.Groups {
+		prevSet := make(map[string]bool)
+		for _, member := range groupConfig.Members {
+			if _, found := prevSet[member]; found {
+				errs = append(errs, errorAt(fmt.Errorf("duplicate model member %s found in group: %s", member, groupID), "groups", groupID, "members"))
+				continue
 			}
+			prevSet[member] = true
+
+			if existingGroup, exists := memberUsage[member]; exists {
+				errs = append(errs, errorAt(fmt.Errorf("model member %s is used in multiple groups: %s and %s", member, existingGroup, groupID), "groups", groupID, "members"))
+				continue
+			}
+			memberUsage[member] = groupID
 		}
 
-		// Build merged macro list: MODEL_ID + global macros + model macros (model overrides global)
-		mergedMacros := make(MacroList, 0, len(config.Macros)+len(modelConfig.Macros)+1)
-		mergedMacros = append(mergedMacros, MacroEntry{Name: "MODEL_ID", Value: modelId})
-		mergedMacros = append(mergedMacros, config.Macros...)
+		if groupConfig.MinResidency < 0 {
+			errs = append(errs, errorAt(fmt.Errorf("groups.%s.minResidency must be greater than or equal to 0", groupID), "groups", groupID, "minResidency"))
+		}
+		if groupConfig.MinResidencyRequests < 0 {
+			errs = append(errs, errorAt(fmt.Errorf("groups.%s.minResidencyRequests must be greater than or equal to 0", groupID), "groups", groupID, "minResidencyRequests"))
+		}
+		if groupConfig.MaxSwapWait < 0 {
+			errs = append(errs, errorAt(fmt.Errorf("groups.%s.maxSwapWait must be greater than or equal to 0", groupID), "groups", groupID, "maxSwapWait"))
+		}
+		if groupConfig.ThrashThreshold < 0 {
+			errs = append(errs, errorAt(fmt.Errorf("groups.%s.thrashThreshold must be greater than or equal to 0", groupID), "groups", groupID, "thrashThreshold"))
+		}
+		if groupConfig.ThrashThreshold > 0 && groupConfig.ThrashWindow < 1 {
+			errs = append(errs, errorAt(fmt.Errorf("groups.%s.thrashWindow must be greater than or equal to 1", groupID), "groups", groupID, "thrashWindow"))
+		}
+	}
 
-		// Add model macros (override globals with same name)
-		for _, entry := range modelConfig.Macros {
-			found := false
-			for i, existing := range mergedMacros {
-				if existing.Name == entry.Name {
-					mergedMacros[i] = entry
-					found = true
-					break
-				}
+	// Clean up hooks preload
+	if len(config.Hooks.OnStartup.Preload) > 0 {
+		var toPreload []string
+		for _, modelID := range config.Hooks.OnStartup.Preload {
+			modelID = strings.TrimSpace(modelID)
+			if modelID == "" {
+				continue
 			}
-			if !found {
-				mergedMacros = append(mergedMacros, entry)
+			if real, found := config.RealModelName(modelID); found {
+				toPreload = append(toPreload, real)
 			}
 		}
+		config.Hooks.OnStartup.Preload = toPreload
+	}
 
-		// Substitute remaining macros in model fields (LIFO order)
-		for i := len(mergedMacros) - 1; i >= 0; i-- {
-			entry := mergedMacros[i]
-			macroSlug := fmt.Sprintf("${%s}", entry.Name)
-			macroStr := fmt.Sprintf("%v", entry.Value)
-
-			modelConfig.Cmd = strings.ReplaceAll(modelConfig.Cmd, macroSlug, macroStr)
-			modelConfig.CmdStop = strings.ReplaceAll(modelConfig.CmdStop, macroSlug, macroStr)
-			modelConfig.Proxy = strings.ReplaceAll(modelConfig.Proxy, macroSlug, macroStr)
-			modelConfig.CheckEndpoint = strings.ReplaceAll(modelConfig.CheckEndpoint, macroSlug, macroStr)
-			modelConfig.Filters.StripParams = strings.ReplaceAll(modelConfig.Filters.StripParams, macroSlug, macroStr)
+	// Validate API keys (env macros already substituted at string level)
+	for i, apikey := range config.RequiredAPIKeys {
+		if apikey == "" {
+			errs = append(errs, errorAt(fmt.Errorf("empty api key found in apiKeys"), "apiKeys", strconv.Itoa(i)))
+			continue
+		}
+		if strings.Contains(apikey, " ") {
+			errs = append(errs, errorAt(fmt.Errorf("api key cannot contain spaces: `%s`", apikey), "apiKeys", strconv.Itoa(i)))
+			continue
+		}
+		config.RequiredAPIKeys[i] = apikey
+	}
 
-			// Substitute in metadata (type-preserving)
-			if len(modelConfig.Metadata) > 0 {
-				result, err := substituteMacroInValue(modelConfig.Metadata, entry.Name, entry.Value)
-				if err != nil {
-					return Config{}, fmt.Errorf("model %s metadata: %s", modelId, err.Error())
+	// Validate named API keys, a key is stored as its hash
+	for name, identity := range config.APIKeyIdentities {
+		if strings.TrimSpace(name) == "" || strings.ContainsAny(name, " \t") {
+			errs = append(errs, errorAt(fmt.Errorf("apiKeyIdentities: name %q cannot be empty or contain spaces", name), "apiKeyIdentities", name))
+		}
+		switch {
+		case identity.Key != "" && identity.KeyHash != "":
+			errs = append(errs, errorAt(fmt.Errorf("apiKeyIdentities.%s: only one of key and keyHash can be set", name), "apiKeyIdentities", name))
+		case identity.Key != "":
+			if strings.Contains(identity.Key, " ") {
+				errs = append(errs, errorAt(fmt.Errorf("apiKeyIdentities.%s.key cannot contain spaces", name), "apiKeyIdentities", name, "key"))
+			}
+		case identity.KeyHash != "":
+			hash, found := strings.CutPrefix(strings.ToLower(strings.TrimSpace(identity.KeyHash)), APIKeyHashPrefix)
+			if _, err := hex.DecodeString(hash); !found || err != nil || len(hash) != 64 {
+				errs = append(errs, errorAt(fmt.Errorf("apiKeyIdentities.%s.keyHash must be %s followed by 64 hex characters", name, APIKeyHashPrefix), "apiKeyIdentities", name, "keyHash"))
+			}
+			identity.KeyHash = APIKeyHashPrefix + hash
+		case len(identity.ClientCerts) == 0:
+			errs = append(errs, errorAt(fmt.Errorf("apiKeyIdentities.%s: one of key, keyHash and clientCerts is required", name), "apiKeyIdentities", name))
+		}
+		for i, pattern := range identity.ClientCerts {
+			if _, err := path.Match(pattern, ""); err != nil || strings.TrimSpace(pattern) == "" {
+				errs = append(errs, errorAt(fmt.Errorf("apiKeyIdentities.%s.clientCerts.%d: invalid pattern %q", name, i, pattern), "apiKeyIdentities", name, "clientCerts", strconv.Itoa(i)))
+			}
+		}
+		for i, pattern := range identity.Models {
+			if _, err := path.Match(pattern, ""); err != nil || strings.TrimSpace(pattern) == "" {
+				errs = append(errs, errorAt(fmt.Errorf("apiKeyIdentities.%s.models.%d: invalid pattern %q", name, i, pattern), "apiKeyIdentities", name, "models", strconv.Itoa(i)))
+			}
+		}
+		for i, endpoint := range identity.Endpoints {
+			switch endpoint {
+			case APIKeyEndpointInference, APIKeyEndpointReadOnly, APIKeyEndpointAdmin:
+			default:
+				errs = append(errs, errorAt(fmt.Errorf("apiKeyIdentities.%s.endpoints.%d must be one of: inference, readonly, admin", name, i), "apiKeyIdentities", name, "endpoints", strconv.Itoa(i)))
+			}
+		}
+		for i, quota := range identity.Quotas {
+			index := strconv.Itoa(i)
+			if quota.PeriodDuration() == 0 {
+				errs = append(errs, errorAt(fmt.Errorf("apiKeyIdentities.%s.quotas.%d.period must be one of: minute, hour, day", name, i), "apiKeyIdentities", name, "quotas", index, "period"))
+			}
+			if quota.Requests < 0 || quota.InputTokens < 0 || quota.OutputTokens < 0 {
+				errs = append(errs, errorAt(fmt.Errorf("apiKeyIdentities.%s.quotas.%d: limits must be greater than or equal to 0", name, i), "apiKeyIdentities", name, "quotas", index))
+			} else if quota.Requests+quota.InputTokens+quota.OutputTokens == 0 {
+				errs = append(errs, errorAt(fmt.Errorf("apiKeyIdentities.%s.quotas.%d: one of requests, inputTokens and outputTokens is required", name, i), "apiKeyIdentities", name, "quotas", index))
+			}
+			for j, pattern := range quota.Models {
+				if _, err := path.Match(pattern, ""); err != nil || strings.TrimSpace(pattern) == "" {
+					errs = append(errs, errorAt(fmt.Errorf("apiKeyIdentities.%s.quotas.%d.models.%d: invalid pattern %q", name, i, j, pattern), "apiKeyIdentities", name, "quotas", index, "models", strconv.Itoa(j)))
 				}
-				modelConfig.Metadata = result.(map[string]any)
 			}
 		}
+		config.APIKeyIdentities[name] = identity
+	}
 
-		// Handle PORT macro - only allocate if cmd uses it
-		cmdHasPort := strings.Contains(modelConfig.Cmd, "${PORT}")
-		proxyHasPort := strings.Contains(modelConfig.Proxy, "${PORT}")
-		if cmdHasPort || proxyHasPort {
-			if !cmdHasPort && proxyHasPort {
-				return Config{}, fmt.Errorf("model %s: proxy uses ${PORT} but cmd does not - ${PORT} is only available when used in cmd", modelId)
+	// Validate admin users and OIDC
+	for name, user := range config.AdminAuth.Users {
+		if strings.TrimSpace(name) == "" || strings.ContainsAny(name, " \t:") {
+			errs = append(errs, errorAt(fmt.Errorf("adminAuth.users: name %q cannot be empty or contain spaces or colons", name), "adminAuth", "users", name))
+		}
+		if _, err := bcrypt.Cost([]byte(user.PasswordHash)); err != nil {
+			errs = append(errs, errorAt(fmt.Errorf("adminAuth.users.%s.passwordHash must be a bcrypt hash", name), "adminAuth", "users", name, "passwordHash"))
+		}
+		if AdminRoleRank(user.Role) == 0 {
+			errs = append(errs, errorAt(fmt.Errorf("adminAuth.users.%s.role must be one of: viewer, operator, admin", name), "adminAuth", "users", name, "role"))
+		}
+	}
+	if oidc := config.AdminAuth.OIDC; oidc.Issuer != "" {
+		if issuer, err := url.Parse(oidc.Issuer); err != nil || (issuer.Scheme != "https" && issuer.Scheme != "http") || issuer.Host == "" {
+			errs = append(errs, errorAt(fmt.Errorf("adminAuth.oidc.issuer must be an http or https URL"), "adminAuth", "oidc", "issuer"))
+		}
+		if oidc.ClientID == "" {
+			errs = append(errs, errorAt(fmt.Errorf("adminAuth.oidc.clientID is required"), "adminAuth", "oidc", "clientID"))
+		}
+		if oidc.RedirectURL != "" {
+			if redirect, err := url.Parse(oidc.RedirectURL); err != nil || !redirect.IsAbs() {
+				errs = append(errs, errorAt(fmt.Errorf("adminAuth.oidc.redirectURL must be an absolute URL"), "adminAuth", "oidc", "redirectURL"))
 			}
+		}
+		for value, role := range oidc.Roles {
+			if AdminRoleRank(role) == 0 {
+				errs = append(errs, errorAt(fmt.Errorf("adminAuth.oidc.roles.%s must be one of: viewer, operator, admin", value), "adminAuth", "oidc", "roles", value))
+			}
+		}
+		if oidc.DefaultRole != "" && AdminRoleRank(oidc.DefaultRole) == 0 {
+			errs = append(errs, errorAt(fmt.Errorf("adminAuth.oidc.defaultRole must be empty or one of: viewer, operator, admin"), "adminAuth", "oidc", "defaultRole"))
+		}
+	}
+	if config.AdminAuth.Enabled() && config.AdminAuth.SessionTTL < 60 {
+		errs = append(errs, errorAt(fmt.Errorf("adminAuth.sessionTTL must be at least 60 seconds"), "adminAuth", "sessionTTL"))
+	}
 
-			macroSlug := "${PORT}"
-			macroStr := fmt.Sprintf("%v", nextPort)
-
-			modelConfig.Cmd = strings.ReplaceAll(modelConfig.Cmd, macroSlug, macroStr)
-			modelConfig.CmdStop = strings.ReplaceAll(modelConfig.CmdStop, macroSlug, macroStr)
-			modelConfig.Proxy = strings.ReplaceAll(modelConfig.Proxy, macroSlug, macroStr)
+	// Process peers with global macro substitution
+	for peerName, peerConfig := range config.Peers {
+		peerConfig, err := expandPeerConfig(&config, peerName, peerConfig)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		config.Peers[peerName] = peerConfig
+	}
 
-			if len(modelConfig.Metadata) > 0 {
-				result, err := substituteMacroInValue(modelConfig.Metadata, "PORT", nextPort)
-				if err != nil {
-					return Config{}, fmt.Errorf("model %s metadata: %s", modelId, err.Error())
+	// Validate rate limits, client addresses are stored as CIDRs
+	for i, limit := range config.RateLimits {
+		index := strconv.Itoa(i)
+		if strings.TrimSpace(limit.Name) == "" {
+			limit.Name = "rateLimits." + index
+		}
+		if limit.RequestsPerMinute < 0 || limit.TokensPerMinute < 0 {
+			errs = append(errs, errorAt(fmt.Errorf("rateLimits.%d: requestsPerMinute and tokensPerMinute must be greater than or equal to 0", i), "rateLimits", index))
+		} else if limit.RequestsPerMinute == 0 && limit.TokensPerMinute == 0 {
+			errs = append(errs, errorAt(fmt.Errorf("rateLimits.%d: one of requestsPerMinute and tokensPerMinute is required", i), "rateLimits", index))
+		}
+		if limit.RequestsPerMinute > 0 && limit.Burst < 1 {
+			errs = append(errs, errorAt(fmt.Errorf("rateLimits.%d.burst must be greater than or equal to 1", i), "rateLimits", index, "burst"))
+		}
+		if limit.TokenBurst < 0 || limit.TokenEstimate < 0 {
+			errs = append(errs, errorAt(fmt.Errorf("rateLimits.%d: tokenBurst and tokenEstimate must be greater than or equal to 0", i), "rateLimits", index))
+		}
+		if limit.TokenBurst == 0 {
+			limit.TokenBurst = int(math.Ceil(limit.TokensPerMinute))
+		}
+		for _, list := range []struct {
+			field    string
+			patterns []string
+		}{{"apiKeys", limit.APIKeys}, {"models", limit.Models}, {"endpoints", limit.Endpoints}} {
+			field := list.field
+			for j, pattern := range list.patterns {
+				if _, err := path.Match(pattern, ""); err != nil || strings.TrimSpace(pattern) == "" {
+					errs = append(errs, errorAt(fmt.Errorf("rateLimits.%d.%s.%d: invalid pattern %q", i, field, j, pattern), "rateLimits", index, field, strconv.Itoa(j)))
 				}
-				modelConfig.Metadata = result.(map[string]any)
 			}
-
-			nextPort++
 		}
-
-		// Validate no unknown macros remain
-		fieldMap := map[string]string{
-			"cmd":                 modelConfig.Cmd,
-			"cmdStop":             modelConfig.CmdStop,
-			"proxy":               modelConfig.Proxy,
-			"checkEndpoint":       modelConfig.CheckEndpoint,
-			"filters.stripParams": modelConfig.Filters.StripParams,
+		for j, client := range limit.Clients {
+			cidr, err := ParseCIDR(client)
+			if err != nil {
+				errs = append(errs, errorAt(fmt.Errorf("rateLimits.%d.clients.%d: %w", i, j, err), "rateLimits", index, "clients", strconv.Itoa(j)))
+				continue
+			}
+			limit.Clients[j] = cidr.String()
+		}
+		for j, per := range limit.Per {
+			switch per {
+			case RateLimitPerAPIKey, RateLimitPerClient, RateLimitPerModel:
+			default:
+				errs = append(errs, errorAt(fmt.Errorf("rateLimits.%d.per.%d must be one of: apiKey, client, model", i, j), "rateLimits", index, "per", strconv.Itoa(j)))
+			}
 		}
+		config.RateLimits[i] = limit
+	}
 
-		for fieldName, fieldValue := range fieldMap {
-			matches := macroPatternRegex.FindAllStringSubmatch(fieldValue, -1)
-			for _, match := range matches {
-				macroName := match[1]
-				if macroName == "PID" && fieldName == "cmdStop" {
-					continue // replaced at runtime
+	// Validate trusted proxies and client access rules, addresses are stored
+	// as CIDRs
+	for i, proxy := range config.TrustedProxies {
+		cidr, err := ParseCIDR(proxy)
+		if err != nil {
+			errs = append(errs, errorAt(fmt.Errorf("trustedProxies.%d: %w", i, err), "trustedProxies", strconv.Itoa(i)))
+			continue
+		}
+		config.TrustedProxies[i] = cidr.String()
+	}
+	for i, rule := range config.ClientAccess {
+		index := strconv.Itoa(i)
+		if strings.TrimSpace(rule.Name) == "" {
+			rule.Name = "clientAccess." + index
+		}
+		if len(rule.Allow) == 0 && len(rule.Deny) == 0 {
+			errs = append(errs, errorAt(fmt.Errorf("clientAccess.%d: one of allow and deny is required", i), "clientAccess", index))
+		}
+		for j, route := range rule.Routes {
+			switch route {
+			case ClientAccessRouteInference, ClientAccessRouteUpstream:
+			case ClientAccessRouteAPI, ClientAccessRouteUI, ClientAccessRouteLogs:
+				if len(rule.Models) > 0 {
+					errs = append(errs, errorAt(fmt.Errorf("clientAccess.%d.routes.%d: rules with models only apply to inference and upstream", i, j), "clientAccess", index, "routes", strconv.Itoa(j)))
 				}
-				if macroName == "PORT" || macroName == "MODEL_ID" {
-					return Config{}, fmt.Errorf("macro '${%s}' should have been substituted in %s.%s", macroName, modelId, fieldName)
+			default:
+				errs = append(errs, errorAt(fmt.Errorf("clientAccess.%d.routes.%d must be one of: inference, api, ui, logs, upstream", i, j), "clientAccess", index, "routes", strconv.Itoa(j)))
+			}
+		}
+		for j, pattern := range rule.Models {
+			if _, err := path.Match(pattern, ""); err != nil || strings.TrimSpace(pattern) == "" {
+				errs = append(errs, errorAt(fmt.Errorf("clientAccess.%d.models.%d: invalid pattern %q", i, j, pattern), "clientAccess", index, "models", strconv.Itoa(j)))
+			}
+		}
+		for _, list := range []struct {
+			field   string
+			clients []string
+		}{{"allow", rule.Allow}, {"deny", rule.Deny}} {
+			for j, client := range list.clients {
+				cidr, err := ParseCIDR(client)
+				if err != nil {
+					errs = append(errs, errorAt(fmt.Errorf("clientAccess.%d.%s.%d: %w", i, list.field, j, err), "clientAccess", index, list.field, strconv.Itoa(j)))
+					continue
 				}
-				return Config{}, fmt.Errorf("unknown macro '${%s}' found in %s.%s", macroName, modelId, fieldName)
+				list.clients[j] = cidr.String()
 			}
 		}
+		config.ClientAccess[i] = rule
+	}
 
-		if len(modelConfig.Metadata) > 0 {
-			if err := validateNestedForUnknownMacros(modelConfig.Metadata, fmt.Sprintf("model %s metadata", modelId)); err != nil {
-				return Config{}, err
+	// Validate splits, local variants are stored by their ID
+	for name, split := range config.Splits {
+		if _, found := config.RealModelName(name); found || config.hasPeerModel(name) {
+			errs = append(errs, errorAt(fmt.Errorf("splits.%s: name is already used by a model", name), "splits", name))
+		}
+		switch split.StickyBy {
+		case SplitStickyAPIKey, SplitStickyNone:
+		case SplitStickyHeader:
+			if strings.TrimSpace(split.StickyHeader) == "" {
+				errs = append(errs, errorAt(fmt.Errorf("splits.%s.stickyHeader is required with stickyBy: header", name), "splits", name, "stickyHeader"))
+			}
+		default:
+			errs = append(errs, errorAt(fmt.Errorf("splits.%s.stickyBy must be one of: apiKey, header, none", name), "splits", name, "stickyBy"))
+		}
+		if len(split.Variants) == 0 {
+			errs = append(errs, errorAt(fmt.Errorf("splits.%s.variants must not be empty", name), "splits", name, "variants"))
+		}
+		total := 0
+		for i, variant := range split.Variants {
+			index := strconv.Itoa(i)
+			if variant.Weight < 0 {
+				errs = append(errs, errorAt(fmt.Errorf("splits.%s.variants.%d.weight must be greater than or equal to 0", name, i), "splits", name, "variants", index, "weight"))
 			}
+			total += variant.Weight
+			model := strings.TrimSpace(variant.Model)
+			if real, found := config.RealModelName(model); found {
+				split.Variants[i].Model = real
+			} else if !config.hasPeerModel(model) {
+				errs = append(errs, errorAt(fmt.Errorf("splits.%s.variants.%d: unknown model %q", name, i, model), "splits", name, "variants", index, "model"))
+			}
+		}
+		if len(split.Variants) > 0 && total == 0 {
+			errs = append(errs, errorAt(fmt.Errorf("splits.%s: the sum of the variant weights must be greater than 0", name), "splits", name, "variants"))
 		}
+	}
 
-		if _, err := url.Parse(modelConfig.Proxy); err != nil {
-			return Config{}, fmt.Errorf("model %s: invalid proxy URL: %w", modelId, err)
+	// Validate mirrors, local models are stored by their ID
+	for i, mirror := range config.Mirrors {
+		index := strconv.Itoa(i)
+		if mirror.Percent <= 0 || mirror.Percent > 100 {
+			errs = append(errs, errorAt(fmt.Errorf("mirrors.%d.percent must be greater than 0 and at most 100", i), "mirrors", index, "percent"))
+		}
+		for _, field := range []struct {
+			name  string
+			value *string
+		}{{"model", &config.Mirrors[i].Model}, {"shadow", &config.Mirrors[i].Shadow}} {
+			name := strings.TrimSpace(*field.value)
+			if real, found := config.RealModelName(name); found {
+				*field.value = real
+			} else if !config.hasPeerModel(name) {
+				errs = append(errs, errorAt(fmt.Errorf("mirrors.%d.%s: unknown model %q", i, field.name, name), "mirrors", index, field.name))
+			}
+		}
+		if config.Mirrors[i].Model == config.Mirrors[i].Shadow {
+			errs = append(errs, errorAt(fmt.Errorf("mirrors.%d.shadow must differ from model", i), "mirrors", index, "shadow"))
 		}
+	}
 
-		if modelConfig.SendLoadingState == nil {
-			v := config.SendLoadingState
-			modelConfig.SendLoadingState = &v
+	if len(errs) > 0 {
+		for i, err := range errs {
+			errs[i] = withTemplateChain(err, templateChains)
 		}
+		return Config{}, errors.Join(errs...)
+	}
+	return config, nil
+}
 
-		config.Models[modelId] = modelConfig
+// hasPeerModel reports whether a peer provides the model
+func (c *Config) hasPeerModel(model string) bool {
+	for _, peer := range c.Peers {
+		if slices.Contains(peer.Models, model) {
+			return true
+		}
 	}
+	return false
+}
 
-	config = AddDefaultGroupToConfig(config)
+// expandPeerConfig substitutes global macros in a peer's settings and
+// validates the result
+func expandPeerConfig(config *Config, peerName string, peerConfig PeerConfig) (PeerConfig, error) {
+	var err error
 
-	// Validate group members
-	memberUsage := make(map[string]string)
-	for groupID, groupConfig := range config.Groups {
-		prevSet := make(map[string]bool)
-		for _, member := range groupConfig.Members {
-			if _, found := prevSet[member]; found {
-				return Config{}, fmt.Errorf("duplicate model member %s found in group: %s", member, groupID)
-			}
-			prevSet[member] = true
+	// Substitute global macros (LIFO order)
+	for i := len(config.Macros) - 1; i >= 0; i-- {
+		entry := config.Macros[i]
+		macroSlug := fmt.Sprintf("${%s}", entry.Name)
+		macroStr := fmt.Sprintf("%v", entry.Value)
 
-			if existingGroup, exists := memberUsage[member]; exists {
-				return Config{}, fmt.Errorf("model member %s is used in multiple groups: %s and %s", member, existingGroup, groupID)
+		peerConfig.ApiKey = strings.ReplaceAll(peerConfig.ApiKey, macroSlug, macroStr)
+		peerConfig.Filters.StripParams = strings.ReplaceAll(peerConfig.Filters.StripParams, macroSlug, macroStr)
+
+		// Substitute in setParams (type-preserving)
+		if len(peerConfig.Filters.SetParams) > 0 {
+			result, err := substituteMacroInValue(peerConfig.Filters.SetParams, entry.Name, entry.Value)
+			if err != nil {
+				return PeerConfig{}, errorAt(fmt.Errorf("peers.%s.filters.setParams: %w", peerName, err), "peers", peerName, "filters", "setParams")
 			}
-			memberUsage[member] = groupID
+			peerConfig.Filters.SetParams = result.(map[string]any)
 		}
 	}
 
-	// Clean up hooks preload
-	if len(config.Hooks.OnStartup.Preload) > 0 {
-		var toPreload []string
-		for _, modelID := range config.Hooks.OnStartup.Preload {
-			modelID = strings.TrimSpace(modelID)
-			if modelID == "" {
-				continue
-			}
-			if real, found := config.RealModelName(modelID); found {
-				toPreload = append(toPreload, real)
+	lookup := macroListLookup(config.Macros)
+	if peerConfig.ApiKey, err = substituteExprMacros(peerConfig.ApiKey, lookup); err != nil {
+		return PeerConfig{}, errorAt(fmt.Errorf("peers.%s.apiKey: %w", peerName, err), "peers", peerName, "apiKey")
+	}
+	if peerConfig.Filters.StripParams, err = substituteExprMacros(peerConfig.Filters.StripParams, lookup); err != nil {
+		return PeerConfig{}, errorAt(fmt.Errorf("peers.%s.filters.stripParams: %w", peerName, err), "peers", peerName, "filters", "stripParams")
+	}
+	if len(peerConfig.Filters.SetParams) > 0 {
+		result, err := substituteExprMacrosInValue(peerConfig.Filters.SetParams, lookup)
+		if err != nil {
+			return PeerConfig{}, errorAt(fmt.Errorf("peers.%s.filters.setParams: %w", peerName, err), "peers", peerName, "filters", "setParams")
+		}
+		peerConfig.Filters.SetParams = result.(map[string]any)
+	}
+
+	// Validate no unknown macros remain
+	if matches := macroPatternRegex.FindAllStringSubmatch(peerConfig.ApiKey, -1); len(matches) > 0 {
+		return PeerConfig{}, errorAt(fmt.Errorf("peers.%s.apiKey: unknown macro '${%s}'", peerName, matches[0][1]), "peers", peerName, "apiKey")
+	}
+	if matches := macroPatternRegex.FindAllStringSubmatch(peerConfig.Filters.StripParams, -1); len(matches) > 0 {
+		return PeerConfig{}, errorAt(fmt.Errorf("peers.%s.filters.stripParams: unknown macro '${%s}'", peerName, matches[0][1]), "peers", peerName, "filters", "stripParams")
+	}
+	if len(peerConfig.Filters.SetParams) > 0 {
+		if err := validateNestedForUnknownMacros(peerConfig.Filters.SetParams, fmt.Sprintf("peers.%s.filters.setParams", peerName)); err != nil {
+			return PeerConfig{}, errorAt(err, "peers", peerName, "filters", "setParams")
+		}
+	}
+	return peerConfig, nil
+}
+
+// hostname is replaceable for testing
+var hostname = os.Hostname
+
+// applyHostMacros overrides macros with the hostMacros entry matching host.
+// Hostnames are compared case-insensitively and overridden macros keep their
+// position so the MacroList ordering rules still apply. New macros are appended.
+func applyHostMacros(macros MacroList, hostMacros map[string]MacroList, host string) MacroList {
+	var overlay MacroList
+	for name, entries := range hostMacros {
+		if strings.EqualFold(name, host) {
+			overlay = entries
+			break
+		}
+	}
+	if len(overlay) == 0 {
+		return macros
+	}
+
+	merged := append(MacroList{}, macros...)
+	for _, entry := range overlay {
+		found := false
+		for i, existing := range merged {
+			if existing.Name == entry.Name {
+				merged[i] = entry
+				found = true
+				break
 			}
 		}
-		config.Hooks.OnStartup.Preload = toPreload
+		if !found {
+			merged = append(merged, entry)
+		}
 	}
+	return merged
+}
 
-	// Validate API keys (env macros already substituted at string level)
-	for i, apikey := range config.RequiredAPIKeys {
-		if apikey == "" {
-			return Config{}, fmt.Errorf("empty api key found in apiKeys")
+// expandModelConfig substitutes macros and the automatic ${PORT} in a model's
+// fields and validates the result
+func expandModelConfig(config *Config, modelId string, modelConfig ModelConfig, nextPort *int) (ModelConfig, error) {
+	var err error
+
+	// Strip comments from command fields
+	modelConfig.Cmd = StripComments(modelConfig.Cmd)
+	modelConfig.CmdStop = StripComments(modelConfig.CmdStop)
+
+	// Validate model macros
+	for _, macro := range modelConfig.Macros {
+		if err = validateMacro(macro.Name, macro.Value); err != nil {
+			return ModelConfig{}, errorAt(fmt.Errorf("model %s: %s", modelId, err.Error()), "models", modelId, "macros", macro.Name)
 		}
-		if strings.Contains(apikey, " ") {
-			return Config{}, fmt.Errorf("api key cannot contain spaces: `%s`", apikey)
+	}
+
+	// Build merged macro list: MODEL_ID + global macros + model macros (model overrides global)
+	mergedMacros := make(MacroList, 0, len(config.Macros)+len(modelConfig.Macros)+1)
+	mergedMacros = append(mergedMacros, MacroEntry{Name: "MODEL_ID", Value: modelId})
+	mergedMacros = append(mergedMacros, config.Macros...)
+
+	// Add model macros (override globals with same name)
+	for _, entry := range modelConfig.Macros {
+		found := false
+		for i, existing := range mergedMacros {
+			if existing.Name == entry.Name {
+				mergedMacros[i] = entry
+				found = true
+				break
+			}
+		}
+		if !found {
+			mergedMacros = append(mergedMacros, entry)
 		}
-		config.RequiredAPIKeys[i] = apikey
 	}
 
-	// Process peers with global macro substitution
-	for peerName, peerConfig := range config.Peers {
-		// Substitute global macros (LIFO order)
-		for i := len(config.Macros) - 1; i >= 0; i-- {
-			entry := config.Macros[i]
-			macroSlug := fmt.Sprintf("${%s}", entry.Name)
-			macroStr := fmt.Sprintf("%v", entry.Value)
-
-			peerConfig.ApiKey = strings.ReplaceAll(peerConfig.ApiKey, macroSlug, macroStr)
-			peerConfig.Filters.StripParams = strings.ReplaceAll(peerConfig.Filters.StripParams, macroSlug, macroStr)
-
-			// Substitute in setParams (type-preserving)
-			if len(peerConfig.Filters.SetParams) > 0 {
-				result, err := substituteMacroInValue(peerConfig.Filters.SetParams, entry.Name, entry.Value)
-				if err != nil {
-					return Config{}, fmt.Errorf("peers.%s.filters.setParams: %w", peerName, err)
-				}
-				peerConfig.Filters.SetParams = result.(map[string]any)
+	// Substitute remaining macros in model fields (LIFO order)
+	for i := len(mergedMacros) - 1; i >= 0; i-- {
+		entry := mergedMacros[i]
+		macroSlug := fmt.Sprintf("${%s}", entry.Name)
+		macroStr := fmt.Sprintf("%v", entry.Value)
+
+		modelConfig.Cmd = strings.ReplaceAll(modelConfig.Cmd, macroSlug, macroStr)
+		modelConfig.CmdStop = strings.ReplaceAll(modelConfig.CmdStop, macroSlug, macroStr)
+		modelConfig.Proxy = strings.ReplaceAll(modelConfig.Proxy, macroSlug, macroStr)
+		modelConfig.CheckEndpoint = strings.ReplaceAll(modelConfig.CheckEndpoint, macroSlug, macroStr)
+		modelConfig.Filters.StripParams = strings.ReplaceAll(modelConfig.Filters.StripParams, macroSlug, macroStr)
+
+		// Substitute in metadata (type-preserving)
+		if len(modelConfig.Metadata) > 0 {
+			result, err := substituteMacroInValue(modelConfig.Metadata, entry.Name, entry.Value)
+			if err != nil {
+				return ModelConfig{}, errorAt(fmt.Errorf("model %s metadata: %s", modelId, err.Error()), "models", modelId, "metadata")
 			}
+			modelConfig.Metadata = result.(map[string]any)
 		}
+	}
 
-		// Validate no unknown macros remain
-		if matches := macroPatternRegex.FindAllStringSubmatch(peerConfig.ApiKey, -1); len(matches) > 0 {
-			return Config{}, fmt.Errorf("peers.%s.apiKey: unknown macro '${%s}'", peerName, matches[0][1])
+	// Handle PORT macro - only allocate if cmd uses it
+	cmdHasPort := strings.Contains(modelConfig.Cmd, "${PORT}")
+	proxyHasPort := strings.Contains(modelConfig.Proxy, "${PORT}")
+	if cmdHasPort || proxyHasPort {
+		if !cmdHasPort && proxyHasPort {
+			return ModelConfig{}, errorAt(fmt.Errorf("model %s: proxy uses ${PORT} but cmd does not - ${PORT} is only available when used in cmd", modelId), "models", modelId, "proxy")
 		}
-		if matches := macroPatternRegex.FindAllStringSubmatch(peerConfig.Filters.StripParams, -1); len(matches) > 0 {
-			return Config{}, fmt.Errorf("peers.%s.filters.stripParams: unknown macro '${%s}'", peerName, matches[0][1])
+
+		macroSlug := "${PORT}"
+		macroStr := fmt.Sprintf("%v", *nextPort)
+
+		modelConfig.Cmd = strings.ReplaceAll(modelConfig.Cmd, macroSlug, macroStr)
+		modelConfig.CmdStop = strings.ReplaceAll(modelConfig.CmdStop, macroSlug, macroStr)
+		modelConfig.Proxy = strings.ReplaceAll(modelConfig.Proxy, macroSlug, macroStr)
+
+		if len(modelConfig.Metadata) > 0 {
+			result, err := substituteMacroInValue(modelConfig.Metadata, "PORT", *nextPort)
+			if err != nil {
+				return ModelConfig{}, errorAt(fmt.Errorf("model %s metadata: %s", modelId, err.Error()), "models", modelId, "metadata")
+			}
+			modelConfig.Metadata = result.(map[string]any)
 		}
-		if len(peerConfig.Filters.SetParams) > 0 {
-			if err := validateNestedForUnknownMacros(peerConfig.Filters.SetParams, fmt.Sprintf("peers.%s.filters.setParams", peerName)); err != nil {
-				return Config{}, err
+
+		mergedMacros = append(mergedMacros, MacroEntry{Name: "PORT", Value: *nextPort})
+		*nextPort++
+	}
+
+	// Evaluate ${expr:...} macros now that all plain macros are substituted
+	lookup := macroListLookup(mergedMacros)
+	exprFields := map[string]*string{
+		"cmd":                 &modelConfig.Cmd,
+		"cmdStop":             &modelConfig.CmdStop,
+		"proxy":               &modelConfig.Proxy,
+		"checkEndpoint":       &modelConfig.CheckEndpoint,
+		"filters.stripParams": &modelConfig.Filters.StripParams,
+	}
+	for fieldName, field := range exprFields {
+		if *field, err = substituteExprMacros(*field, lookup); err != nil {
+			return ModelConfig{}, errorAt(fmt.Errorf("model %s.%s: %w", modelId, fieldName, err), fieldPath(modelId, fieldName)...)
+		}
+	}
+	if len(modelConfig.Metadata) > 0 {
+		result, err := substituteExprMacrosInValue(modelConfig.Metadata, lookup)
+		if err != nil {
+			return ModelConfig{}, errorAt(fmt.Errorf("model %s metadata: %w", modelId, err), "models", modelId, "metadata")
+		}
+		modelConfig.Metadata = result.(map[string]any)
+	}
+
+	// Validate no unknown macros remain
+	fieldMap := map[string]string{
+		"cmd":                 modelConfig.Cmd,
+		"cmdStop":             modelConfig.CmdStop,
+		"proxy":               modelConfig.Proxy,
+		"checkEndpoint":       modelConfig.CheckEndpoint,
+		"filters.stripParams": modelConfig.Filters.StripParams,
+	}
+
+	for fieldName, fieldValue := range fieldMap {
+		matches := macroPatternRegex.FindAllStringSubmatch(fieldValue, -1)
+		for _, match := range matches {
+			macroName := match[1]
+			if macroName == "PID" && fieldName == "cmdStop" {
+				continue // replaced at runtime
+			}
+			if macroName == "PORT" || macroName == "MODEL_ID" {
+				return ModelConfig{}, errorAt(fmt.Errorf("macro '${%s}' should have been substituted in %s.%s", macroName, modelId, fieldName), fieldPath(modelId, fieldName)...)
 			}
+			return ModelConfig{}, errorAt(fmt.Errorf("unknown macro '${%s}' found in %s.%s", macroName, modelId, fieldName), fieldPath(modelId, fieldName)...)
 		}
-		config.Peers[peerName] = peerConfig
 	}
 
-	return config, nil
+	if len(modelConfig.Metadata) > 0 {
+		if err := validateNestedForUnknownMacros(modelConfig.Metadata, fmt.Sprintf("model %s metadata", modelId)); err != nil {
+			return ModelConfig{}, errorAt(err, "models", modelId, "metadata")
+		}
+	}
+
+	if _, err := url.Parse(modelConfig.Proxy); err != nil {
+		return ModelConfig{}, errorAt(fmt.Errorf("model %s: invalid proxy URL: %w", modelId, err), "models", modelId, "proxy")
+	}
+
+	if modelConfig.SendLoadingState == nil {
+		v := config.SendLoadingState
+		modelConfig.SendLoadingState = &v
+	}
+
+	return modelConfig, nil
 }
 
 // rewrites the yaml to include a default group with any orphaned models
@@ -672,24 +1651,40 @@ func substituteMacroInValue(value any, macroName string, macroValue any) (any, e
 	}
 }
 
+// substituteLoadMacros substitutes the macros that are resolved at string
+// level before the YAML is parsed: first ${env.VAR} and then ${file:path}, so
+// env macros can be used to build file paths. Relative file paths are resolved
+// against baseDir.
+func substituteLoadMacros(s, baseDir string) (string, error) {
+	s, err := substituteEnvMacros(s)
+	if err != nil {
+		return "", err
+	}
+	return substituteFileMacros(s, baseDir)
+}
+
 // substituteEnvMacros replaces ${env.VAR_NAME} with environment variable values.
-// Returns error if any referenced env var is not set or contains invalid characters.
-// Env macros inside YAML comments are ignored by unmarshalling the YAML first
-// (which strips comments) and only checking the comment-free version for macros.
+// ${env.VAR_NAME:-default} uses default when the variable is unset or empty.
+// Returns error if any referenced env var without a default is not set or
+// contains invalid characters.
 func substituteEnvMacros(s string) (string, error) {
-	// Unmarshal and remarshal to strip YAML comments
+	return substituteEnvMacrosInString(s, stripYAMLComments(s))
+}
+
+// stripYAMLComments returns s without YAML comments so macros inside comments
+// are ignored. This unmarshals the YAML (which strips comments) and marshals
+// it again. If the YAML is invalid the original string is returned so the user
+// gets the macro error rather than a confusing YAML parse error.
+func stripYAMLComments(s string) string {
 	var raw any
 	if err := yaml.Unmarshal([]byte(s), &raw); err != nil {
-		// If YAML is invalid, fall back to scanning the original string
-		// so the user gets the env var error rather than a confusing YAML parse error
-		return substituteEnvMacrosInString(s, s)
+		return s
 	}
 	clean, err := yaml.Marshal(raw)
 	if err != nil {
-		return substituteEnvMacrosInString(s, s)
+		return s
 	}
-
-	return substituteEnvMacrosInString(s, string(clean))
+	return string(clean)
 }
 
 // substituteEnvMacrosInString finds ${env.VAR} macros in scanStr and substitutes
@@ -699,18 +1694,21 @@ func substituteEnvMacrosInString(target, scanStr string) (string, error) {
 	result := target
 	matches := envMacroRegex.FindAllStringSubmatch(scanStr, -1)
 	for _, match := range matches {
-		fullMatch := match[0] // ${env.VAR_NAME}
+		fullMatch := match[0] // ${env.VAR_NAME} or ${env.VAR_NAME:-default}
 		varName := match[1]   // VAR_NAME
 
 		value, exists := os.LookupEnv(varName)
+		if match[2] != "" && value == "" {
+			value, exists = strings.TrimPrefix(match[2], ":-"), true
+		}
 		if !exists {
-			return "", fmt.Errorf("environment variable '%s' is not set", varName)
+			return "", errorAtText(fmt.Errorf("environment variable '%s' is not set", varName), target, fullMatch)
 		}
 
 		// Sanitize the value for safe YAML substitution
 		value, err := sanitizeEnvValueForYAML(value, varName)
 		if err != nil {
-			return "", err
+			return "", errorAtText(err, target, fullMatch)
 		}
 
 		result = strings.ReplaceAll(result, fullMatch, value)
@@ -718,6 +1716,36 @@ func substituteEnvMacrosInString(target, scanStr string) (string, error) {
 	return result, nil
 }
 
+// substituteFileMacros replaces ${file:path} with the contents of the file,
+// e.g. secrets mounted at /run/secrets. A single trailing newline is removed.
+func substituteFileMacros(s, baseDir string) (string, error) {
+	if !strings.Contains(s, "${file:") {
+		return s, nil
+	}
+
+	result := s
+	matches := fileMacroRegex.FindAllStringSubmatch(stripYAMLComments(s), -1)
+	for _, match := range matches {
+		path := strings.TrimSpace(match[1])
+		if !filepath.IsAbs(path) && baseDir != "" {
+			path = filepath.Join(baseDir, path)
+		}
+
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return "", errorAtText(fmt.Errorf("file macro '%s': %w", match[1], err), s, match[0])
+		}
+		value := strings.TrimSuffix(strings.TrimSuffix(string(raw), "\n"), "\r")
+		if strings.ContainsAny(value, "\n\r\x00") {
+			return "", errorAtText(fmt.Errorf("file macro '%s' contains newlines or null bytes which are not allowed in YAML substitution", match[1]), s, match[0])
+		}
+
+		value, _ = sanitizeEnvValueForYAML(value, match[1])
+		result = strings.ReplaceAll(result, match[0], value)
+	}
+	return result, nil
+}
+
 // sanitizeEnvValueForYAML ensures an environment variable value is safe for YAML substitution.
 // It rejects values with characters that break YAML structure and escapes quotes/backslashes
 // for compatibility with double-quoted YAML strings.
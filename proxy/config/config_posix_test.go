@@ -216,6 +216,10 @@ groups:
 		HealthCheckTimeout: 15,
 		MetricsMaxInMemory: 1000,
 		CaptureBuffer:      5,
+		MetricsStore:       MetricsStoreConfig{RetentionDays: 30},
+		CaptureStore:       CaptureStoreConfig{RetentionDays: 7, MaxSizeMB: 1024, Compression: CaptureCompressionGzip},
+		AuditLog:           AuditLogConfig{MaxSizeMB: 100, MaxFiles: 10},
+		Tracing:            TracingConfig{ServiceName: "llama-swap", SampleRatio: 1},
 		Profiles: map[string][]string{
 			"test": {"model1", "model2"},
 		},
@@ -235,12 +239,18 @@ groups:
 				Swap:      true,
 				Exclusive: false,
 				Members:   []string{"model2"},
+
+				MaxSwapWait:  60,
+				ThrashWindow: 300,
 			},
 			"forever": {
 				Swap:       true,
 				Exclusive:  false,
 				Persistent: true,
 				Members:    []string{"model4"},
+
+				MaxSwapWait:  60,
+				ThrashWindow: 300,
 			},
 		},
 	}
@@ -1,11 +1,16 @@
 package config
 
 import (
+	"os"
+	"path/filepath"
 	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestConfig_GroupMemberIsUnique(t *testing.T) {
@@ -41,6 +46,173 @@ groups:
 	assert.Contains(t, err.Error(), "model member model2 is used in multiple groups:")
 }
 
+func TestConfig_GroupResidency(t *testing.T) {
+	content := `
+models:
+  model1:
+    cmd: path/to/cmd --arg1 one
+    proxy: "http://localhost:8080"
+groups:
+  group1:
+    minResidency: 30
+    minResidencyRequests: 5
+    thrashThreshold: 10
+    members: ["model1"]
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	assert.NoError(t, err)
+	group := config.Groups["group1"]
+	assert.Equal(t, 30, group.MinResidency)
+	assert.Equal(t, 5, group.MinResidencyRequests)
+	assert.Equal(t, 60, group.MaxSwapWait)
+	assert.Equal(t, 10, group.ThrashThreshold)
+	assert.Equal(t, 300, group.ThrashWindow)
+
+	content = `
+models:
+  model1:
+    cmd: path/to/cmd --arg1 one
+    proxy: "http://localhost:8080"
+groups:
+  group1:
+    minResidency: -1
+    thrashThreshold: 3
+    thrashWindow: 0
+    members: ["model1"]
+`
+	_, err = LoadConfigFromReader(strings.NewReader(content))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "groups.group1.minResidency must be greater than or equal to 0")
+		assert.Contains(t, err.Error(), "groups.group1.thrashWindow must be greater than or equal to 1")
+	}
+}
+
+func TestConfig_Mirrors(t *testing.T) {
+	content := `
+models:
+  model1:
+    cmd: path/to/cmd --arg1 one
+    proxy: "http://localhost:8080"
+    aliases: [m1]
+  model2:
+    cmd: path/to/cmd --arg1 one
+    proxy: "http://localhost:8081"
+peers:
+  peer1:
+    proxy: http://peer1:8080
+    models: [remote]
+mirrors:
+  - model: m1
+    shadow: model2
+    percent: 10
+  - model: model2
+    shadow: remote
+    percent: 100
+    loadShadow: true
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	require.NoError(t, err)
+	assert.Equal(t, []MirrorConfig{
+		{Model: "model1", Shadow: "model2", Percent: 10},
+		{Model: "model2", Shadow: "remote", Percent: 100, LoadShadow: true},
+	}, config.Mirrors)
+
+	content = `
+models:
+  model1:
+    cmd: path/to/cmd --arg1 one
+    proxy: "http://localhost:8080"
+    aliases: [m1]
+mirrors:
+  - model: model1
+    shadow: missing
+    percent: 0
+  - model: model1
+    shadow: m1
+    percent: 101
+`
+	_, err = LoadConfigFromReader(strings.NewReader(content))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "mirrors.0.percent must be greater than 0 and at most 100")
+		assert.Contains(t, err.Error(), `mirrors.0.shadow: unknown model "missing"`)
+		assert.Contains(t, err.Error(), "mirrors.1.percent must be greater than 0 and at most 100")
+		assert.Contains(t, err.Error(), "mirrors.1.shadow must differ from model")
+	}
+}
+
+func TestConfig_Splits(t *testing.T) {
+	content := `
+models:
+  model1:
+    cmd: path/to/cmd --arg1 one
+    proxy: "http://localhost:8080"
+    aliases: [m1]
+  model2:
+    cmd: path/to/cmd --arg1 one
+    proxy: "http://localhost:8081"
+peers:
+  peer1:
+    proxy: http://peer1:8080
+    models: [remote]
+splits:
+  chat:
+    variants:
+      - model: m1
+        weight: 90
+      - model: remote
+        weight: 10
+  chat-by-user:
+    stickyBy: header
+    stickyHeader: X-User-ID
+    variants:
+      - model: model1
+      - model: model2
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	require.NoError(t, err)
+	assert.Equal(t, SplitConfig{
+		StickyBy: SplitStickyAPIKey,
+		Variants: []SplitVariant{{Model: "model1", Weight: 90}, {Model: "remote", Weight: 10}},
+	}, config.Splits["chat"])
+	assert.Equal(t, SplitConfig{
+		StickyBy:     SplitStickyHeader,
+		StickyHeader: "X-User-ID",
+		Variants:     []SplitVariant{{Model: "model1", Weight: 1}, {Model: "model2", Weight: 1}},
+	}, config.Splits["chat-by-user"])
+
+	content = `
+models:
+  model1:
+    cmd: path/to/cmd --arg1 one
+    proxy: "http://localhost:8080"
+    aliases: [m1]
+splits:
+  m1:
+    stickyBy: header
+    variants:
+      - model: missing
+      - model: model1
+        weight: -1
+  empty:
+    stickyBy: user
+    variants: []
+  zero:
+    variants:
+      - model: model1
+        weight: 0
+`
+	_, err = LoadConfigFromReader(strings.NewReader(content))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "splits.m1: name is already used by a model")
+		assert.Contains(t, err.Error(), "splits.m1.stickyHeader is required with stickyBy: header")
+		assert.Contains(t, err.Error(), `splits.m1.variants.0: unknown model "missing"`)
+		assert.Contains(t, err.Error(), "splits.m1.variants.1.weight must be greater than or equal to 0")
+		assert.Contains(t, err.Error(), "splits.empty.stickyBy must be one of: apiKey, header, none")
+		assert.Contains(t, err.Error(), "splits.empty.variants must not be empty")
+		assert.Contains(t, err.Error(), "splits.zero: the sum of the variant weights must be greater than 0")
+	}
+}
+
 func TestConfig_ModelAliasesAreUnique(t *testing.T) {
 	content := `
 models:
@@ -848,6 +1020,302 @@ func TestConfig_APIKeys_EnvMacros(t *testing.T) {
 	})
 }
 
+func TestConfig_APIKeyIdentities(t *testing.T) {
+	t.Setenv("TEST_BATCH_KEY", "batch-secret")
+	content := `
+apiKeyIdentities:
+  batch:
+    key: "${env.TEST_BATCH_KEY}"
+    owner: data team
+    models: ["qwen-*"]
+  ops:
+    keyHash: "SHA256:` + strings.Repeat("AB", 32) + `"
+    endpoints: [readonly, inference]
+  ci:
+    clientCerts: ["*.ci.example.com"]
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"*.ci.example.com"}, config.APIKeyIdentities["ci"].ClientCerts)
+	assert.Equal(t, APIKeyIdentity{
+		Key:       "batch-secret",
+		Owner:     "data team",
+		Models:    []string{"qwen-*"},
+		Endpoints: []string{APIKeyEndpointInference},
+	}, config.APIKeyIdentities["batch"])
+	ops := config.APIKeyIdentities["ops"]
+	assert.Equal(t, "sha256:"+strings.Repeat("ab", 32), ops.KeyHash)
+	assert.Equal(t, []string{"*"}, ops.Models)
+
+	batch := config.APIKeyIdentities["batch"]
+	assert.True(t, batch.AllowsModel("qwen-32b"))
+	assert.False(t, batch.AllowsModel("llama"))
+	assert.True(t, batch.AllowsEndpoint(APIKeyEndpointInference))
+	assert.False(t, batch.AllowsEndpoint(APIKeyEndpointReadOnly))
+	assert.True(t, ops.AllowsEndpoint(APIKeyEndpointReadOnly))
+	assert.False(t, ops.AllowsEndpoint(APIKeyEndpointAdmin))
+	assert.True(t, APIKeyIdentity{Endpoints: []string{APIKeyEndpointAdmin}}.AllowsEndpoint(APIKeyEndpointReadOnly))
+
+	content = `
+apiKeyIdentities:
+  both:
+    key: abc
+    keyHash: "sha256:` + strings.Repeat("ab", 32) + `"
+  none:
+    owner: nobody
+  short:
+    keyHash: "sha256:abcd"
+  bad:
+    key: "a b"
+    clientCerts: ["[a-"]
+    models: ["[a-"]
+    endpoints: [write]
+`
+	_, err = LoadConfigFromReader(strings.NewReader(content))
+	require.Error(t, err)
+	for _, expected := range []string{
+		"apiKeyIdentities.both: only one of key and keyHash can be set",
+		"apiKeyIdentities.none: one of key, keyHash and clientCerts is required",
+		"apiKeyIdentities.short.keyHash must be sha256: followed by 64 hex characters",
+		"apiKeyIdentities.bad.key cannot contain spaces",
+		`apiKeyIdentities.bad.models.0: invalid pattern "[a-"`,
+		`apiKeyIdentities.bad.clientCerts.0: invalid pattern "[a-"`,
+		"apiKeyIdentities.bad.endpoints.0 must be one of: inference, readonly, admin",
+	} {
+		assert.Contains(t, err.Error(), expected)
+	}
+}
+
+func TestConfig_APIKeyQuotas(t *testing.T) {
+	content := `
+apiKeyIdentities:
+  batch:
+    key: batch-key
+    quotas:
+      - period: hour
+        requests: 100
+      - models: ["qwen-*"]
+        period: day
+        inputTokens: 1000000
+        outputTokens: 200000
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	require.NoError(t, err)
+	quotas := config.APIKeyIdentities["batch"].Quotas
+	require.Len(t, quotas, 2)
+	assert.Equal(t, QuotaConfig{Models: []string{"*"}, Period: QuotaPeriodHour, Requests: 100}, quotas[0])
+	assert.Equal(t, time.Hour, quotas[0].PeriodDuration())
+	assert.Equal(t, 24*time.Hour, quotas[1].PeriodDuration())
+	assert.True(t, quotas[1].AppliesTo("qwen-32b"))
+	assert.False(t, quotas[1].AppliesTo("llama"))
+
+	content = `
+apiKeyIdentities:
+  batch:
+    key: batch-key
+    quotas:
+      - period: week
+        requests: 1
+      - period: hour
+      - period: minute
+        requests: -1
+        models: ["[a-"]
+`
+	_, err = LoadConfigFromReader(strings.NewReader(content))
+	require.Error(t, err)
+	for _, expected := range []string{
+		"apiKeyIdentities.batch.quotas.0.period must be one of: minute, hour, day",
+		"apiKeyIdentities.batch.quotas.1: one of requests, inputTokens and outputTokens is required",
+		"apiKeyIdentities.batch.quotas.2: limits must be greater than or equal to 0",
+		`apiKeyIdentities.batch.quotas.2.models.0: invalid pattern "[a-"`,
+	} {
+		assert.Contains(t, err.Error(), expected)
+	}
+}
+
+func TestConfig_RateLimits(t *testing.T) {
+	content := `
+rateLimits:
+  - apiKeys: ["batch"]
+    clients: ["10.0.0.0/8", "192.168.1.5"]
+    per: [apiKey, model]
+    requestsPerMinute: 30
+  - name: chat tokens
+    endpoints: ["/v1/chat/completions"]
+    tokensPerMinute: 6000
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	require.NoError(t, err)
+	require.Len(t, config.RateLimits, 2)
+	assert.Equal(t, RateLimitConfig{
+		Name:              "rateLimits.0",
+		APIKeys:           []string{"batch"},
+		Clients:           []string{"10.0.0.0/8", "192.168.1.5/32"},
+		Per:               []string{RateLimitPerAPIKey, RateLimitPerModel},
+		RequestsPerMinute: 30,
+		Burst:             5,
+		TokenEstimate:     1024,
+	}, config.RateLimits[0])
+	assert.Equal(t, "chat tokens", config.RateLimits[1].Name)
+	assert.Equal(t, 6000, config.RateLimits[1].TokenBurst)
+
+	content = `
+rateLimits:
+  - clients: ["10.0.0.0/33"]
+  - requestsPerMinute: -1
+  - requestsPerMinute: 10
+    burst: 0
+    per: [user]
+    models: ["[a-"]
+`
+	_, err = LoadConfigFromReader(strings.NewReader(content))
+	require.Error(t, err)
+	for _, expected := range []string{
+		"rateLimits.0: one of requestsPerMinute and tokensPerMinute is required",
+		`rateLimits.0.clients.0: invalid CIDR "10.0.0.0/33"`,
+		"rateLimits.1: requestsPerMinute and tokensPerMinute must be greater than or equal to 0",
+		"rateLimits.2.burst must be greater than or equal to 1",
+		"rateLimits.2.per.0 must be one of: apiKey, client, model",
+		`rateLimits.2.models.0: invalid pattern "[a-"`,
+	} {
+		assert.Contains(t, err.Error(), expected)
+	}
+}
+
+func TestConfig_ClientAccess(t *testing.T) {
+	content := `
+trustedProxies: ["10.0.0.1", "fd00::/64"]
+clientAccess:
+  - routes: [api, ui, logs]
+    allow: ["192.168.10.0/24"]
+  - name: gpu hosts
+    models: ["llama-70b*"]
+    allow: ["10.1.0.5"]
+    deny: ["10.1.0.0/16"]
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1/32", "fd00::/64"}, config.TrustedProxies)
+	require.Len(t, config.ClientAccess, 2)
+	assert.Equal(t, ClientAccessRule{
+		Name:   "clientAccess.0",
+		Routes: []string{ClientAccessRouteAPI, ClientAccessRouteUI, ClientAccessRouteLogs},
+		Allow:  []string{"192.168.10.0/24"},
+	}, config.ClientAccess[0])
+	assert.Equal(t, "gpu hosts", config.ClientAccess[1].Name)
+	assert.Equal(t, []string{"10.1.0.5/32"}, config.ClientAccess[1].Allow)
+
+	// rules with models only apply to inference and upstream
+	assert.True(t, config.ClientAccess[0].AppliesToRoute(ClientAccessRouteAPI))
+	assert.False(t, config.ClientAccess[0].AppliesToRoute(ClientAccessRouteInference))
+	assert.True(t, config.ClientAccess[1].AppliesToRoute(ClientAccessRouteUpstream))
+	assert.False(t, config.ClientAccess[1].AppliesToRoute(ClientAccessRouteUI))
+
+	content = `
+trustedProxies: ["proxy.local"]
+clientAccess:
+  - routes: [admin]
+  - models: ["[a-"]
+    routes: [logs]
+    deny: ["10.0.0.0/33"]
+`
+	_, err = LoadConfigFromReader(strings.NewReader(content))
+	require.Error(t, err)
+	for _, expected := range []string{
+		`trustedProxies.0: invalid address "proxy.local"`,
+		"clientAccess.0: one of allow and deny is required",
+		"clientAccess.0.routes.0 must be one of: inference, api, ui, logs, upstream",
+		"clientAccess.1.routes.0: rules with models only apply to inference and upstream",
+		`clientAccess.1.models.0: invalid pattern "[a-"`,
+		`clientAccess.1.deny.0: invalid CIDR "10.0.0.0/33"`,
+	} {
+		assert.Contains(t, err.Error(), expected)
+	}
+}
+
+func TestConfig_AuditLog(t *testing.T) {
+	config, err := LoadConfigFromReader(strings.NewReader("auditLog:\n  path: ./audit\n"))
+	require.NoError(t, err)
+	assert.Equal(t, AuditLogConfig{Path: "./audit", MaxSizeMB: 100, MaxFiles: 10}, config.AuditLog)
+
+	config, err = LoadConfigFromReader(strings.NewReader("models: {}"))
+	require.NoError(t, err)
+	assert.Equal(t, AuditLogConfig{MaxSizeMB: 100, MaxFiles: 10}, config.AuditLog)
+
+	_, err = LoadConfigFromReader(strings.NewReader("auditLog:\n  maxSizeMB: 0\n  maxFiles: -1\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "auditLog.maxSizeMB must be greater than or equal to 1")
+	assert.Contains(t, err.Error(), "auditLog.maxFiles must be greater than or equal to 0")
+}
+
+func TestConfig_AdminAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	content := `
+adminAuth:
+  users:
+    alice:
+      passwordHash: "` + string(hash) + `"
+      role: admin
+  oidc:
+    issuer: https://sso.example.com/realms/lab
+    clientID: llama-swap
+    roles:
+      llm-admins: admin
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	require.NoError(t, err)
+	assert.True(t, config.AdminAuth.Enabled())
+	assert.Equal(t, 43200, config.AdminAuth.SessionTTL)
+	assert.Equal(t, AdminRoleAdmin, config.AdminAuth.Users["alice"].Role)
+	assert.Equal(t, OIDCConfig{
+		Issuer:        "https://sso.example.com/realms/lab",
+		ClientID:      "llama-swap",
+		Scopes:        []string{"openid", "profile", "email"},
+		UsernameClaim: "preferred_username",
+		RoleClaim:     "groups",
+		Roles:         map[string]string{"llm-admins": AdminRoleAdmin},
+	}, config.AdminAuth.OIDC)
+
+	config, err = LoadConfigFromReader(strings.NewReader("models: {}"))
+	require.NoError(t, err)
+	assert.False(t, config.AdminAuth.Enabled())
+
+	content = `
+adminAuth:
+  users:
+    "bob:x":
+      passwordHash: "` + string(hash) + `"
+      role: admin
+    carol:
+      passwordHash: plaintext
+      role: root
+  oidc:
+    issuer: sso.example.com
+    redirectURL: /callback
+    roles:
+      staff: owner
+    defaultRole: guest
+  sessionTTL: 10
+`
+	_, err = LoadConfigFromReader(strings.NewReader(content))
+	require.Error(t, err)
+	for _, expected := range []string{
+		`adminAuth.users: name "bob:x" cannot be empty or contain spaces or colons`,
+		"adminAuth.users.carol.passwordHash must be a bcrypt hash",
+		"adminAuth.users.carol.role must be one of: viewer, operator, admin",
+		"adminAuth.oidc.issuer must be an http or https URL",
+		"adminAuth.oidc.clientID is required",
+		"adminAuth.oidc.redirectURL must be an absolute URL",
+		"adminAuth.oidc.roles.staff must be one of: viewer, operator, admin",
+		"adminAuth.oidc.defaultRole must be empty or one of: viewer, operator, admin",
+		"adminAuth.sessionTTL must be at least 60 seconds",
+	} {
+		assert.Contains(t, err.Error(), expected)
+	}
+}
+
 func TestConfig_EnvMacros(t *testing.T) {
 	t.Run("basic env substitution in cmd", func(t *testing.T) {
 		t.Setenv("TEST_MODEL_PATH", "/opt/models")
@@ -1383,3 +1851,55 @@ func TestConfig_HealthCheckTimeoutValidation(t *testing.T) {
 		}
 	})
 }
+
+func TestConfig_EnvMacroDefaults(t *testing.T) {
+	t.Setenv("TEST_SET_VAR", "from-env")
+	t.Setenv("TEST_EMPTY_VAR", "")
+
+	content := `
+models:
+  test:
+    cmd: "server ${env.TEST_SET_VAR:-unused} ${env.TEST_EMPTY_VAR:-empty} ${env.TEST_UNSET_VAR_XYZ:-/opt/default} [${env.TEST_UNSET_VAR_XYZ:-}]"
+    proxy: "http://localhost:8080"
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	require.NoError(t, err)
+	assert.Equal(t, "server from-env empty /opt/default []", config.Models["test"].Cmd)
+}
+
+func TestConfig_FileMacros(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "api_key"), []byte("sk-secret\n"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "multi"), []byte("a\nb\n"), 0600))
+
+	t.Run("absolute and relative paths", func(t *testing.T) {
+		t.Setenv("TEST_SECRETS_DIR", dir)
+		configPath := filepath.Join(dir, "config.yaml")
+		require.NoError(t, os.WriteFile(configPath, []byte(`
+apiKeys:
+  - "${file:api_key}"
+models:
+  test:
+    # ${file:/does/not/exist} is ignored in comments
+    cmd: "server --api-key ${file:${env.TEST_SECRETS_DIR}/api_key}"
+    proxy: "http://localhost:8080"
+`), 0644))
+
+		config, err := LoadConfig(configPath)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"sk-secret"}, config.RequiredAPIKeys)
+		assert.Equal(t, "server --api-key sk-secret", config.Models["test"].Cmd)
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := LoadConfigFromReader(strings.NewReader(`apiKeys: ["${file:/does/not/exist}"]`))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "file macro '/does/not/exist'")
+	})
+
+	t.Run("multi line file", func(t *testing.T) {
+		_, err := LoadConfigFromReader(strings.NewReader(`apiKeys: ["${file:` + filepath.Join(dir, "multi") + `}"]`))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "contains newlines")
+	})
+}
@@ -0,0 +1,368 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// includeMergeSections are the top level mappings that may be split across
+// several files. Their entries are merged by key; every other top level key
+// may only be set in a single file.
+var includeMergeSections = map[string]string{
+	"models":     "model",
+	"groups":     "group",
+	"peers":      "peer",
+	"macros":     "macro",
+	"hostMacros": "host macros for",
+	"profiles":   "profile",
+
+	"modelTemplates": "model template",
+}
+
+// configSource is a single config file after ${env.VAR} and ${file:path} substitution
+type configSource struct {
+	path string
+	doc  *yaml.Node // top level mapping node, nil when the file is empty
+}
+
+// includeResolver walks the include graph of a config file
+type includeResolver struct {
+	main    string
+	overlay map[string][]byte
+	visited map[string]bool
+	sources []configSource
+	dirs    []string
+}
+
+// LoadConfigWithOverlay loads the config at path like LoadConfig, but reads the
+// contents for any file listed in overlay (keyed by path) from the map instead
+// of the disk. This allows validating unsaved edits to the main config or to
+// one of its includes against the rest of the config.
+func LoadConfigWithOverlay(path string, overlay map[string][]byte) (Config, error) {
+	absPath, data, normalized, err := readConfigWithOverlay(path, overlay)
+	if err != nil {
+		return Config{}, err
+	}
+	return loadConfigWithIncludes(absPath, data, normalized)
+}
+
+// readConfigWithOverlay returns the absolute path and contents of the main
+// config file, along with overlay keyed by absolute paths
+func readConfigWithOverlay(path string, overlay map[string][]byte) (string, []byte, map[string][]byte, error) {
+	normalized := make(map[string][]byte, len(overlay))
+	for p, data := range overlay {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		normalized[filepath.Clean(abs)] = data
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	absPath = filepath.Clean(absPath)
+
+	data, found := normalized[absPath]
+	if !found {
+		if data, err = os.ReadFile(path); err != nil {
+			return "", nil, nil, err
+		}
+	}
+	return absPath, data, normalized, nil
+}
+
+// ConfigFiles returns the main config file followed by every file it includes,
+// in the order they are merged.
+func ConfigFiles(path string) ([]string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(absPath)
+	if err != nil {
+		return nil, err
+	}
+
+	absPath = filepath.Clean(absPath)
+	resolver := &includeResolver{main: absPath, visited: make(map[string]bool)}
+	if err := resolver.add(absPath, data); err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(resolver.sources))
+	for _, source := range resolver.sources {
+		files = append(files, source.path)
+	}
+	return files, nil
+}
+
+// loadConfigWithIncludes resolves the includes of the main config file and
+// merges all of them into a single document before decoding it. path is used
+// to resolve relative includes; when empty they are relative to the working
+// directory.
+func loadConfigWithIncludes(path string, data []byte, overlay map[string][]byte) (Config, error) {
+	resolver := &includeResolver{main: path, overlay: overlay, visited: make(map[string]bool)}
+	if err := resolver.add(path, data); err != nil {
+		return Config{}, err
+	}
+	return resolver.load(data)
+}
+
+// load decodes the config from the sources found by add. data is the
+// contents of the main config file.
+func (r *includeResolver) load(data []byte) (Config, error) {
+	path := r.main
+
+	// without any includes decode the substituted main file as-is
+	if len(r.sources) == 1 {
+		yamlStr, err := substituteLoadMacros(string(data), configBaseDir(path))
+		if err != nil {
+			return Config{}, err
+		}
+		config, err := loadConfigFromYAML(yamlStr)
+		if err != nil {
+			return Config{}, err
+		}
+		config.IncludeDirs = r.dirs
+		return config, nil
+	}
+
+	merged, err := mergeConfigSources(r.sources)
+	if err != nil {
+		return Config{}, err
+	}
+	rendered, err := yaml.Marshal(merged)
+	if err != nil {
+		return Config{}, err
+	}
+
+	config, err := loadConfigFromYAML(string(rendered))
+	if err != nil {
+		return Config{}, err
+	}
+	for _, source := range r.sources[1:] {
+		config.IncludedFiles = append(config.IncludedFiles, source.path)
+	}
+	config.IncludeDirs = r.dirs
+	return config, nil
+}
+
+// add parses a config file and recursively adds the files it includes
+func (r *includeResolver) add(path string, data []byte) error {
+	if path != "" {
+		if r.visited[path] {
+			return fmt.Errorf("config file %s is included more than once", path)
+		}
+		r.visited[path] = true
+	}
+
+	yamlStr, err := substituteLoadMacros(string(data), configBaseDir(path))
+	if err != nil {
+		return r.wrap(path, err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(yamlStr), &doc); err != nil {
+		return r.wrap(path, err)
+	}
+
+	source := configSource{path: path}
+	if len(doc.Content) > 0 {
+		root := doc.Content[0]
+		if root.Kind != yaml.MappingNode {
+			return r.wrap(path, fmt.Errorf("config must be a mapping"))
+		}
+		source.doc = root
+	}
+	r.sources = append(r.sources, source)
+
+	if source.doc == nil {
+		return nil
+	}
+	includeNode := mappingValue(source.doc, "include")
+	if includeNode == nil || includeNode.Tag == "!!null" {
+		return nil
+	}
+
+	var patterns []string
+	if includeNode.Kind != yaml.SequenceNode {
+		return r.wrap(path, fmt.Errorf("include must be a list of files or globs"))
+	}
+	if err := includeNode.Decode(&patterns); err != nil {
+		return r.wrap(path, fmt.Errorf("include: %w", err))
+	}
+
+	for _, pattern := range patterns {
+		files, err := r.expand(configBaseDir(path), strings.TrimSpace(pattern))
+		if err != nil {
+			return r.wrap(path, err)
+		}
+		for _, file := range files {
+			includeData, found := r.overlay[file]
+			if !found {
+				if includeData, err = os.ReadFile(file); err != nil {
+					return r.wrap(path, fmt.Errorf("include: %w", err))
+				}
+			}
+			if err := r.add(file, includeData); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// wrap prefixes errors from included files with their path. Errors from the
+// main file keep their message. Both record the file for ValidateConfig.
+func (r *includeResolver) wrap(path string, err error) error {
+	if path != r.main {
+		err = fmt.Errorf("%s: %w", path, err)
+	}
+	return &configError{file: path, err: err}
+}
+
+// expand resolves an include pattern relative to baseDir. Globs that match
+// nothing are not an error; a plain file name must exist.
+func (r *includeResolver) expand(baseDir, pattern string) ([]string, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("include: empty file name")
+	}
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(baseDir, pattern)
+	}
+	abs, err := filepath.Abs(pattern)
+	if err != nil {
+		return nil, err
+	}
+	pattern = filepath.Clean(abs)
+
+	// the deepest directory without a glob is where matching files appear
+	dir := filepath.Dir(pattern)
+	for strings.ContainsAny(dir, "*?[") {
+		dir = filepath.Dir(dir)
+	}
+	if !slices.Contains(r.dirs, dir) {
+		r.dirs = append(r.dirs, dir)
+	}
+
+	if !strings.ContainsAny(pattern, "*?[") {
+		return []string{pattern}, nil
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("include: invalid pattern %s: %w", pattern, err)
+	}
+	seen := make(map[string]bool, len(matches))
+	files := make([]string, 0, len(matches))
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && info.IsDir() {
+			continue
+		}
+		seen[match] = true
+		files = append(files, match)
+	}
+	for file := range r.overlay {
+		if ok, _ := filepath.Match(pattern, file); ok && !seen[file] {
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// mergeConfigSources merges the documents of all sources into a single mapping.
+// Entries of the sections in includeMergeSections are combined in file order,
+// any key defined in more than one file is an error.
+func mergeConfigSources(sources []configSource) (*yaml.Node, error) {
+	merged := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	topOwner := make(map[string]string)
+	entryOwner := make(map[string]map[string]string)
+
+	for _, source := range sources {
+		if source.doc == nil {
+			continue
+		}
+		name := displayConfigPath(source.path)
+		for i := 0; i+1 < len(source.doc.Content); i += 2 {
+			keyNode := source.doc.Content[i]
+			valueNode := source.doc.Content[i+1]
+			key := keyNode.Value
+
+			if key == "include" {
+				// only the main file's include list is kept in the merged document
+				if source.path == sources[0].path {
+					merged.Content = append(merged.Content, keyNode, valueNode)
+				}
+				continue
+			}
+
+			kind, mergeable := includeMergeSections[key]
+			if !mergeable {
+				if owner, found := topOwner[key]; found {
+					return nil, &configError{file: source.path, path: []string{key}, err: fmt.Errorf("%s is set in both %s and %s", key, owner, name)}
+				}
+				topOwner[key] = name
+				merged.Content = append(merged.Content, keyNode, valueNode)
+				continue
+			}
+
+			if valueNode.Kind == yaml.ScalarNode && valueNode.Tag == "!!null" {
+				continue
+			}
+			if valueNode.Kind != yaml.MappingNode {
+				return nil, &configError{file: source.path, path: []string{key}, err: fmt.Errorf("%s: %s must be a mapping", name, key)}
+			}
+
+			target := mappingValue(merged, key)
+			if target == nil {
+				target = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+				merged.Content = append(merged.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, target)
+				entryOwner[key] = make(map[string]string)
+			}
+			for j := 0; j+1 < len(valueNode.Content); j += 2 {
+				entryKey := valueNode.Content[j].Value
+				if owner, found := entryOwner[key][entryKey]; found {
+					return nil, &configError{file: source.path, path: []string{key, entryKey}, err: fmt.Errorf("duplicate %s %s found in %s and %s", kind, entryKey, owner, name)}
+				}
+				entryOwner[key][entryKey] = name
+				target.Content = append(target.Content, valueNode.Content[j], valueNode.Content[j+1])
+			}
+		}
+	}
+
+	return merged, nil
+}
+
+// mappingValue returns the value node for key in a mapping node
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// configBaseDir is the directory relative paths in a config file resolve
+// against, the working directory for configs not loaded from a file
+func configBaseDir(path string) string {
+	if path == "" {
+		return "."
+	}
+	return filepath.Dir(path)
+}
+
+func displayConfigPath(path string) string {
+	if path == "" {
+		return "config"
+	}
+	return path
+}
@@ -0,0 +1,246 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeIncludeTestFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestConfig_IncludeMergesSections(t *testing.T) {
+	dir := t.TempDir()
+	mainPath := writeIncludeTestFile(t, dir, "config.yaml", `
+healthCheckTimeout: 30
+include:
+  - conf.d/*.yaml
+  - peers.yaml
+macros:
+  base: "/models"
+models:
+  main-model:
+    cmd: serve ${base}/main.gguf --port ${PORT}
+groups:
+  main:
+    members: ["main-model"]
+`)
+	writeIncludeTestFile(t, dir, "conf.d/20-recipes.yaml", `
+macros:
+  recipe_flag: "--recipe"
+models:
+  recipe-model:
+    cmd: serve ${base}/recipe.gguf ${recipe_flag} --port ${PORT}
+groups:
+  recipes:
+    exclusive: false
+    members: ["recipe-model"]
+`)
+	writeIncludeTestFile(t, dir, "conf.d/10-extra.yaml", `
+models:
+  extra-model:
+    cmd: serve ${base}/extra.gguf --port ${PORT}
+`)
+	writeIncludeTestFile(t, dir, "conf.d/ignored.txt", `not: yaml: at all`)
+	writeIncludeTestFile(t, dir, "peers.yaml", `
+peers:
+  remote:
+    proxy: http://remote:8080
+    models: ["remote-model"]
+`)
+
+	config, err := LoadConfig(mainPath)
+	require.NoError(t, err)
+
+	assert.Equal(t, 30, config.HealthCheckTimeout)
+	assert.Len(t, config.Models, 3)
+	assert.Equal(t, "serve /models/recipe.gguf --recipe --port 5802", config.Models["recipe-model"].Cmd)
+	assert.Equal(t, "serve /models/extra.gguf --port 5800", config.Models["extra-model"].Cmd)
+	assert.Equal(t, []string{"recipe-model"}, config.Groups["recipes"].Members)
+	assert.False(t, config.Groups["recipes"].Exclusive)
+	assert.Equal(t, []string{"extra-model"}, config.Groups[DEFAULT_GROUP_ID].Members)
+	assert.Contains(t, config.Peers, "remote")
+
+	// macros keep the order of the files they were merged from
+	assert.Equal(t, []string{"base", "recipe_flag"}, []string{config.Macros[0].Name, config.Macros[1].Name})
+
+	assert.Equal(t, []string{
+		filepath.Join(dir, "conf.d", "10-extra.yaml"),
+		filepath.Join(dir, "conf.d", "20-recipes.yaml"),
+		filepath.Join(dir, "peers.yaml"),
+	}, config.IncludedFiles)
+	assert.Equal(t, []string{filepath.Join(dir, "conf.d"), dir}, config.IncludeDirs)
+
+	files, err := ConfigFiles(mainPath)
+	require.NoError(t, err)
+	assert.Equal(t, append([]string{mainPath}, config.IncludedFiles...), files)
+}
+
+func TestConfig_IncludeNested(t *testing.T) {
+	dir := t.TempDir()
+	mainPath := writeIncludeTestFile(t, dir, "config.yaml", `
+include: ["sub/models.yaml"]
+`)
+	writeIncludeTestFile(t, dir, "sub/models.yaml", `
+include: ["more.yaml"]
+models:
+  a:
+    cmd: serve a
+    proxy: http://localhost:9000
+`)
+	writeIncludeTestFile(t, dir, "sub/more.yaml", `
+models:
+  b:
+    cmd: serve b
+    proxy: http://localhost:9001
+`)
+
+	config, err := LoadConfig(mainPath)
+	require.NoError(t, err)
+	assert.Contains(t, config.Models, "a")
+	assert.Contains(t, config.Models, "b")
+	assert.Equal(t, []string{filepath.Join(dir, "sub")}, config.IncludeDirs)
+}
+
+func TestConfig_IncludeErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		main     string
+		files    map[string]string
+		errorMsg string
+	}{
+		{
+			name: "duplicate model",
+			main: `
+include: ["a.yaml"]
+models:
+  m1:
+    cmd: serve
+    proxy: http://localhost:9000
+`,
+			files: map[string]string{"a.yaml": `
+models:
+  m1:
+    cmd: serve
+    proxy: http://localhost:9001
+`},
+			errorMsg: "duplicate model m1 found in",
+		},
+		{
+			name: "duplicate macro",
+			main: `
+include: ["a.yaml"]
+macros:
+  x: one
+`,
+			files:    map[string]string{"a.yaml": "macros:\n  x: two\n"},
+			errorMsg: "duplicate macro x found in",
+		},
+		{
+			name: "duplicate group",
+			main: `
+include: ["a.yaml"]
+groups:
+  g: {members: []}
+`,
+			files:    map[string]string{"a.yaml": "groups:\n  g: {members: []}\n"},
+			errorMsg: "duplicate group g found in",
+		},
+		{
+			name:     "duplicate top level setting",
+			main:     "include: [\"a.yaml\"]\nstartPort: 6000\n",
+			files:    map[string]string{"a.yaml": "startPort: 7000\n"},
+			errorMsg: "startPort is set in both",
+		},
+		{
+			name:     "missing file",
+			main:     "include: [\"missing.yaml\"]\n",
+			errorMsg: "missing.yaml",
+		},
+		{
+			name:     "include cycle",
+			main:     "include: [\"a.yaml\"]\n",
+			files:    map[string]string{"a.yaml": "include: [\"config.yaml\"]\n"},
+			errorMsg: "included more than once",
+		},
+		{
+			name:     "include not a list",
+			main:     "include: a.yaml\n",
+			files:    map[string]string{"a.yaml": ""},
+			errorMsg: "include must be a list of files or globs",
+		},
+		{
+			name:     "invalid yaml in include",
+			main:     "include: [\"a.yaml\"]\n",
+			files:    map[string]string{"a.yaml": "models: [\n"},
+			errorMsg: "a.yaml: yaml:",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			mainPath := writeIncludeTestFile(t, dir, "config.yaml", tt.main)
+			for name, content := range tt.files {
+				writeIncludeTestFile(t, dir, name, content)
+			}
+			_, err := LoadConfig(mainPath)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errorMsg)
+		})
+	}
+}
+
+func TestConfig_IncludeGlobWithoutMatches(t *testing.T) {
+	dir := t.TempDir()
+	mainPath := writeIncludeTestFile(t, dir, "config.yaml", `
+include: ["conf.d/*.yaml"]
+models:
+  m1:
+    cmd: serve
+    proxy: http://localhost:9000
+`)
+
+	config, err := LoadConfig(mainPath)
+	require.NoError(t, err)
+	assert.Contains(t, config.Models, "m1")
+	assert.Empty(t, config.IncludedFiles)
+	// the directory is watched for files created later
+	assert.Equal(t, []string{filepath.Join(dir, "conf.d")}, config.IncludeDirs)
+}
+
+func TestConfig_LoadConfigWithOverlay(t *testing.T) {
+	dir := t.TempDir()
+	mainPath := writeIncludeTestFile(t, dir, "config.yaml", `
+include: ["conf.d/*.yaml"]
+models:
+  m1:
+    cmd: serve
+    proxy: http://localhost:9000
+`)
+	recipePath := filepath.Join(dir, "conf.d", "recipes.yaml")
+
+	// the overlay file does not exist on disk yet but matches the glob
+	config, err := LoadConfigWithOverlay(mainPath, map[string][]byte{
+		recipePath: []byte("models:\n  m2:\n    cmd: serve\n    proxy: http://localhost:9001\n"),
+	})
+	require.NoError(t, err)
+	assert.Contains(t, config.Models, "m2")
+	assert.Equal(t, []string{recipePath}, config.IncludedFiles)
+
+	// overlaying the main file replaces its contents
+	_, err = LoadConfigWithOverlay(mainPath, map[string][]byte{
+		mainPath:   []byte("include: [\"conf.d/*.yaml\"]\nmodels:\n  m2:\n    cmd: serve\n    proxy: http://localhost:9000\n"),
+		recipePath: []byte("models:\n  m2:\n    cmd: serve\n    proxy: http://localhost:9001\n"),
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "duplicate model m2")
+}
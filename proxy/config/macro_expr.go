@@ -0,0 +1,617 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// exprMacroRegex matches ${expr: <expression>} macros. Expressions support
+// numbers, quoted strings, true/false, macro names as identifiers, the
+// operators + - * / % == != < <= > >= && || ! and `cond ? a : b`, parentheses
+// and the functions min, max and int.
+var exprMacroRegex = regexp.MustCompile(`\$\{expr:([^{}]*)\}`)
+
+// exprLookup returns the value of a macro used as an identifier in an expression
+type exprLookup func(name string) (any, error)
+
+// substituteExprMacros evaluates all ${expr:...} macros in s
+func substituteExprMacros(s string, lookup exprLookup) (string, error) {
+	var evalErr error
+	result := exprMacroRegex.ReplaceAllStringFunc(s, func(match string) string {
+		if evalErr != nil {
+			return match
+		}
+		source := exprMacroRegex.FindStringSubmatch(match)[1]
+		value, err := evaluateExpr(source, lookup)
+		if err != nil {
+			evalErr = err
+			return match
+		}
+		return formatExprValue(value)
+	})
+	return result, evalErr
+}
+
+// substituteExprMacrosInValue evaluates ${expr:...} macros in a nested value.
+// A string that consists of a single expression is replaced by the typed result.
+func substituteExprMacrosInValue(value any, lookup exprLookup) (any, error) {
+	switch v := value.(type) {
+	case string:
+		if match := exprMacroRegex.FindStringSubmatchIndex(v); match != nil && match[0] == 0 && match[1] == len(v) {
+			return evaluateExpr(v[match[2]:match[3]], lookup)
+		}
+		return substituteExprMacros(v, lookup)
+
+	case map[string]any:
+		newMap := make(map[string]any, len(v))
+		for key, val := range v {
+			newVal, err := substituteExprMacrosInValue(val, lookup)
+			if err != nil {
+				return nil, err
+			}
+			newMap[key] = newVal
+		}
+		return newMap, nil
+
+	case []any:
+		newSlice := make([]any, len(v))
+		for i, val := range v {
+			newVal, err := substituteExprMacrosInValue(val, lookup)
+			if err != nil {
+				return nil, err
+			}
+			newSlice[i] = newVal
+		}
+		return newSlice, nil
+
+	default:
+		return value, nil
+	}
+}
+
+// macroListLookup resolves identifiers against a macro list. A macro's value
+// is expanded with the macros defined before it, following the same ordering
+// rules as regular macro substitution, so expressions can only refer to
+// earlier macros and cannot form cycles.
+func macroListLookup(macros MacroList) exprLookup {
+	return func(name string) (any, error) {
+		for i, entry := range macros {
+			if entry.Name != name {
+				continue
+			}
+			str, ok := entry.Value.(string)
+			if !ok {
+				return entry.Value, nil
+			}
+			for j := i - 1; j >= 0; j-- {
+				str = strings.ReplaceAll(str, fmt.Sprintf("${%s}", macros[j].Name), fmt.Sprintf("%v", macros[j].Value))
+			}
+			if matches := macroPatternRegex.FindStringSubmatch(str); matches != nil {
+				return nil, fmt.Errorf("macro '%s' references unknown macro '${%s}'", name, matches[1])
+			}
+			return substituteExprMacrosInValue(str, macroListLookup(macros[:i]))
+		}
+		return nil, fmt.Errorf("unknown macro '%s'", name)
+	}
+}
+
+func formatExprValue(value any) string {
+	switch v := value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// evaluateExpr parses and evaluates a single expression
+func evaluateExpr(source string, lookup exprLookup) (any, error) {
+	tokens, err := tokenizeExpr(source)
+	if err != nil {
+		return nil, fmt.Errorf("expr '%s': %w", strings.TrimSpace(source), err)
+	}
+	p := &exprParser{tokens: tokens, lookup: lookup}
+	value, err := p.parseTernary()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected '%s'", p.tokens[p.pos].text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("expr '%s': %w", strings.TrimSpace(source), err)
+	}
+	return value, nil
+}
+
+type exprTokenKind int
+
+const (
+	exprNumberToken exprTokenKind = iota
+	exprStringToken
+	exprIdentToken
+	exprOperatorToken
+)
+
+type exprToken struct {
+	kind exprTokenKind
+	text string
+}
+
+func tokenizeExpr(source string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(source); {
+		c := source[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+
+		case c >= '0' && c <= '9' || c == '.':
+			start := i
+			for i < len(source) && (source[i] >= '0' && source[i] <= '9' || source[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: exprNumberToken, text: source[start:i]})
+
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(source[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, exprToken{kind: exprStringToken, text: source[i+1 : i+1+end]})
+			i += end + 2
+
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := i
+			for i < len(source) && (source[i] == '_' || source[i] >= 'a' && source[i] <= 'z' || source[i] >= 'A' && source[i] <= 'Z' || source[i] >= '0' && source[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: exprIdentToken, text: source[start:i]})
+
+		default:
+			if i+1 < len(source) {
+				switch two := source[i : i+2]; two {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					tokens = append(tokens, exprToken{kind: exprOperatorToken, text: two})
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("+-*/%<>!?:(),", rune(c)) {
+				return nil, fmt.Errorf("unexpected character '%c'", c)
+			}
+			tokens = append(tokens, exprToken{kind: exprOperatorToken, text: string(c)})
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+	lookup exprLookup
+}
+
+func (p *exprParser) peekOperator(ops ...string) (string, bool) {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != exprOperatorToken {
+		return "", false
+	}
+	for _, op := range ops {
+		if p.tokens[p.pos].text == op {
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) expect(op string) error {
+	if _, ok := p.peekOperator(op); !ok {
+		return fmt.Errorf("expected '%s'", op)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *exprParser) parseTernary() (any, error) {
+	cond, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := p.peekOperator("?"); !ok {
+		return cond, nil
+	}
+	p.pos++
+	whenTrue, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	whenFalse, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if exprTruthy(cond) {
+		return whenTrue, nil
+	}
+	return whenFalse, nil
+}
+
+func (p *exprParser) parseOr() (any, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.peekOperator("||"); !ok {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = exprTruthy(left) || exprTruthy(right)
+	}
+}
+
+func (p *exprParser) parseAnd() (any, error) {
+	left, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.peekOperator("&&"); !ok {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		left = exprTruthy(left) && exprTruthy(right)
+	}
+}
+
+func (p *exprParser) parseComparison() (any, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.peekOperator("==", "!=", "<", "<=", ">", ">=")
+	if !ok {
+		return left, nil
+	}
+	p.pos++
+	right, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+
+	if l, r, numeric := exprNumbers(left, right); numeric {
+		switch op {
+		case "==":
+			return l == r, nil
+		case "!=":
+			return l != r, nil
+		case "<":
+			return l < r, nil
+		case "<=":
+			return l <= r, nil
+		case ">":
+			return l > r, nil
+		default:
+			return l >= r, nil
+		}
+	}
+
+	l, r := formatExprValue(left), formatExprValue(right)
+	switch op {
+	case "==":
+		return l == r, nil
+	case "!=":
+		return l != r, nil
+	case "<":
+		return l < r, nil
+	case "<=":
+		return l <= r, nil
+	case ">":
+		return l > r, nil
+	default:
+		return l >= r, nil
+	}
+}
+
+func (p *exprParser) parseAdditive() (any, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.peekOperator("+", "-")
+		if !ok {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		if left, err = exprArithmetic(op, left, right); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *exprParser) parseMultiplicative() (any, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.peekOperator("*", "/", "%")
+		if !ok {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if left, err = exprArithmetic(op, left, right); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *exprParser) parseUnary() (any, error) {
+	op, ok := p.peekOperator("!", "-")
+	if !ok {
+		return p.parsePrimary()
+	}
+	p.pos++
+	value, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	if op == "!" {
+		return !exprTruthy(value), nil
+	}
+	return exprArithmetic("-", 0, value)
+}
+
+func (p *exprParser) parsePrimary() (any, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+
+	switch token.kind {
+	case exprNumberToken:
+		return parseExprNumber(token.text)
+
+	case exprStringToken:
+		return token.text, nil
+
+	case exprIdentToken:
+		switch token.text {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+		if _, ok := p.peekOperator("("); ok {
+			return p.parseCall(token.text)
+		}
+		value, err := p.lookup(token.text)
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := value.(string); ok {
+			if n, err := parseExprNumber(strings.TrimSpace(s)); err == nil {
+				return n, nil
+			}
+		}
+		return normalizeExprValue(value), nil
+
+	default:
+		if token.text == "(" {
+			value, err := p.parseTernary()
+			if err != nil {
+				return nil, err
+			}
+			return value, p.expect(")")
+		}
+		return nil, fmt.Errorf("unexpected '%s'", token.text)
+	}
+}
+
+func (p *exprParser) parseCall(name string) (any, error) {
+	p.pos++ // (
+	var args []any
+	if _, ok := p.peekOperator(")"); !ok {
+		for {
+			arg, err := p.parseTernary()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if _, ok := p.peekOperator(","); !ok {
+				break
+			}
+			p.pos++
+		}
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	switch name {
+	case "min", "max":
+		if len(args) == 0 {
+			return nil, fmt.Errorf("%s() needs at least one argument", name)
+		}
+		best := args[0]
+		for _, arg := range args[1:] {
+			l, r, numeric := exprNumbers(best, arg)
+			if !numeric {
+				return nil, fmt.Errorf("%s() arguments must be numbers", name)
+			}
+			if (name == "min" && r < l) || (name == "max" && r > l) {
+				best = arg
+			}
+		}
+		return best, nil
+
+	case "int":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("int() takes exactly one argument")
+		}
+		n, ok := exprNumber(args[0])
+		if !ok {
+			return nil, fmt.Errorf("int() argument must be a number")
+		}
+		return int64(n), nil
+
+	default:
+		return nil, fmt.Errorf("unknown function %s()", name)
+	}
+}
+
+func parseExprNumber(text string) (any, error) {
+	if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return i, nil
+	}
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid number '%s'", text)
+	}
+	return f, nil
+}
+
+// normalizeExprValue converts decoded YAML scalars to int64/float64
+func normalizeExprValue(value any) any {
+	switch v := value.(type) {
+	case int:
+		return int64(v)
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint:
+		return int64(v)
+	case uint8:
+		return int64(v)
+	case uint16:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case uint64:
+		return int64(v)
+	case float32:
+		return float64(v)
+	default:
+		return value
+	}
+}
+
+func exprNumber(value any) (float64, bool) {
+	switch v := normalizeExprValue(value).(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		if n, err := parseExprNumber(strings.TrimSpace(v)); err == nil {
+			return exprNumber(n)
+		}
+	}
+	return 0, false
+}
+
+func exprNumbers(left, right any) (float64, float64, bool) {
+	l, lok := exprNumber(left)
+	r, rok := exprNumber(right)
+	return l, r, lok && rok
+}
+
+func exprTruthy(value any) bool {
+	switch v := normalizeExprValue(value).(type) {
+	case bool:
+		return v
+	case int64:
+		return v != 0
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	default:
+		return value != nil
+	}
+}
+
+func exprArithmetic(op string, left, right any) (any, error) {
+	left, right = normalizeExprValue(left), normalizeExprValue(right)
+
+	if op == "+" {
+		_, leftIsString := left.(string)
+		_, rightIsString := right.(string)
+		if leftIsString || rightIsString {
+			return formatExprValue(left) + formatExprValue(right), nil
+		}
+	}
+
+	li, lInt := left.(int64)
+	ri, rInt := right.(int64)
+	if lInt && rInt {
+		switch op {
+		case "+":
+			return li + ri, nil
+		case "-":
+			return li - ri, nil
+		case "*":
+			return li * ri, nil
+		case "/":
+			if ri == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			if li%ri == 0 {
+				return li / ri, nil
+			}
+			return float64(li) / float64(ri), nil
+		case "%":
+			if ri == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			return li % ri, nil
+		}
+	}
+
+	l, r, numeric := exprNumbers(left, right)
+	if !numeric {
+		return nil, fmt.Errorf("operator '%s' needs numbers, got '%v' and '%v'", op, left, right)
+	}
+	switch op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return l / r, nil
+	default:
+		if r == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return math.Mod(l, r), nil
+	}
+}
@@ -0,0 +1,202 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvaluateExpr(t *testing.T) {
+	lookup := macroListLookup(MacroList{
+		{Name: "ctx", Value: 8192},
+		{Name: "gpu", Value: "rocm"},
+		{Name: "layers", Value: "33"},
+		{Name: "half", Value: "${expr: ctx / 2}"},
+	})
+
+	tests := []struct {
+		expr     string
+		expected any
+	}{
+		{"1 + 2 * 3", int64(7)},
+		{"(1 + 2) * 3", int64(9)},
+		{"ctx * 2", int64(16384)},
+		{"ctx / 3", float64(8192) / 3},
+		{"int(ctx / 3)", int64(2730)},
+		{"layers - 1", int64(32)},
+		{"half + 1", int64(4097)},
+		{"-ctx", int64(-8192)},
+		{"10 % 4", int64(2)},
+		{"1.5 * 2", float64(3)},
+		{"min(ctx, 4096, 16384)", int64(4096)},
+		{"max(ctx, 4096)", int64(8192)},
+		{"ctx >= 8192 && gpu == 'rocm'", true},
+		{"!(ctx > 1) || false", false},
+		{"gpu == \"cuda\" ? 99 : 0", int64(0)},
+		{"ctx > 4096 ? 'large' : 'small'", "large"},
+		{"'--ctx-size ' + ctx", "--ctx-size 8192"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			value, err := evaluateExpr(tt.expr, lookup)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, value)
+		})
+	}
+}
+
+func TestEvaluateExpr_Errors(t *testing.T) {
+	lookup := macroListLookup(MacroList{
+		{Name: "name", Value: "abc"},
+		{Name: "broken", Value: "${missing}"},
+	})
+
+	tests := []struct {
+		expr     string
+		errorMsg string
+	}{
+		{"1 / 0", "division by zero"},
+		{"1 +", "unexpected end of expression"},
+		{"(1 + 2", "expected ')'"},
+		{"1 2", "unexpected '2'"},
+		{"name * 2", "operator '*' needs numbers"},
+		{"nope + 1", "unknown macro 'nope'"},
+		{"broken", "macro 'broken' references unknown macro '${missing}'"},
+		{"foo(1)", "unknown function foo()"},
+		{"'open", "unterminated string"},
+		{"1 # 2", "unexpected character '#'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := evaluateExpr(tt.expr, lookup)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errorMsg)
+		})
+	}
+}
+
+func TestConfig_ExprMacros(t *testing.T) {
+	content := `
+startPort: 9000
+macros:
+  ctx: 16384
+  parallel: 4
+  server: "llama-server --ctx-size ${expr: ctx * parallel} --parallel ${parallel}"
+models:
+  model1:
+    macros:
+      parallel: 2
+    cmd: "${server} --port ${PORT} --threads ${expr: min(parallel * 4, 16)}"
+    proxy: "http://localhost:${PORT}"
+    checkEndpoint: "/health?slot=${expr: PORT - 9000}"
+    metadata:
+      context: "${expr: ctx * parallel}"
+      large: "${expr: ctx > 8192}"
+      label: "ctx=${expr: ctx / 1024}k"
+`
+
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	require.NoError(t, err)
+
+	model := config.Models["model1"]
+	assert.Equal(t, "llama-server --ctx-size 32768 --parallel 2 --port 9000 --threads 8", model.Cmd)
+	assert.Equal(t, "/health?slot=0", model.CheckEndpoint)
+	assert.Equal(t, int64(32768), model.Metadata["context"])
+	assert.Equal(t, true, model.Metadata["large"])
+	assert.Equal(t, "ctx=16k", model.Metadata["label"])
+}
+
+func TestConfig_ExprMacroErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		errorMsg string
+	}{
+		{
+			name: "unknown identifier",
+			content: `
+models:
+  model1:
+    cmd: "server --ctx ${expr: nope * 2}"
+    proxy: "http://localhost:8080"
+`,
+			errorMsg: "model model1.cmd: expr 'nope * 2': unknown macro 'nope'",
+		},
+		{
+			name: "plain macro inside expression is still checked",
+			content: `
+models:
+  model1:
+    cmd: "server ${expr: ${missing} * 2}"
+    proxy: "http://localhost:8080"
+`,
+			errorMsg: "unknown macro '${missing}'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfigFromReader(strings.NewReader(tt.content))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errorMsg)
+		})
+	}
+}
+
+func TestConfig_HostMacros(t *testing.T) {
+	content := `
+macros:
+  base: "/models"
+  gpu_layers: 0
+  model_path: "${base}/llama.gguf"
+hostMacros:
+  GPU-Box:
+    gpu_layers: 99
+    base: "/mnt/fast"
+  laptop:
+    gpu_layers: 10
+models:
+  model1:
+    cmd: "server -m ${model_path} -ngl ${gpu_layers} --ctx ${expr: gpu_layers > 0 ? 32768 : 4096}"
+    proxy: "http://localhost:8080"
+`
+
+	original := hostname
+	t.Cleanup(func() { hostname = original })
+
+	hostname = func() (string, error) { return "gpu-box", nil }
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	require.NoError(t, err)
+	assert.Equal(t, "server -m /mnt/fast/llama.gguf -ngl 99 --ctx 32768", config.Models["model1"].Cmd)
+
+	// overridden macros keep their position in the list
+	names := make([]string, 0, len(config.Macros))
+	for _, entry := range config.Macros {
+		names = append(names, entry.Name)
+	}
+	assert.Equal(t, []string{"base", "gpu_layers", "model_path"}, names)
+
+	hostname = func() (string, error) { return "other", nil }
+	config, err = LoadConfigFromReader(strings.NewReader(content))
+	require.NoError(t, err)
+	assert.Equal(t, "server -m /models/llama.gguf -ngl 0 --ctx 4096", config.Models["model1"].Cmd)
+}
+
+func TestConfig_HostMacrosValidated(t *testing.T) {
+	content := `
+hostMacros:
+  some-other-host:
+    PORT: 1234
+models:
+  model1:
+    cmd: "server"
+    proxy: "http://localhost:8080"
+`
+	_, err := LoadConfigFromReader(strings.NewReader(content))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "hostMacros.some-other-host: macro name 'PORT' is reserved")
+}
@@ -0,0 +1,200 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// replaceTag marks a model field that replaces the inherited template value
+// instead of being merged into it, e.g. `env: !replace ["A=1"]`
+const replaceTag = "!replace"
+
+// applyModelTemplates merges the modelTemplates a model extends into the
+// model's own settings. Mappings are merged key by key, lists are appended to
+// the template's list and scalars from the model override the template. It
+// runs on the YAML document before decoding, so macro expansion and all model
+// validation happen on the merged result.
+//
+// The returned map holds the template chain for every model that extends a
+// template, used to point validation errors back at the templates.
+func applyModelTemplates(root *yaml.Node) (map[string][]string, error) {
+	if root == nil || root.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+
+	templates := make(map[string]*yaml.Node)
+	if templatesNode := mappingValue(root, "modelTemplates"); templatesNode != nil && templatesNode.Tag != "!!null" {
+		if templatesNode.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("line %d: modelTemplates must be a mapping", templatesNode.Line)
+		}
+		for i := 0; i+1 < len(templatesNode.Content); i += 2 {
+			name := templatesNode.Content[i].Value
+			template := templatesNode.Content[i+1]
+			if template.Kind != yaml.MappingNode {
+				return nil, fmt.Errorf("line %d: modelTemplates.%s must be a mapping", template.Line, name)
+			}
+			templates[name] = template
+		}
+	}
+
+	modelsNode := mappingValue(root, "models")
+	if modelsNode == nil || modelsNode.Kind != yaml.MappingNode {
+		modelsNode = &yaml.Node{Kind: yaml.MappingNode}
+	}
+
+	chains := make(map[string][]string)
+	resolved := make(map[string]*yaml.Node)
+	for i := 0; i+1 < len(modelsNode.Content); i += 2 {
+		modelId := modelsNode.Content[i].Value
+		model := modelsNode.Content[i+1]
+		if model.Kind != yaml.MappingNode {
+			continue
+		}
+		extendsNode := mappingValue(model, "extends")
+		if extendsNode == nil || extendsNode.Value == "" {
+			continue
+		}
+
+		template, chain, err := resolveModelTemplate(extendsNode.Value, templates, resolved, nil)
+		if err != nil {
+			return nil, fmt.Errorf("model %s (line %d): %w", modelId, extendsNode.Line, err)
+		}
+		modelsNode.Content[i+1] = mergeTemplateNode(template, model)
+		chains[modelId] = chain
+	}
+
+	// templates are decoded as well, drop any !replace tags they carry
+	if templatesNode := mappingValue(root, "modelTemplates"); templatesNode != nil {
+		for i := 1; i < len(templatesNode.Content); i += 2 {
+			templatesNode.Content[i] = cloneNode(templatesNode.Content[i])
+		}
+	}
+	return chains, nil
+}
+
+// templateChainSuffix names the templates modelId extends, in the order
+// they are merged, for errors about the settings of the model
+func templateChainSuffix(modelId string, chain []string) string {
+	return fmt.Sprintf(" (model %s extends modelTemplates.%s)", modelId, strings.Join(chain, " -> modelTemplates."))
+}
+
+// withTemplateChain adds the templates a model extends to an error about
+// one of its settings, which may have come from a template rather than the
+// model itself
+func withTemplateChain(err error, chains map[string][]string) error {
+	var located *configError
+	if !errors.As(err, &located) || len(located.path) < 3 || located.path[0] != "models" {
+		return err
+	}
+	chain, found := chains[located.path[1]]
+	if !found {
+		return err
+	}
+	return fmt.Errorf("%w%s", err, templateChainSuffix(located.path[1], chain))
+}
+
+// resolveModelTemplate returns a template with all of the templates it extends
+// merged in, along with the chain of template names that were merged
+func resolveModelTemplate(name string, templates, resolved map[string]*yaml.Node, visiting []string) (*yaml.Node, []string, error) {
+	for _, seen := range visiting {
+		if seen == name {
+			return nil, nil, fmt.Errorf("modelTemplates cycle: %s -> %s", strings.Join(visiting, " -> "), name)
+		}
+	}
+
+	template, found := templates[name]
+	if !found {
+		return nil, nil, fmt.Errorf("extends unknown template %s", name)
+	}
+
+	chain := []string{name}
+	extendsNode := mappingValue(template, "extends")
+	if extendsNode != nil && extendsNode.Value != "" {
+		parent, parentChain, err := resolveModelTemplate(extendsNode.Value, templates, resolved, append(visiting, name))
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, done := resolved[name]; !done {
+			resolved[name] = mergeTemplateNode(parent, template)
+		}
+		template = resolved[name]
+		chain = append(chain, parentChain...)
+	}
+	return template, chain, nil
+}
+
+// mergeTemplateNode returns a new node with override deep merged over base.
+// Neither input is modified.
+func mergeTemplateNode(base, override *yaml.Node) *yaml.Node {
+	if override.Tag == replaceTag {
+		merged := cloneNode(override)
+		merged.Tag = ""
+		return merged
+	}
+
+	if base != nil && base.Kind == yaml.AliasNode {
+		base = base.Alias
+	}
+	if base == nil || base.Kind != override.Kind {
+		return cloneNode(override)
+	}
+
+	switch override.Kind {
+	case yaml.MappingNode:
+		merged := cloneNode(base)
+		for i := 0; i+1 < len(override.Content); i += 2 {
+			key := override.Content[i]
+			value := override.Content[i+1]
+
+			found := false
+			for j := 0; j+1 < len(merged.Content); j += 2 {
+				if merged.Content[j].Value == key.Value {
+					merged.Content[j+1] = mergeTemplateNode(merged.Content[j+1], value)
+					found = true
+					break
+				}
+			}
+			if !found {
+				merged.Content = append(merged.Content, cloneNode(key), mergeTemplateNode(nil, value))
+			}
+		}
+		return merged
+
+	case yaml.SequenceNode:
+		merged := cloneNode(base)
+		for _, item := range override.Content {
+			merged.Content = append(merged.Content, cloneNode(item))
+		}
+		return merged
+
+	default:
+		return cloneNode(override)
+	}
+}
+
+// cloneNode deep copies a yaml node, resolving aliases so that the copy does
+// not share any state with the original document
+func cloneNode(node *yaml.Node) *yaml.Node {
+	if node == nil {
+		return nil
+	}
+	if node.Kind == yaml.AliasNode && node.Alias != nil {
+		return cloneNode(node.Alias)
+	}
+
+	copied := *node
+	copied.Anchor = ""
+	if len(node.Content) > 0 {
+		copied.Content = make([]*yaml.Node, len(node.Content))
+		for i, child := range node.Content {
+			copied.Content[i] = cloneNode(child)
+		}
+	}
+	if copied.Tag == replaceTag {
+		copied.Tag = ""
+	}
+	return &copied
+}
@@ -0,0 +1,190 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_ModelTemplatesExtends(t *testing.T) {
+	content := `
+macros:
+  server: /opt/llama-server
+modelTemplates:
+  llama:
+    cmd: ${server} --port ${PORT} -m ${model_path} --ctx-size ${ctx}
+    checkEndpoint: /v1/models
+    ttl: 300
+    env:
+      - "CUDA_VISIBLE_DEVICES=0"
+    macros:
+      ctx: 4096
+    filters:
+      stripParams: "temperature"
+    metadata:
+      family: llama
+      limits:
+        context: ${ctx}
+models:
+  small:
+    extends: llama
+    macros:
+      model_path: /models/small.gguf
+  big:
+    extends: llama
+    ttl: 0
+    env:
+      - "GGML_CUDA_FORCE_MMQ=1"
+    macros:
+      model_path: /models/big.gguf
+      ctx: 32768
+    metadata:
+      limits:
+        output: 8192
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	require.NoError(t, err)
+
+	small := config.Models["small"]
+	assert.Equal(t, "/opt/llama-server --port 5801 -m /models/small.gguf --ctx-size 4096", small.Cmd)
+	assert.Equal(t, "/v1/models", small.CheckEndpoint)
+	assert.Equal(t, 300, small.UnloadAfter)
+	assert.Equal(t, []string{"CUDA_VISIBLE_DEVICES=0"}, small.Env)
+	assert.Equal(t, "temperature", small.Filters.StripParams)
+	assert.Equal(t, "llama", small.Extends)
+	assert.Equal(t, map[string]any{"family": "llama", "limits": map[string]any{"context": 4096}}, small.Metadata)
+
+	// macros from the model are expanded after the merge
+	big := config.Models["big"]
+	assert.Equal(t, "/opt/llama-server --port 5800 -m /models/big.gguf --ctx-size 32768", big.Cmd)
+	assert.Equal(t, 0, big.UnloadAfter)
+	assert.Equal(t, []string{"CUDA_VISIBLE_DEVICES=0", "GGML_CUDA_FORCE_MMQ=1"}, big.Env)
+	assert.Equal(t, map[string]any{
+		"family": "llama",
+		"limits": map[string]any{"context": 32768, "output": 8192},
+	}, big.Metadata)
+
+	assert.Contains(t, config.ModelTemplates, "llama")
+}
+
+func TestConfig_ModelTemplatesReplaceAndChain(t *testing.T) {
+	content := `
+modelTemplates:
+  base:
+    proxy: http://localhost:9000
+    env: ["A=1", "B=2"]
+    aliases: []
+  gpu:
+    extends: base
+    cmd: serve --gpu
+    env: ["C=3"]
+models:
+  m1:
+    extends: gpu
+    env: !replace ["ONLY=1"]
+  m2:
+    extends: gpu
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"ONLY=1"}, config.Models["m1"].Env)
+	assert.Equal(t, "serve --gpu", config.Models["m1"].Cmd)
+	assert.Equal(t, "http://localhost:9000", config.Models["m1"].Proxy)
+	assert.Equal(t, []string{"A=1", "B=2", "C=3"}, config.Models["m2"].Env)
+}
+
+func TestConfig_ModelTemplatesErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		errorMsg []string
+	}{
+		{
+			name: "unknown template",
+			content: `
+models:
+  m1:
+    extends: missing
+    cmd: serve
+`,
+			errorMsg: []string{"model m1 (line 4): extends unknown template missing"},
+		},
+		{
+			name: "template cycle",
+			content: `
+modelTemplates:
+  a:
+    extends: b
+  b:
+    extends: a
+models:
+  m1:
+    extends: a
+    cmd: serve
+`,
+			errorMsg: []string{"modelTemplates cycle: a -> b -> a"},
+		},
+		{
+			name: "validation error names model and template",
+			content: `
+modelTemplates:
+  base:
+    cmd: serve ${missing_macro}
+  child:
+    extends: base
+models:
+  m1:
+    extends: child
+    proxy: http://localhost:9000
+`,
+			errorMsg: []string{
+				"unknown macro '${missing_macro}' found in m1.cmd",
+				"(model m1 extends modelTemplates.child -> modelTemplates.base)",
+			},
+		},
+		{
+			name: "duplicate alias names the template",
+			content: `
+modelTemplates:
+  base:
+    cmd: serve
+    aliases: ["shared"]
+models:
+  m1:
+    extends: base
+  m2:
+    extends: base
+`,
+			errorMsg: []string{
+				"duplicate alias shared",
+				"extends modelTemplates.base)",
+			},
+		},
+		{
+			name: "decode error points at the template line",
+			content: `
+modelTemplates:
+  base:
+    ttl: soon
+models:
+  m1:
+    extends: base
+    cmd: serve
+`,
+			errorMsg: []string{"line 4"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfigFromReader(strings.NewReader(tt.content))
+			require.Error(t, err)
+			for _, msg := range tt.errorMsg {
+				assert.Contains(t, err.Error(), msg)
+			}
+		})
+	}
+}
@@ -0,0 +1,835 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:generate go run ../../cmd/misc/gen-config-schema -o ../../config-schema.json
+
+// schemaInfo documents a config type or setting in the generated JSON schema.
+// Settings are keyed by type and yaml name, e.g. "ModelConfig.cmd", types by
+// their name.
+type schemaInfo struct {
+	description string
+
+	// extra JSON schema keywords, they replace generated keywords of the same name
+	extra schemaObject
+
+	// noDefault leaves out the default value taken from the Go defaults
+	noDefault bool
+}
+
+// schemaDocs describes every setting. TestJSONSchema_DocumentsEveryField fails
+// when a setting is added to the config types without a description here.
+var schemaDocs = map[string]schemaInfo{
+	"Config": {
+		description: "Configuration file for llama-swap",
+		extra:       schemaObject{{"required", []string{"models"}}},
+	},
+	"Config.healthCheckTimeout": {
+		description: "Number of seconds to wait for a model to be ready to serve requests.",
+		extra:       schemaObject{{"minimum", 15}},
+	},
+	"Config.logRequests": {
+		description: "Deprecated, use logLevel instead.",
+	},
+	"Config.logLevel": {
+		description: "Sets the logging value. Valid values: debug, info, warn, error.",
+		extra:       schemaObject{{"enum", []string{"debug", "info", "warn", "error"}}},
+	},
+	"Config.logTimeFormat": {
+		description: "Enables and sets the logging timestamp format. Valid values: \"\", \"ansic\", \"unixdate\", \"rubydate\", \"rfc822\", \"rfc822z\", \"rfc850\", \"rfc1123\", \"rfc1123z\", \"rfc3339\", \"rfc3339nano\", \"kitchen\", \"stamp\", \"stampmilli\", \"stampmicro\", and \"stampnano\". For more info, read: https://pkg.go.dev/time#pkg-constants",
+		extra: schemaObject{{"enum", []string{"", "ansic", "unixdate", "rubydate", "rfc822", "rfc822z", "rfc850", "rfc1123", "rfc1123z",
+			"rfc3339", "rfc3339nano", "kitchen", "stamp", "stampmilli", "stampmicro", "stampnano"}}},
+	},
+	"Config.logToStdout": {
+		description: "Controls what is logged to stdout. 'proxy': logs generated by llama-swap, 'upstream': copy of upstream process stdout logs, 'both': both interleaved together, 'none': no logs written to stdout.",
+		extra:       schemaObject{{"enum", []string{LogToStdoutProxy, LogToStdoutUpstream, LogToStdoutBoth, LogToStdoutNone}}},
+	},
+	"Config.metricsMaxInMemory": {
+		description: "Maximum number of metrics to keep in memory. Controls how many metrics are stored before older ones are discarded.",
+	},
+	"Config.captureBuffer": {
+		description: "Size in megabytes of the buffer for storing request/response captures. Set to 0 to disable captures.",
+		extra:       schemaObject{{"minimum", 0}},
+	},
+	"Config.metricsStore": {
+		description: "Persists request metrics, model swaps and model starts to disk so they survive restarts and config reloads. Query them with /api/metrics/query.",
+	},
+	"MetricsStoreConfig": {
+		extra: schemaObject{{"additionalProperties", false}},
+	},
+	"MetricsStoreConfig.path": {
+		description: "Directory for the metrics files, relative to the working directory. Empty disables the store.",
+	},
+	"MetricsStoreConfig.retentionDays": {
+		description: "Number of days of metrics to keep. Older files are deleted.",
+		extra:       schemaObject{{"minimum", 1}},
+	},
+	"Config.captureStore": {
+		description: "Persists request/response captures to disk so they survive restarts. Export them as HAR or JSONL with /api/captures/export.",
+	},
+	"CaptureStoreConfig": {
+		extra: schemaObject{{"additionalProperties", false}},
+	},
+	"CaptureStoreConfig.path": {
+		description: "Directory for the capture files, relative to the working directory. Empty disables the store.",
+	},
+	"CaptureStoreConfig.retentionDays": {
+		description: "Number of days of captures to keep. Older files are deleted.",
+		extra:       schemaObject{{"minimum", 1}},
+	},
+	"CaptureStoreConfig.maxSizeMB": {
+		description: "Maximum size in megabytes of all capture files. The oldest files are deleted when it is exceeded.",
+		extra:       schemaObject{{"minimum", 1}},
+	},
+	"CaptureStoreConfig.compression": {
+		description: "Compression of the capture files.",
+		extra:       schemaObject{{"enum", []string{CaptureCompressionGzip, CaptureCompressionNone}}},
+	},
+	"Config.auditLog": {
+		description: "Records administrative actions, like config saves, recipe changes, backend actions, image and model deletions, cluster stops and DGX updates, with who made them, the sanitized payload, the target nodes, the result and the duration. Query them with /api/audit.",
+	},
+	"AuditLogConfig": {
+		extra: schemaObject{{"additionalProperties", false}},
+	},
+	"AuditLogConfig.path": {
+		description: "Directory for the append-only JSONL audit files, relative to the working directory. Empty keeps the latest entries in memory only.",
+	},
+	"AuditLogConfig.maxSizeMB": {
+		description: "Size in megabytes of the active audit file before it is rotated.",
+		extra:       schemaObject{{"minimum", 1}},
+	},
+	"AuditLogConfig.maxFiles": {
+		description: "Number of rotated audit files to keep, the oldest are deleted. 0 keeps all of them.",
+		extra:       schemaObject{{"minimum", 0}},
+	},
+	"Config.tracing": {
+		description: "Exports OpenTelemetry traces of requests over OTLP/HTTP, with spans for authentication, model swaps, model starts and the upstream call.",
+	},
+	"TracingConfig": {
+		extra: schemaObject{{"additionalProperties", false}},
+	},
+	"TracingConfig.endpoint": {
+		description: "OTLP/HTTP endpoint of the collector, e.g. http://localhost:4318. /v1/traces is added when the URL has no path. Empty disables tracing.",
+	},
+	"TracingConfig.serviceName": {
+		description: "service.name resource attribute of the exported spans.",
+	},
+	"TracingConfig.sampleRatio": {
+		description: "Fraction of requests without a sampled traceparent header that are traced, from 0 to 1. Requests with a traceparent follow its sampled flag.",
+		extra:       schemaObject{{"minimum", 0}, {"maximum", 1}},
+	},
+	"TracingConfig.headers": {
+		description: "HTTP headers sent with every export, e.g. for authentication.",
+	},
+	"Config.mirrors": {
+		description: "Sends a share of the requests for a model to a shadow model as well, e.g. to compare a new quant with the one in production. Clients only get the response of the primary model. Shadow metrics and captures have mirror_of set to the request ID of the primary request.",
+	},
+	"MirrorConfig": {
+		extra: schemaObject{{"additionalProperties", false}, {"required", []string{"model", "shadow", "percent"}}},
+	},
+	"MirrorConfig.model": {
+		description: "ID or alias of the primary model, or a peer model.",
+	},
+	"MirrorConfig.shadow": {
+		description: "ID or alias of the shadow model, or a peer model.",
+	},
+	"MirrorConfig.percent": {
+		description: "Percentage of the requests for model that are sent to the shadow as well.",
+		extra:       schemaObject{{"exclusiveMinimum", 0}, {"maximum", 100}},
+	},
+	"MirrorConfig.loadShadow": {
+		description: "Start the shadow model when it is not running. The shadow is never started when that would unload the primary model. False: requests are only mirrored while the shadow is loaded.",
+	},
+	"Config.splits": {
+		description: "A dictionary of virtual models that split their requests between models or peer models by weight, e.g. for A/B tests. Each key is the name clients request. Metrics have split set to the name of the split.",
+	},
+	"SplitConfig": {
+		extra: schemaObject{{"additionalProperties", false}, {"required", []string{"variants"}}},
+	},
+	"SplitConfig.variants": {
+		description: "Models that serve the requests of the split.",
+		extra:       schemaObject{{"minItems", 1}},
+	},
+	"SplitConfig.stickyBy": {
+		description: "How clients are assigned to a variant. apiKey: by API key, or by client address when there is none. header: by the value of stickyHeader. none: every request is assigned by weight. A client keeps its variant as long as the variants and weights do not change.",
+		extra:       schemaObject{{"enum", []string{SplitStickyAPIKey, SplitStickyHeader, SplitStickyNone}}},
+	},
+	"SplitConfig.stickyHeader": {
+		description: "Request header that assigns clients to a variant with stickyBy: header, e.g. X-User-ID. Requests without it are assigned by weight.",
+	},
+	"SplitVariant": {
+		extra: schemaObject{{"additionalProperties", false}, {"required", []string{"model"}}},
+	},
+	"SplitVariant.model": {
+		description: "ID or alias of a model, or a peer model.",
+	},
+	"SplitVariant.weight": {
+		description: "Share of the requests relative to the other variants. 0 disables the variant.",
+		extra:       schemaObject{{"minimum", 0}},
+	},
+	"Config.models": {
+		description: "A dictionary of model configurations. Each key is a model's ID. Model settings have defaults if not defined. The model's ID is available as ${MODEL_ID}.",
+		extra: schemaObject{{"additionalProperties", schemaObject{
+			{"allOf", []any{schemaObject{{"$ref", "#/definitions/modelSettings"}}}},
+			{"anyOf", []any{
+				schemaObject{{"required", []string{"cmd"}}},
+				schemaObject{{"required", []string{"extends"}}},
+			}},
+		}}},
+	},
+	"Config.profiles": {
+		description: "Deprecated, replaced by groups. A dictionary of profile names to lists of model IDs.",
+	},
+	"Config.groups": {
+		description: "A dictionary of group settings. Provides advanced controls over model swapping behaviour. Model IDs must be defined in models. A model can only be a member of one group. Behaviour controlled via swap, exclusive, persistent.",
+	},
+	"Config.macros": {
+		description: "Global macros, see the macros definition.",
+	},
+	"Config.hostMacros": {
+		description: "Macros that override the global macros on the host whose hostname matches the key (case-insensitive).",
+	},
+	"Config.startPort": {
+		description: "Starting port number for the automatic ${PORT} macro. The ${PORT} macro is incremented for every model that uses it.",
+		extra:       schemaObject{{"minimum", 1}},
+	},
+	"Config.hooks": {
+		description: "A dictionary of event triggers and actions. Only supported hook is on_startup.",
+	},
+	"Config.sendLoadingState": {
+		description: "Inject loading status updates into the reasoning field. When true, a stream of loading messages will be sent to the client.",
+	},
+	"Config.includeAliasesInList": {
+		description: "Present aliases within the /v1/models OpenAI API listing. when true, model aliases will be output to the API model listing duplicating all fields except for Id so chat UIs can use the alias equivalent to the original.",
+	},
+	"Config.apiKeys": {
+		description: "Require an API key when making requests to inference endpoints. When empty, authorization will not be checked. Each key is a non-empty string.",
+		extra:       schemaObject{{"items", schemaObject{{"type", "string"}, {"minLength", 1}}}},
+	},
+	"Config.apiKeyIdentities": {
+		description: "A dictionary of named API keys that can be limited to some models and endpoints. Each key is the name recorded in metrics and logs for requests with the key. Keys in apiKeys can use every model and endpoint.",
+	},
+	"APIKeyIdentity": {
+		extra: schemaObject{{"additionalProperties", false}},
+	},
+	"APIKeyIdentity.key": {
+		description: "The API key. Use an environment variable macro to keep it out of the config. Only one of key and keyHash can be set.",
+	},
+	"APIKeyIdentity.keyHash": {
+		description: "The SHA-256 of the API key, as sha256: followed by 64 hex characters, e.g. from: printf %s \"$KEY\" | sha256sum",
+		extra:       schemaObject{{"pattern", "^sha256:[0-9a-fA-F]{64}$"}},
+	},
+	"APIKeyIdentity.clientCerts": {
+		description: "Patterns of the common name or subject alternative names (DNS, email, IP or URI) of client certificates that authenticate as this key, e.g. *.build.example.com. Only certificates verified against --tls-client-ca-file are used, and only for requests without an API key.",
+		extra:       schemaObject{{"items", schemaObject{{"type", "string"}, {"minLength", 1}}}},
+	},
+	"APIKeyIdentity.owner": {
+		description: "Who the key belongs to, for reference.",
+	},
+	"APIKeyIdentity.models": {
+		description: "Patterns of the models the key can use, e.g. qwen-*. A request is allowed when the requested name or the model ID matches. /v1/models only lists these models.",
+		extra:       schemaObject{{"items", schemaObject{{"type", "string"}, {"minLength", 1}}}},
+	},
+	"APIKeyIdentity.endpoints": {
+		description: "Endpoint classes the key can call. inference: inference routes, /v1/models and /upstream. readonly: the routes of the viewer admin role, GET requests to /api, /logs, /metrics and /running. admin: every route.",
+		extra:       schemaObject{{"items", schemaObject{{"type", "string"}, {"enum", []string{APIKeyEndpointInference, APIKeyEndpointReadOnly, APIKeyEndpointAdmin}}}}},
+	},
+	"APIKeyIdentity.quotas": {
+		description: "Limits on the requests and tokens of the key within each minute, hour or day. A request counts towards every quota of its model and is rejected with 429 before the model is loaded when one is used up.",
+	},
+	"QuotaConfig": {
+		extra: schemaObject{{"additionalProperties", false}, {"required", []string{"period"}}},
+	},
+	"QuotaConfig.models": {
+		description: "Patterns of the models the quota applies to, matched against the model ID, the split name or the peer model. Quotas with different models are counted separately.",
+		extra:       schemaObject{{"items", schemaObject{{"type", "string"}, {"minLength", 1}}}},
+	},
+	"QuotaConfig.period": {
+		description: "Length of the windows usage is counted in. Windows start at the full minute, hour or day in UTC.",
+		extra:       schemaObject{{"enum", []string{QuotaPeriodMinute, QuotaPeriodHour, QuotaPeriodDay}}},
+	},
+	"QuotaConfig.requests": {
+		description: "Requests per period, 0 for no limit.",
+		extra:       schemaObject{{"minimum", 0}},
+	},
+	"QuotaConfig.inputTokens": {
+		description: "Input tokens per period, 0 for no limit. Tokens are counted once the response is done, so the request that uses up the quota is not cut short.",
+		extra:       schemaObject{{"minimum", 0}},
+	},
+	"QuotaConfig.outputTokens": {
+		description: "Output tokens per period, 0 for no limit. Tokens are counted once the response is done, so the request that uses up the quota is not cut short.",
+		extra:       schemaObject{{"minimum", 0}},
+	},
+	"Config.adminAuth": {
+		description: "Admin users that sign in to the UI and /api with a password or an OpenID Connect provider. When set, keys in apiKeys only grant inference routes and /api, /ui, /logs, /metrics and /running require a signed in user with the role of the route, or a named API key with the endpoint class of the role.",
+	},
+	"AdminAuthConfig": {
+		extra: schemaObject{{"additionalProperties", false}},
+	},
+	"AdminAuthConfig.users": {
+		description: "A dictionary of users that sign in with a password. Each key is the user name.",
+	},
+	"AdminAuthConfig.oidc": {
+		description: "Sign in with an OpenID Connect provider using the authorization code flow.",
+	},
+	"AdminAuthConfig.sessionTTL": {
+		description: "Seconds a session lasts after sign in. Sessions are kept in memory and end when llama-swap restarts.",
+		extra:       schemaObject{{"minimum", 60}},
+	},
+	"AdminUser": {
+		extra: schemaObject{{"additionalProperties", false}, {"required", []string{"passwordHash", "role"}}},
+	},
+	"AdminUser.passwordHash": {
+		description: "bcrypt hash of the password, e.g. from: htpasswd -bnBC 10 \"\" \"$PASSWORD\" | tr -d ':\\n'",
+		extra:       schemaObject{{"pattern", `^\$2[aby]?\$`}},
+	},
+	"AdminUser.role": {
+		description: "viewer: GET routes of /api, /logs, /metrics and /running. operator: also unloading models, stopping the cluster, benchmarks and replays. admin: every route, including the config, recipes, backends and cluster updates.",
+		extra:       schemaObject{{"enum", []string{AdminRoleViewer, AdminRoleOperator, AdminRoleAdmin}}},
+	},
+	"OIDCConfig": {
+		extra: schemaObject{{"additionalProperties", false}},
+	},
+	"OIDCConfig.issuer": {
+		description: "Issuer URL of the provider, its discovery document is read from <issuer>/.well-known/openid-configuration.",
+		extra:       schemaObject{{"format", "uri"}},
+	},
+	"OIDCConfig.clientID": {
+		description: "Client ID registered with the provider.",
+	},
+	"OIDCConfig.clientSecret": {
+		description: "Client secret registered with the provider, empty for public clients. Use an environment variable macro to keep it out of the config.",
+	},
+	"OIDCConfig.redirectURL": {
+		description: "Callback URL registered with the provider, e.g. https://llm.example.com/auth/oidc/callback. Defaults to /auth/oidc/callback on the host of the request.",
+	},
+	"OIDCConfig.scopes": {
+		description: "Scopes requested from the provider.",
+		extra:       schemaObject{{"items", schemaObject{{"type", "string"}, {"minLength", 1}}}},
+	},
+	"OIDCConfig.usernameClaim": {
+		description: "ID token claim with the user name. Falls back to email and sub.",
+	},
+	"OIDCConfig.roleClaim": {
+		description: "ID token claim, a string or a list of strings, that is mapped to a role with roles.",
+	},
+	"OIDCConfig.roles": {
+		description: "A dictionary of roleClaim values to roles. A user with several values gets the highest role.",
+		extra:       schemaObject{{"additionalProperties", schemaObject{{"type", "string"}, {"enum", []string{AdminRoleViewer, AdminRoleOperator, AdminRoleAdmin}}}}},
+	},
+	"OIDCConfig.defaultRole": {
+		description: "Role of users without a value in roles. When empty, these users cannot sign in.",
+		extra:       schemaObject{{"enum", []string{"", AdminRoleViewer, AdminRoleOperator, AdminRoleAdmin}}},
+	},
+	"Config.rateLimits": {
+		description: "Rules that limit the rate of inference requests. A rule applies to the requests matching all of its apiKeys, models, clients and endpoints, an empty list matches every request. A request is rejected with 429 and a Retry-After header before the model is loaded when a matching rule has no budget left. Changes are applied without restarting the models.",
+	},
+	"RateLimitConfig": {
+		extra: schemaObject{{"additionalProperties", false}},
+	},
+	"RateLimitConfig.name": {
+		description: "Name of the rule in logs and error messages. Defaults to rateLimits.<index>.",
+	},
+	"RateLimitConfig.apiKeys": {
+		description: "Patterns of the names of the API keys the rule applies to, named keys by their name, keys in apiKeys by their key-<hash> ID.",
+		extra:       schemaObject{{"items", schemaObject{{"type", "string"}, {"minLength", 1}}}},
+	},
+	"RateLimitConfig.models": {
+		description: "Patterns of the models the rule applies to, matched against the requested name and the model ID.",
+		extra:       schemaObject{{"items", schemaObject{{"type", "string"}, {"minLength", 1}}}},
+	},
+	"RateLimitConfig.clients": {
+		description: "CIDRs or addresses of the clients the rule applies to, e.g. 10.0.0.0/8. Behind a reverse proxy, set trustedProxies so the address of the client is used.",
+		extra:       schemaObject{{"items", schemaObject{{"type", "string"}, {"minLength", 1}}}},
+	},
+	"RateLimitConfig.endpoints": {
+		description: "Patterns of the request paths the rule applies to, e.g. /v1/chat/completions or /upstream/*/*. * does not match /.",
+		extra:       schemaObject{{"items", schemaObject{{"type", "string"}, {"minLength", 1}}}},
+	},
+	"RateLimitConfig.per": {
+		description: "What the rule keeps a separate budget for. apiKey: each API key, client: each client address, model: each model. Empty: all matching requests share one budget.",
+		extra:       schemaObject{{"items", schemaObject{{"type", "string"}, {"enum", []string{RateLimitPerAPIKey, RateLimitPerClient, RateLimitPerModel}}}}},
+	},
+	"RateLimitConfig.requestsPerMinute": {
+		description: "Requests per minute, 0 for no limit. At least one of requestsPerMinute and tokensPerMinute is required.",
+		extra:       schemaObject{{"minimum", 0}},
+	},
+	"RateLimitConfig.burst": {
+		description: "Requests that can be made at once before requestsPerMinute applies.",
+		extra:       schemaObject{{"minimum", 1}},
+	},
+	"RateLimitConfig.tokensPerMinute": {
+		description: "Output tokens per minute, 0 for no limit. A request reserves its max_tokens, or tokenEstimate when it does not set one, and the reservation is corrected with the output tokens of the response.",
+		extra:       schemaObject{{"minimum", 0}},
+	},
+	"RateLimitConfig.tokenBurst": {
+		description: "Output tokens that can be reserved at once. Defaults to tokensPerMinute. A request reserving more passes once the budget is full.",
+		extra:       schemaObject{{"minimum", 0}},
+	},
+	"RateLimitConfig.tokenEstimate": {
+		description: "Output tokens reserved for requests without max_tokens.",
+		extra:       schemaObject{{"minimum", 0}},
+	},
+	"Config.peers": {
+		description: "A dictionary of remote peers and models they provide. Peers can be another llama-swap or any server that provides the /v1/ generative API endpoints supported by llama-swap.",
+	},
+	"Config.allowedOrigins": {
+		description: "Origins allowed to make cross-origin (CORS) requests. When empty any origin is allowed.",
+	},
+	"Config.trustedProxies": {
+		description: "CIDRs or addresses of the reverse proxies in front of llama-swap. The client address is read from X-Forwarded-For only when the request comes from one of them, otherwise it is the address of the connection. Requires a restart.",
+		extra:       schemaObject{{"items", schemaObject{{"type", "string"}, {"minLength", 1}}}},
+	},
+	"Config.clientAccess": {
+		description: "Rules that allow or deny client addresses per route class. Every rule matching a request must allow the client, otherwise the request is rejected with 403 and logged. /health and /wol-health are not checked. Changes are applied without restarting the models.",
+	},
+	"ClientAccessRule": {
+		extra: schemaObject{{"additionalProperties", false}},
+	},
+	"ClientAccessRule.name": {
+		description: "Name of the rule in logs. Defaults to clientAccess.<index>.",
+	},
+	"ClientAccessRule.routes": {
+		description: "Route classes the rule applies to, empty for all. inference: the /v1 and llama-server endpoints, api: /api, /metrics, /running and /unload, ui: /ui and the sign in pages, logs: /logs, upstream: /upstream.",
+		extra:       schemaObject{{"items", schemaObject{{"type", "string"}, {"enum", []string{ClientAccessRouteInference, ClientAccessRouteAPI, ClientAccessRouteUI, ClientAccessRouteLogs, ClientAccessRouteUpstream}}}}},
+	},
+	"ClientAccessRule.models": {
+		description: "Patterns of the models the rule applies to, matched against the requested name and the model ID. A rule with models only applies to inference and upstream routes.",
+		extra:       schemaObject{{"items", schemaObject{{"type", "string"}, {"minLength", 1}}}},
+	},
+	"ClientAccessRule.allow": {
+		description: "CIDRs or addresses of the clients that are allowed, e.g. 10.0.0.0/24. When empty every client not in deny is allowed.",
+		extra:       schemaObject{{"items", schemaObject{{"type", "string"}, {"minLength", 1}}}},
+	},
+	"ClientAccessRule.deny": {
+		description: "CIDRs or addresses of the clients that are denied, even when they are in allow.",
+		extra:       schemaObject{{"items", schemaObject{{"type", "string"}, {"minLength", 1}}}},
+	},
+	"Config.modelTemplates": {
+		description: "A dictionary of reusable model settings. Models inherit them with extends. Templates accept the same settings as a model and can extend other templates.",
+	},
+	"Config.include": {
+		description: "Additional config files or globs merged into this one, relative to the including file. Models, groups, peers, macros, hostMacros and profiles are merged across files; defining the same entry in two files is an error.",
+		extra:       schemaObject{{"items", schemaObject{{"type", "string"}, {"minLength", 1}}}},
+	},
+
+	"ModelConfig.cmd": {
+		description: "Command to run to start the inference server. Macros can be used. Comments allowed with |.",
+		extra:       schemaObject{{"minLength", 1}},
+		noDefault:   true,
+	},
+	"ModelConfig.cmdStop": {
+		description: "Command to run to stop the model gracefully. Uses ${PID} macro for upstream process id. If empty, default shutdown behavior is used.",
+		// the Go default is platform specific
+		extra: schemaObject{{"default", ""}},
+	},
+	"ModelConfig.proxy": {
+		description: "URL where llama-swap routes API requests. If custom port is used in cmd, this must be set.",
+		extra:       schemaObject{{"format", "uri"}},
+	},
+	"ModelConfig.aliases": {
+		description: "Alternative model names for this configuration. Must be unique globally.",
+		extra:       schemaObject{{"items", schemaObject{{"type", "string"}, {"minLength", 1}}}},
+	},
+	"ModelConfig.env": {
+		description: "Array of environment variables to inject into cmd's environment. Each value is a string in ENV_NAME=value format.",
+		extra:       schemaObject{{"items", schemaObject{{"type", "string"}, {"pattern", "^[A-Z_][A-Z0-9_]*=.*$"}}}},
+	},
+	"ModelConfig.checkEndpoint": {
+		description: "URL path to check if the server is ready. Use 'none' to skip health checking.",
+		extra:       schemaObject{{"pattern", "^/.*$|^none$"}},
+	},
+	"ModelConfig.ttl": {
+		description: "Automatically unload the model after ttl seconds. 0 disables unloading. Must be >0 to enable.",
+		extra:       schemaObject{{"minimum", 0}},
+	},
+	"ModelConfig.unlisted": {
+		description: "If true the model will not show up in /v1/models responses. It can still be used as normal in API requests.",
+	},
+	"ModelConfig.useModelName": {
+		description: "Override the model name sent to upstream server. Useful if upstream expects a different name.",
+	},
+	"ModelConfig.name": {
+		description: "Display name for the model. Used in v1/models API response.",
+		extra:       schemaObject{{"maxLength", 128}},
+	},
+	"ModelConfig.description": {
+		description: "Description for the model. Used in v1/models API response.",
+		extra:       schemaObject{{"maxLength", 1024}},
+	},
+	"ModelConfig.concurrencyLimit": {
+		description: "Overrides allowed number of active parallel requests to a model. 0 uses internal default of 10. >0 overrides default. Requests exceeding limit get HTTP 429.",
+		extra:       schemaObject{{"minimum", 0}},
+	},
+	"ModelConfig.filters": {
+		description: "Dictionary of filter settings. Supports stripParams and setParams.",
+		extra:       schemaObject{{"default", schemaObject{}}},
+	},
+	"ModelConfig.macros": {
+		description: "Model level macros, they override global macros with the same name.",
+	},
+	"ModelConfig.metadata": {
+		description: "Dictionary of arbitrary values included in /v1/models, e.g. the recipe a model was created from. Can contain complex types and macros.",
+	},
+	"ModelConfig.sendLoadingState": {
+		description: "Overrides the global sendLoadingState for this model. Omitting this property will use the global setting.",
+	},
+	"ModelConfig.extends": {
+		description: "Name of a modelTemplates entry to inherit settings from. Mappings are merged key by key, lists are appended and other values override the template. Tag a value with !replace to replace the inherited value.",
+	},
+
+	"Filters.stripParams": {
+		description: "Comma separated list of parameters to remove from the request. The model parameter can not be removed.",
+		extra:       schemaObject{{"pattern", "^[a-zA-Z0-9_, ]*$"}},
+	},
+	"Filters.setParams": {
+		description: "Dictionary of parameters to set/override in requests. Protected params like 'model' cannot be overridden. Values can be strings, numbers, booleans, arrays, or objects.",
+	},
+
+	"Filters": {
+		extra: schemaObject{{"additionalProperties", false}},
+	},
+	"ModelFilters": {
+		extra: schemaObject{{"additionalProperties", false}},
+	},
+	"HooksConfig": {
+		extra: schemaObject{{"additionalProperties", false}},
+	},
+	"HookOnStartup": {
+		extra: schemaObject{{"additionalProperties", false}},
+	},
+	"GroupConfig": {
+		extra: schemaObject{{"required", []string{"members"}}},
+	},
+	"GroupConfig.swap": {
+		description: "Controls model swapping behaviour within the group. True: only one model runs at a time. False: all models can run together.",
+	},
+	"GroupConfig.exclusive": {
+		description: "Controls how the group affects other groups. True: causes all other groups to unload when this group runs a model. False: does not affect other groups.",
+	},
+	"GroupConfig.persistent": {
+		description: "Prevents other groups from unloading the models in this group. Does not affect individual model behaviour.",
+	},
+	"GroupConfig.members": {
+		description: "Array of model IDs that are members of this group. Model IDs must be defined in models.",
+	},
+	"GroupConfig.minResidency": {
+		description: "Seconds a model of this group stays loaded before a swap can unload it. Requests that would unload it earlier wait, see maxSwapWait. 0 disables the time limit.",
+		extra:       schemaObject{{"minimum", 0}},
+	},
+	"GroupConfig.minResidencyRequests": {
+		description: "Requests a model of this group serves before a swap can unload it. When set with minResidency, the model can be unloaded as soon as either is reached. 0 disables the request limit.",
+		extra:       schemaObject{{"minimum", 0}},
+	},
+	"GroupConfig.maxSwapWait": {
+		description: "Seconds a request waits for the residency of a model of this group to end. When it would take longer the request is rejected with 503 and a Retry-After header.",
+		extra:       schemaObject{{"minimum", 0}},
+	},
+	"GroupConfig.thrashThreshold": {
+		description: "Emit a warning when more than this many swaps unload models of this group within thrashWindow. 0 disables thrash detection.",
+		extra:       schemaObject{{"minimum", 0}},
+	},
+	"GroupConfig.thrashWindow": {
+		description: "Window in seconds over which swaps are counted for thrashThreshold.",
+		extra:       schemaObject{{"minimum", 1}},
+	},
+
+	"HooksConfig.on_startup": {
+		description: "Actions to perform on startup. Only supported action is preload.",
+	},
+	"HookOnStartup.preload": {
+		description: "List of model IDs to load on startup. Model names must match keys in models. When preloading multiple models, define a group to prevent swapping.",
+	},
+
+	"PeerConfig": {
+		extra: schemaObject{{"required", []string{"proxy", "models"}}},
+	},
+	"PeerConfig.proxy": {
+		description: "A valid base URL to proxy requests to. Requested path to llama-swap will be appended to the end of the proxy value.",
+		extra:       schemaObject{{"format", "uri"}},
+	},
+	"PeerConfig.apiKey": {
+		description: "A string key to be injected into the request. If blank, no key will be added. Key will be injected into headers: Authorization: Bearer <key> and x-api-key: <key>.",
+	},
+	"PeerConfig.models": {
+		description: "A list of models served by the peer.",
+		extra:       schemaObject{{"items", schemaObject{{"type", "string"}, {"minLength", 1}}}},
+	},
+	"PeerConfig.filters": {
+		description: "Dictionary of filter settings for peer requests. Supports stripParams and setParams.",
+		extra:       schemaObject{{"default", schemaObject{}}},
+	},
+}
+
+// macrosSchema is the schema of a MacroList, which is decoded by hand
+var macrosSchema = schemaObject{
+	{"type", "object"},
+	{"additionalProperties", schemaObject{{"oneOf", []any{
+		schemaObject{{"type", "string"}, {"minLength", 0}, {"maxLength", 1024}},
+		schemaObject{{"type", "number"}},
+		schemaObject{{"type", "boolean"}},
+	}}}},
+	{"propertyNames", schemaObject{
+		{"type", "string"},
+		{"minLength", 1},
+		{"maxLength", 64},
+		{"pattern", macroNameRegex.String()},
+		{"not", schemaObject{{"enum", []string{"PORT", "MODEL_ID"}}}},
+	}},
+	{"default", schemaObject{}},
+	{"description", "A dictionary of string substitutions. Macros are reusable snippets used in model cmd, cmdStop, proxy, checkEndpoint, filters.stripParams. Macro names must be <64 chars, match ^[a-zA-Z0-9_-]+$, and not be PORT or MODEL_ID. Values can be string, number, or boolean. Macros can reference other macros defined before them. Supports ${env.VAR:-default}, ${file:/path} and ${expr: <expression>} macros."},
+}
+
+// schemaDefinitions are types emitted once under definitions and referenced
+var schemaDefinitions = map[reflect.Type]string{
+	macroListType:                 "macros",
+	reflect.TypeOf(ModelConfig{}): "modelSettings",
+}
+
+// GenerateJSONSchema returns the JSON schema of the config file, generated
+// from the Config types and schemaDocs. config-schema.json is generated with
+// go generate.
+func GenerateJSONSchema() ([]byte, error) {
+	g := &schemaGenerator{}
+	root := g.object(reflect.TypeOf(Config{}), defaultConfig())
+
+	modelDefaults := ModelConfig{}
+	if err := yaml.Unmarshal([]byte("{}"), &modelDefaults); err != nil {
+		return nil, err
+	}
+
+	schema := schemaObject{
+		{"$schema", "https://json-schema.org/draft-07/schema#"},
+		{"$id", "llama-swap-config-schema.json"},
+		{"title", "llama-swap configuration"},
+	}
+	for _, keyword := range root {
+		if keyword.key == "properties" {
+			schema.set("definitions", schemaObject{
+				{"macros", macrosSchema},
+				{"modelSettings", g.object(reflect.TypeOf(ModelConfig{}), modelDefaults)},
+			})
+		}
+		schema.set(keyword.key, keyword.value)
+	}
+	if len(g.missing) > 0 {
+		return nil, fmt.Errorf("settings without a description in schemaDocs: %s", strings.Join(g.missing, ", "))
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "    ")
+	if err := encoder.Encode(schema); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type schemaGenerator struct {
+	missing []string // settings without documentation
+}
+
+// object returns the schema of a struct type, defaults holds the value of
+// every field when it is not set
+func (g *schemaGenerator) object(typ reflect.Type, defaults any) schemaObject {
+	var schema schemaObject
+	info := schemaDocs[typ.Name()]
+	if info.description != "" {
+		schema.set("description", info.description)
+	}
+	schema.set("type", "object")
+
+	// required settings have no default
+	required := make(map[string]bool)
+	for _, keyword := range info.extra {
+		if names, ok := keyword.value.([]string); ok && keyword.key == "required" {
+			for _, name := range names {
+				required[name] = true
+			}
+		}
+	}
+
+	defaultValue := reflect.ValueOf(defaults)
+	var properties schemaObject
+	for _, field := range yamlFields(typ) {
+		key := field.owner.Name() + "." + field.name
+		fieldInfo, documented := schemaDocs[key]
+		if !documented {
+			g.missing = append(g.missing, key)
+		}
+
+		property := g.property(field.typ, defaultValue.FieldByIndex(field.index))
+		for _, keyword := range fieldInfo.extra {
+			property.set(keyword.key, keyword.value)
+		}
+		if fieldInfo.noDefault || required[field.name] {
+			property.remove("default")
+		}
+		if fieldInfo.description != "" {
+			property.remove("description")
+			property.set("description", fieldInfo.description)
+		}
+		properties = append(properties, schemaKeyword{field.name, property})
+	}
+	for _, keyword := range info.extra {
+		schema.set(keyword.key, keyword.value)
+	}
+	schema.set("properties", properties)
+	return schema
+}
+
+// property returns the schema of a field type with value as its default
+func (g *schemaGenerator) property(typ reflect.Type, value reflect.Value) schemaObject {
+	if name, found := schemaDefinitions[typ]; found {
+		return schemaObject{{"$ref", "#/definitions/" + name}}
+	}
+
+	var schema schemaObject
+	switch typ.Kind() {
+	case reflect.Pointer:
+		// pointers are optional settings without a default
+		return g.property(typ.Elem(), reflect.Value{})
+	case reflect.String:
+		schema = schemaObject{{"type", "string"}}
+	case reflect.Bool:
+		schema = schemaObject{{"type", "boolean"}}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		schema = schemaObject{{"type", "integer"}}
+	case reflect.Float32, reflect.Float64:
+		schema = schemaObject{{"type", "number"}}
+	case reflect.Slice:
+		schema = schemaObject{{"type", "array"}, {"items", g.property(typ.Elem(), reflect.Value{})}}
+		if value.IsValid() {
+			return append(schema, schemaKeyword{"default", []any{}})
+		}
+		return schema
+	case reflect.Map:
+		schema = schemaObject{{"type", "object"}}
+		if elem := g.property(typ.Elem(), reflect.Value{}); len(elem) > 0 {
+			schema.set("additionalProperties", elem)
+		} else {
+			schema.set("additionalProperties", true)
+		}
+		if value.IsValid() {
+			return append(schema, schemaKeyword{"default", schemaObject{}})
+		}
+		return schema
+	case reflect.Struct:
+		var defaults any = reflect.New(typ).Elem().Interface()
+		if value.IsValid() {
+			defaults = value.Interface()
+		}
+		// structs with their own defaults set them when decoding an empty mapping
+		decoded := reflect.New(typ)
+		if err := yaml.Unmarshal([]byte("{}"), decoded.Interface()); err == nil {
+			defaults = decoded.Elem().Interface()
+		}
+		return g.object(typ, defaults)
+	default:
+		// interface values can be anything
+		return schemaObject{}
+	}
+
+	if value.IsValid() {
+		schema = append(schema, schemaKeyword{"default", value.Interface()})
+	}
+	return schema
+}
+
+type yamlField struct {
+	name  string
+	typ   reflect.Type
+	owner reflect.Type // struct declaring the field, differs for inlined fields
+	index []int
+}
+
+// yamlFields returns the fields of a struct type the way yaml decodes them:
+// named by their yaml tag, with inlined structs flattened and ignored fields
+// left out
+func yamlFields(typ reflect.Type) []yamlField {
+	var fields []yamlField
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag := field.Tag.Get("yaml")
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "-" {
+			continue
+		}
+		if options == "inline" {
+			for _, inlined := range yamlFields(field.Type) {
+				inlined.index = append([]int{i}, inlined.index...)
+				fields = append(fields, inlined)
+			}
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields = append(fields, yamlField{name: name, typ: field.Type, owner: typ, index: []int{i}})
+	}
+	return fields
+}
+
+// schemaObject is a JSON object that keeps its keys in order
+type schemaObject []schemaKeyword
+
+type schemaKeyword struct {
+	key   string
+	value any
+}
+
+// set replaces the value of key, or appends it when it is not set
+func (o *schemaObject) set(key string, value any) {
+	for i := range *o {
+		if (*o)[i].key == key {
+			(*o)[i].value = value
+			return
+		}
+	}
+	*o = append(*o, schemaKeyword{key, value})
+}
+
+func (o *schemaObject) remove(key string) {
+	for i := range *o {
+		if (*o)[i].key == key {
+			*o = append((*o)[:i], (*o)[i+1:]...)
+			return
+		}
+	}
+}
+
+func (o schemaObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, keyword := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(keyword.key); err != nil {
+			return nil, err
+		}
+		buf.Truncate(buf.Len() - 1) // Encode adds a newline
+		buf.WriteByte(':')
+		if err := encoder.Encode(keyword.value); err != nil {
+			return nil, err
+		}
+		buf.Truncate(buf.Len() - 1)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONSchema_UpToDate(t *testing.T) {
+	generated, err := GenerateJSONSchema()
+	require.NoError(t, err)
+
+	existing, err := os.ReadFile("../../config-schema.json")
+	require.NoError(t, err)
+	assert.Equal(t, string(generated), string(existing), "config-schema.json is out of date, run: go generate ./proxy/config")
+}
+
+func TestJSONSchema_DocumentsEveryField(t *testing.T) {
+	original := schemaDocs["ModelConfig.extends"]
+	delete(schemaDocs, "ModelConfig.extends")
+	defer func() { schemaDocs["ModelConfig.extends"] = original }()
+
+	_, err := GenerateJSONSchema()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "ModelConfig.extends")
+}
+
+func TestJSONSchema_Contents(t *testing.T) {
+	generated, err := GenerateJSONSchema()
+	require.NoError(t, err)
+
+	var schema map[string]any
+	require.NoError(t, json.Unmarshal(generated, &schema))
+
+	properties := schema["properties"].(map[string]any)
+	for _, field := range yamlFields(reflect.TypeOf(Config{})) {
+		assert.Contains(t, properties, field.name)
+	}
+	assert.NotContains(t, properties, "IncludedFiles")
+	assert.NotContains(t, properties, "IncludeDirs")
+
+	healthCheck := properties["healthCheckTimeout"].(map[string]any)
+	assert.Equal(t, float64(120), healthCheck["default"])
+	assert.Equal(t, float64(15), healthCheck["minimum"])
+
+	modelSettings := schema["definitions"].(map[string]any)["modelSettings"].(map[string]any)["properties"].(map[string]any)
+	assert.Equal(t, "http://localhost:${PORT}", modelSettings["proxy"].(map[string]any)["default"])
+	assert.NotContains(t, modelSettings["sendLoadingState"], "default")
+	assert.NotContains(t, modelSettings["cmd"], "default")
+
+	filters := modelSettings["filters"].(map[string]any)["properties"].(map[string]any)
+	assert.Contains(t, filters, "stripParams")
+	assert.Contains(t, filters, "setParams")
+}
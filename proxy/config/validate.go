@@ -0,0 +1,504 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// ValidationError is a problem found by ValidateConfig. Line and Column are
+// 1-based and zero when the position is not known.
+type ValidationError struct {
+	Severity string `json:"severity"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Path     string `json:"path,omitempty"` // dotted path of the setting, e.g. models.llama.cmd
+	Message  string `json:"message"`
+}
+
+// String formats the error as file:line:column: severity: message
+func (e ValidationError) String() string {
+	var location strings.Builder
+	if e.File != "" {
+		location.WriteString(e.File)
+		if e.Line > 0 {
+			fmt.Fprintf(&location, ":%d", e.Line)
+			if e.Column > 0 {
+				fmt.Fprintf(&location, ":%d", e.Column)
+			}
+		}
+		location.WriteString(": ")
+	}
+	return fmt.Sprintf("%s%s: %s", location.String(), e.Severity, e.Message)
+}
+
+// HasValidationErrors reports if any of the results has error severity
+func HasValidationErrors(results []ValidationError) bool {
+	for _, result := range results {
+		if result.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// configError attaches the location of a setting to an error so
+// ValidateConfig can report where it is. The error message is unchanged.
+type configError struct {
+	file         string   // config file, empty when not known
+	path         []string // path of the setting, e.g. models, llama, cmd
+	line, column int      // position in the file when there is no path
+	err          error
+}
+
+func (e *configError) Error() string {
+	return e.err.Error()
+}
+
+func (e *configError) Unwrap() error {
+	return e.err
+}
+
+// errorAt records that err is about the setting at path
+func errorAt(err error, path ...string) error {
+	return &configError{path: path, err: err}
+}
+
+// errorAtText records that err is about the first occurrence of match in the
+// text of a config file
+func errorAtText(err error, text, match string) error {
+	offset := strings.Index(text, match)
+	if offset < 0 {
+		return err
+	}
+	line := strings.Count(text[:offset], "\n") + 1
+	column := offset - strings.LastIndex(text[:offset], "\n")
+	return &configError{line: line, column: column, err: err}
+}
+
+// fieldPath returns the path of a model field given in dotted form, e.g. filters.stripParams
+func fieldPath(modelId, field string) []string {
+	return append([]string{"models", modelId}, strings.Split(field, ".")...)
+}
+
+// yamlLineRegex finds the line number in errors from the yaml package
+var yamlLineRegex = regexp.MustCompile(`line (\d+)`)
+
+// ValidateConfig checks the config file at path and all of the files it
+// includes. Unlike LoadConfig it does not stop at the first problem: every
+// error is reported with the file, line and column it was found at. Along
+// with the errors LoadConfig would return it warns about unknown settings and
+// checks for problems that only show up at runtime: models whose ports
+// collide, aliases that shadow the models of a peer and models that are not
+// in any group. overlay works as in LoadConfigWithOverlay.
+func ValidateConfig(path string, overlay map[string][]byte) []ValidationError {
+	absPath, data, normalized, err := readConfigWithOverlay(path, overlay)
+	if err != nil {
+		return []ValidationError{{Severity: SeverityError, File: path, Message: err.Error()}}
+	}
+
+	v := &configValidator{positions: make(map[string]nodePosition), fileOrder: make(map[string]int)}
+	resolver := &includeResolver{main: absPath, overlay: normalized, visited: make(map[string]bool)}
+	err = resolver.add(absPath, data)
+	v.indexSources(resolver.sources)
+	if err != nil {
+		v.addError(SeverityError, err, absPath)
+		return v.sorted()
+	}
+
+	for _, source := range resolver.sources {
+		v.checkSource(source)
+	}
+	if HasValidationErrors(v.results) {
+		// decoding errors stop the loader before any of its checks run
+		return v.sorted()
+	}
+
+	config, err := resolver.load(data)
+	if err != nil {
+		v.addError(SeverityError, err, "")
+		return v.sorted()
+	}
+
+	v.templateChains = config.templateChains
+	v.checkPortCollisions(config)
+	v.checkAliasesShadowPeers(config)
+	v.checkUngroupedModels(config)
+	return v.sorted()
+}
+
+type nodePosition struct {
+	file   string
+	line   int
+	column int
+}
+
+type configValidator struct {
+	results   []ValidationError
+	positions map[string]nodePosition // keyed by pathKey
+	fileOrder map[string]int
+
+	// of the loaded config, for the checks that run after loading it
+	templateChains map[string][]string
+}
+
+func pathKey(path []string) string {
+	return strings.Join(path, "\x00")
+}
+
+// indexSources records the position of every setting in the config files
+func (v *configValidator) indexSources(sources []configSource) {
+	for i, source := range sources {
+		v.fileOrder[source.path] = i
+		if source.doc != nil {
+			v.indexNode(source.path, nil, source.doc)
+		}
+	}
+}
+
+func (v *configValidator) indexNode(file string, path []string, node *yaml.Node) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			childPath := append(append([]string{}, path...), key.Value)
+			v.positions[pathKey(childPath)] = nodePosition{file: file, line: key.Line, column: key.Column}
+			v.indexNode(file, childPath, node.Content[i+1])
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			childPath := append(append([]string{}, path...), strconv.Itoa(i))
+			v.positions[pathKey(childPath)] = nodePosition{file: file, line: item.Line, column: item.Column}
+			v.indexNode(file, childPath, item)
+		}
+	}
+}
+
+// position returns the position of path, falling back to the closest parent
+// that is in a config file. Settings inherited from a model template are
+// reported at the model.
+func (v *configValidator) position(path []string) (nodePosition, bool) {
+	for n := len(path); n > 0; n-- {
+		if pos, found := v.positions[pathKey(path[:n])]; found {
+			return pos, true
+		}
+	}
+	return nodePosition{}, false
+}
+
+// add records a result for the setting at path
+func (v *configValidator) add(severity string, path []string, format string, args ...any) {
+	result := ValidationError{Severity: severity, Path: strings.Join(path, "."), Message: fmt.Sprintf(format, args...)}
+	if len(path) >= 3 && path[0] == "models" {
+		if chain, found := v.templateChains[path[1]]; found {
+			result.Message += templateChainSuffix(path[1], chain)
+		}
+	}
+	if pos, found := v.position(path); found {
+		result.File, result.Line, result.Column = pos.file, pos.line, pos.column
+	}
+	v.results = append(v.results, result)
+}
+
+// addError records err and every error joined into it. file is used for
+// errors that carry a yaml line number but no file of their own.
+func (v *configValidator) addError(severity string, err error, file string) {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range joined.Unwrap() {
+			v.addError(severity, e, file)
+		}
+		return
+	}
+
+	// errors are wrapped with the file they are in, collect what every
+	// configError in the chain knows about the location
+	result := ValidationError{Severity: severity, File: file, Message: err.Error()}
+	var path []string
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		located, ok := e.(*configError)
+		if !ok {
+			continue
+		}
+		if located.file != "" && result.File == file {
+			result.File = located.file
+		}
+		if len(located.path) > 0 && path == nil {
+			path = located.path
+		}
+		if located.line > 0 && result.Line == 0 {
+			result.Line, result.Column = located.line, located.column
+		}
+	}
+	if len(path) > 0 {
+		result.Path = strings.Join(path, ".")
+		if pos, found := v.position(path); found && (result.File == "" || pos.file == result.File) {
+			result.File, result.Line, result.Column = pos.file, pos.line, pos.column
+		}
+	}
+	if result.Line == 0 && result.File != "" {
+		if match := yamlLineRegex.FindStringSubmatch(result.Message); match != nil {
+			result.Line, _ = strconv.Atoi(match[1])
+		}
+	}
+	v.results = append(v.results, result)
+}
+
+// sorted returns the results ordered by file, in include order, and position
+func (v *configValidator) sorted() []ValidationError {
+	results := v.results
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.File != b.File {
+			return v.fileOrder[a.File] < v.fileOrder[b.File]
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		if a.Column != b.Column {
+			return a.Column < b.Column
+		}
+		return a.Message < b.Message
+	})
+	if results == nil {
+		results = []ValidationError{}
+	}
+	return results
+}
+
+// checkSource decodes every top level setting, and every entry of the
+// mergeable sections, of a config file separately so that all decoding
+// errors are found, and warns about settings llama-swap does not know.
+func (v *configValidator) checkSource(source configSource) {
+	if source.doc == nil {
+		return
+	}
+	v.checkUnknownKeys(source.path, nil, source.doc, reflect.TypeOf(Config{}))
+
+	for i := 0; i+1 < len(source.doc.Content); i += 2 {
+		key := source.doc.Content[i]
+		value := source.doc.Content[i+1]
+
+		_, mergeable := includeMergeSections[key.Value]
+		if !mergeable || value.Kind != yaml.MappingNode {
+			v.checkDecode(source.path, []string{key.Value}, key, value)
+			continue
+		}
+		for j := 0; j+1 < len(value.Content); j += 2 {
+			entry := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{value.Content[j], value.Content[j+1]}}
+			v.checkDecode(source.path, []string{key.Value, value.Content[j].Value}, key, entry)
+		}
+	}
+}
+
+// checkDecode decodes a single top level key of the config
+func (v *configValidator) checkDecode(file string, path []string, key, value *yaml.Node) {
+	root := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{key, cloneNode(value)}}
+	config := defaultConfig()
+	err := root.Decode(&config)
+	if err == nil {
+		return
+	}
+
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		for _, message := range typeErr.Errors {
+			result := ValidationError{Severity: SeverityError, File: file, Path: strings.Join(path, "."), Message: message}
+			if match := yamlLineRegex.FindStringSubmatch(message); match != nil {
+				result.Line, _ = strconv.Atoi(match[1])
+				result.Message = strings.TrimSpace(strings.TrimPrefix(message, match[0]+":"))
+				result.Column = v.columnAt(file, result.Line)
+			}
+			v.results = append(v.results, result)
+		}
+		return
+	}
+	v.add(SeverityError, path, "%s: %s", strings.Join(path, "."), err.Error())
+}
+
+// columnAt returns the column of the first setting indexed on a line
+func (v *configValidator) columnAt(file string, line int) int {
+	column := 0
+	for _, pos := range v.positions {
+		if pos.file == file && pos.line == line && (column == 0 || pos.column < column) {
+			column = pos.column
+		}
+	}
+	return column
+}
+
+var (
+	macroListType = reflect.TypeOf(MacroList{})
+
+	// legacyKeys are accepted for backwards compatibility but not documented
+	legacyKeys = map[reflect.Type][]string{
+		reflect.TypeOf(ModelFilters{}): {"strip_params"},
+	}
+)
+
+// checkUnknownKeys warns about mapping keys that are not a field of typ
+func (v *configValidator) checkUnknownKeys(file string, path []string, node *yaml.Node, typ reflect.Type) {
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	if node.Kind != yaml.MappingNode || typ == macroListType {
+		return
+	}
+
+	switch typ.Kind() {
+	case reflect.Map:
+		elem := typ.Elem()
+		for elem.Kind() == reflect.Pointer {
+			elem = elem.Elem()
+		}
+		if elem.Kind() != reflect.Struct {
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			v.checkUnknownKeys(file, append(path, node.Content[i].Value), node.Content[i+1], elem)
+		}
+
+	case reflect.Struct:
+		fields := make(map[string]reflect.Type)
+		for _, field := range yamlFields(typ) {
+			fields[field.name] = field.typ
+		}
+		for _, legacy := range legacyKeys[typ] {
+			fields[legacy] = reflect.TypeOf("")
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			keyPath := append(append([]string{}, path...), key.Value)
+			fieldType, known := fields[key.Value]
+			if !known {
+				if len(path) == 0 {
+					v.add(SeverityWarning, keyPath, "unknown setting %s", key.Value)
+				} else {
+					v.add(SeverityWarning, keyPath, "unknown setting %s in %s", key.Value, strings.Join(path, "."))
+				}
+				continue
+			}
+			v.checkUnknownKeys(file, keyPath, node.Content[i+1], fieldType)
+		}
+	}
+}
+
+// checkPortCollisions reports models that listen on the same address and
+// can be running at the same time
+func (v *configValidator) checkPortCollisions(config Config) {
+	modelIds := make([]string, 0, len(config.Models))
+	for modelId := range config.Models {
+		modelIds = append(modelIds, modelId)
+	}
+	sort.Strings(modelIds)
+
+	groupOf := make(map[string]string)
+	for groupId, group := range config.Groups {
+		for _, member := range group.Members {
+			groupOf[member] = groupId
+		}
+	}
+
+	owners := make(map[string][]string)
+	for _, modelId := range modelIds {
+		address, ok := proxyAddress(config.Models[modelId].Proxy)
+		if !ok {
+			continue
+		}
+		for _, other := range owners[address] {
+			if canRunTogether(config, groupOf[other], groupOf[modelId]) {
+				v.add(SeverityError, []string{"models", modelId, "proxy"},
+					"models %s and %s both use %s and can run at the same time", other, modelId, address)
+			}
+		}
+		owners[address] = append(owners[address], modelId)
+	}
+}
+
+// proxyAddress returns the host:port a model's proxy URL points at. Loopback
+// and unspecified hosts are treated as the same host.
+func proxyAddress(proxy string) (string, bool) {
+	u, err := url.Parse(proxy)
+	if err != nil || u.Hostname() == "" {
+		return "", false
+	}
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		default:
+			return "", false
+		}
+	}
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && (ip.IsLoopback() || ip.IsUnspecified())) {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port), true
+}
+
+// canRunTogether reports if models of the two groups can be loaded at the
+// same time. A swapping group runs one model at a time and loading a model of
+// an exclusive group unloads the other groups.
+func canRunTogether(config Config, groupA, groupB string) bool {
+	a, b := config.Groups[groupA], config.Groups[groupB]
+	if groupA == groupB {
+		return !a.Swap
+	}
+	return !a.Exclusive || !b.Exclusive
+}
+
+// checkAliasesShadowPeers warns about aliases that hide a model of a peer,
+// requests for the alias never reach the peer
+func (v *configValidator) checkAliasesShadowPeers(config Config) {
+	peerModels := make(map[string]string)
+	peerIds := make([]string, 0, len(config.Peers))
+	for peerId := range config.Peers {
+		peerIds = append(peerIds, peerId)
+	}
+	sort.Strings(peerIds)
+	for _, peerId := range peerIds {
+		for _, model := range config.Peers[peerId].Models {
+			if _, found := peerModels[model]; !found {
+				peerModels[model] = peerId
+			}
+		}
+	}
+
+	for modelId, model := range config.Models {
+		for i, alias := range model.Aliases {
+			if peerId, found := peerModels[alias]; found {
+				v.add(SeverityWarning, []string{"models", modelId, "aliases", strconv.Itoa(i)},
+					"alias %s of model %s shadows model %s of peer %s", alias, modelId, alias, peerId)
+			}
+		}
+	}
+}
+
+// checkUngroupedModels warns about models that are not a member of any of
+// the configured groups and end up in the default group
+func (v *configValidator) checkUngroupedModels(config Config) {
+	if len(config.Groups) < 2 {
+		// without configured groups every model is in the default group
+		return
+	}
+	for _, modelId := range config.Groups[DEFAULT_GROUP_ID].Members {
+		v.add(SeverityWarning, []string{"models", modelId},
+			"model %s is not a member of any group and is added to the %s group", modelId, DEFAULT_GROUP_ID)
+	}
+}
@@ -0,0 +1,236 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateConfig_Valid(t *testing.T) {
+	dir := t.TempDir()
+	mainPath := writeIncludeTestFile(t, dir, "config.yaml", `
+models:
+  m1:
+    cmd: serve --port ${PORT}
+  m2:
+    cmd: serve --port ${PORT}
+`)
+
+	results := ValidateConfig(mainPath, nil)
+	assert.Empty(t, results)
+	assert.False(t, HasValidationErrors(results))
+}
+
+func TestValidateConfig_ReportsEveryError(t *testing.T) {
+	dir := t.TempDir()
+	mainPath := writeIncludeTestFile(t, dir, "config.yaml", `healthCheckTimeout: 5
+logToStdout: sometimes
+include: ["models.yaml"]
+macros:
+  PORT: 1234
+models:
+  m1:
+    cmd: serve ${unknown}
+    proxy: http://localhost:9000
+`)
+	includePath := writeIncludeTestFile(t, dir, "models.yaml", `models:
+  m2:
+    cmd: serve --port ${PORT}
+    checkEndpoint: ${missing}
+apiKeys:
+  - ""
+`)
+
+	results := ValidateConfig(mainPath, nil)
+	require.True(t, HasValidationErrors(results))
+
+	expected := []ValidationError{
+		{Severity: SeverityError, File: mainPath, Line: 1, Column: 1, Path: "healthCheckTimeout", Message: "healthCheckTimeout must be greater than or equal to 15"},
+		{Severity: SeverityError, File: mainPath, Line: 2, Column: 1, Path: "logToStdout", Message: "logToStdout must be one of: proxy, upstream, both, none"},
+		{Severity: SeverityError, File: mainPath, Line: 5, Column: 3, Path: "macros.PORT", Message: "macro name 'PORT' is reserved"},
+		{Severity: SeverityError, File: mainPath, Line: 8, Column: 5, Path: "models.m1.cmd", Message: "unknown macro '${unknown}' found in m1.cmd"},
+		{Severity: SeverityError, File: includePath, Line: 4, Column: 5, Path: "models.m2.checkEndpoint", Message: "unknown macro '${missing}' found in m2.checkEndpoint"},
+		{Severity: SeverityError, File: includePath, Line: 6, Column: 5, Path: "apiKeys.0", Message: "empty api key found in apiKeys"},
+	}
+	assert.Equal(t, expected, results)
+}
+
+func TestValidateConfig_DecodeErrors(t *testing.T) {
+	dir := t.TempDir()
+	mainPath := writeIncludeTestFile(t, dir, "config.yaml", `startPort: abc
+models:
+  m1:
+    cmd: serve
+    ttl: soon
+    cmdd: typo
+  m2:
+    cmd: serve
+    aliases: "not-a-list"
+peers:
+  remote:
+    models: ["x"]
+`)
+
+	results := ValidateConfig(mainPath, nil)
+	require.Len(t, results, 5)
+
+	assert.Equal(t, 1, results[0].Line)
+	assert.Equal(t, "startPort", results[0].Path)
+	assert.Contains(t, results[0].Message, "cannot unmarshal !!str `abc` into int")
+
+	assert.Equal(t, 5, results[1].Line)
+	assert.Equal(t, 5, results[1].Column)
+	assert.Contains(t, results[1].Message, "cannot unmarshal !!str `soon` into int")
+
+	assert.Equal(t, ValidationError{Severity: SeverityWarning, File: mainPath, Line: 6, Column: 5, Path: "models.m1.cmdd", Message: "unknown setting cmdd in models.m1"}, results[2])
+
+	assert.Equal(t, 9, results[3].Line)
+	assert.Equal(t, "models.m2", results[3].Path)
+
+	assert.Equal(t, ValidationError{Severity: SeverityError, File: mainPath, Line: 11, Column: 3, Path: "peers.remote", Message: "peers.remote: proxy is required"}, results[4])
+}
+
+func TestValidateConfig_SyntaxError(t *testing.T) {
+	dir := t.TempDir()
+	mainPath := writeIncludeTestFile(t, dir, "config.yaml", "include: [\"bad.yaml\"]\n")
+	badPath := writeIncludeTestFile(t, dir, "bad.yaml", "models:\n  m1:\n    cmd: [\n")
+
+	results := ValidateConfig(mainPath, nil)
+	require.Len(t, results, 1)
+	assert.Equal(t, SeverityError, results[0].Severity)
+	assert.Equal(t, badPath, results[0].File)
+	assert.Equal(t, 3, results[0].Line)
+	assert.Contains(t, results[0].Message, "bad.yaml: yaml: line 3")
+}
+
+func TestValidateConfig_DuplicateAcrossIncludes(t *testing.T) {
+	dir := t.TempDir()
+	mainPath := writeIncludeTestFile(t, dir, "config.yaml", `include: ["a.yaml"]
+models:
+  m1:
+    cmd: serve
+    proxy: http://localhost:9000
+`)
+	includePath := writeIncludeTestFile(t, dir, "a.yaml", `models:
+  m1:
+    cmd: serve
+    proxy: http://localhost:9001
+`)
+
+	results := ValidateConfig(mainPath, nil)
+	require.Len(t, results, 1)
+	assert.Equal(t, includePath, results[0].File)
+	assert.Equal(t, 2, results[0].Line)
+	assert.Equal(t, "models.m1", results[0].Path)
+	assert.Contains(t, results[0].Message, "duplicate model m1 found in")
+}
+
+func TestValidateConfig_TemplateErrorsPointAtModel(t *testing.T) {
+	dir := t.TempDir()
+	mainPath := writeIncludeTestFile(t, dir, "config.yaml", `modelTemplates:
+  base:
+    cmd: serve ${model_file}
+models:
+  m1:
+    extends: base
+    proxy: http://localhost:9000
+`)
+
+	results := ValidateConfig(mainPath, nil)
+	require.Len(t, results, 1)
+	assert.Equal(t, 5, results[0].Line)
+	assert.Equal(t, "models.m1.cmd", results[0].Path)
+	assert.Contains(t, results[0].Message, "(model m1 extends modelTemplates.base)")
+}
+
+func TestValidateConfig_SemanticChecksNameTemplate(t *testing.T) {
+	dir := t.TempDir()
+	mainPath := writeIncludeTestFile(t, dir, "config.yaml", `modelTemplates:
+  base:
+    cmd: serve
+    proxy: http://localhost:9000
+models:
+  a:
+    cmd: serve
+    proxy: http://localhost:9000
+  b:
+    extends: base
+groups:
+  together:
+    swap: false
+    members: ["a", "b"]
+`)
+
+	results := ValidateConfig(mainPath, nil)
+	var messages []string
+	for _, result := range results {
+		if result.Path == "models.b.proxy" {
+			messages = append(messages, result.Message)
+		}
+	}
+	require.NotEmpty(t, messages)
+	for _, message := range messages {
+		assert.Contains(t, message, "(model b extends modelTemplates.base)")
+	}
+}
+
+func TestValidateConfig_SemanticChecks(t *testing.T) {
+	dir := t.TempDir()
+	mainPath := writeIncludeTestFile(t, dir, "config.yaml", `models:
+  a:
+    cmd: serve
+    proxy: http://127.0.0.1:9000
+  b:
+    cmd: serve
+    proxy: http://localhost:9000
+  c:
+    cmd: serve
+    proxy: http://localhost:9000
+  d:
+    cmd: serve
+    proxy: http://localhost:9000
+  e:
+    cmd: serve
+    proxy: http://localhost:9100
+    aliases: ["gpt-4o"]
+groups:
+  swapping:
+    members: ["a", "b"]
+  together:
+    swap: false
+    exclusive: false
+    members: ["c"]
+peers:
+  openai:
+    proxy: https://api.openai.com
+    models: ["gpt-4o"]
+`)
+
+	results := ValidateConfig(mainPath, nil)
+	var messages []string
+	for _, result := range results {
+		messages = append(messages, result.String())
+	}
+
+	// a and b swap, a and d are both in exclusive groups so only c collides
+	assert.Equal(t, []string{
+		mainPath + ":10:5: error: models a and c both use localhost:9000 and can run at the same time",
+		mainPath + ":10:5: error: models b and c both use localhost:9000 and can run at the same time",
+		mainPath + ":11:3: warning: model d is not a member of any group and is added to the (default) group",
+		mainPath + ":13:5: error: models c and d both use localhost:9000 and can run at the same time",
+		mainPath + ":14:3: warning: model e is not a member of any group and is added to the (default) group",
+		mainPath + ":17:15: warning: alias gpt-4o of model e shadows model gpt-4o of peer openai",
+	}, messages)
+}
+
+func TestValidateConfig_Overlay(t *testing.T) {
+	dir := t.TempDir()
+	mainPath := writeIncludeTestFile(t, dir, "config.yaml", "models:\n  m1:\n    cmd: serve\n    proxy: http://localhost:9000\n")
+
+	results := ValidateConfig(mainPath, map[string][]byte{
+		mainPath: []byte("models:\n  m1:\n    cmd: serve ${nope}\n    proxy: http://localhost:9000\n"),
+	})
+	require.Len(t, results, 1)
+	assert.Equal(t, 3, results[0].Line)
+}
@@ -1,7 +1,6 @@
 package proxy
 
 import (
-	"bytes"
 	"fmt"
 	"net/http"
 	"os"
@@ -38,7 +37,14 @@ func (pm *ProxyManager) apiSaveConfigEditor(c *gin.Context) {
 		return
 	}
 
-	parsedConfig, err := config.LoadConfigFromReader(bytes.NewReader([]byte(req.Content)))
+	configPath, err := pm.getConfigPath()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// validate together with any included files
+	parsedConfig, err := config.LoadConfigWithOverlay(configPath, map[string][]byte{configPath: []byte(req.Content)})
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": fmt.Sprintf("invalid config: %v", err),
@@ -53,12 +59,6 @@ func (pm *ProxyManager) apiSaveConfigEditor(c *gin.Context) {
 		return
 	}
 
-	configPath, err := pm.getConfigPath()
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
 	if err := writeConfigRawFile(configPath, []byte(req.Content)); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": fmt.Sprintf("failed to write config: %v", err),
@@ -82,6 +82,40 @@ func (pm *ProxyManager) apiSaveConfigEditor(c *gin.Context) {
 	c.JSON(http.StatusOK, state)
 }
 
+type configValidateResponse struct {
+	Valid   bool                     `json:"valid"`
+	Results []config.ValidationError `json:"results"`
+}
+
+// apiValidateConfig checks the config file and its includes and reports every
+// problem with its file, line and column. When the body has content it is
+// validated in place of the config file, like a save from the editor would be.
+func (pm *ProxyManager) apiValidateConfig(c *gin.Context) {
+	var req configEditorUpdateRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON body"})
+			return
+		}
+	}
+
+	configPath, err := pm.getConfigPath()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var overlay map[string][]byte
+	if req.Content != "" {
+		overlay = map[string][]byte{configPath: []byte(req.Content)}
+	}
+	results := config.ValidateConfig(configPath, overlay)
+	c.JSON(http.StatusOK, configValidateResponse{
+		Valid:   !config.HasValidationErrors(results),
+		Results: results,
+	})
+}
+
 func (pm *ProxyManager) readConfigEditorState() (configEditorState, error) {
 	configPath, err := pm.getConfigPath()
 	if err != nil {
@@ -74,3 +74,44 @@ func quoteJSONString(s string) string {
 	b.WriteByte('"')
 	return b.String()
 }
+
+func TestConfigEditorAPI_Validate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	root := t.TempDir()
+	cfgPath := filepath.Join(root, "config.yaml")
+	if err := os.WriteFile(cfgPath, []byte("models:\n  m1:\n    cmd: serve\n    proxy: http://127.0.0.1:9001\n"), 0o644); err != nil {
+		t.Fatalf("write initial config: %v", err)
+	}
+
+	pm := &ProxyManager{configPath: cfgPath}
+	router := gin.New()
+	router.POST("/api/config/validate", pm.apiValidateConfig)
+
+	// the config on disk
+	req := httptest.NewRequest(http.MethodPost, "/api/config/validate", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), `"valid":true`) {
+		t.Fatalf("expected valid config, got body=%s", rec.Body.String())
+	}
+
+	// unsaved content from the editor
+	content := "models:\n  m1:\n    cmd: serve ${missing}\n    proxy: http://127.0.0.1:9001\n"
+	body := []byte(`{"content":` + quoteJSONString(content) + `}`)
+	req = httptest.NewRequest(http.MethodPost, "/api/config/validate", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	for _, want := range []string{`"valid":false`, `"line":3`, `"column":5`, `"path":"models.m1.cmd"`, "unknown macro '${missing}'"} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Fatalf("expected %s in body=%s", want, rec.Body.String())
+		}
+	}
+}
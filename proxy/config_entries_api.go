@@ -0,0 +1,334 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mostlygeek/llama-swap/event"
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"gopkg.in/yaml.v3"
+)
+
+// configEntrySections are the config sections whose entries can be edited
+// one at a time through /api/config/<section>
+var configEntrySections = []string{"models", "groups", "macros", "peers"}
+
+// configEntriesMu serializes read-modify-write cycles on the config files
+var configEntriesMu sync.Mutex
+
+var (
+	errConfigEntryNotFound = errors.New("not found")
+	errConfigEntryExists   = errors.New("already exists")
+)
+
+// configEntry is a single model, group, macro or peer as written in the
+// config, before macros are expanded
+type configEntry struct {
+	Name  string          `json:"name"`
+	File  string          `json:"file"`
+	Value json.RawMessage `json:"value"`
+}
+
+// configEntryFile is a parsed config file holding, or about to hold, an entry
+type configEntryFile struct {
+	path    string
+	raw     []byte
+	doc     *yaml.Node
+	section *yaml.Node
+}
+
+func (pm *ProxyManager) apiListConfigEntries(section string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		configPath, err := pm.getConfigPath()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		entries, err := listConfigEntries(configPath, section)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, entries)
+	}
+}
+
+func (pm *ProxyManager) apiGetConfigEntry(section string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name, configPath, ok := pm.configEntryRequest(c)
+		if !ok {
+			return
+		}
+		file, err := findConfigEntry(configPath, section, name)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if file == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("%s %s not found", sectionItem(section), name)})
+			return
+		}
+		entry, err := file.entry(name)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, entry)
+	}
+}
+
+// apiCreateConfigEntry adds a new entry to the main config file
+func (pm *ProxyManager) apiCreateConfigEntry(section string) gin.HandlerFunc {
+	return pm.configEntryWriteHandler(section, http.StatusCreated, func(file *configEntryFile, name string, value *yaml.Node) error {
+		if mappingEntry(file.section, name) >= 0 {
+			return errConfigEntryExists
+		}
+		file.section.Content = append(file.section.Content, yamlKey(name), value)
+		return nil
+	})
+}
+
+// apiUpdateConfigEntry replaces an entry in the file that defines it. Only
+// the settings that change are rewritten.
+func (pm *ProxyManager) apiUpdateConfigEntry(section string) gin.HandlerFunc {
+	return pm.configEntryWriteHandler(section, http.StatusOK, func(file *configEntryFile, name string, value *yaml.Node) error {
+		i := mappingEntry(file.section, name)
+		if i < 0 {
+			return errConfigEntryNotFound
+		}
+		current := file.section.Content[i+1]
+		guard := guardYAMLAliases(file.doc, current)
+		mergeYAMLNode(current, value)
+		guard.restore(false)
+		return nil
+	})
+}
+
+func (pm *ProxyManager) apiDeleteConfigEntry(section string) gin.HandlerFunc {
+	return pm.configEntryWriteHandler(section, http.StatusOK, func(file *configEntryFile, name string, _ *yaml.Node) error {
+		i := mappingEntry(file.section, name)
+		if i < 0 {
+			return errConfigEntryNotFound
+		}
+		guard := guardYAMLAliases(file.doc, file.section.Content[i+1])
+		file.section.Content = append(file.section.Content[:i], file.section.Content[i+2:]...)
+		guard.restore(true)
+		return nil
+	})
+}
+
+// configEntryWriteHandler runs edit against the file holding the named entry,
+// or the main config file when no file has it yet. The edited file is
+// validated together with the rest of the config before it is written and
+// the new config is applied.
+func (pm *ProxyManager) configEntryWriteHandler(section string, status int, edit func(file *configEntryFile, name string, value *yaml.Node) error) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name, configPath, ok := pm.configEntryRequest(c)
+		if !ok {
+			return
+		}
+
+		var value *yaml.Node
+		if c.Request.Method != http.MethodDelete {
+			raw, err := c.GetRawData()
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if value, err = jsonToYAMLNode(raw); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON body"})
+				return
+			}
+		}
+
+		configEntriesMu.Lock()
+		defer configEntriesMu.Unlock()
+
+		file, err := findConfigEntry(configPath, section, name)
+		if err == nil && file == nil {
+			file, err = loadConfigEntryFile(configPath, section, true)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := edit(file, name, value); err != nil {
+			switch {
+			case errors.Is(err, errConfigEntryNotFound):
+				c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("%s %s not found", sectionItem(section), name)})
+			case errors.Is(err, errConfigEntryExists):
+				c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("%s %s already exists", sectionItem(section), name)})
+			default:
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		rendered, err := encodeConfigDocument(file.doc)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		rendered = restoreBlankLines(file.raw, rendered)
+		loaded, err := writeValidatedConfigFile(configPath, file.path, rendered)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		pm.applyConfigAndSyncProcessGroups(loaded)
+		event.Emit(ConfigFileChangedEvent{ReloadingState: ReloadingStateEnd})
+
+		if value == nil {
+			c.JSON(status, gin.H{"name": name, "file": file.path})
+			return
+		}
+		entry, err := file.entry(name)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(status, entry)
+	}
+}
+
+// configEntryRequest returns the entry name from the URL and the config path
+func (pm *ProxyManager) configEntryRequest(c *gin.Context) (string, string, bool) {
+	name := strings.TrimPrefix(c.Param("name"), "/")
+	if strings.TrimSpace(name) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return "", "", false
+	}
+	configPath, err := pm.getConfigPath()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return "", "", false
+	}
+	return name, configPath, true
+}
+
+func sectionItem(section string) string {
+	return strings.TrimSuffix(section, "s")
+}
+
+// listConfigEntries returns every entry of section in the order the config
+// files and their includes define them
+func listConfigEntries(configPath, section string) ([]configEntry, error) {
+	files, err := config.ConfigFiles(configPath)
+	if err != nil {
+		return nil, err
+	}
+	entries := []configEntry{}
+	for _, path := range files {
+		file, err := loadConfigEntryFile(path, section, false)
+		if err != nil {
+			return nil, err
+		}
+		if file.section == nil {
+			continue
+		}
+		for i := 0; i+1 < len(file.section.Content); i += 2 {
+			entry, err := file.entry(file.section.Content[i].Value)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// findConfigEntry returns the config file that defines name in section, or
+// nil when no file does
+func findConfigEntry(configPath, section, name string) (*configEntryFile, error) {
+	files, err := config.ConfigFiles(configPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range files {
+		file, err := loadConfigEntryFile(path, section, false)
+		if err != nil {
+			return nil, err
+		}
+		if file.section != nil && mappingEntry(file.section, name) >= 0 {
+			return file, nil
+		}
+	}
+	return nil, nil
+}
+
+// loadConfigEntryFile parses the config file at path. With create set a
+// missing section is added to it.
+func loadConfigEntryFile(path, section string, create bool) (*configEntryFile, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	doc, err := parseConfigDocument(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	sectionNode, err := yamlSection(doc.Content[0], section, create)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &configEntryFile{path: path, raw: raw, doc: doc, section: sectionNode}, nil
+}
+
+func (f *configEntryFile) entry(name string) (configEntry, error) {
+	i := mappingEntry(f.section, name)
+	if i < 0 {
+		return configEntry{}, errConfigEntryNotFound
+	}
+	value, err := yamlNodeToJSON(f.section.Content[i+1])
+	if err != nil {
+		return configEntry{}, err
+	}
+	return configEntry{Name: name, File: f.path, Value: value}, nil
+}
+
+// writeValidatedConfigFile writes rendered to targetPath, which is either the
+// main config or one of its includes, after validating it as part of the full
+// config loaded from configPath. It returns the config that was validated.
+func writeValidatedConfigFile(configPath, targetPath string, rendered []byte) (config.Config, error) {
+	loaded, err := config.LoadConfigWithOverlay(configPath, map[string][]byte{targetPath: rendered})
+	if err != nil {
+		return config.Config{}, fmt.Errorf("generated config is invalid: %w", err)
+	}
+	absConfig, err := filepath.Abs(configPath)
+	if err != nil {
+		return config.Config{}, err
+	}
+	absTarget, err := filepath.Abs(targetPath)
+	if err != nil {
+		return config.Config{}, err
+	}
+	if absTarget != absConfig {
+		if !slices.Contains(loaded.IncludedFiles, absTarget) {
+			return config.Config{}, fmt.Errorf("%s is not included from %s, add it to include:", targetPath, configPath)
+		}
+		if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+			return config.Config{}, err
+		}
+	}
+	loaded = normalizeLegacyVLLMConfigCommands(loaded)
+	if err := validateConfigModelShellCommands(loaded); err != nil {
+		return config.Config{}, fmt.Errorf("generated config has invalid launcher command: %w", err)
+	}
+
+	tmp := targetPath + ".tmp"
+	if err := os.WriteFile(tmp, rendered, 0600); err != nil {
+		return config.Config{}, err
+	}
+	return loaded, os.Rename(tmp, targetPath)
+}
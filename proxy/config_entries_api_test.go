@@ -0,0 +1,274 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+const configEntriesTestConfig = `# main config
+macros:
+  # the server binary
+  server: /opt/llama-server
+  port_base: 9001
+
+models:
+  # first model, keep it fast
+  m1: &base
+    cmd: ${server} --model m1.gguf # inline note
+    proxy: http://127.0.0.1:${port_base}
+    ttl: 30
+  # shares settings with m1
+  m2:
+    <<: *base
+    cmd: ${server} --model m2.gguf
+
+groups:
+  main:
+    swap: true
+    members: [m1, m2]
+`
+
+func newConfigEntriesTestServer(t *testing.T, content string) (*gin.Engine, string) {
+	t.Helper()
+
+	cfgPath := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(cfgPath, []byte(content), 0o644))
+
+	pm := &ProxyManager{
+		configPath:     cfgPath,
+		processGroups:  map[string]*ProcessGroup{},
+		proxyLogger:    NewLogMonitorWriter(io.Discard),
+		upstreamLogger: NewLogMonitorWriter(io.Discard),
+	}
+	router := gin.New()
+	for _, section := range configEntrySections {
+		router.GET("/api/config/"+section, pm.apiListConfigEntries(section))
+		router.GET("/api/config/"+section+"/*name", pm.apiGetConfigEntry(section))
+		router.POST("/api/config/"+section+"/*name", pm.apiCreateConfigEntry(section))
+		router.PUT("/api/config/"+section+"/*name", pm.apiUpdateConfigEntry(section))
+		router.DELETE("/api/config/"+section+"/*name", pm.apiDeleteConfigEntry(section))
+	}
+	return router, cfgPath
+}
+
+func doConfigEntryRequest(router *gin.Engine, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func readConfigFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestConfigEntriesAPI_Get(t *testing.T) {
+	router, cfgPath := newConfigEntriesTestServer(t, configEntriesTestConfig)
+
+	rec := doConfigEntryRequest(router, http.MethodGet, "/api/config/models", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var entries []configEntry
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &entries))
+	require.Len(t, entries, 2)
+	assert.Equal(t, "m1", entries[0].Name)
+	assert.Equal(t, cfgPath, entries[0].File)
+	assert.JSONEq(t, `{"cmd":"${server} --model m1.gguf","proxy":"http://127.0.0.1:${port_base}","ttl":30}`, string(entries[0].Value))
+	// settings keep the order of the file
+	assert.Equal(t, `{"cmd":"${server} --model m1.gguf","proxy":"http://127.0.0.1:${port_base}","ttl":30}`, string(entries[0].Value))
+	// merge keys are resolved
+	assert.JSONEq(t, `{"cmd":"${server} --model m2.gguf","proxy":"http://127.0.0.1:${port_base}","ttl":30}`, string(entries[1].Value))
+
+	rec = doConfigEntryRequest(router, http.MethodGet, "/api/config/macros/port_base", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.JSONEq(t, `{"name":"port_base","file":"`+cfgPath+`","value":9001}`, rec.Body.String())
+
+	rec = doConfigEntryRequest(router, http.MethodGet, "/api/config/peers/missing", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Contains(t, rec.Body.String(), "peer missing not found")
+}
+
+func TestConfigEntriesAPI_UpdateKeepsComments(t *testing.T) {
+	router, cfgPath := newConfigEntriesTestServer(t, configEntriesTestConfig)
+
+	rec := doConfigEntryRequest(router, http.MethodPut, "/api/config/models/m2",
+		`{"cmd":"${server} --model m2.gguf --ctx-size 8192","proxy":"http://127.0.0.1:${port_base}","ttl":30}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	assert.Equal(t, `# main config
+macros:
+  # the server binary
+  server: /opt/llama-server
+  port_base: 9001
+
+models:
+  # first model, keep it fast
+  m1: &base
+    cmd: ${server} --model m1.gguf # inline note
+    proxy: http://127.0.0.1:${port_base}
+    ttl: 30
+  # shares settings with m1
+  m2:
+    <<: *base
+    cmd: ${server} --model m2.gguf --ctx-size 8192
+
+groups:
+  main:
+    swap: true
+    members: [m1, m2]
+`, readConfigFile(t, cfgPath))
+
+	// changing m1 must not change m2, which inherits from it
+	rec = doConfigEntryRequest(router, http.MethodPut, "/api/config/models/m1",
+		`{"cmd":"${server} --model m1.gguf # inline note","proxy":"http://127.0.0.1:${port_base}","ttl":60}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	content := readConfigFile(t, cfgPath)
+	assert.Contains(t, content, "  # first model, keep it fast\n  m1: &base\n")
+	assert.Contains(t, content, "    ttl: 60\n")
+	assert.NotContains(t, content, "*base")
+
+	rec = doConfigEntryRequest(router, http.MethodGet, "/api/config/models/m2", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), `"ttl":30`)
+}
+
+func TestConfigEntriesAPI_CreateAndDelete(t *testing.T) {
+	router, cfgPath := newConfigEntriesTestServer(t, configEntriesTestConfig)
+
+	rec := doConfigEntryRequest(router, http.MethodPost, "/api/config/models/org/m3",
+		`{"cmd":"${server} --model m3.gguf","proxy":"http://127.0.0.1:9003","aliases":["m3"]}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	assert.Contains(t, readConfigFile(t, cfgPath), `
+  org/m3:
+    cmd: ${server} --model m3.gguf
+    proxy: http://127.0.0.1:9003
+    aliases:
+      - m3
+`)
+
+	rec = doConfigEntryRequest(router, http.MethodPost, "/api/config/models/org/m3", `{"cmd":"x","proxy":"http://127.0.0.1:9004"}`)
+	assert.Equal(t, http.StatusConflict, rec.Code, rec.Body.String())
+
+	rec = doConfigEntryRequest(router, http.MethodPost, "/api/config/peers/remote",
+		`{"proxy":"http://10.0.0.2:8080","models":["big"]}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	assert.True(t, strings.HasSuffix(readConfigFile(t, cfgPath), "peers:\n  remote:\n    proxy: http://10.0.0.2:8080\n    models:\n      - big\n"))
+
+	// m2 inherits from m1, so it gets a copy of the settings
+	rec = doConfigEntryRequest(router, http.MethodPut, "/api/config/groups/main", `{"swap":true,"members":["m2"]}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = doConfigEntryRequest(router, http.MethodDelete, "/api/config/models/m1", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	content := readConfigFile(t, cfgPath)
+	assert.NotContains(t, content, "m1:")
+	assert.NotContains(t, content, "*base")
+	rec = doConfigEntryRequest(router, http.MethodGet, "/api/config/models/m2", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.JSONEq(t, `{"cmd":"${server} --model m2.gguf","proxy":"http://127.0.0.1:${port_base}","ttl":30}`, entryValue(t, rec.Body.Bytes()))
+
+	rec = doConfigEntryRequest(router, http.MethodDelete, "/api/config/models/m1", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func entryValue(t *testing.T, body []byte) string {
+	t.Helper()
+	var entry configEntry
+	require.NoError(t, json.Unmarshal(body, &entry))
+	return string(entry.Value)
+}
+
+func TestConfigEntriesAPI_RejectsInvalidConfig(t *testing.T) {
+	router, cfgPath := newConfigEntriesTestServer(t, configEntriesTestConfig)
+
+	tests := []struct {
+		name, method, path, body, want string
+	}{
+		{"unknown macro", http.MethodPut, "/api/config/models/m2", `{"cmd":"${nope}","proxy":"http://127.0.0.1:9002"}`, "unknown macro"},
+		{"model in two groups", http.MethodPost, "/api/config/groups/other", `{"members":["m1"]}`, "used in multiple groups"},
+		{"macro still in use", http.MethodDelete, "/api/config/macros/server", "", "server"},
+		{"invalid JSON", http.MethodPut, "/api/config/models/m2", `{"cmd":`, "invalid JSON body"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := readConfigFile(t, cfgPath)
+			rec := doConfigEntryRequest(router, tt.method, tt.path, tt.body)
+			assert.Equal(t, http.StatusBadRequest, rec.Code, rec.Body.String())
+			assert.Contains(t, rec.Body.String(), tt.want)
+			assert.Equal(t, before, readConfigFile(t, cfgPath))
+		})
+	}
+}
+
+func TestConfigEntriesAPI_EditsInclude(t *testing.T) {
+	router, cfgPath := newConfigEntriesTestServer(t, "include: [models.yaml]\nmodels:\n  m1:\n    cmd: serve m1\n    proxy: http://127.0.0.1:9001\n")
+	includePath := filepath.Join(filepath.Dir(cfgPath), "models.yaml")
+	require.NoError(t, os.WriteFile(includePath, []byte("models:\n  # from the include\n  m2:\n    cmd: serve m2\n    proxy: http://127.0.0.1:9002\n"), 0o644))
+
+	rec := doConfigEntryRequest(router, http.MethodPut, "/api/config/models/m2", `{"cmd":"serve m2 --fast","proxy":"http://127.0.0.1:9002"}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), `"file":"`+includePath+`"`)
+	assert.Equal(t, "models:\n  # from the include\n  m2:\n    cmd: serve m2 --fast\n    proxy: http://127.0.0.1:9002\n", readConfigFile(t, includePath))
+	assert.NotContains(t, readConfigFile(t, cfgPath), "m2")
+}
+
+func TestMergeYAMLNode(t *testing.T) {
+	parse := func(s string) *yaml.Node {
+		doc, err := parseConfigDocument([]byte(s))
+		require.NoError(t, err)
+		return doc
+	}
+
+	tests := []struct {
+		name, dst, src, want string
+	}{
+		{
+			name: "unchanged values keep their style",
+			dst:  "a: 'x' # note\nb: [1, 2]\n",
+			src:  "a: x\nb: [1, 2]\n",
+			want: "a: 'x' # note\nb: [1, 2]\n",
+		},
+		{
+			name: "removed and added keys",
+			dst:  "a: 1 # gone\n# kept\nb: 2\n",
+			src:  "b: 3\nc: 4\n",
+			want: "# kept\nb: 3\nc: 4\n",
+		},
+		{
+			name: "merge key kept while every inherited key is wanted",
+			dst:  "base: &b {x: 1, y: 2}\nm:\n  <<: *b\n  z: 3\n",
+			src:  "base: {x: 1, y: 2}\nm: {x: 1, y: 5, z: 3}\n",
+			want: "base: &b {x: 1, y: 2}\nm:\n  <<: *b\n  z: 3\n  y: 5\n",
+		},
+		{
+			name: "merge key dropped when an inherited key is removed",
+			dst:  "base: &b {x: 1, y: 2}\nm:\n  <<: *b\n  z: 3\n",
+			src:  "base: {x: 1, y: 2}\nm: {x: 1, z: 3}\n",
+			want: "base: &b {x: 1, y: 2}\nm:\n  z: 3\n  x: 1\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := parse(tt.dst)
+			mergeYAMLNode(dst.Content[0], parse(tt.src).Content[0])
+			out, err := encodeConfigDocument(dst)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(out))
+		})
+	}
+}
@@ -39,7 +39,26 @@ func (pm *ProxyManager) applyConfigAndSyncProcessGroups(newConfig config.Config)
 
 	pm.config = newConfig
 	pm.processGroups = nextGroups
+	// revoked or changed keys must not keep their old permissions
+	pm.accessMu.Lock()
+	pm.apiKeys = newAPIKeyEntries(newConfig)
+	if pm.quotas != nil {
+		quotas, err := pm.quotas.rebuild(newConfig.APIKeyIdentities, pm.metricsStore)
+		if err != nil {
+			pm.proxyLogger.Errorf("Failed to restore quota usage from the metrics store: %v", err)
+		}
+		pm.quotas = quotas
+		pm.quotaIdentities = newConfig.APIKeyIdentities
+	}
+	pm.splits = pm.splits.rebuild(newConfig.Splits)
+	pm.accessMu.Unlock()
 	pm.Unlock()
+	if pm.rateLimits != nil {
+		pm.rateLimits.update(newConfig.RateLimits)
+	}
+	if pm.clientAccess != nil {
+		pm.clientAccess.update(newConfig.ClientAccess)
+	}
 
 	for _, process := range processesToShutdown {
 		process.Shutdown()
@@ -0,0 +1,420 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The helpers in this file edit a config file as a yaml.Node tree instead of
+// round-tripping it through map[string]any. Only the parts of the tree that
+// actually change are rewritten, so comments, anchors, aliases, key order and
+// quoting in hand written configs survive an edit.
+
+// parseConfigDocument parses raw into a document node whose content is a
+// single mapping. An empty file, or one holding only comments, becomes an
+// empty mapping.
+func parseConfigDocument(raw []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Kind == 0 {
+		doc.Kind = yaml.DocumentNode
+	}
+	if len(doc.Content) == 0 {
+		doc.Content = []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}
+	}
+	if doc.Content[0].Kind != yaml.MappingNode {
+		return nil, errors.New("config root is not a mapping")
+	}
+	return &doc, nil
+}
+
+// encodeConfigDocument renders doc using the same layout as marshalConfigRawMap
+func encodeConfigDocument(doc *yaml.Node) ([]byte, error) {
+	// yaml.v3 writes a parsed << key back as "!!merge <<"
+	walkYAMLNodes(doc, func(n *yaml.Node) {
+		if n.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				if isMergeKey(n.Content[i]) {
+					n.Content[i].Tag = ""
+				}
+			}
+		}
+	})
+
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		_ = enc.Close()
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// restoreBlankLines puts back the blank lines of original that yaml.v3 drops
+// when rendered is encoded from it. A blank line is restored in front of the
+// next line that is still found unchanged in rendered, matching lines in order.
+func restoreBlankLines(original, rendered []byte) []byte {
+	lines := strings.SplitAfter(string(rendered), "\n")
+	blankBefore := make([]int, len(lines))
+
+	next, blanks := 0, 0
+	for _, line := range strings.SplitAfter(string(original), "\n") {
+		if strings.TrimSpace(line) == "" {
+			if line != "" {
+				blanks++
+			}
+			continue
+		}
+		for i := next; i < len(lines); i++ {
+			if strings.TrimRight(lines[i], "\r\n") == strings.TrimRight(line, "\r\n") {
+				blankBefore[i] = blanks
+				next = i + 1
+				break
+			}
+		}
+		blanks = 0
+	}
+
+	var out strings.Builder
+	for i, line := range lines {
+		for j := 0; j < blankBefore[i] && i > 0; j++ {
+			out.WriteString("\n")
+		}
+		out.WriteString(line)
+	}
+	return []byte(out.String())
+}
+
+// jsonToYAMLNode parses a JSON document into a block style yaml.Node. JSON is
+// valid YAML, so parsing it with the YAML parser keeps the key order of the
+// request instead of sorting it like a map[string]any would.
+func jsonToYAMLNode(raw []byte) (*yaml.Node, error) {
+	if !json.Valid(raw) {
+		return nil, errors.New("invalid JSON")
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, errors.New("invalid JSON")
+	}
+	node := doc.Content[0]
+	clearYAMLStyle(node)
+	applyReadableCommandStyle(node)
+	return node, nil
+}
+
+func clearYAMLStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		clearYAMLStyle(child)
+	}
+}
+
+// yamlNodeToJSON renders node as JSON. Mapping keys keep their order from the
+// file, unless the mapping uses a << merge key.
+func yamlNodeToJSON(node *yaml.Node) (json.RawMessage, error) {
+	for node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		if mappingHasMergeKey(node) {
+			break
+		}
+		var out bytes.Buffer
+		out.WriteByte('{')
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			key, err := json.Marshal(node.Content[i].Value)
+			if err != nil {
+				return nil, err
+			}
+			value, err := yamlNodeToJSON(node.Content[i+1])
+			if err != nil {
+				return nil, err
+			}
+			out.Write(key)
+			out.WriteByte(':')
+			out.Write(value)
+		}
+		out.WriteByte('}')
+		return out.Bytes(), nil
+	case yaml.SequenceNode:
+		var out bytes.Buffer
+		out.WriteByte('[')
+		for i, item := range node.Content {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			value, err := yamlNodeToJSON(item)
+			if err != nil {
+				return nil, err
+			}
+			out.Write(value)
+		}
+		out.WriteByte(']')
+		return out.Bytes(), nil
+	}
+
+	var value any
+	if err := node.Decode(&value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(normalizeYAMLValue(value))
+}
+
+// mappingEntry returns the index of key in the mapping node m, or -1
+func mappingEntry(m *yaml.Node, key string) int {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func mappingHasMergeKey(m *yaml.Node) bool {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if isMergeKey(m.Content[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func isMergeKey(key *yaml.Node) bool {
+	return key.Kind == yaml.ScalarNode && key.Value == "<<" && (key.Tag == "!!merge" || key.Tag == "")
+}
+
+// yamlSection returns the mapping stored under key in the mapping node root.
+// When create is set a missing section is appended to root.
+func yamlSection(root *yaml.Node, key string, create bool) (*yaml.Node, error) {
+	if i := mappingEntry(root, key); i >= 0 {
+		section := root.Content[i+1]
+		if section.Kind == yaml.ScalarNode && section.Tag == "!!null" {
+			*section = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", HeadComment: section.HeadComment, LineComment: section.LineComment, FootComment: section.FootComment}
+		}
+		if section.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("%s is not a mapping", key)
+		}
+		return section, nil
+	}
+	if !create {
+		return nil, nil
+	}
+	section := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	root.Content = append(root.Content, yamlKey(key), section)
+	return section, nil
+}
+
+func yamlKey(key string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}
+}
+
+func yamlNodesEqual(a, b *yaml.Node) bool {
+	var av, bv any
+	if err := a.Decode(&av); err != nil {
+		return false
+	}
+	if err := b.Decode(&bv); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(av, bv)
+}
+
+// mergeYAMLNode updates dst in place so that it holds the value of src. Parts
+// of dst that already hold the same value are left alone, keeping their
+// comments, anchors and formatting; only what changed is rewritten.
+func mergeYAMLNode(dst, src *yaml.Node) {
+	if yamlNodesEqual(dst, src) {
+		return
+	}
+	switch {
+	case dst.Kind == yaml.MappingNode && src.Kind == yaml.MappingNode:
+		mergeYAMLMapping(dst, src)
+	case dst.Kind == yaml.SequenceNode && src.Kind == yaml.SequenceNode:
+		for i := 0; i < len(dst.Content) && i < len(src.Content); i++ {
+			mergeYAMLNode(dst.Content[i], src.Content[i])
+		}
+		if len(dst.Content) > len(src.Content) {
+			dst.Content = dst.Content[:len(src.Content)]
+		} else {
+			dst.Content = append(dst.Content, src.Content[len(dst.Content):]...)
+		}
+	default:
+		replaceYAMLNode(dst, src)
+	}
+}
+
+// replaceYAMLNode overwrites dst with src, keeping the comments around dst
+func replaceYAMLNode(dst, src *yaml.Node) {
+	head, line, foot := dst.HeadComment, dst.LineComment, dst.FootComment
+	*dst = *src
+	dst.HeadComment, dst.LineComment, dst.FootComment = head, line, foot
+}
+
+// mergeYAMLMapping merges the mapping src into dst. Keys missing from src are
+// removed, changed keys are merged recursively and new keys are appended in
+// the order of src. A << merge key is kept as long as every key it provides
+// is still wanted; keys whose value matches the inherited one are not
+// written out.
+func mergeYAMLMapping(dst, src *yaml.Node) {
+	wanted := make(map[string]*yaml.Node, len(src.Content)/2)
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		wanted[src.Content[i].Value] = src.Content[i+1]
+	}
+
+	explicit := map[string]bool{}
+	for i := 0; i+1 < len(dst.Content); i += 2 {
+		if !isMergeKey(dst.Content[i]) {
+			explicit[dst.Content[i].Value] = true
+		}
+	}
+	inherited := inheritedYAMLValues(dst)
+	for key := range inherited {
+		if _, ok := wanted[key]; !ok && !explicit[key] {
+			// the merge would bring back a removed key
+			inherited = nil
+			break
+		}
+	}
+
+	content := make([]*yaml.Node, 0, len(dst.Content))
+	seen := map[string]bool{}
+	for i := 0; i+1 < len(dst.Content); i += 2 {
+		key, value := dst.Content[i], dst.Content[i+1]
+		if isMergeKey(key) {
+			if inherited != nil {
+				content = append(content, key, value)
+			}
+			continue
+		}
+		srcValue, ok := wanted[key.Value]
+		if !ok {
+			continue
+		}
+		mergeYAMLNode(value, srcValue)
+		content = append(content, key, value)
+		seen[key.Value] = true
+	}
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, value := src.Content[i], src.Content[i+1]
+		if seen[key.Value] {
+			continue
+		}
+		if base, ok := inherited[key.Value]; ok && yamlNodesEqual(base, value) {
+			continue
+		}
+		content = append(content, key, value)
+	}
+	dst.Content = content
+}
+
+// inheritedYAMLValues returns the values m receives through << merge keys
+func inheritedYAMLValues(m *yaml.Node) map[string]*yaml.Node {
+	inherited := map[string]*yaml.Node{}
+	var add func(node *yaml.Node)
+	add = func(node *yaml.Node) {
+		for node.Kind == yaml.AliasNode {
+			node = node.Alias
+		}
+		switch node.Kind {
+		case yaml.MappingNode:
+			for key, value := range inheritedYAMLValues(node) {
+				if _, ok := inherited[key]; !ok {
+					inherited[key] = value
+				}
+			}
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if key := node.Content[i]; !isMergeKey(key) {
+					inherited[key.Value] = node.Content[i+1]
+				}
+			}
+		case yaml.SequenceNode:
+			// earlier mappings take precedence over later ones
+			for i := len(node.Content) - 1; i >= 0; i-- {
+				add(node.Content[i])
+			}
+		}
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if isMergeKey(m.Content[i]) {
+			add(m.Content[i+1])
+		}
+	}
+	return inherited
+}
+
+// yamlAliasGuard protects the rest of a document from an edit to one subtree.
+// Aliases outside the subtree that point into it would silently follow the
+// edit, or dangle once the subtree is removed; restore replaces each of them
+// with a copy of the value it had before the edit.
+type yamlAliasGuard struct {
+	aliases []*yaml.Node
+	before  []*yaml.Node
+}
+
+func guardYAMLAliases(root, subtree *yaml.Node) *yamlAliasGuard {
+	inside := map[*yaml.Node]bool{}
+	walkYAMLNodes(subtree, func(n *yaml.Node) { inside[n] = true })
+
+	guard := &yamlAliasGuard{}
+	walkYAMLNodes(root, func(n *yaml.Node) {
+		if n.Kind == yaml.AliasNode && !inside[n] && inside[n.Alias] {
+			guard.aliases = append(guard.aliases, n)
+			guard.before = append(guard.before, copyYAMLNode(n.Alias))
+		}
+	})
+	return guard
+}
+
+// restore inlines the guarded aliases whose target changed. With removed set
+// every guarded alias is inlined.
+func (g *yamlAliasGuard) restore(removed bool) {
+	for i, alias := range g.aliases {
+		if removed || !yamlNodesEqual(alias.Alias, g.before[i]) {
+			replaceYAMLNode(alias, g.before[i])
+		}
+	}
+}
+
+// walkYAMLNodes calls fn for node and every node below it, without following
+// aliases
+func walkYAMLNodes(node *yaml.Node, fn func(*yaml.Node)) {
+	fn(node)
+	for _, child := range node.Content {
+		walkYAMLNodes(child, fn)
+	}
+}
+
+// copyYAMLNode returns a deep copy of node with aliases resolved and anchors
+// dropped, so it can be placed anywhere in a document
+func copyYAMLNode(node *yaml.Node) *yaml.Node {
+	for node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	out := *node
+	out.Anchor = ""
+	out.Content = make([]*yaml.Node, len(node.Content))
+	for i, child := range node.Content {
+		out.Content[i] = copyYAMLNode(child)
+	}
+	return &out
+}
@@ -245,6 +245,7 @@ func (pm *ProxyManager) apiUpdateDockerImage(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	auditNodes(c, dockerActionNodeLabel(host, isLocal))
 
 	command := fmt.Sprintf("docker pull %s", shellQuote(reference))
 	start := time.Now()
@@ -295,6 +296,7 @@ func (pm *ProxyManager) apiDeleteDockerImage(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	auditNodes(c, dockerActionNodeLabel(host, isLocal))
 
 	command := fmt.Sprintf("docker rmi -f %s", shellQuote(target))
 	start := time.Now()
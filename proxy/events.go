@@ -1,5 +1,7 @@
 package proxy
 
+import "time"
+
 // package level registry of the different event types
 
 const ProcessStateChangeEventID = 0x01
@@ -8,6 +10,12 @@ const ConfigFileChangedEventID = 0x03
 const LogDataEventID = 0x04
 const TokenMetricsEventID = 0x05
 const ModelPreloadedEventID = 0x06
+const ModelSwapEventID = 0x07
+const RequestCompletedEventID = 0x08
+const RequestRejectedEventID = 0x09
+const ModelStartEventID = 0x0A
+const SwapThrashEventID = 0x0B
+const AuditEventID = 0x0C
 
 type ProcessStateChangeEvent struct {
 	ProcessName string
@@ -58,3 +66,72 @@ type ModelPreloadedEvent struct {
 func (e ModelPreloadedEvent) Type() uint32 {
 	return ModelPreloadedEventID
 }
+
+// ModelSwapEvent is emitted when a running model is stopped to make room for
+// another one, either in a swap group or by an exclusive group
+type ModelSwapEvent struct {
+	GroupID   string
+	FromModel string
+	ToModel   string
+}
+
+func (e ModelSwapEvent) Type() uint32 {
+	return ModelSwapEventID
+}
+
+// RequestCompletedEvent is emitted when a request that was routed to a model
+// has been answered, whatever the status
+type RequestCompletedEvent struct {
+	Model    string
+	Endpoint string // route pattern, e.g. /v1/chat/completions
+	Status   int
+	Duration time.Duration
+}
+
+func (e RequestCompletedEvent) Type() uint32 {
+	return RequestCompletedEventID
+}
+
+// RequestRejectedEvent is emitted when a request is turned away before it
+// reaches an upstream. Model is empty when the request was rejected before
+// its model was known.
+type RequestRejectedEvent struct {
+	Model  string
+	Reason string // rate_limit, concurrency, residency, quota or client_access
+}
+
+func (e RequestRejectedEvent) Type() uint32 {
+	return RequestRejectedEventID
+}
+
+// ModelStartEvent is emitted when an attempt to start a model has finished,
+// successful or not
+type ModelStartEvent struct {
+	Start ModelStart
+}
+
+func (e ModelStartEvent) Type() uint32 {
+	return ModelStartEventID
+}
+
+// SwapThrashEvent is emitted when the swaps unloading models of a group
+// exceed the thrashThreshold of the group within its thrashWindow
+type SwapThrashEvent struct {
+	GroupID string
+	Swaps   int // within Window
+	Window  time.Duration
+}
+
+func (e SwapThrashEvent) Type() uint32 {
+	return SwapThrashEventID
+}
+
+// AuditEvent is emitted when an administrative action has been recorded in
+// the audit log
+type AuditEvent struct {
+	Entry AuditEntry
+}
+
+func (e AuditEvent) Type() uint32 {
+	return AuditEventID
+}
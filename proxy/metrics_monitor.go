@@ -4,12 +4,17 @@ import (
 	"bytes"
 	"compress/flate"
 	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -29,20 +34,85 @@ type TokenMetrics struct {
 	TokensPerSecond float64   `json:"tokens_per_second"`
 	DurationMs      int       `json:"duration_ms"`
 	HasCapture      bool      `json:"has_capture"`
+	Endpoint        string    `json:"endpoint"`          // request path
+	APIKey          string    `json:"api_key,omitempty"` // apiKeyID of the key used, never the key itself
+	RequestID       string    `json:"request_id,omitempty"`
+	MirrorOf        string    `json:"mirror_of,omitempty"` // request ID of the primary request of a shadow request
+	Split           string    `json:"split,omitempty"`     // virtual model of a split that assigned the request to Model
+	StatusCode      int       `json:"status_code"`
+	Error           string    `json:"error,omitempty"` // start of the body of error responses
+
+	// latency of streamed responses, -1 when unknown or not streamed
+	TTFTMs           int     `json:"ttft_ms"`     // request received to first content chunk
+	InterTokenMeanMs float64 `json:"itl_mean_ms"` // mean time between content chunks
+	InterTokenP95Ms  float64 `json:"itl_p95_ms"`  // 95th percentile time between content chunks
+
+	// time spent waiting for a model swap, the process to start or a
+	// concurrency slot before the request was handed to the upstream
+	WaitMs int `json:"wait_ms"`
+
+	// ID of the tokens reserved by the rate limits, see rateLimitReservationOf
+	reservation string
+}
+
+// maxErrorSummary is how much of the body of an error response is kept in
+// TokenMetrics.Error
+const maxErrorSummary = 1024
+
+// errorSummary returns the start of the body of an error response: the
+// message of an OpenAI style {"error": ...} body when there is one,
+// otherwise the body itself
+func errorSummary(body []byte) string {
+	summary := strings.TrimSpace(string(body))
+	if gjson.Valid(summary) {
+		parsed := gjson.Parse(summary)
+		if message := parsed.Get("error.message"); message.Type == gjson.String {
+			summary = message.Str
+		} else if message := parsed.Get("error"); message.Type == gjson.String {
+			summary = message.Str
+		}
+	}
+	if len(summary) > maxErrorSummary {
+		summary = strings.ToValidUTF8(summary[:maxErrorSummary], "")
+	}
+	return summary
+}
+
+// status returns the HTTP status of the response, metrics recorded before
+// the status was recorded were all 200
+func (tm *TokenMetrics) status() int {
+	if tm.StatusCode == 0 {
+		return http.StatusOK
+	}
+	return tm.StatusCode
 }
 
 type ReqRespCapture struct {
 	ID          int               `json:"id"`
+	RequestID   string            `json:"request_id,omitempty"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Model       string            `json:"model"`
+	Status      int               `json:"status"`
+	DurationMs  int               `json:"duration_ms"`
+	ReplayOf    string            `json:"replay_of,omitempty"` // request ID of the replayed capture
+	MirrorOf    string            `json:"mirror_of,omitempty"` // request ID of the primary request of a shadow request
+	Split       string            `json:"split,omitempty"`     // virtual model of a split that assigned the request to Model
+	ReqMethod   string            `json:"req_method"`
 	ReqPath     string            `json:"req_path"`
+	ReqQuery    string            `json:"req_query,omitempty"`
 	ReqHeaders  map[string]string `json:"req_headers"`
 	ReqBody     []byte            `json:"req_body"`
 	RespHeaders map[string]string `json:"resp_headers"`
 	RespBody    []byte            `json:"resp_body"`
+
+	// StreamTimings has when each event of an uncompressed SSE response
+	// was written, the API returns them as chunks
+	StreamTimings []streamTiming `json:"stream_timings,omitempty"`
 }
 
 // Size returns the approximate memory usage of this capture in bytes
 func (c *ReqRespCapture) Size() int {
-	size := len(c.ReqPath) + len(c.ReqBody) + len(c.RespBody)
+	size := len(c.ReqPath) + len(c.ReqQuery) + len(c.ReqBody) + len(c.RespBody) + len(c.StreamTimings)*16
 	for k, v := range c.ReqHeaders {
 		size += len(k) + len(v)
 	}
@@ -75,6 +145,15 @@ type metricsMonitor struct {
 	captureOrder   []int                  // track insertion order for FIFO eviction
 	captureSize    int                    // current total size in bytes
 	maxCaptureSize int                    // max bytes for captures
+
+	// persists metrics when set
+	store *metricsStore
+
+	// persists captures when set, even with the capture buffer disabled
+	captureStore *captureStore
+
+	// recent model starts, up to maxMetrics
+	starts []ModelStart
 }
 
 // newMetricsMonitor creates a new metricsMonitor. captureBufferMB is the
@@ -103,13 +182,62 @@ func (mp *metricsMonitor) addMetrics(metric TokenMetrics) int {
 	if len(mp.metrics) > mp.maxMetrics {
 		mp.metrics = mp.metrics[len(mp.metrics)-mp.maxMetrics:]
 	}
+	if mp.store != nil {
+		mp.store.recordMetrics(metric)
+	}
 	event.Emit(TokenMetricsEvent{Metrics: metric})
 	return metric.ID
 }
 
+// useStore persists new metrics to store and loads the most recent ones
+// from it, so they survive restarts and config reloads
+func (mp *metricsMonitor) useStore(store *metricsStore) error {
+	recent, err := store.recentMetrics(mp.maxMetrics)
+	if err != nil {
+		return err
+	}
+
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.store = store
+	for _, metric := range recent {
+		metric.ID = mp.nextID
+		mp.nextID++
+		mp.metrics = append(mp.metrics, metric)
+	}
+	return nil
+}
+
+// addStart records a model start
+func (mp *metricsMonitor) addStart(start ModelStart) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.starts = append(mp.starts, start)
+	if len(mp.starts) > mp.maxMetrics {
+		mp.starts = mp.starts[len(mp.starts)-mp.maxMetrics:]
+	}
+}
+
+// getStarts returns a copy of the recent model starts, oldest first
+func (mp *metricsMonitor) getStarts() []ModelStart {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	return slices.Clone(mp.starts)
+}
+
+// capturing reports whether requests and responses are captured, in memory
+// or by the capture store
+func (mp *metricsMonitor) capturing() bool {
+	return mp.enableCaptures || mp.captureStore != nil
+}
+
 // addCapture adds a new capture to the buffer with size-based eviction.
 // Captures are skipped if enableCaptures is false or if capture exceeds maxCaptureSize.
+// The capture store, when set, gets every capture.
 func (mp *metricsMonitor) addCapture(capture ReqRespCapture) {
+	if mp.captureStore != nil {
+		mp.captureStore.append(capture)
+	}
 	if !mp.enableCaptures {
 		return
 	}
@@ -149,6 +277,20 @@ func (mp *metricsMonitor) getCaptureByID(id int) *ReqRespCapture {
 	return nil
 }
 
+// getCaptures returns a copy of the captures in memory, oldest first
+func (mp *metricsMonitor) getCaptures() []ReqRespCapture {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	result := make([]ReqRespCapture, 0, len(mp.captureOrder))
+	for _, id := range mp.captureOrder {
+		if capture, exists := mp.captures[id]; exists {
+			result = append(result, capture)
+		}
+	}
+	return result
+}
+
 // getMetrics returns a copy of the current metrics
 func (mp *metricsMonitor) getMetrics() []TokenMetrics {
 	mp.mu.RLock()
@@ -166,6 +308,69 @@ func (mp *metricsMonitor) getMetricsJSON() ([]byte, error) {
 	return json.Marshal(mp.metrics)
 }
 
+// requestTiming follows a request on its way through llama-swap. It is kept
+// in the request context so whoever hands the request to the upstream can
+// mark when that happened, separating the wait for a swap or start from the
+// time spent generating.
+type requestTiming struct {
+	received time.Time
+	upstream atomic.Int64 // unix nanoseconds, 0 until handed to the upstream
+}
+
+func newRequestTiming() *requestTiming {
+	return &requestTiming{received: time.Now()}
+}
+
+// markUpstreamStart records that r is being sent to the upstream now
+func markUpstreamStart(r *http.Request) {
+	if timing, ok := r.Context().Value(proxyCtxKey("timing")).(*requestTiming); ok {
+		timing.upstream.CompareAndSwap(0, time.Now().UnixNano())
+	}
+}
+
+// upstreamStart returns when the request was handed to the upstream, or the
+// time it was received when that was never marked
+func (t *requestTiming) upstreamStart() time.Time {
+	if nanos := t.upstream.Load(); nanos != 0 {
+		return time.Unix(0, nanos)
+	}
+	return t.received
+}
+
+// applyLatency fills in the wait and streaming latency fields of tm from the
+// timestamps of the content chunks of the response
+func (t *requestTiming) applyLatency(tm *TokenMetrics, chunkTimes []time.Time) {
+	upstream := t.upstreamStart()
+	tm.WaitMs = int(upstream.Sub(t.received).Milliseconds())
+	tm.TTFTMs = -1
+	tm.InterTokenMeanMs = -1
+	tm.InterTokenP95Ms = -1
+
+	// chunks written before the upstream was reached are loading messages
+	first := 0
+	for first < len(chunkTimes) && chunkTimes[first].Before(upstream) {
+		first++
+	}
+	chunkTimes = chunkTimes[first:]
+	if len(chunkTimes) == 0 {
+		return
+	}
+	tm.TTFTMs = int(chunkTimes[0].Sub(t.received).Milliseconds())
+	if len(chunkTimes) < 2 {
+		return
+	}
+
+	gaps := make([]float64, len(chunkTimes)-1)
+	total := 0.0
+	for i := 1; i < len(chunkTimes); i++ {
+		gaps[i-1] = float64(chunkTimes[i].Sub(chunkTimes[i-1])) / float64(time.Millisecond)
+		total += gaps[i-1]
+	}
+	sort.Float64s(gaps)
+	tm.InterTokenMeanMs = total / float64(len(gaps))
+	tm.InterTokenP95Ms = percentile(gaps, 0.95)
+}
+
 // wrapHandler wraps the proxy handler to extract token metrics
 // if wrapHandler returns an error it is safe to assume that no
 // data was sent to the client
@@ -178,7 +383,7 @@ func (mp *metricsMonitor) wrapHandler(
 	// Capture request body and headers if captures enabled
 	var reqBody []byte
 	var reqHeaders map[string]string
-	if mp.enableCaptures {
+	if mp.capturing() {
 		if request.Body != nil {
 			var err error
 			reqBody, err = io.ReadAll(request.Body)
@@ -197,6 +402,8 @@ func (mp *metricsMonitor) wrapHandler(
 		redactHeaders(reqHeaders)
 	}
 
+	timing := newRequestTiming()
+	request = request.WithContext(context.WithValue(request.Context(), proxyCtxKey("timing"), timing))
 	recorder := newBodyCopier(writer)
 
 	// Filter Accept-Encoding to only include encodings we can decompress for metrics
@@ -204,29 +411,113 @@ func (mp *metricsMonitor) wrapHandler(
 		request.Header.Set("Accept-Encoding", filterAcceptEncoding(ae))
 	}
 
-	if err := next(modelID, recorder, request); err != nil {
-		return err
-	}
-
-	// after this point we have to assume that data was sent to the client
-	// and we can only log errors but not send them to clients
-
-	if recorder.Status() != http.StatusOK {
-		mp.logger.Warnf("metrics skipped, HTTP status=%d, path=%s", recorder.Status(), request.URL.Path)
-		return nil
-	}
+	nextErr := next(modelID, recorder, request)
 
 	// Initialize default metrics - these will always be recorded
+	status := recorder.Status()
+	if nextErr != nil {
+		status = handlerErrorStatus(nextErr)
+	}
 	tm := TokenMetrics{
 		Timestamp:  time.Now(),
 		Model:      modelID,
 		DurationMs: int(time.Since(recorder.StartTime()).Milliseconds()),
 	}
+	recordMetrics := func(tm TokenMetrics) int {
+		timing.applyLatency(&tm, recorder.ChunkTimes())
+		tm.Endpoint = request.URL.Path
+		tm.APIKey, _ = request.Context().Value(proxyCtxKey("apiKey")).(string)
+		tm.RequestID = requestIDOf(request)
+		tm.reservation = rateLimitReservationOf(request)
+		tm.MirrorOf = mirrorOf(request)
+		tm.Split = splitOf(request)
+		tm.StatusCode = status
+		return mp.addMetrics(tm)
+	}
+
+	// record stores tm together with a capture of the request and of the
+	// decompressed response body, when captures are enabled
+	record := func(tm TokenMetrics, body []byte) {
+		var capture *ReqRespCapture
+		if mp.capturing() {
+			respHeaders := make(map[string]string)
+			for key, values := range recorder.Header() {
+				if len(values) > 0 {
+					respHeaders[key] = values[0]
+				}
+			}
+			redactHeaders(respHeaders)
+			delete(respHeaders, "Content-Encoding")
+			capture = &ReqRespCapture{
+				RequestID:   requestIDOf(request),
+				Timestamp:   tm.Timestamp,
+				Model:       modelID,
+				Status:      status,
+				DurationMs:  tm.DurationMs,
+				ReqMethod:   request.Method,
+				ReqPath:     request.URL.Path,
+				ReqQuery:    request.URL.RawQuery,
+				ReqHeaders:  reqHeaders,
+				ReqBody:     reqBody,
+				RespHeaders: respHeaders,
+				RespBody:    body,
+			}
+			capture.ReplayOf, _ = request.Context().Value(proxyCtxKey("replayOf")).(string)
+			capture.MirrorOf = mirrorOf(request)
+			capture.Split = splitOf(request)
+			capture.StreamTimings = streamTimings(timing.received, recorder.Events(), len(body))
+			// Only set HasCapture if the capture will actually be stored (not too large)
+			if mp.enableCaptures && capture.Size() <= mp.maxCaptureSize {
+				tm.HasCapture = true
+			}
+		}
+
+		metricID := recordMetrics(tm)
+
+		// Store capture if enabled
+		if capture != nil {
+			capture.ID = metricID
+			mp.addCapture(*capture)
+		}
+	}
+
+	// the caller sends the error response of a failed handler, e.g. when the
+	// process could not be started, it is recorded like an upstream error
+	if nextErr != nil {
+		tm.CachedTokens = -1
+		tm.PromptPerSecond = -1
+		tm.TokensPerSecond = -1
+		tm.Error = errorSummary([]byte(nextErr.Error()))
+		record(tm, []byte(nextErr.Error()))
+		return nextErr
+	}
+
+	// after this point we have to assume that data was sent to the client
+	// and we can only log errors but not send them to clients
 
 	body := recorder.body.Bytes()
+
+	// error responses have no usage data, their body explains what went wrong
+	if status != http.StatusOK {
+		if encoding := recorder.Header().Get("Content-Encoding"); encoding != "" {
+			if decoded, err := decompressBody(body, encoding); err == nil {
+				body = decoded
+			}
+		}
+		tm.CachedTokens = -1
+		tm.PromptPerSecond = -1
+		tm.TokensPerSecond = -1
+		if status >= http.StatusBadRequest {
+			tm.Error = errorSummary(body)
+		}
+		mp.logger.Debugf("metrics: HTTP status=%d, path=%s, recording without usage", status, request.URL.Path)
+		record(tm, body)
+		return nil
+	}
+
 	if len(body) == 0 {
 		mp.logger.Warn("metrics: empty body, recording minimal metrics")
-		mp.addMetrics(tm)
+		recordMetrics(tm)
 		return nil
 	}
 
@@ -236,7 +527,7 @@ func (mp *metricsMonitor) wrapHandler(
 		body, err = decompressBody(body, encoding)
 		if err != nil {
 			mp.logger.Warnf("metrics: decompression failed: %v, path=%s, recording minimal metrics", err, request.URL.Path)
-			mp.addMetrics(tm)
+			recordMetrics(tm)
 			return nil
 		}
 	}
@@ -272,39 +563,18 @@ func (mp *metricsMonitor) wrapHandler(
 		}
 	}
 
-	// Build capture if enabled and determine if it will be stored
-	var capture *ReqRespCapture
-	if mp.enableCaptures {
-		respHeaders := make(map[string]string)
-		for key, values := range recorder.Header() {
-			if len(values) > 0 {
-				respHeaders[key] = values[0]
-			}
-		}
-		redactHeaders(respHeaders)
-		delete(respHeaders, "Content-Encoding")
-		capture = &ReqRespCapture{
-			ReqPath:     request.URL.Path,
-			ReqHeaders:  reqHeaders,
-			ReqBody:     reqBody,
-			RespHeaders: respHeaders,
-			RespBody:    body,
-		}
-		// Only set HasCapture if the capture will actually be stored (not too large)
-		if capture.Size() <= mp.maxCaptureSize {
-			tm.HasCapture = true
-		}
-	}
-
-	metricID := mp.addMetrics(tm)
+	record(tm, body)
+	return nil
+}
 
-	// Store capture if enabled
-	if capture != nil {
-		capture.ID = metricID
-		mp.addCapture(*capture)
+// handlerErrorStatus returns the status of the response sent for an error
+// of the proxy handler, see sendResidencyError
+func handlerErrorStatus(err error) int {
+	var residencyErr *residencyError
+	if errors.As(err, &residencyErr) {
+		return http.StatusServiceUnavailable
 	}
-
-	return nil
+	return http.StatusInternalServerError
 }
 
 func processStreamingResponse(modelID string, start time.Time, body []byte) (TokenMetrics, error) {
@@ -442,6 +712,25 @@ type responseBodyCopier struct {
 	body  *bytes.Buffer
 	tee   io.Writer
 	start time.Time
+
+	// for uncompressed SSE responses, the time each content chunk was written
+	// and when each event was complete
+	mu           sync.Mutex
+	streaming    bool
+	pendingLine  []byte
+	chunkTimes   []time.Time
+	checkedFirst bool
+	scanned      int // bytes of the body before pendingLine
+	eventLines   int // lines of the event being read
+	events       []sseEventTime
+	lastWrite    time.Time
+}
+
+// sseEventTime marks when the SSE event ending at byte end of the body was
+// written
+type sseEventTime struct {
+	at  time.Time
+	end int
 }
 
 func newBodyCopier(w gin.ResponseWriter) *responseBodyCopier {
@@ -454,14 +743,118 @@ func newBodyCopier(w gin.ResponseWriter) *responseBodyCopier {
 }
 
 func (w *responseBodyCopier) Write(b []byte) (int, error) {
+	now := time.Now()
 	if w.start.IsZero() {
-		w.start = time.Now()
+		w.start = now
 	}
+	w.scanChunks(b, now)
 
 	// Single write operation that writes to both the response and buffer
 	return w.tee.Write(b)
 }
 
+// scanChunks timestamps every SSE data line in b that carries generated
+// content. Lines may be split across writes.
+func (w *responseBodyCopier) scanChunks(b []byte, now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.checkedFirst {
+		w.checkedFirst = true
+		w.streaming = strings.Contains(w.Header().Get("Content-Type"), "text/event-stream") &&
+			w.Header().Get("Content-Encoding") == ""
+	}
+	if !w.streaming {
+		return
+	}
+
+	w.lastWrite = now
+	w.pendingLine = append(w.pendingLine, b...)
+	for {
+		end := bytes.IndexByte(w.pendingLine, '\n')
+		if end < 0 {
+			return
+		}
+		line := bytes.TrimSpace(w.pendingLine[:end])
+		w.pendingLine = w.pendingLine[end+1:]
+		w.scanned += end + 1
+		if len(line) == 0 {
+			// a blank line ends an event
+			if w.eventLines > 0 {
+				w.events = append(w.events, sseEventTime{at: now, end: w.scanned})
+				w.eventLines = 0
+			}
+			continue
+		}
+		w.eventLines++
+		if data, ok := bytes.CutPrefix(line, []byte("data:")); ok && sseDataHasContent(bytes.TrimSpace(data)) {
+			w.chunkTimes = append(w.chunkTimes, now)
+		}
+	}
+}
+
+// ChunkTimes returns when each content chunk of a streamed response was written
+func (w *responseBodyCopier) ChunkTimes() []time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return slices.Clone(w.chunkTimes)
+}
+
+// Events returns when each event of a streamed response was written. An
+// event cut short at the end of the response counts as written last.
+func (w *responseBodyCopier) Events() []sseEventTime {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	events := slices.Clone(w.events)
+	if w.eventLines > 0 || len(bytes.TrimSpace(w.pendingLine)) > 0 {
+		events = append(events, sseEventTime{at: w.lastWrite, end: w.scanned + len(w.pendingLine)})
+	}
+	return events
+}
+
+// sseContentPaths are where the supported streaming APIs put generated content
+var sseContentPaths = []string{
+	// v1/chat/completions and v1/completions
+	"choices.0.delta.content",
+	"choices.0.delta.reasoning_content",
+	"choices.0.delta.tool_calls",
+	"choices.0.text",
+	// v1/messages
+	"delta.text",
+	"delta.thinking",
+	"delta.partial_json",
+	// llama-server /completion
+	"content",
+}
+
+// sseDataHasContent reports whether the payload of an SSE data line carries
+// generated tokens, as opposed to role announcements, usage or [DONE]
+func sseDataHasContent(data []byte) bool {
+	if len(data) == 0 || data[0] != '{' {
+		return false
+	}
+	parsed := gjson.ParseBytes(data)
+	// v1/responses, e.g. response.output_text.delta
+	if eventType := parsed.Get("type").String(); strings.HasPrefix(eventType, "response.") && strings.HasSuffix(eventType, ".delta") {
+		return parsed.Get("delta").String() != ""
+	}
+	for _, path := range sseContentPaths {
+		value := parsed.Get(path)
+		switch {
+		case !value.Exists():
+		case value.Type == gjson.String:
+			if value.Str != "" {
+				return true
+			}
+		case value.IsArray():
+			if len(value.Array()) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (w *responseBodyCopier) WriteHeader(statusCode int) {
 	w.ResponseWriter.WriteHeader(statusCode)
 }
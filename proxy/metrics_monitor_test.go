@@ -7,13 +7,16 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/mostlygeek/llama-swap/event"
+	"github.com/mostlygeek/llama-swap/proxy/config"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMetricsMonitor_AddMetrics(t *testing.T) {
@@ -274,24 +277,38 @@ data: [DONE]
 		assert.Equal(t, 20, metrics[0].OutputTokens)
 	})
 
-	t.Run("non-OK status code does not record metrics", func(t *testing.T) {
-		mm := newMetricsMonitor(testLogger, 10, 0)
+	t.Run("non-OK status code records the error", func(t *testing.T) {
+		mm := newMetricsMonitor(testLogger, 10, 1)
 
 		nextHandler := func(modelID string, w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("error"))
+			w.Write([]byte(`{"error":{"message":"invalid tool schema","type":"invalid_request_error"}}`))
 			return nil
 		}
 
-		req := httptest.NewRequest("POST", "/test", nil)
+		req := httptest.NewRequest("POST", "/test", bytes.NewBufferString(`{"tools":[{}]}`))
 		rec := httptest.NewRecorder()
 		ginCtx, _ := gin.CreateTestContext(rec)
 
 		err := mm.wrapHandler("test-model", ginCtx.Writer, req, nextHandler)
 		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
 
 		metrics := mm.getMetrics()
-		assert.Equal(t, 0, len(metrics))
+		assert.Equal(t, 1, len(metrics))
+		assert.Equal(t, http.StatusBadRequest, metrics[0].StatusCode)
+		assert.Equal(t, "invalid tool schema", metrics[0].Error)
+		assert.Equal(t, 0, metrics[0].OutputTokens)
+		assert.Equal(t, -1.0, metrics[0].TokensPerSecond)
+		assert.True(t, metrics[0].HasCapture)
+
+		capture := mm.getCaptureByID(metrics[0].ID)
+		if assert.NotNil(t, capture) {
+			assert.Equal(t, http.StatusBadRequest, capture.Status)
+			assert.Equal(t, `{"tools":[{}]}`, string(capture.ReqBody))
+			assert.Contains(t, string(capture.RespBody), "invalid tool schema")
+		}
 	})
 
 	t.Run("empty response body records minimal metrics", func(t *testing.T) {
@@ -355,8 +372,41 @@ data: [DONE]
 		err := mm.wrapHandler("test-model", ginCtx.Writer, req, nextHandler)
 		assert.Equal(t, expectedErr, err)
 
+		// recorded with the status the caller sends for it
 		metrics := mm.getMetrics()
-		assert.Equal(t, 0, len(metrics))
+		require.Equal(t, 1, len(metrics))
+		assert.Equal(t, http.StatusInternalServerError, metrics[0].StatusCode)
+		assert.Equal(t, expectedErr.Error(), metrics[0].Error)
+		assert.Equal(t, -1.0, metrics[0].TokensPerSecond)
+	})
+
+	t.Run("next handler residency error is recorded with a capture", func(t *testing.T) {
+		mm := newMetricsMonitor(testLogger, 10, 1)
+
+		residencyErr := &residencyError{Group: "g", Model: "resident", RetryAfter: time.Minute}
+		nextHandler := func(modelID string, w http.ResponseWriter, r *http.Request) error {
+			return residencyErr
+		}
+
+		req := httptest.NewRequest("POST", "/test", bytes.NewBufferString(`{"model":"test-model"}`))
+		rec := httptest.NewRecorder()
+		ginCtx, _ := gin.CreateTestContext(rec)
+
+		err := mm.wrapHandler("test-model", ginCtx.Writer, req, nextHandler)
+		assert.Equal(t, residencyErr, err)
+
+		metrics := mm.getMetrics()
+		require.Equal(t, 1, len(metrics))
+		assert.Equal(t, http.StatusServiceUnavailable, metrics[0].StatusCode)
+		assert.Equal(t, residencyErr.Error(), metrics[0].Error)
+		assert.True(t, metrics[0].HasCapture)
+
+		capture := mm.getCaptureByID(metrics[0].ID)
+		if assert.NotNil(t, capture) {
+			assert.Equal(t, http.StatusServiceUnavailable, capture.Status)
+			assert.Equal(t, `{"model":"test-model"}`, string(capture.ReqBody))
+			assert.Equal(t, residencyErr.Error(), string(capture.RespBody))
+		}
 	})
 
 	t.Run("response without usage or timings records minimal metrics", func(t *testing.T) {
@@ -1126,3 +1176,158 @@ func TestMetricsMonitor_WrapHandler_Capture(t *testing.T) {
 		assert.Nil(t, capture)
 	})
 }
+
+func TestMetricsMonitor_StreamingLatency(t *testing.T) {
+	t.Run("times content chunks of a stream", func(t *testing.T) {
+		mm := newMetricsMonitor(testLogger, 10, 0)
+
+		nextHandler := func(modelID string, w http.ResponseWriter, r *http.Request) error {
+			// queued behind a swap before reaching the upstream
+			time.Sleep(30 * time.Millisecond)
+			markUpstreamStart(r)
+
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("data: {\"choices\":[{\"delta\":{\"role\":\"assistant\"}}]}\n\n"))
+			for _, token := range []string{"Hel", "lo", " Wor", "ld"} {
+				time.Sleep(20 * time.Millisecond)
+				// split a line across writes
+				w.Write([]byte(`data: {"choices":[{"delta":{"content":"` + token))
+				w.Write([]byte("\"}}]}\n\n"))
+			}
+			w.Write([]byte("data: {\"usage\":{\"prompt_tokens\":10,\"completion_tokens\":4}}\n\ndata: [DONE]\n\n"))
+			return nil
+		}
+
+		req := httptest.NewRequest("POST", "/test", nil)
+		rec := httptest.NewRecorder()
+		ginCtx, _ := gin.CreateTestContext(rec)
+
+		err := mm.wrapHandler("test-model", ginCtx.Writer, req, nextHandler)
+		assert.NoError(t, err)
+
+		metrics := mm.getMetrics()
+		assert.Equal(t, 1, len(metrics))
+		m := metrics[0]
+		assert.Equal(t, 4, m.OutputTokens)
+		assert.GreaterOrEqual(t, m.WaitMs, 30)
+		assert.GreaterOrEqual(t, m.TTFTMs, 50)
+		assert.GreaterOrEqual(t, m.InterTokenMeanMs, 15.0)
+		assert.GreaterOrEqual(t, m.InterTokenP95Ms, m.InterTokenMeanMs)
+	})
+
+	t.Run("non-streaming responses have no token latency", func(t *testing.T) {
+		mm := newMetricsMonitor(testLogger, 10, 0)
+
+		nextHandler := func(modelID string, w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"content":"hello","usage":{"prompt_tokens":10,"completion_tokens":1}}`))
+			return nil
+		}
+
+		req := httptest.NewRequest("POST", "/test", nil)
+		rec := httptest.NewRecorder()
+		ginCtx, _ := gin.CreateTestContext(rec)
+
+		err := mm.wrapHandler("test-model", ginCtx.Writer, req, nextHandler)
+		assert.NoError(t, err)
+
+		metrics := mm.getMetrics()
+		assert.Equal(t, 1, len(metrics))
+		assert.Equal(t, -1, metrics[0].TTFTMs)
+		assert.Equal(t, -1.0, metrics[0].InterTokenMeanMs)
+		assert.Equal(t, -1.0, metrics[0].InterTokenP95Ms)
+	})
+}
+
+func TestRequestTiming_ApplyLatency(t *testing.T) {
+	received := time.Now()
+	timing := &requestTiming{received: received}
+	timing.upstream.Store(received.Add(100 * time.Millisecond).UnixNano())
+
+	at := func(ms int) time.Time { return received.Add(time.Duration(ms) * time.Millisecond) }
+	chunks := []time.Time{
+		at(50), // loading message sent while the model started
+		at(150), at(160), at(170), at(180), at(190), at(200), at(210), at(220), at(230), at(240), at(290),
+	}
+
+	var tm TokenMetrics
+	timing.applyLatency(&tm, chunks)
+	assert.Equal(t, 100, tm.WaitMs)
+	assert.Equal(t, 150, tm.TTFTMs)
+	assert.InDelta(t, 14.0, tm.InterTokenMeanMs, 0.001)
+	assert.InDelta(t, 50.0, tm.InterTokenP95Ms, 0.001)
+
+	timing.applyLatency(&tm, chunks[:2])
+	assert.Equal(t, 150, tm.TTFTMs)
+	assert.Equal(t, -1.0, tm.InterTokenMeanMs)
+}
+
+func TestSSEDataHasContent(t *testing.T) {
+	tests := []struct {
+		data string
+		want bool
+	}{
+		{`{"choices":[{"delta":{"content":"hi"}}]}`, true},
+		{`{"choices":[{"delta":{"reasoning_content":"hmm"}}]}`, true},
+		{`{"choices":[{"delta":{"tool_calls":[{"index":0}]}}]}`, true},
+		{`{"choices":[{"text":"hi"}]}`, true},
+		{`{"type":"content_block_delta","delta":{"type":"text_delta","text":"hi"}}`, true},
+		{`{"type":"response.output_text.delta","delta":"hi"}`, true},
+		{`{"content":"hi","stop":false}`, true},
+		{`{"choices":[{"delta":{"role":"assistant","content":""}}]}`, false},
+		{`{"choices":[{"delta":{"content":null}}]}`, false},
+		{`{"type":"response.created","response":{}}`, false},
+		{`{"usage":{"prompt_tokens":1}}`, false},
+		{`[DONE]`, false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, sseDataHasContent([]byte(tt.data)), tt.data)
+	}
+}
+
+func TestErrorSummary(t *testing.T) {
+	assert.Equal(t, "invalid tool schema", errorSummary([]byte(`{"error":{"message":"invalid tool schema","code":400}}`)))
+	assert.Equal(t, "model not found", errorSummary([]byte(`{"error":"model not found"}`)))
+	assert.Equal(t, `{"detail":"bad request"}`, errorSummary([]byte(`{"detail":"bad request"}`)))
+	assert.Equal(t, "upstream unavailable", errorSummary([]byte("  upstream unavailable\n")))
+	assert.Len(t, errorSummary(bytes.Repeat([]byte("x"), 5000)), maxErrorSummary)
+}
+
+func TestProxyManager_ErrorMetrics(t *testing.T) {
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error":{"message":"slow down"}}`))
+	}))
+	defer peer.Close()
+	peerURL, _ := url.Parse(peer.URL)
+
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models:             map[string]config.ModelConfig{},
+		Peers: map[string]config.PeerConfig{
+			"peer1": {Proxy: peer.URL, ProxyURL: peerURL, Models: []string{"busy-model"}},
+		},
+		CaptureBuffer: 1,
+		LogLevel:      "error",
+	})
+	proxy := New(conf)
+	defer proxy.Shutdown()
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"busy-model"}`))
+	w := CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	metrics := proxy.metricsMonitor.getMetrics()
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "busy-model", metrics[0].Model)
+	assert.Equal(t, http.StatusTooManyRequests, metrics[0].StatusCode)
+	assert.Equal(t, "slow down", metrics[0].Error)
+	require.True(t, metrics[0].HasCapture)
+	capture := proxy.metricsMonitor.getCaptureByID(metrics[0].ID)
+	require.NotNil(t, capture)
+	assert.Equal(t, `{"error":{"message":"slow down"}}`, string(capture.RespBody))
+}
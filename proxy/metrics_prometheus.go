@@ -0,0 +1,319 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mostlygeek/llama-swap/event"
+)
+
+// prometheusContentType is the content type of the Prometheus text exposition format
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	requestDurationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+	tokensPerSecondBuckets = []float64{1, 5, 10, 20, 30, 50, 75, 100, 150, 200, 300, 500, 1000, 2000, 5000, 10000}
+	startDurationBuckets   = []float64{1, 2, 5, 10, 20, 30, 60, 120, 300, 600}
+	latencyBuckets         = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+)
+
+// promMetrics collects the counters and histograms served on /metrics. It is
+// fed from the event bus, so it lives as long as the llama-swap process: the
+// ProxyManager is replaced on every config reload, and counters must not go
+// back to zero when that happens.
+var promMetrics = newPrometheusCollector().subscribe()
+
+// prometheusCollector turns events into Prometheus series
+type prometheusCollector struct {
+	mu sync.Mutex
+
+	requests        *promVec
+	requestDuration *promVec
+	promptSpeed     *promVec
+	generateSpeed   *promVec
+	timeToFirst     *promVec
+	interToken      *promVec
+	wait            *promVec
+	tokens          *promVec
+	starts          *promVec
+	startDuration   *promVec
+	swaps           *promVec
+	rejections      *promVec
+	thrash          *promVec
+
+	// when each process entered StateStarting
+	startingSince map[string]time.Time
+}
+
+func newPrometheusCollector() *prometheusCollector {
+	return &prometheusCollector{
+		requests:        newPromVec("llama_swap_requests_total", "Requests proxied to a model.", "counter", "model", "endpoint", "status"),
+		requestDuration: newPromHistogram("llama_swap_request_duration_seconds", "Time from receiving a request to sending the last byte of the response.", requestDurationBuckets, "model"),
+		promptSpeed:     newPromHistogram("llama_swap_prompt_tokens_per_second", "Prompt processing speed reported by the upstream.", tokensPerSecondBuckets, "model"),
+		generateSpeed:   newPromHistogram("llama_swap_generation_tokens_per_second", "Token generation speed reported by the upstream.", tokensPerSecondBuckets, "model"),
+		timeToFirst:     newPromHistogram("llama_swap_time_to_first_token_seconds", "Time from receiving a streamed request to its first generated token.", latencyBuckets, "model"),
+		interToken:      newPromHistogram("llama_swap_inter_token_latency_seconds", "Mean time between generated tokens of a streamed response.", latencyBuckets, "model"),
+		wait:            newPromHistogram("llama_swap_request_wait_seconds", "Time a request waited for a model swap, start or concurrency slot.", latencyBuckets, "model"),
+		tokens:          newPromVec("llama_swap_tokens_total", "Tokens processed by type: input, output or cached.", "counter", "model", "type"),
+		starts:          newPromVec("llama_swap_model_starts_total", "Upstream process starts by result: success or failed.", "counter", "model", "result"),
+		startDuration:   newPromHistogram("llama_swap_model_start_duration_seconds", "Time for an upstream process to become ready.", startDurationBuckets, "model"),
+		swaps:           newPromVec("llama_swap_model_swaps_total", "Times a model was unloaded to make room for another one.", "counter", "group", "model"),
+		rejections:      newPromVec("llama_swap_rejected_requests_total", "Requests rejected before reaching a model, by reason: rate_limit, concurrency, residency, quota or client_access.", "counter", "model", "reason"),
+		thrash:          newPromVec("llama_swap_swap_thrash_total", "Times the swaps of a group exceeded its thrashThreshold.", "counter", "group"),
+		startingSince:   map[string]time.Time{},
+	}
+}
+
+// subscribe feeds pc from the event bus
+func (pc *prometheusCollector) subscribe() *prometheusCollector {
+	event.On(pc.onRequestCompleted)
+	event.On(pc.onTokenMetrics)
+	event.On(pc.onProcessStateChange)
+	event.On(pc.onModelSwap)
+	event.On(pc.onRequestRejected)
+	event.On(pc.onSwapThrash)
+	return pc
+}
+
+func (pc *prometheusCollector) onRequestCompleted(e RequestCompletedEvent) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.requests.add(1, e.Model, e.Endpoint, strconv.Itoa(e.Status))
+	pc.requestDuration.observe(e.Duration.Seconds(), e.Model)
+}
+
+func (pc *prometheusCollector) onTokenMetrics(e TokenMetricsEvent) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	m := e.Metrics
+	pc.tokens.add(float64(m.InputTokens), m.Model, "input")
+	pc.tokens.add(float64(m.OutputTokens), m.Model, "output")
+	// -1 means unknown
+	if m.CachedTokens >= 0 {
+		pc.tokens.add(float64(m.CachedTokens), m.Model, "cached")
+	}
+	if m.PromptPerSecond >= 0 {
+		pc.promptSpeed.observe(m.PromptPerSecond, m.Model)
+	}
+	if m.TokensPerSecond >= 0 {
+		pc.generateSpeed.observe(m.TokensPerSecond, m.Model)
+	}
+	if m.TTFTMs >= 0 {
+		pc.timeToFirst.observe(float64(m.TTFTMs)/1000, m.Model)
+	}
+	if m.InterTokenMeanMs >= 0 {
+		pc.interToken.observe(m.InterTokenMeanMs/1000, m.Model)
+	}
+	pc.wait.observe(float64(m.WaitMs)/1000, m.Model)
+}
+
+func (pc *prometheusCollector) onProcessStateChange(e ProcessStateChangeEvent) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	switch {
+	case e.NewState == StateStarting:
+		pc.startingSince[e.ProcessName] = time.Now()
+	case e.OldState == StateStarting:
+		began, ok := pc.startingSince[e.ProcessName]
+		delete(pc.startingSince, e.ProcessName)
+		if e.NewState != StateReady {
+			pc.starts.add(1, e.ProcessName, "failed")
+			return
+		}
+		pc.starts.add(1, e.ProcessName, "success")
+		if ok {
+			pc.startDuration.observe(time.Since(began).Seconds(), e.ProcessName)
+		}
+	}
+}
+
+func (pc *prometheusCollector) onModelSwap(e ModelSwapEvent) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.swaps.add(1, e.GroupID, e.FromModel)
+}
+
+func (pc *prometheusCollector) onRequestRejected(e RequestRejectedEvent) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.rejections.add(1, e.Model, e.Reason)
+}
+
+func (pc *prometheusCollector) onSwapThrash(e SwapThrashEvent) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.thrash.add(1, e.GroupID)
+}
+
+func (pc *prometheusCollector) write(w io.Writer) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	for _, v := range []*promVec{
+		pc.requests, pc.requestDuration, pc.promptSpeed, pc.generateSpeed,
+		pc.timeToFirst, pc.interToken, pc.wait, pc.tokens,
+		pc.starts, pc.startDuration, pc.swaps, pc.rejections, pc.thrash,
+	} {
+		v.write(w)
+	}
+}
+
+// prometheusMetricsHandler serves the metrics in the Prometheus text format.
+// Counters and histograms come from promMetrics; the gauges describe the
+// processes of this ProxyManager at the time of the scrape.
+func (pm *ProxyManager) prometheusMetricsHandler(c *gin.Context) {
+	states := newPromVec("llama_swap_process_state", "Current state of each upstream process, 1 for the state it is in.", "gauge", "model", "state")
+	inFlight := newPromVec("llama_swap_in_flight_requests", "Requests being served by an upstream process.", "gauge", "model")
+	queued := newPromVec("llama_swap_queued_requests", "Requests waiting for a model swap or for the process to start.", "gauge", "model")
+
+	pm.Lock()
+	for _, group := range pm.processGroups {
+		for modelID, process := range group.processes {
+			current := process.CurrentState()
+			for _, state := range []ProcessState{StateStopped, StateStarting, StateReady, StateStopping, StateShutdown} {
+				value := 0.0
+				if state == current {
+					value = 1
+				}
+				states.set(value, modelID, string(state))
+			}
+			inFlight.set(float64(process.inFlightRequestsCount.Load()), modelID)
+			queued.set(float64(process.queuedRequestsCount.Load()), modelID)
+		}
+	}
+	pm.Unlock()
+
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", prometheusContentType)
+	out := bufio.NewWriter(c.Writer)
+	promMetrics.write(out)
+	states.write(out)
+	inFlight.write(out)
+	queued.write(out)
+	out.Flush()
+}
+
+// promVec is a metric family with one series per combination of label values
+type promVec struct {
+	name    string
+	help    string
+	kind    string // counter, gauge or histogram
+	labels  []string
+	buckets []float64
+	series  map[string]*promSeries
+}
+
+type promSeries struct {
+	labelValues []string
+	value       float64
+	// histograms only
+	bucketCounts []uint64
+	sum          float64
+	count        uint64
+}
+
+func newPromVec(name, help, kind string, labels ...string) *promVec {
+	return &promVec{name: name, help: help, kind: kind, labels: labels, series: map[string]*promSeries{}}
+}
+
+func newPromHistogram(name, help string, buckets []float64, labels ...string) *promVec {
+	v := newPromVec(name, help, "histogram", labels...)
+	v.buckets = buckets
+	return v
+}
+
+func (v *promVec) get(labelValues []string) *promSeries {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &promSeries{labelValues: labelValues, bucketCounts: make([]uint64, len(v.buckets))}
+		v.series[key] = s
+	}
+	return s
+}
+
+func (v *promVec) add(delta float64, labelValues ...string) {
+	v.get(labelValues).value += delta
+}
+
+func (v *promVec) set(value float64, labelValues ...string) {
+	v.get(labelValues).value = value
+}
+
+func (v *promVec) observe(value float64, labelValues ...string) {
+	s := v.get(labelValues)
+	for i, upper := range v.buckets {
+		if value <= upper {
+			s.bucketCounts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// write renders the family in the text exposition format, series sorted by
+// their label values
+func (v *promVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := v.series[key]
+		labels := promLabels(v.labels, s.labelValues)
+		if v.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, wrapPromLabels(labels), formatPromValue(s.value))
+			continue
+		}
+		for i, upper := range v.buckets {
+			le := append(labels, `le="`+formatPromValue(upper)+`"`)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, wrapPromLabels(le), s.bucketCounts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, wrapPromLabels(append(labels, `le="+Inf"`)), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, wrapPromLabels(labels), formatPromValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, wrapPromLabels(labels), s.count)
+	}
+}
+
+func promLabels(names, values []string) []string {
+	labels := make([]string, len(names), len(names)+1)
+	for i, name := range names {
+		labels[i] = name + `="` + escapePromLabel(values[i]) + `"`
+	}
+	return labels
+}
+
+func wrapPromLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapePromLabel(value string) string {
+	return promLabelEscaper.Replace(value)
+}
+
+func formatPromValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
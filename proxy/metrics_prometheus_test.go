@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPromVec_Write(t *testing.T) {
+	counter := newPromVec("test_total", "A counter.", "counter", "model", "status")
+	counter.add(1, "b", "200")
+	counter.add(2, `a"quoted\`, "500")
+	counter.add(1, "b", "200")
+
+	histogram := newPromHistogram("test_seconds", "A histogram.", []float64{1, 5}, "model")
+	histogram.observe(0.5, "m")
+	histogram.observe(3, "m")
+	histogram.observe(10, "m")
+
+	var out bytes.Buffer
+	counter.write(&out)
+	histogram.write(&out)
+
+	assert.Equal(t, `# HELP test_total A counter.
+# TYPE test_total counter
+test_total{model="a\"quoted\\",status="500"} 2
+test_total{model="b",status="200"} 2
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{model="m",le="1"} 1
+test_seconds_bucket{model="m",le="5"} 2
+test_seconds_bucket{model="m",le="+Inf"} 3
+test_seconds_sum{model="m"} 13.5
+test_seconds_count{model="m"} 3
+`, out.String())
+}
+
+func TestPrometheusCollector_Events(t *testing.T) {
+	pc := newPrometheusCollector()
+
+	pc.onProcessStateChange(ProcessStateChangeEvent{ProcessName: "m", OldState: StateStopped, NewState: StateStarting})
+	pc.onProcessStateChange(ProcessStateChangeEvent{ProcessName: "m", OldState: StateStarting, NewState: StateReady})
+	pc.onProcessStateChange(ProcessStateChangeEvent{ProcessName: "m", OldState: StateStopped, NewState: StateStarting})
+	pc.onProcessStateChange(ProcessStateChangeEvent{ProcessName: "m", OldState: StateStarting, NewState: StateStopped})
+	pc.onTokenMetrics(TokenMetricsEvent{Metrics: TokenMetrics{Model: "m", InputTokens: 10, OutputTokens: 20, CachedTokens: -1, PromptPerSecond: 120, TokensPerSecond: -1, TTFTMs: 250, InterTokenMeanMs: -1, InterTokenP95Ms: -1, WaitMs: 1200}})
+	pc.onModelSwap(ModelSwapEvent{GroupID: "g", FromModel: "m", ToModel: "n"})
+	pc.onRequestRejected(RequestRejectedEvent{Reason: "rate_limit"})
+	pc.onSwapThrash(SwapThrashEvent{GroupID: "g", Swaps: 5, Window: time.Minute})
+
+	var out bytes.Buffer
+	pc.write(&out)
+	metrics := out.String()
+
+	for _, want := range []string{
+		`llama_swap_model_starts_total{model="m",result="success"} 1`,
+		`llama_swap_model_starts_total{model="m",result="failed"} 1`,
+		`llama_swap_model_start_duration_seconds_count{model="m"} 1`,
+		`llama_swap_tokens_total{model="m",type="input"} 10`,
+		`llama_swap_tokens_total{model="m",type="output"} 20`,
+		`llama_swap_prompt_tokens_per_second_count{model="m"} 1`,
+		`llama_swap_time_to_first_token_seconds_bucket{model="m",le="0.25"} 1`,
+		`llama_swap_request_wait_seconds_sum{model="m"} 1.2`,
+		`llama_swap_model_swaps_total{group="g",model="m"} 1`,
+		`llama_swap_rejected_requests_total{model="",reason="rate_limit"} 1`,
+		`llama_swap_swap_thrash_total{group="g"} 1`,
+	} {
+		assert.Contains(t, metrics, want)
+	}
+	// unknown values are not counted
+	assert.NotContains(t, metrics, `type="cached"`)
+	assert.NotContains(t, metrics, `llama_swap_generation_tokens_per_second_count{model="m"}`)
+	assert.NotContains(t, metrics, `llama_swap_inter_token_latency_seconds_count{model="m"}`)
+}
+
+func TestProxyManager_PrometheusMetrics(t *testing.T) {
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"prom-model1": getTestSimpleResponderConfig("prom-model1"),
+			"prom-model2": getTestSimpleResponderConfig("prom-model2"),
+		},
+		LogLevel: "error",
+	})
+
+	proxy := New(conf)
+	defer proxy.StopProcesses(StopWaitForInflightRequest)
+
+	for _, modelName := range []string{"prom-model1", "prom-model2"} {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(fmt.Sprintf(`{"model":"%s"}`, modelName)))
+		w := CreateTestResponseRecorder()
+		proxy.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	scrape := func() string {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, prometheusContentType, w.Header().Get("Content-Type"))
+		return w.Body.String()
+	}
+
+	// counters are fed asynchronously from the event bus
+	want := []string{
+		`llama_swap_requests_total{model="prom-model1",endpoint="/v1/chat/completions",status="200"} 1`,
+		`llama_swap_request_duration_seconds_count{model="prom-model2"} 1`,
+		`llama_swap_model_starts_total{model="prom-model1",result="success"} 1`,
+		`llama_swap_model_swaps_total{group="(default)",model="prom-model1"} 1`,
+		`llama_swap_tokens_total{model="prom-model2",type="output"}`,
+	}
+	assert.Eventually(t, func() bool {
+		metrics := scrape()
+		for _, w := range want {
+			if !strings.Contains(metrics, w) {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 50*time.Millisecond)
+
+	metrics := scrape()
+	assert.Contains(t, metrics, `llama_swap_process_state{model="prom-model1",state="stopped"} 1`)
+	assert.Contains(t, metrics, `llama_swap_process_state{model="prom-model2",state="ready"} 1`)
+	assert.Contains(t, metrics, `llama_swap_in_flight_requests{model="prom-model2"} 0`)
+	assert.Contains(t, metrics, `llama_swap_queued_requests{model="prom-model2"} 0`)
+}
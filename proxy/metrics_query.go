@@ -0,0 +1,406 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// metricsGroupKeys are the request fields the query API can group and filter by
+var metricsGroupKeys = []string{"model", "api_key", "endpoint", "status", "split"}
+
+// metricsQuery selects and groups records of the metrics store
+type metricsQuery struct {
+	From    time.Time
+	To      time.Time
+	Bucket  time.Duration // 0 for one bucket covering the whole range
+	GroupBy []string      // subset of metricsGroupKeys
+	Filters map[string]string
+}
+
+// latencySummary describes a set of measurements in milliseconds
+type latencySummary struct {
+	Count int     `json:"count"`
+	Mean  float64 `json:"mean"`
+	P50   float64 `json:"p50"`
+	P95   float64 `json:"p95"`
+	P99   float64 `json:"p99"`
+}
+
+// requestAggregate sums up the requests of one group and time bucket
+type requestAggregate struct {
+	Bucket       *time.Time `json:"bucket,omitempty"`
+	Model        *string    `json:"model,omitempty"`
+	APIKey       *string    `json:"api_key,omitempty"`
+	Endpoint     *string    `json:"endpoint,omitempty"`
+	Status       *int       `json:"status,omitempty"`
+	Split        *string    `json:"split,omitempty"`
+	Requests     int        `json:"requests"`
+	Errors       int        `json:"errors"`     // responses with a status of 400 or more
+	ErrorRate    float64    `json:"error_rate"` // Errors / Requests
+	InputTokens  int        `json:"input_tokens"`
+	OutputTokens int        `json:"output_tokens"`
+	CachedTokens int        `json:"cached_tokens"`
+
+	DurationMs      *latencySummary `json:"duration_ms"`
+	WaitMs          *latencySummary `json:"wait_ms"`
+	TTFTMs          *latencySummary `json:"ttft_ms"`
+	InterTokenMs    *latencySummary `json:"itl_ms"`
+	TokensPerSecond *latencySummary `json:"tokens_per_second"`
+
+	samples map[string][]float64
+}
+
+// modelAggregate counts the swaps and starts of one model and time bucket
+type modelAggregate struct {
+	Bucket       *time.Time      `json:"bucket,omitempty"`
+	Model        string          `json:"model"`
+	Swaps        int             `json:"swaps"`
+	Starts       int             `json:"starts"`
+	FailedStarts int             `json:"failed_starts"`
+	ColdStartMs  *latencySummary `json:"cold_start_ms"`
+
+	startSamples []float64
+}
+
+// metricsQueryResult is the response of /api/metrics/query
+type metricsQueryResult struct {
+	From     time.Time           `json:"from"`
+	To       time.Time           `json:"to"`
+	Bucket   string              `json:"bucket,omitempty"`
+	GroupBy  []string            `json:"group_by"`
+	Requests []*requestAggregate `json:"requests"`
+	Models   []*modelAggregate   `json:"models"`
+}
+
+// parseMetricsQuery reads a query from the URL parameters:
+//
+//   - from, to: RFC 3339 times or how long ago, e.g. 7d or 90m. Defaults to
+//     the last 24 hours.
+//   - bucket: size of the time buckets, e.g. 1h or 1d
+//   - groupBy: comma separated list of model, api_key, endpoint, status and
+//     split, defaults to model
+//   - model, api_key, endpoint, status, split: only include requests with
+//     this value
+func parseMetricsQuery(values map[string][]string, now time.Time) (metricsQuery, error) {
+	get := func(key string) string {
+		if v := values[key]; len(v) > 0 {
+			return strings.TrimSpace(v[0])
+		}
+		return ""
+	}
+
+	q := metricsQuery{To: now, Filters: make(map[string]string)}
+	if to := get("to"); to != "" {
+		t, err := parseQueryTime(to, now)
+		if err != nil {
+			return q, fmt.Errorf("invalid to: %w", err)
+		}
+		q.To = t
+	}
+	q.From = q.To.Add(-24 * time.Hour)
+	if from := get("from"); from != "" {
+		t, err := parseQueryTime(from, now)
+		if err != nil {
+			return q, fmt.Errorf("invalid from: %w", err)
+		}
+		q.From = t
+	}
+	if !q.From.Before(q.To) {
+		return q, fmt.Errorf("from must be before to")
+	}
+
+	if bucket := get("bucket"); bucket != "" {
+		d, err := parseQueryDuration(bucket)
+		if err != nil || d < time.Minute {
+			return q, fmt.Errorf("invalid bucket %q, must be at least 1m", bucket)
+		}
+		q.Bucket = d
+	}
+
+	groupBy := get("groupBy")
+	if groupBy == "" {
+		groupBy = "model"
+	}
+	for _, key := range strings.Split(groupBy, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		if !slices.Contains(metricsGroupKeys, key) {
+			return q, fmt.Errorf("invalid groupBy %q, must be one of: %s", key, strings.Join(metricsGroupKeys, ", "))
+		}
+		if !slices.Contains(q.GroupBy, key) {
+			q.GroupBy = append(q.GroupBy, key)
+		}
+	}
+
+	for _, key := range metricsGroupKeys {
+		if value := get(key); value != "" {
+			q.Filters[key] = value
+		}
+	}
+	return q, nil
+}
+
+// parseQueryTime parses an RFC 3339 time or a duration before now
+func parseQueryTime(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	d, err := parseQueryDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not an RFC 3339 time or a duration", value)
+	}
+	return now.Add(-d), nil
+}
+
+// parseQueryDuration parses a Go duration, with d for days added
+func parseQueryDuration(value string) (time.Duration, error) {
+	if days, found := strings.CutSuffix(value, "d"); found {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return d, nil
+}
+
+// requestField returns the value of a metricsGroupKeys field of tm
+func requestField(tm *TokenMetrics, key string) string {
+	switch key {
+	case "model":
+		return tm.Model
+	case "api_key":
+		return tm.APIKey
+	case "endpoint":
+		return tm.Endpoint
+	case "status":
+		return strconv.Itoa(tm.status())
+	case "split":
+		return tm.Split
+	}
+	return ""
+}
+
+// queryMetrics aggregates the records of the store selected by q
+func (s *metricsStore) queryMetrics(q metricsQuery) (metricsQueryResult, error) {
+	result := metricsQueryResult{
+		From:     q.From,
+		To:       q.To,
+		GroupBy:  q.GroupBy,
+		Requests: []*requestAggregate{},
+		Models:   []*modelAggregate{},
+	}
+	if q.Bucket > 0 {
+		result.Bucket = q.Bucket.String()
+	}
+
+	requests := make(map[string]*requestAggregate)
+	models := make(map[string]*modelAggregate)
+
+	bucketOf := func(t time.Time) (*time.Time, string) {
+		if q.Bucket == 0 {
+			return nil, ""
+		}
+		start := t.UTC().Truncate(q.Bucket)
+		return &start, start.Format(time.RFC3339)
+	}
+
+	err := s.read(q.From, q.To, func(record metricsRecord) {
+		if model, ok := q.Filters["model"]; ok && record.Model != model {
+			return
+		}
+		bucket, bucketKey := bucketOf(record.Timestamp)
+
+		if record.Type == metricsRecordRequest {
+			tm := record.Metrics
+			if tm == nil {
+				return
+			}
+			for key, value := range q.Filters {
+				if requestField(tm, key) != value {
+					return
+				}
+			}
+
+			parts := []string{bucketKey}
+			for _, key := range q.GroupBy {
+				parts = append(parts, requestField(tm, key))
+			}
+			groupKey := strings.Join(parts, "\xff")
+			agg, found := requests[groupKey]
+			if !found {
+				agg = &requestAggregate{Bucket: bucket, samples: make(map[string][]float64)}
+				for _, key := range q.GroupBy {
+					value := requestField(tm, key)
+					switch key {
+					case "model":
+						agg.Model = &value
+					case "api_key":
+						agg.APIKey = &value
+					case "endpoint":
+						agg.Endpoint = &value
+					case "status":
+						status, _ := strconv.Atoi(value)
+						agg.Status = &status
+					case "split":
+						agg.Split = &value
+					}
+				}
+				requests[groupKey] = agg
+			}
+			agg.add(tm)
+			return
+		}
+
+		groupKey := bucketKey + "\xff" + record.Model
+		agg, found := models[groupKey]
+		if !found {
+			agg = &modelAggregate{Bucket: bucket, Model: record.Model}
+			models[groupKey] = agg
+		}
+		switch record.Type {
+		case metricsRecordSwap:
+			agg.Swaps++
+		case metricsRecordStart:
+			if record.Start == nil {
+				return
+			}
+			agg.Starts++
+			if !record.Start.Success {
+				agg.FailedStarts++
+			} else {
+				agg.startSamples = append(agg.startSamples, float64(record.Start.ColdStartMs()))
+			}
+		}
+	})
+	if err != nil {
+		return result, err
+	}
+
+	for _, agg := range requests {
+		agg.DurationMs = summarizeLatency(agg.samples["duration"])
+		agg.WaitMs = summarizeLatency(agg.samples["wait"])
+		agg.TTFTMs = summarizeLatency(agg.samples["ttft"])
+		agg.InterTokenMs = summarizeLatency(agg.samples["itl"])
+		agg.TokensPerSecond = summarizeLatency(agg.samples["tps"])
+		agg.ErrorRate = float64(agg.Errors) / float64(agg.Requests)
+		result.Requests = append(result.Requests, agg)
+	}
+	for _, agg := range models {
+		agg.ColdStartMs = summarizeLatency(agg.startSamples)
+		result.Models = append(result.Models, agg)
+	}
+
+	sort.Slice(result.Requests, func(i, j int) bool {
+		return requestSortKey(result.Requests[i]) < requestSortKey(result.Requests[j])
+	})
+	sort.Slice(result.Models, func(i, j int) bool {
+		a, b := result.Models[i], result.Models[j]
+		if a.Bucket != nil && !a.Bucket.Equal(*b.Bucket) {
+			return a.Bucket.Before(*b.Bucket)
+		}
+		return a.Model < b.Model
+	})
+	return result, nil
+}
+
+func (agg *requestAggregate) add(tm *TokenMetrics) {
+	agg.Requests++
+	if tm.status() >= http.StatusBadRequest {
+		agg.Errors++
+	}
+	agg.InputTokens += tm.InputTokens
+	agg.OutputTokens += tm.OutputTokens
+	// -1 means unknown
+	if tm.CachedTokens > 0 {
+		agg.CachedTokens += tm.CachedTokens
+	}
+	agg.samples["duration"] = append(agg.samples["duration"], float64(tm.DurationMs))
+	agg.samples["wait"] = append(agg.samples["wait"], float64(tm.WaitMs))
+	if tm.TTFTMs >= 0 {
+		agg.samples["ttft"] = append(agg.samples["ttft"], float64(tm.TTFTMs))
+	}
+	if tm.InterTokenMeanMs >= 0 {
+		agg.samples["itl"] = append(agg.samples["itl"], tm.InterTokenMeanMs)
+	}
+	if tm.TokensPerSecond >= 0 {
+		agg.samples["tps"] = append(agg.samples["tps"], tm.TokensPerSecond)
+	}
+}
+
+func requestSortKey(agg *requestAggregate) string {
+	var key strings.Builder
+	if agg.Bucket != nil {
+		key.WriteString(agg.Bucket.Format(time.RFC3339))
+	}
+	for _, value := range []*string{agg.Model, agg.APIKey, agg.Endpoint, agg.Split} {
+		key.WriteByte(0)
+		if value != nil {
+			key.WriteString(*value)
+		}
+	}
+	key.WriteByte(0)
+	if agg.Status != nil {
+		key.WriteString(strconv.Itoa(*agg.Status))
+	}
+	return key.String()
+}
+
+// summarizeLatency returns the mean and percentiles of samples, nil when
+// there are none
+func summarizeLatency(samples []float64) *latencySummary {
+	if len(samples) == 0 {
+		return nil
+	}
+	sorted := slices.Clone(samples)
+	sort.Float64s(sorted)
+	total := 0.0
+	for _, sample := range sorted {
+		total += sample
+	}
+	return &latencySummary{
+		Count: len(sorted),
+		Mean:  total / float64(len(sorted)),
+		P50:   percentile(sorted, 0.50),
+		P95:   percentile(sorted, 0.95),
+		P99:   percentile(sorted, 0.99),
+	}
+}
+
+// percentile returns the nearest-rank percentile p of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
+
+func (pm *ProxyManager) apiQueryMetrics(c *gin.Context) {
+	if pm.metricsStore == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "metrics store is disabled, set metricsStore.path in the config"})
+		return
+	}
+	q, err := parseMetricsQuery(c.Request.URL.Query(), time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	result, err := pm.metricsStore.queryMetrics(q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to read metrics: %v", err)})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,261 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mostlygeek/llama-swap/event"
+)
+
+const (
+	metricsRecordRequest = "request"
+	metricsRecordSwap    = "swap"
+	metricsRecordStart   = "start"
+
+	// segments are named by the UTC day of their records, e.g. metrics-2025-01-31.jsonl
+	metricsSegmentPrefix = "metrics-"
+	metricsSegmentSuffix = ".jsonl"
+	metricsSegmentDay    = "2006-01-02"
+)
+
+// metricsRecord is one line of a metrics store segment
+type metricsRecord struct {
+	Type      string    `json:"type"` // request, swap or start
+	Timestamp time.Time `json:"timestamp"`
+	Model     string    `json:"model"`
+
+	// request records
+	Metrics *TokenMetrics `json:"metrics,omitempty"`
+
+	// swap records, Model was unloaded to run ToModel
+	Group   string `json:"group,omitempty"`
+	ToModel string `json:"to_model,omitempty"`
+
+	// start records
+	Start *ModelStart `json:"start,omitempty"`
+}
+
+// metricsStore persists metrics records to append-only JSONL files in dir,
+// one file per day. Files older than the retention are deleted.
+//
+// Every append opens the segment file on its own, so requests finishing on a
+// ProxyManager that was replaced by a config reload are still recorded.
+type metricsStore struct {
+	mu        sync.Mutex
+	dir       string
+	retention int // days
+	logger    *LogMonitor
+	lastPrune string // day of the last prune
+
+	unsubscribe []func()
+
+	now func() time.Time
+}
+
+// openMetricsStore creates dir if needed and removes expired segments
+func openMetricsStore(dir string, retentionDays int, logger *LogMonitor) (*metricsStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create metrics store directory: %w", err)
+	}
+	s := &metricsStore{
+		dir:       dir,
+		retention: retentionDays,
+		logger:    logger,
+		now:       time.Now,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune()
+	return s, nil
+}
+
+// subscribe records model swaps and starts from the event bus until close
+func (s *metricsStore) subscribe() *metricsStore {
+	s.unsubscribe = append(s.unsubscribe,
+		event.On(func(e ModelSwapEvent) {
+			s.append(metricsRecord{Type: metricsRecordSwap, Model: e.FromModel, Group: e.GroupID, ToModel: e.ToModel})
+		}),
+		event.On(func(e ModelStartEvent) {
+			s.recordStart(e.Start)
+		}),
+	)
+	return s
+}
+
+// close stops recording events. Request metrics can still be appended.
+func (s *metricsStore) close() {
+	for _, cancel := range s.unsubscribe {
+		cancel()
+	}
+	s.unsubscribe = nil
+}
+
+// recordMetrics appends a request record for tm
+func (s *metricsStore) recordMetrics(tm TokenMetrics) {
+	tm.HasCapture = false // captures are not persisted
+	s.append(metricsRecord{Type: metricsRecordRequest, Timestamp: tm.Timestamp, Model: tm.Model, Metrics: &tm})
+}
+
+// recordStart appends a start record for start
+func (s *metricsStore) recordStart(start ModelStart) {
+	s.append(metricsRecord{Type: metricsRecordStart, Timestamp: start.Timestamp, Model: start.Model, Start: &start})
+}
+
+// append writes record to the segment of its day
+func (s *metricsStore) append(record metricsRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if record.Timestamp.IsZero() {
+		record.Timestamp = s.now()
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		s.logger.Errorf("metrics store: failed to encode record: %v", err)
+		return
+	}
+
+	day := record.Timestamp.UTC().Format(metricsSegmentDay)
+	if day != s.lastPrune {
+		s.prune()
+	}
+
+	file, err := os.OpenFile(s.segmentPath(day), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		s.logger.Errorf("metrics store: %v", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		s.logger.Errorf("metrics store: failed to write record: %v", err)
+	}
+}
+
+func (s *metricsStore) segmentPath(day string) string {
+	return filepath.Join(s.dir, metricsSegmentPrefix+day+metricsSegmentSuffix)
+}
+
+// segments returns the days that have a segment file, oldest first
+func (s *metricsStore) segments() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var days []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, metricsSegmentPrefix) || !strings.HasSuffix(name, metricsSegmentSuffix) {
+			continue
+		}
+		day := strings.TrimSuffix(strings.TrimPrefix(name, metricsSegmentPrefix), metricsSegmentSuffix)
+		if _, err := time.Parse(metricsSegmentDay, day); err == nil {
+			days = append(days, day)
+		}
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+// prune deletes segments older than the retention. s.mu must be held.
+func (s *metricsStore) prune() {
+	now := s.now().UTC()
+	s.lastPrune = now.Format(metricsSegmentDay)
+	oldest := now.AddDate(0, 0, -s.retention).Format(metricsSegmentDay)
+
+	days, err := s.segments()
+	if err != nil {
+		s.logger.Errorf("metrics store: %v", err)
+		return
+	}
+	for _, day := range days {
+		if day > oldest {
+			break
+		}
+		if err := os.Remove(s.segmentPath(day)); err != nil {
+			s.logger.Errorf("metrics store: failed to remove expired segment: %v", err)
+		} else {
+			s.logger.Debugf("metrics store: removed expired segment %s", day)
+		}
+	}
+}
+
+// read calls fn for every record with a timestamp in [from, to), oldest
+// segment first. Lines that can not be decoded, like one cut short by a
+// crash, are skipped.
+func (s *metricsStore) read(from, to time.Time, fn func(metricsRecord)) error {
+	days, err := s.segments()
+	if err != nil {
+		return err
+	}
+	fromDay := from.UTC().Format(metricsSegmentDay)
+	toDay := to.UTC().Format(metricsSegmentDay)
+	for _, day := range days {
+		if day < fromDay || day > toDay {
+			continue
+		}
+		err := s.readSegment(day, func(record metricsRecord) {
+			if !record.Timestamp.Before(from) && record.Timestamp.Before(to) {
+				fn(record)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *metricsStore) readSegment(day string, fn func(metricsRecord)) error {
+	file, err := os.Open(s.segmentPath(day))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil // removed by prune
+		}
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record metricsRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		fn(record)
+	}
+	return scanner.Err()
+}
+
+// recentMetrics returns up to n of the newest request metrics, oldest first
+func (s *metricsStore) recentMetrics(n int) ([]TokenMetrics, error) {
+	days, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	var recent []TokenMetrics
+	for i := len(days) - 1; i >= 0 && len(recent) < n; i-- {
+		var segment []TokenMetrics
+		err := s.readSegment(days[i], func(record metricsRecord) {
+			if record.Type == metricsRecordRequest && record.Metrics != nil {
+				segment = append(segment, *record.Metrics)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		recent = append(segment, recent...)
+	}
+	if len(recent) > n {
+		recent = recent[len(recent)-n:]
+	}
+	return recent, nil
+}
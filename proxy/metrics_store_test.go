@@ -0,0 +1,358 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsStore_AppendAndRead(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	store, err := openMetricsStore(dir, 30, testLogger)
+	require.NoError(t, err)
+	store.now = func() time.Time { return now }
+
+	// segments of the last 30 days are kept
+	for _, day := range []string{"2025-02-08", "2025-02-09", "2025-02-10"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "metrics-"+day+".jsonl"), nil, 0644))
+	}
+	store.mu.Lock()
+	store.prune()
+	store.mu.Unlock()
+
+	days, err := store.segments()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2025-02-09", "2025-02-10"}, days)
+
+	store.recordMetrics(TokenMetrics{ID: 7, Timestamp: now.Add(-24 * time.Hour), Model: "a", OutputTokens: 1, HasCapture: true})
+	store.recordMetrics(TokenMetrics{Timestamp: now.Add(-time.Hour), Model: "b", OutputTokens: 2})
+	store.recordMetrics(TokenMetrics{Timestamp: now, Model: "c", OutputTokens: 3})
+	store.append(metricsRecord{Type: metricsRecordSwap, Model: "a", Group: "g", ToModel: "b"})
+
+	// a line cut short by a crash is skipped
+	segment := filepath.Join(dir, "metrics-2025-03-10.jsonl")
+	file, err := os.OpenFile(segment, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	file.WriteString(`{"type":"request","timest`)
+	file.Close()
+
+	var records []metricsRecord
+	require.NoError(t, store.read(now.Add(-2*time.Hour), now.Add(time.Second), func(r metricsRecord) {
+		records = append(records, r)
+	}))
+	require.Len(t, records, 3)
+	assert.Equal(t, "b", records[0].Model)
+	assert.Equal(t, metricsRecordSwap, records[2].Type)
+	assert.Equal(t, "g", records[2].Group)
+
+	recent, err := store.recentMetrics(2)
+	require.NoError(t, err)
+	require.Len(t, recent, 2)
+	assert.Equal(t, "b", recent[0].Model)
+	assert.Equal(t, "c", recent[1].Model)
+
+	recent, err = store.recentMetrics(10)
+	require.NoError(t, err)
+	require.Len(t, recent, 3)
+	assert.False(t, recent[0].HasCapture, "captures are not persisted")
+}
+
+func TestMetricsStore_RecordsStarts(t *testing.T) {
+	store, err := openMetricsStore(t.TempDir(), 30, testLogger)
+	require.NoError(t, err)
+
+	store.recordStart(ModelStart{Timestamp: time.Now(), Model: "m", Trigger: startTriggerRequest, StopPreviousMs: 500, SpawnMs: 2000, Success: true})
+	store.recordStart(ModelStart{Timestamp: time.Now(), Model: "m", Trigger: startTriggerRequest, SpawnMs: 100, Error: "exited"})
+
+	result, err := store.queryMetrics(metricsQuery{From: time.Now().Add(-time.Hour), To: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	require.Len(t, result.Models, 1)
+	assert.Equal(t, "m", result.Models[0].Model)
+	assert.Equal(t, 2, result.Models[0].Starts)
+	assert.Equal(t, 1, result.Models[0].FailedStarts)
+	require.NotNil(t, result.Models[0].ColdStartMs)
+	assert.Equal(t, 1, result.Models[0].ColdStartMs.Count)
+	assert.Equal(t, 2500.0, result.Models[0].ColdStartMs.Mean)
+}
+
+func TestMetricsStore_Query(t *testing.T) {
+	store, err := openMetricsStore(t.TempDir(), 30, testLogger)
+	require.NoError(t, err)
+
+	base := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return base }
+	add := func(minutes int, model, key, endpoint string, output, durationMs, ttftMs int) {
+		store.recordMetrics(TokenMetrics{
+			Timestamp:        base.Add(time.Duration(minutes) * time.Minute),
+			Model:            model,
+			APIKey:           key,
+			Endpoint:         endpoint,
+			InputTokens:      10,
+			OutputTokens:     output,
+			CachedTokens:     -1,
+			TokensPerSecond:  -1,
+			DurationMs:       durationMs,
+			TTFTMs:           ttftMs,
+			InterTokenMeanMs: -1,
+		})
+	}
+	add(0, "a", "key-1", "/v1/chat/completions", 5, 100, 10)
+	add(10, "a", "key-1", "/v1/chat/completions", 5, 200, 20)
+	add(20, "a", "key-2", "/v1/completions", 5, 300, -1)
+	add(70, "a", "key-1", "/v1/chat/completions", 5, 400, 40)
+	add(80, "b", "key-1", "/v1/chat/completions", 7, 500, 50)
+	store.append(metricsRecord{Type: metricsRecordSwap, Timestamp: base.Add(75 * time.Minute), Model: "a", ToModel: "b"})
+
+	t.Run("group by model", func(t *testing.T) {
+		result, err := store.queryMetrics(metricsQuery{From: base, To: base.Add(2 * time.Hour), GroupBy: []string{"model"}})
+		require.NoError(t, err)
+		require.Len(t, result.Requests, 2)
+
+		a := result.Requests[0]
+		assert.Equal(t, "a", *a.Model)
+		assert.Nil(t, a.APIKey)
+		assert.Nil(t, a.Bucket)
+		assert.Equal(t, 4, a.Requests)
+		assert.Equal(t, 40, a.InputTokens)
+		assert.Equal(t, 20, a.OutputTokens)
+		assert.Equal(t, 0, a.CachedTokens)
+		assert.Equal(t, 250.0, a.DurationMs.Mean)
+		assert.Equal(t, 200.0, a.DurationMs.P50)
+		assert.Equal(t, 400.0, a.DurationMs.P95)
+		assert.Equal(t, 3, a.TTFTMs.Count)
+		assert.Nil(t, a.InterTokenMs)
+		assert.Nil(t, a.TokensPerSecond)
+
+		require.Len(t, result.Models, 1)
+		assert.Equal(t, 1, result.Models[0].Swaps)
+		assert.Nil(t, result.Models[0].ColdStartMs)
+	})
+
+	t.Run("buckets and filters", func(t *testing.T) {
+		result, err := store.queryMetrics(metricsQuery{
+			From:    base,
+			To:      base.Add(2 * time.Hour),
+			Bucket:  time.Hour,
+			GroupBy: []string{"api_key", "endpoint"},
+			Filters: map[string]string{"model": "a"},
+		})
+		require.NoError(t, err)
+		require.Len(t, result.Requests, 3)
+		assert.Equal(t, base, *result.Requests[0].Bucket)
+		assert.Equal(t, "key-1", *result.Requests[0].APIKey)
+		assert.Equal(t, 2, result.Requests[0].Requests)
+		assert.Equal(t, "key-2", *result.Requests[1].APIKey)
+		assert.Equal(t, "/v1/completions", *result.Requests[1].Endpoint)
+		assert.Equal(t, base.Add(time.Hour), *result.Requests[2].Bucket)
+		assert.Equal(t, 1, result.Requests[2].Requests)
+		assert.Nil(t, result.Requests[2].Model)
+	})
+
+	t.Run("time range", func(t *testing.T) {
+		result, err := store.queryMetrics(metricsQuery{From: base.Add(time.Hour), To: base.Add(75 * time.Minute), GroupBy: []string{"model"}})
+		require.NoError(t, err)
+		require.Len(t, result.Requests, 1)
+		assert.Equal(t, 1, result.Requests[0].Requests)
+		assert.Empty(t, result.Models)
+	})
+}
+
+func TestMetricsStore_QueryErrors(t *testing.T) {
+	store, err := openMetricsStore(t.TempDir(), 30, testLogger)
+	require.NoError(t, err)
+
+	base := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return base }
+	for i, status := range []int{0, 200, 200, 400, 429, 429, 500} {
+		model := "a"
+		if i%2 == 1 {
+			model = "b"
+		}
+		store.recordMetrics(TokenMetrics{Timestamp: base.Add(time.Duration(i) * time.Minute), Model: model, StatusCode: status})
+	}
+
+	t.Run("error rate per model", func(t *testing.T) {
+		result, err := store.queryMetrics(metricsQuery{From: base, To: base.Add(time.Hour), GroupBy: []string{"model"}})
+		require.NoError(t, err)
+		require.Len(t, result.Requests, 2)
+		assert.Equal(t, "a", *result.Requests[0].Model)
+		assert.Equal(t, 4, result.Requests[0].Requests)
+		assert.Equal(t, 2, result.Requests[0].Errors)
+		assert.Equal(t, 0.5, result.Requests[0].ErrorRate)
+		assert.Equal(t, 3, result.Requests[1].Requests)
+		assert.Equal(t, 2, result.Requests[1].Errors)
+	})
+
+	t.Run("per status", func(t *testing.T) {
+		result, err := store.queryMetrics(metricsQuery{From: base, To: base.Add(time.Hour), GroupBy: []string{"status"}})
+		require.NoError(t, err)
+		require.Len(t, result.Requests, 4)
+		var statuses, counts []int
+		for _, agg := range result.Requests {
+			statuses = append(statuses, *agg.Status)
+			counts = append(counts, agg.Requests)
+		}
+		// metrics recorded before the status count as 200
+		assert.Equal(t, []int{200, 400, 429, 500}, statuses)
+		assert.Equal(t, []int{3, 1, 2, 1}, counts)
+		assert.Equal(t, 1.0, result.Requests[2].ErrorRate)
+	})
+
+	t.Run("filter by status", func(t *testing.T) {
+		result, err := store.queryMetrics(metricsQuery{From: base, To: base.Add(time.Hour), GroupBy: []string{"model"}, Filters: map[string]string{"status": "429"}})
+		require.NoError(t, err)
+		require.Len(t, result.Requests, 2)
+		assert.Equal(t, 1, result.Requests[0].Requests)
+		assert.Equal(t, 1, result.Requests[1].Requests)
+	})
+}
+
+func TestMetricsStore_QuerySplits(t *testing.T) {
+	store, err := openMetricsStore(t.TempDir(), 30, testLogger)
+	require.NoError(t, err)
+
+	base := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return base }
+	for i, model := range []string{"a", "b", "a", "a"} {
+		store.recordMetrics(TokenMetrics{Timestamp: base.Add(time.Duration(i) * time.Minute), Model: model, Split: "ab", DurationMs: 100 * (i + 1)})
+	}
+	store.recordMetrics(TokenMetrics{Timestamp: base.Add(5 * time.Minute), Model: "a"})
+
+	result, err := store.queryMetrics(metricsQuery{From: base, To: base.Add(time.Hour), GroupBy: []string{"split", "model"}, Filters: map[string]string{"split": "ab"}})
+	require.NoError(t, err)
+	require.Len(t, result.Requests, 2)
+	assert.Equal(t, "ab", *result.Requests[0].Split)
+	assert.Equal(t, "a", *result.Requests[0].Model)
+	assert.Equal(t, 3, result.Requests[0].Requests)
+	assert.Equal(t, "b", *result.Requests[1].Model)
+	assert.Equal(t, 1, result.Requests[1].Requests)
+	assert.Equal(t, 200.0, result.Requests[1].DurationMs.Mean)
+}
+
+func TestParseMetricsQuery(t *testing.T) {
+	now := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	q, err := parseMetricsQuery(url.Values{}, now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(-24*time.Hour), q.From)
+	assert.Equal(t, now, q.To)
+	assert.Equal(t, []string{"model"}, q.GroupBy)
+	assert.Zero(t, q.Bucket)
+
+	q, err = parseMetricsQuery(url.Values{
+		"from":     {"7d"},
+		"to":       {"2025-03-10T11:00:00Z"},
+		"bucket":   {"1d"},
+		"groupBy":  {"api_key, endpoint,api_key"},
+		"model":    {"llama"},
+		"endpoint": {"/v1/chat/completions"},
+	}, now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(-7*24*time.Hour), q.From)
+	assert.Equal(t, now.Add(-time.Hour), q.To)
+	assert.Equal(t, 24*time.Hour, q.Bucket)
+	assert.Equal(t, []string{"api_key", "endpoint"}, q.GroupBy)
+	assert.Equal(t, map[string]string{"model": "llama", "endpoint": "/v1/chat/completions"}, q.Filters)
+
+	for _, values := range []url.Values{
+		{"from": {"yesterday"}},
+		{"from": {"1h"}, "to": {"2h"}},
+		{"bucket": {"10s"}},
+		{"groupBy": {"user"}},
+	} {
+		_, err := parseMetricsQuery(values, now)
+		assert.Error(t, err, values)
+	}
+}
+
+func TestProxyManager_MetricsStore(t *testing.T) {
+	dir := t.TempDir()
+	newConfig := func() config.Config {
+		conf := config.AddDefaultGroupToConfig(config.Config{
+			HealthCheckTimeout: 15,
+			Models: map[string]config.ModelConfig{
+				"store-model": getTestSimpleResponderConfig("store-model"),
+			},
+			LogLevel:        "error",
+			RequiredAPIKeys: []string{"secret-key"},
+		})
+		conf.MetricsStore = config.MetricsStoreConfig{Path: dir, RetentionDays: 30}
+		return conf
+	}
+
+	proxy := New(newConfig())
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"store-model"}`))
+		req.Header.Set("Authorization", "Bearer secret-key")
+		w := CreateTestResponseRecorder()
+		proxy.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+	proxy.StopProcesses(StopWaitForInflightRequest)
+	proxy.Shutdown()
+
+	// metrics survive the ProxyManager being replaced
+	proxy = New(newConfig())
+	defer proxy.Shutdown()
+	assert.Len(t, proxy.metricsMonitor.getMetrics(), 2)
+
+	req := httptest.NewRequest("GET", "/api/metrics/query?groupBy=model,api_key,endpoint", nil)
+	req.Header.Set("Authorization", "Bearer secret-key")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var result metricsQueryResult
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	require.Len(t, result.Requests, 1)
+	agg := result.Requests[0]
+	assert.Equal(t, "store-model", *agg.Model)
+	assert.Equal(t, apiKeyID("secret-key"), *agg.APIKey)
+	assert.NotContains(t, w.Body.String(), "secret-key")
+	assert.Equal(t, "/v1/chat/completions", *agg.Endpoint)
+	assert.Equal(t, 2, agg.Requests)
+
+	req = httptest.NewRequest("GET", "/api/metrics/query?groupBy=status", nil)
+	req.Header.Set("Authorization", "Bearer secret-key")
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	require.Len(t, result.Requests, 1)
+	assert.Equal(t, http.StatusOK, *result.Requests[0].Status)
+	assert.Equal(t, 0, result.Requests[0].Errors)
+
+	req = httptest.NewRequest("GET", "/api/metrics/query?groupBy=user", nil)
+	req.Header.Set("Authorization", "Bearer secret-key")
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestProxyManager_MetricsStoreDisabled(t *testing.T) {
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models:             map[string]config.ModelConfig{},
+		LogLevel:           "error",
+	})
+	proxy := New(conf)
+	defer proxy.Shutdown()
+
+	req := httptest.NewRequest("GET", "/api/metrics/query", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code, fmt.Sprintf("body: %s", w.Body.String()))
+}
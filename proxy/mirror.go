@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/tidwall/sjson"
+)
+
+// mirrorRequest sends the request r for modelID, with the body the client
+// sent, to the shadow models of the mirrors that sample it. It is called
+// once the response of the primary model was written, the shadow requests
+// run in the background and their responses are discarded.
+func (pm *ProxyManager) mirrorRequest(r *http.Request, modelID string, body []byte) {
+	pm.RLock()
+	mirrors := pm.config.Mirrors
+	pm.RUnlock()
+	for _, mirror := range mirrors {
+		if mirror.Model != modelID || rand.Float64()*100 >= mirror.Percent {
+			continue
+		}
+		header := r.Header.Clone()
+		go pm.sendMirror(mirror, r.Method, r.URL.RequestURI(), header, requestIDOf(r), body)
+	}
+}
+
+// sendMirror sends a copy of a request to the shadow of mirror and records
+// it with mirror_of set to the request ID of the primary request
+func (pm *ProxyManager) sendMirror(mirror config.MirrorConfig, method, uri string, header http.Header, primaryID string, body []byte) {
+	ctx := context.WithValue(pm.shutdownCtx, proxyCtxKey("mirrorOf"), primaryID)
+	// loading messages would end up in the captured response
+	ctx = context.WithValue(ctx, proxyCtxKey("streaming"), false)
+	ctx = context.WithValue(ctx, proxyCtxKey("model"), mirror.Shadow)
+	ctx = context.WithValue(ctx, proxyCtxKey("startTrigger"), startTriggerMirror)
+
+	target, err := pm.resolveShadowTarget(ctx, mirror)
+	if err != nil {
+		pm.proxyLogger.Debugf("<%s> not mirroring request %s to %s: %v", mirror.Model, primaryID, mirror.Shadow, err)
+		return
+	}
+
+	body, err = sjson.SetBytes(body, "model", mirror.Shadow)
+	if err == nil {
+		body, err = pm.applyModelFilters(target, mirror.Shadow, body)
+	}
+	if err != nil {
+		pm.proxyLogger.Warnf("<%s> not mirroring request %s to %s: %v", mirror.Model, primaryID, mirror.Shadow, err)
+		return
+	}
+
+	r, err := http.NewRequestWithContext(ctx, method, uri, bytes.NewReader(body))
+	if err != nil {
+		pm.proxyLogger.Warnf("<%s> not mirroring request %s to %s: %v", mirror.Model, primaryID, mirror.Shadow, err)
+		return
+	}
+	r.Header = header
+	r.Header.Del(requestIDHeader)
+	r.Header.Del("Transfer-Encoding")
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	r, _ = withRequestID(r)
+
+	w := &mirrorResponseWriter{header: make(http.Header)}
+	if pm.metricsMonitor != nil && method == http.MethodPost {
+		err = pm.metricsMonitor.wrapHandler(target.modelID, w, r, target.handler)
+	} else {
+		err = target.handler(target.modelID, w, r)
+	}
+	if err != nil {
+		pm.proxyLogger.Warnf("<%s> mirrored request %s to %s failed: %v", mirror.Model, primaryID, mirror.Shadow, err)
+	}
+}
+
+// errShadowNotLoaded is why requests are not mirrored to a stopped shadow
+// without loadShadow
+var errShadowNotLoaded = errors.New("shadow model is not loaded")
+
+// errShadowEvictsPrimary is why a stopped shadow is not started
+var errShadowEvictsPrimary = errors.New("loading the shadow model would unload the primary model")
+
+// resolveShadowTarget returns where to send the requests for the shadow of
+// mirror. A loaded local shadow is sent the request directly, without a
+// swap. A stopped one is only started with loadShadow, and never when that
+// unloads the primary model.
+func (pm *ProxyManager) resolveShadowTarget(ctx context.Context, mirror config.MirrorConfig) (*resolvedModelTarget, error) {
+	// the config and groups can be replaced by an edit of the config
+	pm.RLock()
+	shadowConfig := pm.config.Models[mirror.Shadow]
+	shadowGroup := pm.findGroupByModelName(mirror.Shadow)
+	primaryGroup := pm.findGroupByModelName(mirror.Model)
+	pm.RUnlock()
+	if shadowGroup == nil {
+		if pm.peerProxy != nil && pm.peerProxy.HasPeerModel(mirror.Shadow) {
+			return &resolvedModelTarget{modelID: mirror.Shadow, isPeer: true, handler: pm.peerProxy.ProxyRequest}, nil
+		}
+		return nil, errors.New("shadow model not found")
+	}
+
+	target := &resolvedModelTarget{
+		modelID:      mirror.Shadow,
+		useModelName: shadowConfig.UseModelName,
+	}
+	process, found := shadowGroup.GetMember(mirror.Shadow)
+	if !found {
+		return nil, errors.New("shadow model not found")
+	}
+	if process.CurrentState() == StateReady {
+		target.handler = func(_ string, w http.ResponseWriter, r *http.Request) error {
+			process.ProxyRequest(w, r)
+			return nil
+		}
+		return target, nil
+	}
+
+	if !mirror.LoadShadow {
+		return nil, errShadowNotLoaded
+	}
+	if primaryGroup != nil {
+		if primaryGroup == shadowGroup && shadowGroup.swap {
+			return nil, errShadowEvictsPrimary
+		}
+		if primaryGroup != shadowGroup && shadowGroup.exclusive && !primaryGroup.persistent {
+			return nil, errShadowEvictsPrimary
+		}
+	}
+	processGroup, err := pm.swapProcessGroup(ctx, mirror.Shadow)
+	if err != nil {
+		return nil, err
+	}
+	target.handler = processGroup.ProxyRequest
+	return target, nil
+}
+
+// mirrorResponseWriter discards the response of a shadow request. It is a
+// gin.ResponseWriter so the metrics monitor can record the response.
+type mirrorResponseWriter struct {
+	header http.Header
+	status int
+	size   int
+}
+
+func (w *mirrorResponseWriter) Header() http.Header { return w.header }
+
+func (w *mirrorResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *mirrorResponseWriter) WriteHeaderNow() { w.WriteHeader(http.StatusOK) }
+
+func (w *mirrorResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	w.size += len(b)
+	return len(b), nil
+}
+
+func (w *mirrorResponseWriter) WriteString(s string) (int, error) { return w.Write([]byte(s)) }
+
+func (w *mirrorResponseWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *mirrorResponseWriter) Size() int {
+	if w.status == 0 {
+		return -1
+	}
+	return w.size
+}
+
+func (w *mirrorResponseWriter) Written() bool { return w.status != 0 }
+
+func (w *mirrorResponseWriter) Flush() {}
+
+// CloseNotify never fires, shadow requests end with llama-swap
+func (w *mirrorResponseWriter) CloseNotify() <-chan bool { return nil }
+
+func (w *mirrorResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, errors.New("shadow requests can not be hijacked")
+}
+
+func (w *mirrorResponseWriter) Pusher() http.Pusher { return nil }
+
+// mirrorOf returns the request ID of the primary request of a shadow
+// request, empty for other requests
+func mirrorOf(r *http.Request) string {
+	id, _ := r.Context().Value(proxyCtxKey("mirrorOf")).(string)
+	return id
+}
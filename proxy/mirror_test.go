@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+)
+
+// shadowMetrics returns the metrics of the requests mirrored to shadow
+func shadowMetrics(proxy *ProxyManager, shadow string) []TokenMetrics {
+	var found []TokenMetrics
+	for _, tm := range proxy.metricsMonitor.getMetrics() {
+		if tm.Model == shadow && tm.MirrorOf != "" {
+			found = append(found, tm)
+		}
+	}
+	return found
+}
+
+func TestProxyManager_Mirror(t *testing.T) {
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"primary": getTestSimpleResponderConfig("primary"),
+			"shadow":  getTestSimpleResponderConfig("shadow"),
+		},
+		Groups: map[string]config.GroupConfig{
+			"both": {Swap: false, Members: []string{"primary", "shadow"}},
+		},
+		Mirrors:       []config.MirrorConfig{{Model: "primary", Shadow: "shadow", Percent: 100, LoadShadow: true}},
+		CaptureBuffer: 5,
+		LogLevel:      "error",
+	})
+	proxy := New(conf)
+	defer proxy.StopProcesses(StopImmediately)
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"primary","messages":[]}`))
+	req.Header.Set(requestIDHeader, "primary-1")
+	w := CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// the client only gets the response of the primary
+	assert.Equal(t, "primary", gjson.Get(w.Body.String(), "responseMessage").String())
+
+	require.Eventually(t, func() bool {
+		return len(shadowMetrics(proxy, "shadow")) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	shadow := shadowMetrics(proxy, "shadow")[0]
+	assert.Equal(t, "primary-1", shadow.MirrorOf)
+	assert.NotEqual(t, "primary-1", shadow.RequestID)
+	assert.Equal(t, http.StatusOK, shadow.StatusCode)
+	assert.Equal(t, 25, shadow.InputTokens)
+
+	require.True(t, shadow.HasCapture)
+	capture := proxy.metricsMonitor.getCaptureByID(shadow.ID)
+	require.NotNil(t, capture)
+	assert.Equal(t, "primary-1", capture.MirrorOf)
+	assert.Equal(t, "shadow", gjson.GetBytes(capture.ReqBody, "model").String())
+	assert.Equal(t, "shadow", gjson.GetBytes(capture.RespBody, "responseMessage").String())
+
+	// requests for the shadow itself are not mirrored
+	req = httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"shadow","messages":[]}`))
+	w = CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, shadowMetrics(proxy, "shadow"), 1)
+}
+
+func TestProxyManager_MirrorNeverEvictsPrimary(t *testing.T) {
+	for name, loadShadow := range map[string]bool{"shadow not loaded": false, "loading evicts primary": true} {
+		t.Run(name, func(t *testing.T) {
+			conf := config.AddDefaultGroupToConfig(config.Config{
+				HealthCheckTimeout: 15,
+				Models: map[string]config.ModelConfig{
+					"primary": getTestSimpleResponderConfig("primary"),
+					"shadow":  getTestSimpleResponderConfig("shadow"),
+				},
+				Mirrors:  []config.MirrorConfig{{Model: "primary", Shadow: "shadow", Percent: 100, LoadShadow: loadShadow}},
+				LogLevel: "error",
+			})
+			proxy := New(conf)
+			defer proxy.StopProcesses(StopImmediately)
+
+			for i := 0; i < 3; i++ {
+				req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"primary","messages":[]}`))
+				w := CreateTestResponseRecorder()
+				proxy.ServeHTTP(w, req)
+				require.Equal(t, http.StatusOK, w.Code)
+			}
+			time.Sleep(100 * time.Millisecond)
+
+			group := proxy.findGroupByModelName("primary")
+			assert.Equal(t, StateReady, group.processes["primary"].CurrentState())
+			assert.Equal(t, StateStopped, group.processes["shadow"].CurrentState())
+			assert.Empty(t, shadowMetrics(proxy, "shadow"))
+		})
+	}
+}
+
+func TestProxyManager_MirrorResolveShadowTarget(t *testing.T) {
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"primary":   getTestSimpleResponderConfig("primary"),
+			"exclusive": getTestSimpleResponderConfig("exclusive"),
+			"same":      getTestSimpleResponderConfig("same"),
+		},
+		Groups: map[string]config.GroupConfig{
+			"main":  {Swap: false, Exclusive: false, Members: []string{"primary", "same"}},
+			"other": {Swap: true, Exclusive: true, Members: []string{"exclusive"}},
+		},
+		LogLevel: "error",
+	})
+	proxy := New(conf)
+	defer proxy.StopProcesses(StopImmediately)
+
+	_, err := proxy.resolveShadowTarget(t.Context(), config.MirrorConfig{Model: "primary", Shadow: "same"})
+	assert.ErrorIs(t, err, errShadowNotLoaded)
+
+	// an exclusive group would unload the primary
+	_, err = proxy.resolveShadowTarget(t.Context(), config.MirrorConfig{Model: "primary", Shadow: "exclusive", LoadShadow: true})
+	assert.ErrorIs(t, err, errShadowEvictsPrimary)
+
+	// a group that runs its models together does not
+	target, err := proxy.resolveShadowTarget(t.Context(), config.MirrorConfig{Model: "primary", Shadow: "same", LoadShadow: true})
+	require.NoError(t, err)
+	assert.Equal(t, "same", target.modelID)
+	assert.False(t, target.isPeer)
+
+	// a member without a process is not found rather than used
+	group := proxy.findGroupByModelName("exclusive")
+	group.Lock()
+	delete(group.processes, "exclusive")
+	group.Unlock()
+	_, err = proxy.resolveShadowTarget(t.Context(), config.MirrorConfig{Model: "primary", Shadow: "exclusive"})
+	assert.EqualError(t, err, "shadow model not found")
+
+	// neither is a shadow removed by an edit of the config
+	updated := conf
+	updated.Models = map[string]config.ModelConfig{"primary": conf.Models["primary"]}
+	updated.Groups = map[string]config.GroupConfig{"main": {Swap: false, Members: []string{"primary"}}}
+	proxy.applyConfigAndSyncProcessGroups(updated)
+	_, err = proxy.resolveShadowTarget(t.Context(), config.MirrorConfig{Model: "primary", Shadow: "same"})
+	assert.EqualError(t, err, "shadow model not found")
+}
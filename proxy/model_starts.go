@@ -0,0 +1,321 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mostlygeek/llama-swap/event"
+)
+
+// what caused a model to start
+const (
+	startTriggerRequest = "request" // an inference request
+	startTriggerPreload = "preload" // hooks.on_startup.preload
+	startTriggerBenchy  = "benchy"  // a benchy run
+	startTriggerAPI     = "api"     // a request to /upstream, e.g. the Load button of the UI
+	startTriggerMirror  = "mirror"  // a mirrored request to a shadow model
+)
+
+// modelStartLogTailLines is how much upstream output is kept with a failed start
+const modelStartLogTailLines = 20
+
+// ModelStart describes one attempt to start a model
+type ModelStart struct {
+	Timestamp time.Time `json:"timestamp"` // when the start finished
+	Model     string    `json:"model"`
+	Trigger   string    `json:"trigger"` // request, preload, benchy or api
+
+	// time spent stopping the models that were unloaded to make room
+	StopPreviousMs int `json:"stop_previous_ms"`
+	// time from running the command to the health check passing
+	SpawnMs int `json:"spawn_ms"`
+	// part of SpawnMs after the upstream first answered the health check,
+	// i.e. loading the weights and warming up
+	WarmupMs int `json:"warmup_ms"`
+
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+	LogTail string `json:"log_tail,omitempty"` // last lines of upstream output when the start failed
+}
+
+// ColdStartMs is the time it took until the model could serve requests
+func (s ModelStart) ColdStartMs() int {
+	return s.StopPreviousMs + s.SpawnMs
+}
+
+// withStartTrigger records in the request context what a model started for
+// r would be started for
+func withStartTrigger(r *http.Request, trigger string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), proxyCtxKey("startTrigger"), trigger))
+}
+
+func startTriggerOf(r *http.Request) string {
+	if trigger, ok := r.Context().Value(proxyCtxKey("startTrigger")).(string); ok {
+		return trigger
+	}
+	return startTriggerRequest
+}
+
+// errHealthCheckStatus is returned by checkHealthEndpoint when the upstream
+// answered with a status other than 200
+var errHealthCheckStatus = errors.New("status code")
+
+// startTelemetry times a start of a Process, see ModelStart
+type startTelemetry struct {
+	process  *Process
+	start    ModelStart
+	spawned  time.Time // when the command was run
+	answered time.Time // when the upstream first answered the health check
+
+	// the start is traced as a span with children for the time until the
+	// upstream answered and for the warmup after it
+	ctx         context.Context
+	span        *span
+	phase       *span
+	healthCount int
+}
+
+func (p *Process) beginStartTelemetry(ctx context.Context, trigger string) *startTelemetry {
+	ctx, span := startSpan(ctx, "start "+p.ID, spanKindInternal)
+	span.setAttr("llama_swap.model", p.ID)
+	span.setAttr("llama_swap.start_trigger", trigger)
+	return &startTelemetry{
+		process: p,
+		start: ModelStart{
+			Model:          p.ID,
+			Trigger:        trigger,
+			StopPreviousMs: int(time.Duration(p.stopPreviousNanos.Swap(0)).Milliseconds()),
+		},
+		ctx:  ctx,
+		span: span,
+	}
+}
+
+// markSpawned records that the command was run
+func (t *startTelemetry) markSpawned() {
+	t.spawned = time.Now()
+	_, t.phase = startSpan(t.ctx, "spawn", spanKindInternal)
+}
+
+// healthChecked records the result of a health check
+func (t *startTelemetry) healthChecked(err error) {
+	t.healthCount++
+	if err != nil {
+		t.span.addEvent("health check failed", map[string]any{"error": err.Error()})
+	}
+	if t.answered.IsZero() && (err == nil || errors.Is(err, errHealthCheckStatus)) {
+		t.answered = time.Now()
+		t.phase.end()
+		_, t.phase = startSpan(t.ctx, "warmup", spanKindInternal)
+	}
+}
+
+// finish emits the ModelStartEvent, err is the result of the start
+func (t *startTelemetry) finish(err error) {
+	now := time.Now()
+	t.start.Timestamp = now
+	if !t.spawned.IsZero() {
+		t.start.SpawnMs = int(now.Sub(t.spawned).Milliseconds())
+		if !t.answered.IsZero() {
+			t.start.WarmupMs = int(now.Sub(t.answered).Milliseconds())
+		}
+	}
+	t.start.Success = err == nil
+	if err != nil {
+		t.start.Error = err.Error()
+		t.start.LogTail = logTail(t.process.processLogger.GetHistory(), modelStartLogTailLines)
+	}
+	t.phase.setError(err)
+	t.phase.end()
+	t.span.setAttr("llama_swap.health_checks", t.healthCount)
+	t.span.setError(err)
+	t.span.end()
+	event.Emit(ModelStartEvent{Start: t.start})
+}
+
+// addStopPrevious records time spent unloading other models so p can start
+func (p *Process) addStopPrevious(d time.Duration) {
+	p.stopPreviousNanos.Add(int64(d))
+}
+
+// logTail returns the last n lines of log
+func logTail(log []byte, n int) string {
+	log = bytes.TrimRight(log, "\n")
+	start := len(log)
+	for i := 0; i < n && start > 0; i++ {
+		start = bytes.LastIndexByte(log[:start], '\n')
+		if start < 0 {
+			start = 0
+			break
+		}
+	}
+	return strings.TrimLeft(string(log[start:]), "\n")
+}
+
+// modelStartSummary sums up the starts of a model
+type modelStartSummary struct {
+	Model    string         `json:"model"`
+	Starts   int            `json:"starts"`
+	Failures int            `json:"failures"`
+	Triggers map[string]int `json:"triggers"`
+
+	// of successful starts
+	ColdStartMs    *latencySummary `json:"cold_start_ms"`
+	StopPreviousMs *latencySummary `json:"stop_previous_ms"`
+	SpawnMs        *latencySummary `json:"spawn_ms"`
+	WarmupMs       *latencySummary `json:"warmup_ms"`
+
+	LastFailure *ModelStart `json:"last_failure,omitempty"`
+}
+
+// summarizeModelStarts sums up starts per model, sorted by model
+func summarizeModelStarts(starts []ModelStart) []*modelStartSummary {
+	byModel := make(map[string]*modelStartSummary)
+	samples := make(map[string]map[string][]float64)
+	for i := range starts {
+		start := starts[i]
+		summary, found := byModel[start.Model]
+		if !found {
+			summary = &modelStartSummary{Model: start.Model, Triggers: make(map[string]int)}
+			byModel[start.Model] = summary
+			samples[start.Model] = make(map[string][]float64)
+		}
+		summary.Starts++
+		summary.Triggers[start.Trigger]++
+		if !start.Success {
+			summary.Failures++
+			if summary.LastFailure == nil || start.Timestamp.After(summary.LastFailure.Timestamp) {
+				summary.LastFailure = &start
+			}
+			continue
+		}
+		s := samples[start.Model]
+		s["cold"] = append(s["cold"], float64(start.ColdStartMs()))
+		s["stop"] = append(s["stop"], float64(start.StopPreviousMs))
+		s["spawn"] = append(s["spawn"], float64(start.SpawnMs))
+		s["warmup"] = append(s["warmup"], float64(start.WarmupMs))
+	}
+
+	summaries := make([]*modelStartSummary, 0, len(byModel))
+	for model, summary := range byModel {
+		s := samples[model]
+		summary.ColdStartMs = summarizeLatency(s["cold"])
+		summary.StopPreviousMs = summarizeLatency(s["stop"])
+		summary.SpawnMs = summarizeLatency(s["spawn"])
+		summary.WarmupMs = summarizeLatency(s["warmup"])
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Model < summaries[j].Model })
+	return summaries
+}
+
+// modelStartsQuery selects starts by time, model and outcome
+type modelStartsQuery struct {
+	From, To time.Time
+	Model    string
+	Failed   bool // only failed starts
+	Limit    int
+}
+
+// parseModelStartsQuery reads from, to (as in /api/metrics/query), model,
+// failed and limit
+func parseModelStartsQuery(c *gin.Context, now time.Time) (modelStartsQuery, error) {
+	q := modelStartsQuery{To: now, Model: c.Query("model"), Failed: c.Query("failed") == "true", Limit: 100}
+	if to := c.Query("to"); to != "" {
+		t, err := parseQueryTime(to, now)
+		if err != nil {
+			return q, fmt.Errorf("invalid to: %w", err)
+		}
+		q.To = t
+	}
+	q.From = q.To.Add(-7 * 24 * time.Hour)
+	if from := c.Query("from"); from != "" {
+		t, err := parseQueryTime(from, now)
+		if err != nil {
+			return q, fmt.Errorf("invalid from: %w", err)
+		}
+		q.From = t
+	}
+	if !q.From.Before(q.To) {
+		return q, fmt.Errorf("from must be before to")
+	}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return q, fmt.Errorf("invalid limit %q", limit)
+		}
+		q.Limit = n
+	}
+	return q, nil
+}
+
+func (q modelStartsQuery) matches(start ModelStart) bool {
+	return !start.Timestamp.Before(q.From) && start.Timestamp.Before(q.To) &&
+		(q.Model == "" || start.Model == q.Model) &&
+		(!q.Failed || !start.Success)
+}
+
+// findModelStarts returns the starts matching q, oldest first. They are read
+// from the metrics store when it is enabled and from memory otherwise.
+func (pm *ProxyManager) findModelStarts(q modelStartsQuery) ([]ModelStart, error) {
+	var starts []ModelStart
+	if pm.metricsStore != nil {
+		err := pm.metricsStore.read(q.From, q.To, func(record metricsRecord) {
+			if record.Type == metricsRecordStart && record.Start != nil && q.matches(*record.Start) {
+				starts = append(starts, *record.Start)
+			}
+		})
+		return starts, err
+	}
+	for _, start := range pm.metricsMonitor.getStarts() {
+		if q.matches(start) {
+			starts = append(starts, start)
+		}
+	}
+	return starts, nil
+}
+
+// apiGetModelStarts lists the newest starts first
+func (pm *ProxyManager) apiGetModelStarts(c *gin.Context) {
+	q, err := parseModelStartsQuery(c, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	starts, err := pm.findModelStarts(q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to read model starts: %v", err)})
+		return
+	}
+	slices.Reverse(starts)
+	if len(starts) > q.Limit {
+		starts = starts[:q.Limit]
+	}
+	if starts == nil {
+		starts = []ModelStart{}
+	}
+	c.JSON(http.StatusOK, gin.H{"from": q.From, "to": q.To, "starts": starts})
+}
+
+func (pm *ProxyManager) apiGetModelStartsSummary(c *gin.Context) {
+	q, err := parseModelStartsQuery(c, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	starts, err := pm.findModelStarts(q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to read model starts: %v", err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"from": q.From, "to": q.To, "models": summarizeModelStarts(starts)})
+}
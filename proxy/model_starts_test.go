@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mostlygeek/llama-swap/event"
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// collectModelStarts gathers the ModelStartEvents of model
+func collectModelStarts(t *testing.T, model string) func() []ModelStart {
+	var mu sync.Mutex
+	var starts []ModelStart
+	cancel := event.On(func(e ModelStartEvent) {
+		if e.Start.Model == model {
+			mu.Lock()
+			starts = append(starts, e.Start)
+			mu.Unlock()
+		}
+	})
+	t.Cleanup(cancel)
+	return func() []ModelStart {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]ModelStart(nil), starts...)
+	}
+}
+
+func TestProcess_StartEmitsModelStartEvent(t *testing.T) {
+	starts := collectModelStarts(t, "start-telemetry")
+
+	process := NewProcess("start-telemetry", 15, getTestSimpleResponderConfig("start-telemetry"), debugLogger, debugLogger)
+	defer process.Stop()
+
+	process.addStopPrevious(300 * time.Millisecond)
+	require.NoError(t, process.startFor(context.Background(), startTriggerPreload))
+
+	require.Eventually(t, func() bool { return len(starts()) == 1 }, time.Second, 10*time.Millisecond)
+	start := starts()[0]
+	assert.Equal(t, startTriggerPreload, start.Trigger)
+	assert.True(t, start.Success)
+	assert.Empty(t, start.Error)
+	assert.Equal(t, 300, start.StopPreviousMs)
+	assert.Greater(t, start.SpawnMs, 0)
+	assert.LessOrEqual(t, start.WarmupMs, start.SpawnMs)
+	assert.Equal(t, 300+start.SpawnMs, start.ColdStartMs())
+
+	// the time spent stopping other models is only counted once
+	assert.Zero(t, process.stopPreviousNanos.Load())
+}
+
+func TestProcess_FailedStartKeepsLogTail(t *testing.T) {
+	starts := collectModelStarts(t, "start-failure")
+
+	modelConfig := config.ModelConfig{
+		Cmd:           fmt.Sprintf("%s --no-such-flag", filepath.ToSlash(simpleResponderPath)),
+		Proxy:         "http://127.0.0.1:9914",
+		CheckEndpoint: "/health",
+	}
+	processLogger := NewLogMonitorWriter(io.Discard)
+	process := NewProcess("start-failure", 15, modelConfig, processLogger, debugLogger)
+	process.healthCheckLoopInterval = time.Second
+
+	require.Error(t, process.start())
+
+	require.Eventually(t, func() bool { return len(starts()) == 1 }, time.Second, 10*time.Millisecond)
+	start := starts()[0]
+	assert.Equal(t, startTriggerRequest, start.Trigger)
+	assert.False(t, start.Success)
+	assert.NotEmpty(t, start.Error)
+	assert.Contains(t, start.LogTail, "flag provided but not defined")
+	assert.Zero(t, start.WarmupMs)
+}
+
+func TestLogTail(t *testing.T) {
+	assert.Equal(t, "", logTail(nil, 3))
+	assert.Equal(t, "one", logTail([]byte("one\n"), 3))
+	assert.Equal(t, "two\nthree", logTail([]byte("one\ntwo\nthree\n"), 2))
+	assert.Equal(t, "one\ntwo\nthree", logTail([]byte("one\ntwo\nthree"), 5))
+}
+
+func TestSummarizeModelStarts(t *testing.T) {
+	now := time.Now()
+	summaries := summarizeModelStarts([]ModelStart{
+		{Timestamp: now, Model: "b", Trigger: startTriggerRequest, SpawnMs: 1000, Success: true},
+		{Timestamp: now, Model: "a", Trigger: startTriggerRequest, StopPreviousMs: 100, SpawnMs: 1000, WarmupMs: 600, Success: true},
+		{Timestamp: now.Add(time.Second), Model: "a", Trigger: startTriggerPreload, StopPreviousMs: 100, SpawnMs: 3000, WarmupMs: 2000, Success: true},
+		{Timestamp: now.Add(2 * time.Second), Model: "a", Trigger: startTriggerAPI, SpawnMs: 50, Error: "first"},
+		{Timestamp: now.Add(3 * time.Second), Model: "a", Trigger: startTriggerAPI, SpawnMs: 50, Error: "second"},
+	})
+	require.Len(t, summaries, 2)
+
+	a := summaries[0]
+	assert.Equal(t, "a", a.Model)
+	assert.Equal(t, 4, a.Starts)
+	assert.Equal(t, 2, a.Failures)
+	assert.Equal(t, map[string]int{"request": 1, "preload": 1, "api": 2}, a.Triggers)
+	assert.Equal(t, 2, a.ColdStartMs.Count)
+	assert.Equal(t, 1100.0, a.ColdStartMs.P50)
+	assert.Equal(t, 3100.0, a.ColdStartMs.P95)
+	assert.Equal(t, 1300.0, a.WarmupMs.Mean)
+	require.NotNil(t, a.LastFailure)
+	assert.Equal(t, "second", a.LastFailure.Error)
+
+	assert.Equal(t, "b", summaries[1].Model)
+	assert.Nil(t, summaries[1].LastFailure)
+}
+
+func TestProxyManager_ModelStartsAPI(t *testing.T) {
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"starts-model1": getTestSimpleResponderConfig("starts-model1"),
+			"starts-model2": getTestSimpleResponderConfig("starts-model2"),
+		},
+		LogLevel: "error",
+	})
+
+	proxy := New(conf)
+	defer proxy.StopProcesses(StopWaitForInflightRequest)
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"starts-model1"}`))
+	w := CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// the Load button of the UI goes through /upstream
+	req = httptest.NewRequest("GET", "/upstream/starts-model2/health", nil)
+	w = CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var listed struct {
+		Starts []ModelStart `json:"starts"`
+	}
+	require.Eventually(t, func() bool {
+		req := httptest.NewRequest("GET", "/api/starts", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed))
+		return len(listed.Starts) == 2
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// newest first
+	assert.Equal(t, "starts-model2", listed.Starts[0].Model)
+	assert.Equal(t, startTriggerAPI, listed.Starts[0].Trigger)
+	assert.Greater(t, listed.Starts[0].StopPreviousMs, 0, "starts-model1 was unloaded first")
+	assert.Equal(t, "starts-model1", listed.Starts[1].Model)
+	assert.Equal(t, startTriggerRequest, listed.Starts[1].Trigger)
+	assert.Zero(t, listed.Starts[1].StopPreviousMs)
+
+	req = httptest.NewRequest("GET", "/api/starts/summary?model=starts-model1", nil)
+	w = CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var summary struct {
+		Models []modelStartSummary `json:"models"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &summary))
+	require.Len(t, summary.Models, 1)
+	assert.Equal(t, 1, summary.Models[0].Starts)
+	assert.Equal(t, 0, summary.Models[0].Failures)
+	require.NotNil(t, summary.Models[0].ColdStartMs)
+
+	req = httptest.NewRequest("GET", "/api/starts?limit=0", nil)
+	w = CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
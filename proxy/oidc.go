@@ -0,0 +1,477 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mostlygeek/llama-swap/proxy/config"
+)
+
+const (
+	oidcCallbackPath = "/auth/oidc/callback"
+
+	// the JWKS is fetched again for an unknown key ID, at most this often
+	oidcKeysRefresh = time.Minute
+
+	// allowed clock difference to the provider
+	oidcClockSkew = time.Minute
+)
+
+// oidcDiscovery is the part of the OpenID provider metadata that is used
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcProvider signs users in with the authorization code flow and PKCE,
+// the ID token is verified against the keys of the provider
+type oidcProvider struct {
+	config config.OIDCConfig
+	client *http.Client
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]crypto.PublicKey // by key ID
+	keysFetched time.Time
+
+	now func() time.Time
+}
+
+func newOIDCProvider(conf config.OIDCConfig) *oidcProvider {
+	if conf.Issuer == "" {
+		return nil
+	}
+	return &oidcProvider{
+		config: conf,
+		client: &http.Client{Timeout: 10 * time.Second},
+		now:    time.Now,
+	}
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, target string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: HTTP %d", target, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// discover returns the provider metadata, it is fetched once
+func (p *oidcProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	issuer := strings.TrimSuffix(p.config.Issuer, "/")
+	var discovery oidcDiscovery
+	if err := p.getJSON(ctx, issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("OIDC discovery failed: %w", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("OIDC discovery returned issuer %q, expected %q", discovery.Issuer, p.config.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, errors.New("OIDC discovery is missing an endpoint")
+	}
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+// authURL returns where the browser is sent to sign in
+func (p *oidcProvider) authURL(ctx context.Context, redirectURL, state, nonce, verifier string) (string, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {redirectURL},
+		"scope":                 {strings.Join(p.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// exchange returns the ID token for an authorization code
+func (p *oidcProvider) exchange(ctx context.Context, code, redirectURL, verifier string) (string, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+		"client_id":     {p.config.ClientID},
+		"code_verifier": {verifier},
+	}
+	if p.config.ClientSecret != "" {
+		form.Set("client_secret", p.config.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("OIDC token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+		return "", fmt.Errorf("OIDC token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || token.IDToken == "" {
+		return "", fmt.Errorf("OIDC token request failed: HTTP %d %s", resp.StatusCode, token.Error)
+	}
+	return token.IDToken, nil
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(value string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// key returns the signing key with the key ID, the keys are fetched again
+// when it is not known
+func (p *oidcProvider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, found := p.keys[kid]; found {
+		return key, nil
+	}
+	if p.now().Sub(p.keysFetched) < oidcKeysRefresh {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(ctx, discovery.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("fetching the OIDC signing keys failed: %w", err)
+	}
+	p.keysFetched = p.now()
+	p.keys = make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := jwk.publicKey(); err == nil {
+			p.keys[jwk.Kid] = key
+		}
+	}
+	if key, found := p.keys[kid]; found {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// verifySignature checks the JWS signature of signed with key for alg
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	var h hash.Hash
+	var hashID crypto.Hash
+	switch alg[len(alg)-3:] {
+	case "256":
+		h, hashID = sha256.New(), crypto.SHA256
+	case "384":
+		h, hashID = sha512.New384(), crypto.SHA384
+	case "512":
+		h, hashID = sha512.New(), crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch {
+	case strings.HasPrefix(alg, "RS"):
+		if key, ok := key.(*rsa.PublicKey); ok {
+			return rsa.VerifyPKCS1v15(key, hashID, digest, signature)
+		}
+	case strings.HasPrefix(alg, "PS"):
+		if key, ok := key.(*rsa.PublicKey); ok {
+			return rsa.VerifyPSS(key, hashID, digest, signature, nil)
+		}
+	case strings.HasPrefix(alg, "ES"):
+		if key, ok := key.(*ecdsa.PublicKey); ok {
+			size := (key.Curve.Params().BitSize + 7) / 8
+			if len(signature) != 2*size {
+				return errors.New("invalid signature length")
+			}
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if !ecdsa.Verify(key, digest, r, s) {
+				return errors.New("invalid signature")
+			}
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	return fmt.Errorf("key does not match algorithm %q", alg)
+}
+
+// verify checks the signature, issuer, audience, expiry and nonce of an ID
+// token and returns its claims
+func (p *oidcProvider) verify(ctx context.Context, idToken, nonce string) (map[string]any, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerJSON, &header) != nil || len(header.Alg) < 5 {
+		return nil, errors.New("malformed ID token header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed ID token signature")
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, fmt.Errorf("ID token signature: %w", err)
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed ID token claims")
+	}
+	var claims map[string]any
+	decoder := json.NewDecoder(strings.NewReader(string(claimsJSON)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&claims); err != nil {
+		return nil, errors.New("malformed ID token claims")
+	}
+
+	if issuer, _ := claims["iss"].(string); strings.TrimSuffix(issuer, "/") != strings.TrimSuffix(p.config.Issuer, "/") {
+		return nil, fmt.Errorf("ID token issuer %q does not match", issuer)
+	}
+	if !slices.Contains(claimStrings(claims["aud"]), p.config.ClientID) {
+		return nil, errors.New("ID token is not for this client")
+	}
+	exp, ok := claims["exp"].(json.Number)
+	expires, err := exp.Int64()
+	if !ok || err != nil || p.now().After(time.Unix(expires, 0).Add(oidcClockSkew)) {
+		return nil, errors.New("ID token expired")
+	}
+	if claimNonce, _ := claims["nonce"].(string); claimNonce != nonce {
+		return nil, errors.New("ID token nonce does not match")
+	}
+	return claims, nil
+}
+
+// claimStrings returns a string claim, or the strings of an array claim
+func claimStrings(value any) []string {
+	switch value := value.(type) {
+	case string:
+		return []string{value}
+	case []any:
+		var values []string
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// identity returns the user name and the role of a signed in user, the
+// role is empty when the user has none
+func (p *oidcProvider) identity(claims map[string]any) (string, string) {
+	var username string
+	for _, claim := range []string{p.config.UsernameClaim, "email", "sub"} {
+		if value, _ := claims[claim].(string); value != "" {
+			username = value
+			break
+		}
+	}
+
+	role := p.config.DefaultRole
+	for _, value := range claimStrings(claims[p.config.RoleClaim]) {
+		if mapped := p.config.Roles[value]; config.AdminRoleRank(mapped) > config.AdminRoleRank(role) {
+			role = mapped
+		}
+	}
+	return username, role
+}
+
+// oidcRedirectURL returns the callback URL registered with the provider
+func (pm *ProxyManager) oidcRedirectURL(c *gin.Context) string {
+	if redirectURL := pm.config.AdminAuth.OIDC.RedirectURL; redirectURL != "" {
+		return redirectURL
+	}
+	scheme := "http"
+	if c.Request.TLS != nil || strings.EqualFold(c.GetHeader("X-Forwarded-Proto"), "https") {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host + oidcCallbackPath
+}
+
+func (pm *ProxyManager) oidcLogin(c *gin.Context) {
+	if pm.oidc == nil {
+		pm.sendErrorResponse(c, http.StatusNotFound, "single sign-on is not enabled")
+		return
+	}
+	state := randomToken()
+	login := &oidcLogin{nonce: randomToken(), verifier: randomToken(), next: localRedirect(c.Query("next"))}
+	target, err := pm.oidc.authURL(c.Request.Context(), pm.oidcRedirectURL(c), state, login.nonce, login.verifier)
+	if err != nil {
+		pm.proxyLogger.Errorf("OIDC sign in failed: %v", err)
+		pm.renderLoginPage(c, http.StatusBadGateway, "Single sign-on is not available")
+		return
+	}
+	pm.adminSessions.addLogin(state, login)
+	c.Redirect(http.StatusFound, target)
+}
+
+func (pm *ProxyManager) oidcCallback(c *gin.Context) {
+	if pm.oidc == nil {
+		pm.sendErrorResponse(c, http.StatusNotFound, "single sign-on is not enabled")
+		return
+	}
+	if providerError := c.Query("error"); providerError != "" {
+		pm.proxyLogger.Infof("OIDC sign in failed: %s %s", providerError, c.Query("error_description"))
+		pm.renderLoginPage(c, http.StatusUnauthorized, "Single sign-on failed")
+		return
+	}
+	login := pm.adminSessions.takeLogin(c.Query("state"))
+	if login == nil {
+		pm.renderLoginPage(c, http.StatusBadRequest, "The sign in expired, please try again")
+		return
+	}
+
+	ctx := c.Request.Context()
+	idToken, err := pm.oidc.exchange(ctx, c.Query("code"), pm.oidcRedirectURL(c), login.verifier)
+	var claims map[string]any
+	if err == nil {
+		claims, err = pm.oidc.verify(ctx, idToken, login.nonce)
+	}
+	if err != nil {
+		pm.proxyLogger.Errorf("OIDC sign in failed: %v", err)
+		pm.renderLoginPage(c, http.StatusUnauthorized, "Single sign-on failed")
+		return
+	}
+
+	username, role := pm.oidc.identity(claims)
+	if username == "" || role == "" {
+		pm.proxyLogger.Infof("OIDC user %q from %s has no role", username, c.ClientIP())
+		pm.renderLoginPage(c, http.StatusForbidden, "Your account has no access to llama-swap")
+		return
+	}
+
+	ttl := time.Duration(pm.config.AdminAuth.SessionTTL) * time.Second
+	session := pm.adminSessions.create(username, role, adminAuthOIDC, ttl)
+	pm.setAdminSessionCookies(c, session)
+	pm.proxyLogger.Infof("User %s (%s) signed in with OIDC from %s", session.user, session.role, c.ClientIP())
+	c.Redirect(http.StatusFound, login.next)
+}
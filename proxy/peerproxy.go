@@ -136,6 +136,16 @@ func (p *PeerProxy) ProxyRequest(model_id string, writer http.ResponseWriter, re
 		request.Header.Set("x-api-key", pp.apiKey)
 	}
 
+	ctx, peerSpan := startSpan(request.Context(), "peer "+model_id, spanKindClient)
+	if peerSpan != nil {
+		peerSpan.setAttr("llama_swap.model", model_id)
+		peerSpan.setAttr("llama_swap.peer", pp.peerID)
+		request = request.WithContext(ctx)
+		injectTraceparent(ctx, request.Header)
+	}
+	defer peerSpan.end()
+
+	markUpstreamStart(request)
 	pp.reverseProxy.ServeHTTP(writer, request)
 	return nil
 }
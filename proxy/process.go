@@ -88,6 +88,17 @@ type Process struct {
 	inFlightRequests      sync.WaitGroup
 	inFlightRequestsCount atomic.Int32
 
+	// requests waiting for a model swap or for the process to start
+	queuedRequestsCount atomic.Int32
+
+	// time spent stopping other models for the next start, see ModelStart
+	stopPreviousNanos atomic.Int64
+
+	// when the process last became ready and the requests it handled since,
+	// see ProcessGroup.residentModel
+	readySince         atomic.Int64 // unix nanoseconds
+	requestsSinceReady atomic.Int64
+
 	// used to block on multiple start() calls
 	waitStarting sync.WaitGroup
 
@@ -258,6 +269,12 @@ func validateCommand(cmd string) error {
 // it is a private method because starting is automatic but stopping can be called
 // at any time.
 func (p *Process) start() error {
+	return p.startFor(context.Background(), startTriggerRequest)
+}
+
+// startFor is start, with trigger recorded as the cause in the ModelStartEvent
+// and the start traced as a child of the current span of ctx
+func (p *Process) startFor(ctx context.Context, trigger string) (err error) {
 
 	if p.config.Proxy == "" {
 		return fmt.Errorf("can not start(), upstream proxy missing")
@@ -278,7 +295,10 @@ func (p *Process) start() error {
 			// already starting, just wait for it to complete and expect
 			// it to be be in the Ready start after. If not, return an error
 			if curState == StateStarting {
+				_, waitSpan := startSpan(ctx, "wait for start", spanKindInternal)
+				waitSpan.setAttr("llama_swap.model", p.ID)
 				p.waitStarting.Wait()
+				waitSpan.end()
 				if state := p.CurrentState(); state == StateReady {
 					return nil
 				} else {
@@ -294,6 +314,8 @@ func (p *Process) start() error {
 
 	// waitStarting.Add(1) is now called atomically in swapState() when transitioning to StateStarting
 	defer p.waitStarting.Done()
+	telemetry := p.beginStartTelemetry(ctx, trigger)
+	defer func() { telemetry.finish(err) }()
 	cmdContext, ctxCancelUpstream := context.WithCancel(context.Background())
 
 	p.cmd = exec.CommandContext(cmdContext, args[0], args[1:]...)
@@ -312,6 +334,7 @@ func (p *Process) start() error {
 	p.failedStartCount++ // this will be reset to zero when the process has successfully started
 
 	p.proxyLogger.Debugf("<%s> Executing start command: %s, env: %s", p.ID, strings.Join(args, " "), strings.Join(p.config.Env, ", "))
+	telemetry.markSpawned()
 	err = p.cmd.Start()
 
 	// Set process state to failed
@@ -378,7 +401,9 @@ func (p *Process) start() error {
 				return fmt.Errorf("health check timed out after %vs", maxDuration.Seconds())
 			}
 
-			if err := p.checkHealthEndpoint(healthURL); err == nil {
+			err := p.checkHealthEndpoint(healthURL)
+			telemetry.healthChecked(err)
+			if err == nil {
 				p.proxyLogger.Infof("<%s> Health check passed on %s", p.ID, healthURL)
 				break
 			} else {
@@ -441,6 +466,8 @@ func (p *Process) start() error {
 		}()
 	}
 
+	p.readySince.Store(time.Now().UnixNano())
+	p.requestsSinceReady.Store(0)
 	if curState, err := p.swapState(StateStarting, StateReady); err != nil {
 		return fmt.Errorf("failed to set Process state to ready: current state: %v, error: %v", curState, err)
 	} else {
@@ -548,7 +575,7 @@ func (p *Process) checkHealthEndpoint(healthURL string) error {
 
 	// got a response but it was not an OK
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("status code: %d", resp.StatusCode)
+		return fmt.Errorf("%w: %d", errHealthCheckStatus, resp.StatusCode)
 	}
 
 	return nil
@@ -575,6 +602,7 @@ func (p *Process) ProxyRequest(w http.ResponseWriter, r *http.Request) {
 	case p.concurrencyLimitSemaphore <- struct{}{}:
 		defer func() { <-p.concurrencyLimitSemaphore }()
 	default:
+		event.Emit(RequestRejectedEvent{Model: p.ID, Reason: "concurrency"})
 		http.Error(w, "Too many requests", http.StatusTooManyRequests)
 		return
 	}
@@ -583,6 +611,7 @@ func (p *Process) ProxyRequest(w http.ResponseWriter, r *http.Request) {
 	p.inFlightRequestsCount.Add(1)
 	defer func() {
 		p.setLastRequestHandled(time.Now())
+		p.requestsSinceReady.Add(1)
 		p.inFlightRequestsCount.Add(-1)
 		p.inFlightRequests.Done()
 	}()
@@ -608,7 +637,10 @@ func (p *Process) ProxyRequest(w http.ResponseWriter, r *http.Request) {
 		}
 
 		beginStartTime := time.Now()
-		if err := p.start(); err != nil {
+		p.queuedRequestsCount.Add(1)
+		err := p.startFor(r.Context(), startTriggerOf(r))
+		p.queuedRequestsCount.Add(-1)
+		if err != nil {
 			errstr := fmt.Sprintf("unable to start process: %s", err)
 			cancelLoadCtx()
 			if srw != nil {
@@ -640,14 +672,25 @@ func (p *Process) ProxyRequest(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
+	upstreamCtx, upstreamSpan := startSpan(r.Context(), "upstream "+p.ID, spanKindClient)
+	if upstreamSpan != nil {
+		upstreamSpan.setAttr("llama_swap.model", p.ID)
+		upstreamSpan.setAttr("server.address", p.config.Proxy)
+		r = r.WithContext(upstreamCtx)
+		injectTraceparent(upstreamCtx, r.Header)
+	}
+	defer upstreamSpan.end()
+
 	if srw != nil {
 		// Wait for the goroutine to finish writing its final messages
 		const completionTimeout = 1 * time.Second
 		if !srw.waitForCompletion(completionTimeout) {
 			p.proxyLogger.Warnf("<%s> status updates goroutine did not complete within %v, proceeding with proxy request", p.ID, completionTimeout)
 		}
+		markUpstreamStart(r)
 		p.reverseProxy.ServeHTTP(srw, r)
 	} else {
+		markUpstreamStart(r)
 		p.reverseProxy.ServeHTTP(w, r)
 	}
 
@@ -5,7 +5,9 @@ import (
 	"net/http"
 	"slices"
 	"sync"
+	"time"
 
+	"github.com/mostlygeek/llama-swap/event"
 	"github.com/mostlygeek/llama-swap/proxy/config"
 )
 
@@ -21,6 +23,11 @@ type ProcessGroup struct {
 	exclusive  bool
 	persistent bool
 
+	// swap hysteresis, see waitForResidency
+	minResidency         time.Duration
+	minResidencyRequests int64
+	maxSwapWait          time.Duration
+
 	proxyLogger    *LogMonitor
 	upstreamLogger *LogMonitor
 
@@ -36,11 +43,16 @@ func NewProcessGroup(id string, config config.Config, proxyLogger *LogMonitor, u
 	}
 
 	pg := &ProcessGroup{
-		id:             id,
-		config:         config,
-		swap:           groupConfig.Swap,
-		exclusive:      groupConfig.Exclusive,
-		persistent:     groupConfig.Persistent,
+		id:         id,
+		config:     config,
+		swap:       groupConfig.Swap,
+		exclusive:  groupConfig.Exclusive,
+		persistent: groupConfig.Persistent,
+
+		minResidency:         time.Duration(groupConfig.MinResidency) * time.Second,
+		minResidencyRequests: int64(groupConfig.MinResidencyRequests),
+		maxSwapWait:          time.Duration(groupConfig.MaxSwapWait) * time.Second,
+
 		proxyLogger:    proxyLogger,
 		upstreamLogger: upstreamLogger,
 		processes:      make(map[string]*Process),
@@ -65,7 +77,19 @@ func (pg *ProcessGroup) ProxyRequest(modelID string, writer http.ResponseWriter,
 	}
 
 	if pg.swap {
+		process := pg.processes[modelID]
+		process.queuedRequestsCount.Add(1)
+		// wait outside of swapRequestMu so the resident model keeps serving
+		// the requests that count towards minResidencyRequests
+		if err := pg.waitForResidency(request.Context(), modelID); err != nil {
+			process.queuedRequestsCount.Add(-1)
+			return err
+		}
+		_, lockSpan := startSpan(request.Context(), "wait for swap lock", spanKindInternal)
+		lockSpan.setAttr("llama_swap.group", pg.id)
 		pg.swapRequestMu.Lock()
+		lockSpan.end()
+		process.queuedRequestsCount.Add(-1)
 		defer pg.swapRequestMu.Unlock()
 
 		previousModelID := ""
@@ -79,7 +103,17 @@ func (pg *ProcessGroup) ProxyRequest(modelID string, writer http.ResponseWriter,
 
 		if previousModelID != "" {
 			if previousProcess, ok := pg.processes[previousModelID]; ok {
-				previousProcess.Stop()
+				if previousProcess.CurrentState() != StateStopped {
+					event.Emit(ModelSwapEvent{GroupID: pg.id, FromModel: previousModelID, ToModel: modelID})
+					_, stopSpan := startSpan(request.Context(), "stop "+previousModelID, spanKindInternal)
+					stopSpan.setAttr("llama_swap.model", previousModelID)
+					stopBegin := time.Now()
+					previousProcess.Stop()
+					process.addStopPrevious(time.Since(stopBegin))
+					stopSpan.end()
+				} else {
+					previousProcess.Stop()
+				}
 			}
 		}
 
@@ -95,11 +129,16 @@ func (pg *ProcessGroup) HasMember(modelName string) bool {
 	return slices.Contains(pg.config.Groups[pg.id].Members, modelName)
 }
 
+// GetMember returns the process of the member modelName, false when it is
+// not a member or has no process after a config change
 func (pg *ProcessGroup) GetMember(modelName string) (*Process, bool) {
-	if pg.HasMember(modelName) {
-		return pg.processes[modelName], true
+	pg.Lock()
+	defer pg.Unlock()
+	if !slices.Contains(pg.config.Groups[pg.id].Members, modelName) {
+		return nil, false
 	}
-	return nil, false
+	process := pg.processes[modelName]
+	return process, process != nil
 }
 
 func (pg *ProcessGroup) StopProcess(modelID string, strategy StopStrategy) error {
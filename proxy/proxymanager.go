@@ -3,7 +3,6 @@ package proxy
 import (
 	"bytes"
 	"context"
-	"crypto/subtle"
 	"encoding/base64"
 	"fmt"
 	"io"
@@ -34,8 +33,12 @@ type proxyCtxKey string
 // This is used for internal actions that need to call back into protected endpoints (e.g. benchy).
 const ctxKeyAPIKey = "apiKey"
 
+// ginModelKey is the gin.Context key where handlers store the model a request
+// was routed to, for the request metrics.
+const ginModelKey = "model"
+
 type ProxyManager struct {
-	sync.Mutex
+	sync.RWMutex
 
 	config     config.Config
 	configPath string
@@ -47,6 +50,15 @@ type ProxyManager struct {
 	muxLogger      *LogMonitor
 
 	metricsMonitor *metricsMonitor
+	metricsStore   *metricsStore // nil when metricsStore.path is not set
+	auditLog       *auditLog
+
+	// stops collecting ModelStartEvents into metricsMonitor
+	cancelStartEvents context.CancelFunc
+
+	thrashDetector *swapThrashDetector
+
+	tracer *tracer // nil when tracing.endpoint is not set
 
 	processGroups map[string]*ProcessGroup
 
@@ -62,12 +74,35 @@ type ProxyManager struct {
 	// peer proxy see: #296, #433
 	peerProxy *PeerProxy
 
+	// rebuilt with the config under accessMu, read it with splitRouter
+	splits *splitRouter
+
+	// accepted API keys, empty when auth is disabled. Rebuilt with the config,
+	// read them with apiKeyEntries.
+	apiKeys []apiKeyEntry
+
+	// guards the state rebuilt from the config in
+	// applyConfigAndSyncProcessGroups, so requests do not wait for pm.Lock
+	accessMu sync.RWMutex
+
+	// admin users signed in to the UI and /api, see admin_auth.go
+	adminSessions *adminSessions
+	oidc          *oidcProvider // nil when adminAuth.oidc is not set
+	apiRoles      map[string]string
+
+	// quotas of quotaIdentities, rebuilt with the config, see quotaTracker
+	quotas          *quotaTracker
+	quotaIdentities map[string]config.APIKeyIdentity
+
 	// Benchy jobs (llama-benchy runner)
 	benchyMu      sync.Mutex
 	benchyJobs    map[string]*BenchyJob
 	benchyCancels map[string]context.CancelFunc
 
 	rateLimiter *proxyRateLimiter
+	rateLimits  *rateLimits
+
+	clientAccess *clientAccess
 
 	backendActionStatusMu sync.Mutex
 	backendActionStatus   recipeBackendActionStatus
@@ -195,6 +230,12 @@ func newProxyManager(proxyConfig config.Config, configPath string) *ProxyManager
 		version:   "0",
 
 		peerProxy: peerProxy,
+		splits:    newSplitRouter(proxyConfig.Splits),
+		apiKeys:   newAPIKeyEntries(proxyConfig),
+
+		adminSessions: newAdminSessions(),
+		oidc:          newOIDCProvider(proxyConfig.AdminAuth.OIDC),
+		apiRoles:      make(map[string]string),
 
 		benchyJobs:    make(map[string]*BenchyJob),
 		benchyCancels: make(map[string]context.CancelFunc),
@@ -202,6 +243,44 @@ func newProxyManager(proxyConfig config.Config, configPath string) *ProxyManager
 		rateLimiter: newProxyRateLimiter(proxyLogger),
 	}
 
+	pm.cancelStartEvents = event.On(func(e ModelStartEvent) {
+		pm.metricsMonitor.addStart(e.Start)
+	})
+	pm.thrashDetector = newSwapThrashDetector(proxyConfig.Groups, proxyLogger).subscribe()
+	pm.quotas = newQuotaTracker(proxyConfig.APIKeyIdentities).subscribe()
+	pm.quotaIdentities = proxyConfig.APIKeyIdentities
+	pm.rateLimits = newRateLimits(proxyConfig.RateLimits).subscribe()
+	pm.clientAccess = newClientAccess(proxyConfig.ClientAccess)
+	pm.tracer = newTracer(proxyConfig.Tracing, proxyLogger)
+	if storePath := strings.TrimSpace(proxyConfig.MetricsStore.Path); storePath != "" {
+		if store, err := openMetricsStore(storePath, proxyConfig.MetricsStore.RetentionDays, proxyLogger); err != nil {
+			proxyLogger.Errorf("Metrics will not be persisted: %v", err)
+		} else if err := pm.metricsMonitor.useStore(store); err != nil {
+			proxyLogger.Errorf("Metrics will not be persisted, failed to read metrics store: %v", err)
+		} else {
+			pm.metricsStore = store.subscribe()
+			if err := pm.quotas.restore(store); err != nil {
+				proxyLogger.Errorf("Failed to restore quota usage from the metrics store: %v", err)
+			}
+		}
+	}
+	pm.auditLog = newAuditLog(proxyLogger)
+	if auditPath := strings.TrimSpace(proxyConfig.AuditLog.Path); auditPath != "" {
+		maxSize := int64(proxyConfig.AuditLog.MaxSizeMB) * 1024 * 1024
+		if err := pm.auditLog.persist(auditPath, maxSize, proxyConfig.AuditLog.MaxFiles); err != nil {
+			proxyLogger.Errorf("Audit entries will not be persisted: %v", err)
+		}
+	}
+	if storePath := strings.TrimSpace(proxyConfig.CaptureStore.Path); storePath != "" {
+		maxSize := int64(proxyConfig.CaptureStore.MaxSizeMB) * 1024 * 1024
+		compress := proxyConfig.CaptureStore.Compression != config.CaptureCompressionNone
+		if store, err := openCaptureStore(storePath, proxyConfig.CaptureStore.RetentionDays, maxSize, compress, proxyLogger); err != nil {
+			proxyLogger.Errorf("Captures will not be persisted: %v", err)
+		} else {
+			pm.metricsMonitor.captureStore = store
+		}
+	}
+
 	pm.loadRecipesBackendOverride()
 	pm.loadHFHubPathOverride()
 
@@ -227,7 +306,7 @@ func newProxyManager(proxyConfig config.Config, configPath string) *ProxyManager
 				}
 
 				proxyLogger.Infof("Preloading model: %s", modelID)
-				processGroup, err := pm.swapProcessGroup(modelID)
+				processGroup, err := pm.swapProcessGroup(shutdownCtx, modelID)
 
 				if err != nil {
 					event.Emit(ModelPreloadedEvent{
@@ -238,7 +317,7 @@ func newProxyManager(proxyConfig config.Config, configPath string) *ProxyManager
 					continue
 				} else {
 					req, _ := http.NewRequest("GET", "/", nil)
-					processGroup.ProxyRequest(modelID, discardWriter, req)
+					processGroup.ProxyRequest(modelID, discardWriter, withStartTrigger(req, startTriggerPreload))
 					event.Emit(ModelPreloadedEvent{
 						ModelName: modelID,
 						Success:   true,
@@ -252,6 +331,11 @@ func newProxyManager(proxyConfig config.Config, configPath string) *ProxyManager
 }
 
 func (pm *ProxyManager) setupGinEngine() {
+	// X-Forwarded-For is only used for the client address of requests from
+	// trustedProxies, see clientAccess
+	if err := pm.ginEngine.SetTrustedProxies(pm.config.TrustedProxies); err != nil {
+		pm.proxyLogger.Errorf("Failed to set trusted proxies: %v", err)
+	}
 
 	pm.ginEngine.Use(func(c *gin.Context) {
 
@@ -264,11 +348,27 @@ func (pm *ProxyManager) setupGinEngine() {
 		// Start timer
 		start := time.Now()
 
+		var requestID string
+		c.Request, requestID = withRequestID(c.Request)
+		c.Header(requestIDHeader, requestID)
+
 		// capture these because /upstream/:model rewrites them in c.Next()
 		clientIP := c.ClientIP()
 		method := c.Request.Method
 		path := c.Request.URL.Path
 
+		route := c.FullPath()
+		if route == "" {
+			route = path
+		}
+		var requestSpan *span
+		c.Request, requestSpan = pm.tracer.startRequestSpan(c.Request, method+" "+route)
+		requestSpan.setAttr("http.request.method", method)
+		requestSpan.setAttr("http.route", route)
+		requestSpan.setAttr("url.path", path)
+		requestSpan.setAttr("client.address", clientIP)
+		requestSpan.setAttr("llama_swap.request_id", requestID)
+
 		// Process request
 		c.Next()
 
@@ -278,7 +378,35 @@ func (pm *ProxyManager) setupGinEngine() {
 		statusCode := c.Writer.Status()
 		bodySize := c.Writer.Size()
 
-		pm.proxyLogger.Infof("Request %s \"%s %s %s\" %d %d \"%s\" %v",
+		requestSpan.setAttr("http.response.status_code", statusCode)
+		if modelID := c.GetString(ginModelKey); modelID != "" {
+			requestSpan.setAttr("llama_swap.model", modelID)
+		}
+		if statusCode >= 500 {
+			requestSpan.setError(fmt.Errorf("HTTP %d", statusCode))
+		}
+		requestSpan.end()
+
+		if modelID := c.GetString(ginModelKey); modelID != "" {
+			event.Emit(RequestCompletedEvent{
+				Model:    modelID,
+				Endpoint: c.FullPath(),
+				Status:   statusCode,
+				Duration: duration,
+			})
+		}
+
+		// the API key name, or its ID for keys in apiKeys
+		var keyInfo string
+		if name := c.GetString(ginAPIKeyName); name != "" {
+			keyInfo = " key=" + name
+		}
+		if session, ok := c.Value(ginAdminSession).(*adminSession); ok {
+			keyInfo += " user=" + session.user
+		}
+
+		pm.proxyLogger.Infof("Request %s %s \"%s %s %s\" %d %d \"%s\" %v%s",
+			requestID,
 			clientIP,
 			method,
 			path,
@@ -287,10 +415,12 @@ func (pm *ProxyManager) setupGinEngine() {
 			bodySize,
 			c.Request.UserAgent(),
 			duration,
+			keyInfo,
 		)
 	})
 
 	pm.ginEngine.Use(pm.securityHeadersMiddleware())
+	pm.ginEngine.Use(pm.clientAccessCheck)
 	pm.ginEngine.Use(pm.rateLimiter.middleware())
 
 	// see: issue: #81, #77 and #42 for CORS issues
@@ -329,45 +459,49 @@ func (pm *ProxyManager) setupGinEngine() {
 	})
 
 	// Set up routes using the Gin engine
-	// Protected routes use pm.apiKeyAuth() middleware
-	pm.ginEngine.POST("/v1/chat/completions", pm.apiKeyAuth(), pm.proxyInferenceHandler)
-	pm.ginEngine.POST("/v1/responses", pm.apiKeyAuth(), pm.proxyInferenceHandler)
+	// Protected routes use pm.apiKeyAuth() middleware for the endpoint class
+	// of the route
+	inferenceAuth := pm.apiKeyAuth(config.APIKeyEndpointInference)
+	viewerAuth := pm.requireRole(config.AdminRoleViewer)
+	operatorAuth := pm.requireRole(config.AdminRoleOperator)
+	pm.ginEngine.POST("/v1/chat/completions", inferenceAuth, pm.proxyInferenceHandler)
+	pm.ginEngine.POST("/v1/responses", inferenceAuth, pm.proxyInferenceHandler)
 	// Support legacy /v1/completions api, see issue #12
-	pm.ginEngine.POST("/v1/completions", pm.apiKeyAuth(), pm.proxyInferenceHandler)
+	pm.ginEngine.POST("/v1/completions", inferenceAuth, pm.proxyInferenceHandler)
 	// Support anthropic /v1/messages (added https://github.com/ggml-org/llama.cpp/pull/17570)
-	pm.ginEngine.POST("/v1/messages", pm.apiKeyAuth(), pm.proxyInferenceHandler)
+	pm.ginEngine.POST("/v1/messages", inferenceAuth, pm.proxyInferenceHandler)
 	// Support anthropic count_tokens API (Also added in the above PR)
-	pm.ginEngine.POST("/v1/messages/count_tokens", pm.apiKeyAuth(), pm.proxyInferenceHandler)
+	pm.ginEngine.POST("/v1/messages/count_tokens", inferenceAuth, pm.proxyInferenceHandler)
 
 	// Support embeddings and reranking
-	pm.ginEngine.POST("/v1/embeddings", pm.apiKeyAuth(), pm.proxyInferenceHandler)
+	pm.ginEngine.POST("/v1/embeddings", inferenceAuth, pm.proxyInferenceHandler)
 
 	// llama-server's /reranking endpoint + aliases
-	pm.ginEngine.POST("/reranking", pm.apiKeyAuth(), pm.proxyInferenceHandler)
-	pm.ginEngine.POST("/rerank", pm.apiKeyAuth(), pm.proxyInferenceHandler)
-	pm.ginEngine.POST("/v1/rerank", pm.apiKeyAuth(), pm.proxyInferenceHandler)
-	pm.ginEngine.POST("/v1/reranking", pm.apiKeyAuth(), pm.proxyInferenceHandler)
+	pm.ginEngine.POST("/reranking", inferenceAuth, pm.proxyInferenceHandler)
+	pm.ginEngine.POST("/rerank", inferenceAuth, pm.proxyInferenceHandler)
+	pm.ginEngine.POST("/v1/rerank", inferenceAuth, pm.proxyInferenceHandler)
+	pm.ginEngine.POST("/v1/reranking", inferenceAuth, pm.proxyInferenceHandler)
 
 	// llama-server's /infill endpoint for code infilling
-	pm.ginEngine.POST("/infill", pm.apiKeyAuth(), pm.proxyInferenceHandler)
+	pm.ginEngine.POST("/infill", inferenceAuth, pm.proxyInferenceHandler)
 
 	// llama-server's /completion endpoint
-	pm.ginEngine.POST("/completion", pm.apiKeyAuth(), pm.proxyInferenceHandler)
+	pm.ginEngine.POST("/completion", inferenceAuth, pm.proxyInferenceHandler)
 
 	// Support audio/speech endpoint
-	pm.ginEngine.POST("/v1/audio/speech", pm.apiKeyAuth(), pm.proxyInferenceHandler)
-	pm.ginEngine.POST("/v1/audio/voices", pm.apiKeyAuth(), pm.proxyInferenceHandler)
-	pm.ginEngine.GET("/v1/audio/voices", pm.apiKeyAuth(), pm.proxyGETModelHandler)
-	pm.ginEngine.POST("/v1/audio/transcriptions", pm.apiKeyAuth(), pm.proxyOAIPostFormHandler)
-	pm.ginEngine.POST("/v1/images/generations", pm.apiKeyAuth(), pm.proxyInferenceHandler)
-	pm.ginEngine.POST("/v1/images/edits", pm.apiKeyAuth(), pm.proxyOAIPostFormHandler)
+	pm.ginEngine.POST("/v1/audio/speech", inferenceAuth, pm.proxyInferenceHandler)
+	pm.ginEngine.POST("/v1/audio/voices", inferenceAuth, pm.proxyInferenceHandler)
+	pm.ginEngine.GET("/v1/audio/voices", inferenceAuth, pm.proxyGETModelHandler)
+	pm.ginEngine.POST("/v1/audio/transcriptions", inferenceAuth, pm.proxyOAIPostFormHandler)
+	pm.ginEngine.POST("/v1/images/generations", inferenceAuth, pm.proxyInferenceHandler)
+	pm.ginEngine.POST("/v1/images/edits", inferenceAuth, pm.proxyOAIPostFormHandler)
 
-	pm.ginEngine.GET("/v1/models", pm.apiKeyAuth(), pm.listModelsHandler)
+	pm.ginEngine.GET("/v1/models", inferenceAuth, pm.listModelsHandler)
 
 	// in proxymanager_loghandlers.go
-	pm.ginEngine.GET("/logs", pm.apiKeyAuth(), pm.sendLogsHandlers)
-	pm.ginEngine.GET("/logs/stream", pm.apiKeyAuth(), pm.streamLogsHandler)
-	pm.ginEngine.GET("/logs/stream/*logMonitorID", pm.apiKeyAuth(), pm.streamLogsHandler)
+	pm.ginEngine.GET("/logs", viewerAuth, pm.sendLogsHandlers)
+	pm.ginEngine.GET("/logs/stream", viewerAuth, pm.streamLogsHandler)
+	pm.ginEngine.GET("/logs/stream/*logMonitorID", viewerAuth, pm.streamLogsHandler)
 
 	/**
 	 * User Interface Endpoints
@@ -379,9 +513,11 @@ func (pm *ProxyManager) setupGinEngine() {
 	pm.ginEngine.GET("/upstream", func(c *gin.Context) {
 		c.Redirect(http.StatusFound, "/ui/models")
 	})
-	pm.ginEngine.Any("/upstream/*upstreamPath", pm.apiKeyAuth(), pm.proxyToUpstream)
-	pm.ginEngine.GET("/unload", pm.apiKeyAuth(), pm.unloadAllModelsHandler)
-	pm.ginEngine.GET("/running", pm.apiKeyAuth(), pm.listRunningProcessesHandler)
+	pm.ginEngine.Any("/upstream/*upstreamPath", inferenceAuth, pm.proxyToUpstream)
+	pm.ginEngine.GET("/metrics", viewerAuth, pm.prometheusMetricsHandler)
+	pm.ginEngine.POST("/unload", pm.audit, operatorAuth, pm.unloadAllModelsHandler)
+	pm.ginEngine.GET("/unload", pm.audit, operatorAuth, pm.refuseSessionSafeMethod, pm.unloadAllModelsHandler)
+	pm.ginEngine.GET("/running", viewerAuth, pm.listRunningProcessesHandler)
 	pm.ginEngine.GET("/health", func(c *gin.Context) {
 		c.String(http.StatusOK, "OK")
 	})
@@ -406,6 +542,9 @@ func (pm *ProxyManager) setupGinEngine() {
 		// Serve files with compression support under /ui/*
 		// This handler checks for pre-compressed .br and .gz files
 		pm.ginEngine.GET("/ui/*filepath", func(c *gin.Context) {
+			if !pm.uiAuth(c) {
+				return
+			}
 			filepath := strings.TrimPrefix(c.Param("filepath"), "/")
 			// Default to index.html for directory-like paths
 			if filepath == "" {
@@ -421,6 +560,9 @@ func (pm *ProxyManager) setupGinEngine() {
 				c.AbortWithStatus(http.StatusNotFound)
 				return
 			}
+			if !pm.uiAuth(c) {
+				return
+			}
 
 			// Check if this looks like a file request (has extension)
 			path := c.Request.URL.Path
@@ -439,6 +581,9 @@ func (pm *ProxyManager) setupGinEngine() {
 	// add API handler functions
 	addApiHandlers(pm)
 
+	// see: admin_auth.go
+	addAdminAuthHandlers(pm)
+
 	// Disable console color for testing
 	gin.DisableConsoleColor()
 }
@@ -486,22 +631,67 @@ func (pm *ProxyManager) Shutdown() {
 		}(processGroup)
 	}
 	wg.Wait()
+	pm.cancelStartEvents()
+	pm.thrashDetector.close()
+	pm.quotaTracker().close()
+	pm.rateLimits.close()
+	pm.tracer.close()
+	if pm.metricsStore != nil {
+		pm.metricsStore.close()
+	}
 	pm.shutdownCancel()
 }
 
-func (pm *ProxyManager) swapProcessGroup(realModelName string) (*ProcessGroup, error) {
+// swapProcessGroup finds the group of realModelName and, when the group is
+// exclusive, stops the other groups once their minimum residency allows it
+func (pm *ProxyManager) swapProcessGroup(ctx context.Context, realModelName string) (_ *ProcessGroup, err error) {
+	ctx, swapSpan := startSpan(ctx, "swap process group", spanKindInternal)
+	swapSpan.setAttr("llama_swap.model", realModelName)
+	defer func() {
+		swapSpan.setError(err)
+		swapSpan.end()
+	}()
+
 	processGroup := pm.findGroupByModelName(realModelName)
 	if processGroup == nil {
 		return nil, fmt.Errorf("could not find process group for model %s", realModelName)
 	}
+	swapSpan.setAttr("llama_swap.group", processGroup.id)
+	swapSpan.setAttr("llama_swap.exclusive", processGroup.exclusive)
 
 	if processGroup.exclusive {
 		pm.proxyLogger.Debugf("Exclusive mode for group %s, stopping other process groups", processGroup.id)
 		for groupId, otherGroup := range pm.processGroups {
 			if groupId != processGroup.id && !otherGroup.persistent {
+				if err := otherGroup.waitForResidency(ctx, realModelName); err != nil {
+					return nil, err
+				}
+			}
+		}
+		stopBegin := time.Now()
+		stoppedAny := false
+		for groupId, otherGroup := range pm.processGroups {
+			if groupId != processGroup.id && !otherGroup.persistent {
+				running := false
+				for modelID, process := range otherGroup.processes {
+					if process.CurrentState() != StateStopped {
+						event.Emit(ModelSwapEvent{GroupID: groupId, FromModel: modelID, ToModel: realModelName})
+						running = true
+					}
+				}
+				var stopSpan *span
+				if running {
+					_, stopSpan = startSpan(ctx, "stop group "+groupId, spanKindInternal)
+					stopSpan.setAttr("llama_swap.group", groupId)
+				}
 				otherGroup.StopProcesses(StopWaitForInflightRequest)
+				stopSpan.end()
+				stoppedAny = stoppedAny || running
 			}
 		}
+		if process, ok := processGroup.processes[realModelName]; ok && stoppedAny && process.CurrentState() != StateReady {
+			process.addStopPrevious(time.Since(stopBegin))
+		}
 	}
 
 	return processGroup, nil
@@ -540,12 +730,14 @@ func (pm *ProxyManager) listModelsHandler(c *gin.Context) {
 			continue
 		}
 
-		data = append(data, newRecord(id, modelConfig))
+		if pm.modelAllowed(c, id) {
+			data = append(data, newRecord(id, modelConfig))
+		}
 
 		// Include aliases
 		if pm.config.IncludeAliasesInList {
 			for _, alias := range modelConfig.Aliases {
-				if alias := strings.TrimSpace(alias); alias != "" {
+				if alias := strings.TrimSpace(alias); alias != "" && pm.modelAllowed(c, alias) {
 					data = append(data, newRecord(alias, modelConfig))
 				}
 			}
@@ -556,7 +748,9 @@ func (pm *ProxyManager) listModelsHandler(c *gin.Context) {
 		for peerID, peer := range pm.peerProxy.ListPeers() {
 			// add peer models
 			for _, modelID := range peer.Models {
-				// Skip unlisted models if not showing them
+				if !pm.modelAllowed(c, modelID) {
+					continue
+				}
 				record := newRecord(modelID, config.ModelConfig{
 					Name: fmt.Sprintf("%s: %s", peerID, modelID),
 					Metadata: map[string]any{
@@ -569,6 +763,18 @@ func (pm *ProxyManager) listModelsHandler(c *gin.Context) {
 		}
 	}
 
+	splits := pm.splitRouter()
+	for _, name := range splits.names() {
+		if !pm.modelAllowed(c, name) {
+			continue
+		}
+		data = append(data, newRecord(name, config.ModelConfig{
+			Metadata: map[string]any{
+				"split": splits.status(name),
+			},
+		}))
+	}
+
 	// Sort by the "id" key
 	sort.Slice(data, func(i, j int) bool {
 		si, _ := data[i]["id"].(string)
@@ -626,12 +832,16 @@ func (pm *ProxyManager) proxyToUpstream(c *gin.Context) {
 		pm.sendErrorResponse(c, http.StatusBadRequest, "model id required in path")
 		return
 	}
+	if !pm.checkAdmission(c, searchModelName, nil) {
+		return
+	}
 
 	// Redirect /upstream/modelname to /upstream/modelname/ for URL consistency.
 	// This ensures relative URLs in upstream responses resolve correctly and
 	// provides canonical URL form. Uses 308 for POST/PUT/etc to preserve the
 	// HTTP method (301 would downgrade to GET).
 	if remainingPath == "/" && !strings.HasSuffix(upstreamPath, "/") {
+		pm.releaseAdmission(c)
 		newPath := "/upstream/" + searchModelName + "/"
 		if c.Request.URL.RawQuery != "" {
 			newPath += "?" + c.Request.URL.RawQuery
@@ -644,8 +854,13 @@ func (pm *ProxyManager) proxyToUpstream(c *gin.Context) {
 		return
 	}
 
-	processGroup, err := pm.swapProcessGroup(modelID)
+	c.Set(ginModelKey, modelID)
+	processGroup, err := pm.swapProcessGroup(c.Request.Context(), modelID)
 	if err != nil {
+		pm.releaseAdmission(c)
+		if pm.sendResidencyError(c, err) {
+			return
+		}
 		pm.sendErrorResponse(c, http.StatusInternalServerError, fmt.Sprintf("error swapping process group: %s", err.Error()))
 		return
 	}
@@ -653,10 +868,14 @@ func (pm *ProxyManager) proxyToUpstream(c *gin.Context) {
 	// rewrite the path
 	originalPath := c.Request.URL.Path
 	c.Request.URL.Path = remainingPath
+	c.Request = withStartTrigger(c.Request, startTriggerAPI)
 
 	// attempt to record metrics if it is a POST request
 	if pm.metricsMonitor != nil && c.Request.Method == "POST" {
 		if err := pm.metricsMonitor.wrapHandler(modelID, c.Writer, c.Request, processGroup.ProxyRequest); err != nil {
+			if pm.sendResidencyError(c, err) {
+				return
+			}
 			pm.sendErrorResponse(c, http.StatusInternalServerError, fmt.Sprintf("error proxying metrics wrapped request: %s", err.Error()))
 			pm.proxyLogger.Errorf("Error proxying wrapped upstream request for model %s, path=%s", modelID, originalPath)
 			return
@@ -673,12 +892,23 @@ type resolvedModelTarget struct {
 	modelID      string
 	useModelName string
 	isPeer       bool
+	split        string // the split that assigned the request to modelID
 	handler      func(modelID string, w http.ResponseWriter, r *http.Request) error
 }
 
-func (pm *ProxyManager) resolveModelTarget(requestedModel string) (*resolvedModelTarget, error) {
+func (pm *ProxyManager) resolveModelTarget(c *gin.Context, requestedModel string) (*resolvedModelTarget, error) {
+	if variant, found := pm.splitRouter().assign(requestedModel, c.Request, c.ClientIP()); found {
+		pm.proxyLogger.Debugf("ProxyManager using variant %s of split %s", variant, requestedModel)
+		target, err := pm.resolveModelTarget(c, variant)
+		if target != nil {
+			target.split = requestedModel
+		}
+		return target, err
+	}
+
+	ctx := c.Request.Context()
 	if modelID, found := pm.config.RealModelName(requestedModel); found {
-		processGroup, err := pm.swapProcessGroup(modelID)
+		processGroup, err := pm.swapProcessGroup(ctx, modelID)
 		if err != nil {
 			return nil, fmt.Errorf("error swapping process group: %w", err)
 		}
@@ -703,74 +933,41 @@ func (pm *ProxyManager) resolveModelTarget(requestedModel string) (*resolvedMode
 	return nil, nil
 }
 
-func (pm *ProxyManager) proxyInferenceHandler(c *gin.Context) {
-	// Limit body size to prevent memory exhaustion.
-	limitedReader := io.LimitReader(c.Request.Body, maxInferenceBodyBytes+1) // +1 to detect overflow
-
-	bodyBytes, err := io.ReadAll(limitedReader)
-	if err != nil {
-		pm.sendErrorResponse(c, http.StatusBadRequest, "could not read request body")
-		return
-	}
-
-	// Check if body was truncated
-	if len(bodyBytes) > maxInferenceBodyBytes {
-		pm.sendErrorResponse(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body too large (max %d MB)", maxInferenceBodyBytes>>20))
-		return
-	}
-
-	requestedModel := gjson.GetBytes(bodyBytes, "model").String()
-	if requestedModel == "" {
-		pm.sendErrorResponse(c, http.StatusBadRequest, "missing or invalid 'model' key")
-		return
-	}
-
-	target, err := pm.resolveModelTarget(requestedModel)
-	if err != nil {
-		pm.sendErrorResponse(c, http.StatusInternalServerError, err.Error())
-		return
-	}
-	if target == nil {
-		pm.sendErrorResponse(c, http.StatusBadRequest, fmt.Sprintf("could not find suitable inference handler for %s", requestedModel))
-		return
-	}
-	modelID := target.modelID
-	nextHandler := target.handler
-
+// applyModelFilters rewrites the request body for the model of target: the
+// model name sent upstream and the stripParams and setParams filters
+func (pm *ProxyManager) applyModelFilters(target *resolvedModelTarget, requestedModel string, bodyBytes []byte) ([]byte, error) {
+	var err error
 	if !target.isPeer {
 		// issue #69 allow custom model names to be sent to upstream
 		useModelName := target.useModelName
 		if useModelName != "" {
 			bodyBytes, err = sjson.SetBytes(bodyBytes, "model", useModelName)
 			if err != nil {
-				pm.sendErrorResponse(c, http.StatusInternalServerError, fmt.Sprintf("error rewriting model name in JSON: %s", err.Error()))
-				return
+				return nil, fmt.Errorf("error rewriting model name in JSON: %s", err.Error())
 			}
 		}
 
 		// issue #174 strip parameters from the JSON body
-		stripParams, err := pm.config.Models[modelID].Filters.SanitizedStripParams()
+		stripParams, err := pm.config.Models[target.modelID].Filters.SanitizedStripParams()
 		if err != nil { // just log it and continue
-			pm.proxyLogger.Errorf("Error sanitizing strip params string: %s, %s", pm.config.Models[modelID].Filters.StripParams, err.Error())
+			pm.proxyLogger.Errorf("Error sanitizing strip params string: %s, %s", pm.config.Models[target.modelID].Filters.StripParams, err.Error())
 		} else {
 			for _, param := range stripParams {
-				pm.proxyLogger.Debugf("<%s> stripping param: %s", modelID, param)
+				pm.proxyLogger.Debugf("<%s> stripping param: %s", target.modelID, param)
 				bodyBytes, err = sjson.DeleteBytes(bodyBytes, param)
 				if err != nil {
-					pm.sendErrorResponse(c, http.StatusInternalServerError, fmt.Sprintf("error deleting parameter %s from request", param))
-					return
+					return nil, fmt.Errorf("error deleting parameter %s from request", param)
 				}
 			}
 		}
 
 		// issue #453 set/override parameters in the JSON body
-		setParams, setParamKeys := pm.config.Models[modelID].Filters.SanitizedSetParams()
+		setParams, setParamKeys := pm.config.Models[target.modelID].Filters.SanitizedSetParams()
 		for _, key := range setParamKeys {
-			pm.proxyLogger.Debugf("<%s> setting param: %s", modelID, key)
+			pm.proxyLogger.Debugf("<%s> setting param: %s", target.modelID, key)
 			bodyBytes, err = sjson.SetBytes(bodyBytes, key, setParams[key])
 			if err != nil {
-				pm.sendErrorResponse(c, http.StatusInternalServerError, fmt.Sprintf("error setting parameter %s in request", key))
-				return
+				return nil, fmt.Errorf("error setting parameter %s in request", key)
 			}
 		}
 
@@ -784,8 +981,7 @@ func (pm *ProxyManager) proxyInferenceHandler(c *gin.Context) {
 			pm.proxyLogger.Debugf("<%s> stripping param: %s", requestedModel, param)
 			bodyBytes, err = sjson.DeleteBytes(bodyBytes, param)
 			if err != nil {
-				pm.sendErrorResponse(c, http.StatusInternalServerError, fmt.Sprintf("error stripping parameter %s from request", param))
-				return
+				return nil, fmt.Errorf("error stripping parameter %s from request", param)
 			}
 		}
 
@@ -795,12 +991,74 @@ func (pm *ProxyManager) proxyInferenceHandler(c *gin.Context) {
 			pm.proxyLogger.Debugf("<%s> setting param: %s", requestedModel, key)
 			bodyBytes, err = sjson.SetBytes(bodyBytes, key, setParams[key])
 			if err != nil {
-				pm.sendErrorResponse(c, http.StatusInternalServerError, fmt.Sprintf("error setting parameter %s in request", key))
-				return
+				return nil, fmt.Errorf("error setting parameter %s in request", key)
 			}
 		}
 
 	}
+	return bodyBytes, nil
+}
+
+func (pm *ProxyManager) proxyInferenceHandler(c *gin.Context) {
+	// Limit body size to prevent memory exhaustion.
+	limitedReader := io.LimitReader(c.Request.Body, maxInferenceBodyBytes+1) // +1 to detect overflow
+
+	bodyBytes, err := io.ReadAll(limitedReader)
+	if err != nil {
+		pm.sendErrorResponse(c, http.StatusBadRequest, "could not read request body")
+		return
+	}
+
+	// Check if body was truncated
+	if len(bodyBytes) > maxInferenceBodyBytes {
+		pm.sendErrorResponse(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body too large (max %d MB)", maxInferenceBodyBytes>>20))
+		return
+	}
+
+	requestedModel := gjson.GetBytes(bodyBytes, "model").String()
+	if requestedModel == "" {
+		pm.sendErrorResponse(c, http.StatusBadRequest, "missing or invalid 'model' key")
+		return
+	}
+	if !pm.checkAdmission(c, requestedModel, bodyBytes) {
+		return
+	}
+
+	target, err := pm.resolveModelTarget(c, requestedModel)
+	if err != nil {
+		pm.releaseAdmission(c)
+		if pm.sendResidencyError(c, err) {
+			return
+		}
+		pm.sendErrorResponse(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if target == nil {
+		pm.releaseAdmission(c)
+		pm.sendErrorResponse(c, http.StatusBadRequest, fmt.Sprintf("could not find suitable inference handler for %s", requestedModel))
+		return
+	}
+	modelID := target.modelID
+	nextHandler := target.handler
+	c.Set(ginModelKey, modelID)
+
+	clientBody := bodyBytes
+	if target.split != "" {
+		// the variant is sent the request as if it was asked for by name
+		requestedModel = modelID
+		bodyBytes, err = sjson.SetBytes(bodyBytes, "model", modelID)
+		if err != nil {
+			pm.releaseAdmission(c)
+			pm.sendErrorResponse(c, http.StatusInternalServerError, fmt.Sprintf("error rewriting model name in JSON: %s", err.Error()))
+			return
+		}
+	}
+	bodyBytes, err = pm.applyModelFilters(target, requestedModel, bodyBytes)
+	if err != nil {
+		pm.releaseAdmission(c)
+		pm.sendErrorResponse(c, http.StatusInternalServerError, err.Error())
+		return
+	}
 
 	c.Request.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 
@@ -813,10 +1071,16 @@ func (pm *ProxyManager) proxyInferenceHandler(c *gin.Context) {
 	isStreaming := gjson.GetBytes(bodyBytes, "stream").Bool()
 	ctx := context.WithValue(c.Request.Context(), proxyCtxKey("streaming"), isStreaming)
 	ctx = context.WithValue(ctx, proxyCtxKey("model"), modelID)
+	if target.split != "" {
+		ctx = context.WithValue(ctx, proxyCtxKey("split"), target.split)
+	}
 	c.Request = c.Request.WithContext(ctx)
 
 	if pm.metricsMonitor != nil && c.Request.Method == "POST" {
 		if err := pm.metricsMonitor.wrapHandler(modelID, c.Writer, c.Request, nextHandler); err != nil {
+			if pm.sendResidencyError(c, err) {
+				return
+			}
 			pm.sendErrorResponse(c, http.StatusInternalServerError, fmt.Sprintf("error proxying metrics wrapped request: %s", err.Error()))
 			pm.proxyLogger.Errorf("Error Proxying Metrics Wrapped Request model %s", modelID)
 			return
@@ -827,6 +1091,8 @@ func (pm *ProxyManager) proxyInferenceHandler(c *gin.Context) {
 			return
 		}
 	}
+
+	pm.mirrorRequest(c.Request, modelID, clientBody)
 }
 
 func (pm *ProxyManager) proxyOAIPostFormHandler(c *gin.Context) {
@@ -842,19 +1108,28 @@ func (pm *ProxyManager) proxyOAIPostFormHandler(c *gin.Context) {
 		pm.sendErrorResponse(c, http.StatusBadRequest, "missing or invalid 'model' parameter in form data")
 		return
 	}
+	if !pm.checkAdmission(c, requestedModel, nil) {
+		return
+	}
 
 	// Look for a matching local model first, then check peers
-	target, err := pm.resolveModelTarget(requestedModel)
+	target, err := pm.resolveModelTarget(c, requestedModel)
 	if err != nil {
+		pm.releaseAdmission(c)
+		if pm.sendResidencyError(c, err) {
+			return
+		}
 		pm.sendErrorResponse(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 	if target == nil {
+		pm.releaseAdmission(c)
 		pm.sendErrorResponse(c, http.StatusBadRequest, fmt.Sprintf("could not find suitable handler for %s", requestedModel))
 		return
 	}
 	modelID := target.modelID
 	nextHandler := target.handler
+	c.Set(ginModelKey, modelID)
 	useModelName := target.useModelName
 
 	// We need to reconstruct the multipart form in any case since the body is consumed
@@ -871,6 +1146,8 @@ func (pm *ProxyManager) proxyOAIPostFormHandler(c *gin.Context) {
 				// # issue #69 allow custom model names to be sent to upstream
 				if useModelName != "" {
 					fieldValue = useModelName
+				} else if target.split != "" {
+					fieldValue = modelID
 				} else {
 					fieldValue = requestedModel
 				}
@@ -950,18 +1227,27 @@ func (pm *ProxyManager) proxyGETModelHandler(c *gin.Context) {
 		pm.sendErrorResponse(c, http.StatusBadRequest, "missing required 'model' query parameter")
 		return
 	}
+	if !pm.checkAdmission(c, requestedModel, nil) {
+		return
+	}
 
-	target, err := pm.resolveModelTarget(requestedModel)
+	target, err := pm.resolveModelTarget(c, requestedModel)
 	if err != nil {
+		pm.releaseAdmission(c)
+		if pm.sendResidencyError(c, err) {
+			return
+		}
 		pm.sendErrorResponse(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 	if target == nil {
+		pm.releaseAdmission(c)
 		pm.sendErrorResponse(c, http.StatusBadRequest, fmt.Sprintf("could not find suitable handler for %s", requestedModel))
 		return
 	}
 	modelID := target.modelID
 	nextHandler := target.handler
+	c.Set(ginModelKey, modelID)
 
 	if err := nextHandler(modelID, c.Writer, c.Request); err != nil {
 		pm.sendProxyRequestError(c, err, "Error Proxying GET Request for model %s", modelID)
@@ -970,6 +1256,9 @@ func (pm *ProxyManager) proxyGETModelHandler(c *gin.Context) {
 }
 
 func (pm *ProxyManager) sendProxyRequestError(c *gin.Context, err error, logFormat string, logArgs ...any) {
+	if pm.sendResidencyError(c, err) {
+		return
+	}
 	pm.sendErrorResponse(c, http.StatusInternalServerError, fmt.Sprintf("error proxying request: %s", err.Error()))
 	pm.proxyLogger.Errorf(logFormat, logArgs...)
 }
@@ -1006,70 +1295,99 @@ func (pm *ProxyManager) isOriginAllowed(origin string) bool {
 	return false
 }
 
-// apiKeyAuth returns a middleware that validates API keys if configured.
+// apiKeyAuth returns a middleware that validates API keys if configured and
+// that the key can call routes of the endpoint class.
 // Returns a pass-through handler if no API keys are configured.
-func (pm *ProxyManager) apiKeyAuth() gin.HandlerFunc {
-	if len(pm.config.RequiredAPIKeys) == 0 {
-		return func(c *gin.Context) { c.Next() }
-	}
-
+func (pm *ProxyManager) apiKeyAuth(class string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		xApiKey := c.GetHeader("x-api-key")
-
-		var bearerKey string
-		var basicKey string
-		if auth := c.GetHeader("Authorization"); auth != "" {
-			if strings.HasPrefix(auth, "Bearer ") {
-				bearerKey = strings.TrimPrefix(auth, "Bearer ")
-			} else if strings.HasPrefix(auth, "Basic ") {
-				// Basic Auth: base64(username:password), password is the API key
-				encoded := strings.TrimPrefix(auth, "Basic ")
-				if decoded, err := base64.StdEncoding.DecodeString(encoded); err == nil {
-					parts := strings.SplitN(string(decoded), ":", 2)
-					if len(parts) == 2 {
-						basicKey = parts[1] // password is the API key
-					}
-				}
-			}
+		// keys can be added or removed by a config edit
+		if len(pm.apiKeyEntries()) == 0 {
+			c.Next()
+			return
 		}
 
-		// Use first key found: Basic, then Bearer, then x-api-key
-		var providedKey string
-		if basicKey != "" {
-			providedKey = basicKey
-		} else if bearerKey != "" {
-			providedKey = bearerKey
-		} else {
-			providedKey = xApiKey
-		}
+		_, authSpan := startSpan(c.Request.Context(), "auth", spanKindInternal)
+		defer authSpan.end()
 
-		// Validate key using constant-time comparison to prevent timing attacks
-		valid := false
-		for _, key := range pm.config.RequiredAPIKeys {
-			// Use constant-time comparison to prevent timing attacks
-			if subtle.ConstantTimeCompare([]byte(providedKey), []byte(key)) == 1 {
-				valid = true
-				break
+		entry, providedKey := pm.requestAPIKeyEntry(c)
+		authSpan.setAttr("llama_swap.auth.valid", entry != nil)
+		if entry == nil {
+			// signed in admin users can use the inference routes, e.g. from
+			// the playground
+			if class == config.APIKeyEndpointInference {
+				session, ok := pm.checkAdminSession(c)
+				if !ok {
+					return
+				}
+				if session != nil {
+					authSpan.setAttr("llama_swap.auth.user", session.user)
+					authSpan.end()
+					c.Next()
+					return
+				}
 			}
-		}
-
-		if !valid {
 			c.Header("WWW-Authenticate", `Basic realm="llama-swap"`)
 			pm.sendErrorResponse(c, http.StatusUnauthorized, "unauthorized: invalid or missing API key")
 			c.Abort()
 			return
 		}
+		authSpan.setAttr("llama_swap.auth.key", entry.name)
+
+		if entry.identity != nil {
+			if !entry.identity.AllowsEndpoint(class) {
+				pm.proxyLogger.Infof("API key %s is not allowed to call %s endpoint %s %s", entry.name, class, c.Request.Method, c.Request.URL.Path)
+				c.Set(ginAPIKeyName, entry.name)
+				pm.sendErrorResponse(c, http.StatusForbidden, "forbidden: API key is not allowed to call this endpoint")
+				c.Abort()
+				return
+			}
+		}
+		pm.setAPIKey(c, entry, providedKey)
 
-		// Preserve the validated key for internal use (e.g., benchmarks that call back into /v1).
-		// Headers are stripped below to prevent leakage to upstream servers.
-		c.Set(ctxKeyAPIKey, providedKey)
+		authSpan.end()
+		c.Next()
+	}
+}
 
-		// Strip auth headers to prevent leakage to upstream
-		c.Request.Header.Del("Authorization")
-		c.Request.Header.Del("x-api-key")
+// requestAPIKey returns the API key of the request: the password of Basic
+// auth, then the Bearer token, then the x-api-key header
+func requestAPIKey(c *gin.Context) string {
+	if auth := c.GetHeader("Authorization"); auth != "" {
+		if strings.HasPrefix(auth, "Bearer ") {
+			if key := strings.TrimPrefix(auth, "Bearer "); key != "" {
+				return key
+			}
+		} else if strings.HasPrefix(auth, "Basic ") {
+			// Basic Auth: base64(username:password), password is the API key
+			encoded := strings.TrimPrefix(auth, "Basic ")
+			if decoded, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+				parts := strings.SplitN(string(decoded), ":", 2)
+				if len(parts) == 2 && parts[1] != "" {
+					return parts[1] // password is the API key
+				}
+			}
+		}
+	}
+	return c.GetHeader("x-api-key")
+}
 
-		c.Next()
+// setAPIKey records the validated API key of the request
+func (pm *ProxyManager) setAPIKey(c *gin.Context, entry *apiKeyEntry, providedKey string) {
+	c.Set(ginAPIKeyName, entry.name)
+	if entry.identity != nil {
+		c.Set(ginAPIKeyIdentity, entry.identity)
 	}
+
+	// Preserve the validated key for internal use (e.g., benchmarks that call back into /v1).
+	// Headers are stripped below to prevent leakage to upstream servers.
+	c.Set(ctxKeyAPIKey, providedKey)
+	// the name, not the key, identifies the client for split stickiness and
+	// metrics, it is the only identity of a client certificate
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), proxyCtxKey("apiKey"), entry.name))
+
+	// Strip auth headers to prevent leakage to upstream
+	c.Request.Header.Del("Authorization")
+	c.Request.Header.Del("x-api-key")
 }
 
 func (pm *ProxyManager) unloadAllModelsHandler(c *gin.Context) {
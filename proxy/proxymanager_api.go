@@ -13,6 +13,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/mostlygeek/llama-swap/event"
+	"github.com/mostlygeek/llama-swap/proxy/config"
 )
 
 type Model struct {
@@ -26,49 +27,102 @@ type Model struct {
 	RecipeRef      string `json:"recipeRef,omitempty"`
 	Mode           string `json:"mode,omitempty"`
 	TensorParallel int    `json:"tensorParallel,omitempty"`
+
+	Split *splitStatus `json:"split,omitempty"`
 }
 
 func addApiHandlers(pm *ProxyManager) {
 	// Add API endpoints for React to consume
-	// Protected with API key authentication
-	apiGroup := pm.ginEngine.Group("/api", pm.apiKeyAuth())
+	// Every route is tagged with the admin role it requires, see requireRole
+	apiGroup := pm.ginEngine.Group("/api")
+	roleAuth := pm.apiRoleAuth()
+	route := func(method, path, role string, handler gin.HandlerFunc) {
+		pm.apiRoles[method+" /api"+path] = role
+		if method == http.MethodGet {
+			apiGroup.Handle(method, path, roleAuth, handler)
+		} else {
+			// every change is recorded in the audit log, attempts refused by
+			// roleAuth included
+			apiGroup.Handle(method, path, pm.audit, roleAuth, handler)
+		}
+	}
+	const (
+		viewer   = config.AdminRoleViewer
+		operator = config.AdminRoleOperator
+		admin    = config.AdminRoleAdmin
+	)
 	{
-		apiGroup.POST("/models/unload", pm.apiUnloadAllModels)
-		apiGroup.POST("/models/unload/*model", pm.apiUnloadSingleModelHandler)
-		apiGroup.POST("/cluster/stop", pm.apiStopCluster)
-		apiGroup.GET("/cluster/status", pm.apiGetClusterStatus)
-		apiGroup.POST("/cluster/dgx/update", pm.apiRunClusterDGXUpdate)
-		apiGroup.GET("/images/docker", pm.apiListDockerImages)
-		apiGroup.POST("/images/docker/update", pm.apiUpdateDockerImage)
-		apiGroup.POST("/images/docker/delete", pm.apiDeleteDockerImage)
-		apiGroup.GET("/config/editor", pm.apiGetConfigEditor)
-		apiGroup.PUT("/config/editor", pm.apiSaveConfigEditor)
-		apiGroup.GET("/recipes/state", pm.apiGetRecipeState)
-		apiGroup.GET("/recipes/backend", pm.apiGetRecipeBackend)
-		apiGroup.PUT("/recipes/backend", pm.apiSetRecipeBackend)
-		apiGroup.GET("/recipes/containers", pm.apiGetDockerContainers)
-		apiGroup.GET("/recipes/selected-container", pm.apiGetSelectedContainer)
-		apiGroup.PUT("/recipes/selected-container", pm.apiSetSelectedContainer)
-		apiGroup.POST("/recipes/backend/action", pm.apiRunRecipeBackendAction)
-		apiGroup.GET("/recipes/backend/action-status", pm.apiGetRecipeBackendActionStatus)
-		apiGroup.GET("/recipes/backend/hf-models", pm.apiListRecipeBackendHFModels)
-		apiGroup.PUT("/recipes/backend/hf-models/path", pm.apiSetRecipeBackendHFHubPath)
-		apiGroup.DELETE("/recipes/backend/hf-models", pm.apiDeleteRecipeBackendHFModel)
-		apiGroup.POST("/recipes/backend/hf-models/recipe", pm.apiGenerateRecipeBackendHFModel)
-		apiGroup.POST("/recipes/models", pm.apiUpsertRecipeModel)
-		apiGroup.DELETE("/recipes/models/:id", pm.apiDeleteRecipeModel)
-		apiGroup.GET("/recipes/source", pm.apiGetRecipeSource)
-		apiGroup.PUT("/recipes/source", pm.apiSaveRecipeSource)
-		apiGroup.DELETE("/recipes/source", pm.apiDeleteRecipeSource)
-		apiGroup.POST("/recipes/source/create", pm.apiCreateRecipeSource)
-		apiGroup.POST("/recipes/source/sync-defaults", pm.apiSyncRecipeSourceDefaults)
-		apiGroup.POST("/benchy", pm.apiStartBenchy)
-		apiGroup.GET("/benchy/:id", pm.apiGetBenchyJob)
-		apiGroup.POST("/benchy/:id/cancel", pm.apiCancelBenchyJob)
-		apiGroup.GET("/events", pm.apiSendEvents)
-		apiGroup.GET("/metrics", pm.apiGetMetrics)
-		apiGroup.GET("/version", pm.apiGetVersion)
-		apiGroup.GET("/captures/:id", pm.apiGetCapture)
+		route("POST", "/models/unload", operator, pm.apiUnloadAllModels)
+		route("POST", "/models/unload/*model", operator, pm.apiUnloadSingleModelHandler)
+		route("POST", "/cluster/stop", operator, pm.apiStopCluster)
+		route("GET", "/cluster/status", viewer, pm.apiGetClusterStatus)
+		route("POST", "/cluster/dgx/update", admin, pm.apiRunClusterDGXUpdate)
+		route("GET", "/images/docker", viewer, pm.apiListDockerImages)
+		route("POST", "/images/docker/update", admin, pm.apiUpdateDockerImage)
+		route("POST", "/images/docker/delete", admin, pm.apiDeleteDockerImage)
+		// the config has the API keys and password hashes
+		route("GET", "/config/editor", admin, pm.apiGetConfigEditor)
+		route("PUT", "/config/editor", admin, pm.apiSaveConfigEditor)
+		route("POST", "/config/validate", admin, pm.apiValidateConfig)
+		for _, section := range configEntrySections {
+			route("GET", "/config/"+section, admin, pm.apiListConfigEntries(section))
+			route("GET", "/config/"+section+"/*name", admin, pm.apiGetConfigEntry(section))
+			route("POST", "/config/"+section+"/*name", admin, pm.apiCreateConfigEntry(section))
+			route("PUT", "/config/"+section+"/*name", admin, pm.apiUpdateConfigEntry(section))
+			route("DELETE", "/config/"+section+"/*name", admin, pm.apiDeleteConfigEntry(section))
+		}
+		route("GET", "/recipes/state", viewer, pm.apiGetRecipeState)
+		route("GET", "/recipes/backend", viewer, pm.apiGetRecipeBackend)
+		route("PUT", "/recipes/backend", admin, pm.apiSetRecipeBackend)
+		route("GET", "/recipes/containers", viewer, pm.apiGetDockerContainers)
+		route("GET", "/recipes/selected-container", viewer, pm.apiGetSelectedContainer)
+		route("PUT", "/recipes/selected-container", operator, pm.apiSetSelectedContainer)
+		// backend actions run git, builds and image pulls on the cluster
+		route("POST", "/recipes/backend/action", admin, pm.apiRunRecipeBackendAction)
+		route("GET", "/recipes/backend/action-status", viewer, pm.apiGetRecipeBackendActionStatus)
+		route("GET", "/recipes/backend/hf-models", viewer, pm.apiListRecipeBackendHFModels)
+		route("PUT", "/recipes/backend/hf-models/path", admin, pm.apiSetRecipeBackendHFHubPath)
+		route("DELETE", "/recipes/backend/hf-models", admin, pm.apiDeleteRecipeBackendHFModel)
+		route("POST", "/recipes/backend/hf-models/recipe", admin, pm.apiGenerateRecipeBackendHFModel)
+		route("POST", "/recipes/models", admin, pm.apiUpsertRecipeModel)
+		route("DELETE", "/recipes/models/:id", admin, pm.apiDeleteRecipeModel)
+		route("GET", "/recipes/source", admin, pm.apiGetRecipeSource)
+		route("PUT", "/recipes/source", admin, pm.apiSaveRecipeSource)
+		route("DELETE", "/recipes/source", admin, pm.apiDeleteRecipeSource)
+		route("POST", "/recipes/source/create", admin, pm.apiCreateRecipeSource)
+		route("POST", "/recipes/source/sync-defaults", admin, pm.apiSyncRecipeSourceDefaults)
+		route("POST", "/benchy", operator, pm.apiStartBenchy)
+		route("GET", "/benchy/:id", viewer, pm.apiGetBenchyJob)
+		route("POST", "/benchy/:id/cancel", operator, pm.apiCancelBenchyJob)
+		route("GET", "/events", viewer, pm.apiSendEvents)
+		route("GET", "/metrics", viewer, pm.apiGetMetrics)
+		route("GET", "/metrics/query", viewer, pm.apiQueryMetrics)
+		route("GET", "/starts", viewer, pm.apiGetModelStarts)
+		route("GET", "/starts/summary", viewer, pm.apiGetModelStartsSummary)
+		route("GET", "/version", viewer, pm.apiGetVersion)
+		// captures have the prompts and responses
+		route("GET", "/captures/export", operator, pm.apiExportCaptures)
+		route("GET", "/captures/:id", operator, pm.apiGetCapture)
+		route("POST", "/captures/:id/replay", operator, pm.apiReplayCapture)
+		route("GET", "/requests/:id", operator, pm.apiGetRequest)
+		route("GET", "/quotas", viewer, pm.apiGetQuotas)
+		route("GET", "/audit", viewer, pm.apiGetAudit)
+	}
+}
+
+// apiRoleAuth authenticates /api requests for the role of their route,
+// routes without one require admin
+func (pm *ProxyManager) apiRoleAuth() gin.HandlerFunc {
+	auth := make(map[string]gin.HandlerFunc)
+	for _, role := range []string{config.AdminRoleViewer, config.AdminRoleOperator, config.AdminRoleAdmin} {
+		auth[role] = pm.requireRole(role)
+	}
+	return func(c *gin.Context) {
+		role, found := pm.apiRoles[c.Request.Method+" "+c.FullPath()]
+		if !found {
+			role = config.AdminRoleAdmin
+		}
+		auth[role](c)
 	}
 }
 
@@ -422,6 +476,14 @@ func (pm *ProxyManager) getModelStatus() []Model {
 		}
 	}
 
+	splits := pm.splitRouter()
+	for _, name := range splits.names() {
+		models = append(models, Model{
+			Id:    name,
+			Split: splits.status(name),
+		})
+	}
+
 	return models
 }
 
@@ -480,6 +542,7 @@ const (
 	msgTypeModelStatus messageType = "modelStatus"
 	msgTypeLogData     messageType = "logData"
 	msgTypeMetrics     messageType = "metrics"
+	msgTypeAudit       messageType = "audit"
 )
 
 type messageEnvelope struct {
@@ -539,6 +602,18 @@ func (pm *ProxyManager) apiSendEvents(c *gin.Context) {
 		}
 	}
 
+	sendAudit := func(entry AuditEntry) {
+		jsonData, err := json.Marshal(entry)
+		if err == nil {
+			select {
+			case sendBuffer <- messageEnvelope{Type: msgTypeAudit, Data: string(jsonData)}:
+			case <-ctx.Done():
+				return
+			default:
+			}
+		}
+	}
+
 	/**
 	 * Send updated models list
 	 */
@@ -566,6 +641,13 @@ func (pm *ProxyManager) apiSendEvents(c *gin.Context) {
 		sendMetrics([]TokenMetrics{e.Metrics})
 	})()
 
+	/**
+	 * Send audit entries
+	 */
+	defer event.On(func(e AuditEvent) {
+		sendAudit(e.Entry)
+	})()
+
 	// send initial batch of data (prioritize model status for faster UI paint)
 	sendModels()
 	sendMetrics(pm.metricsMonitor.getMetrics())
@@ -640,7 +722,7 @@ func (pm *ProxyManager) apiGetCapture(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, capture)
+	c.JSON(http.StatusOK, newCaptureView(*capture))
 }
 
 func (pm *ProxyManager) apiGetDockerContainers(c *gin.Context) {
@@ -0,0 +1,308 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mostlygeek/llama-swap/event"
+	"github.com/mostlygeek/llama-swap/proxy/config"
+)
+
+// quotaUsage is the usage of one quota within its current window
+type quotaUsage struct {
+	window       time.Time // start
+	requests     int
+	inputTokens  int
+	outputTokens int
+}
+
+// quotaTracker counts the usage of the quotas of the named API keys.
+// Requests are counted when they are allowed, tokens from the metrics of
+// the finished requests.
+type quotaTracker struct {
+	mu     sync.Mutex
+	quotas map[string][]config.QuotaConfig // by API key name
+	usage  map[string][]quotaUsage         // same index as quotas
+	cancel func()
+
+	now func() time.Time
+}
+
+func newQuotaTracker(identities map[string]config.APIKeyIdentity) *quotaTracker {
+	t := &quotaTracker{
+		quotas: make(map[string][]config.QuotaConfig),
+		usage:  make(map[string][]quotaUsage),
+		now:    time.Now,
+	}
+	for name, identity := range identities {
+		if len(identity.Quotas) > 0 {
+			t.quotas[name] = identity.Quotas
+			t.usage[name] = make([]quotaUsage, len(identity.Quotas))
+		}
+	}
+	return t
+}
+
+// subscribe counts the tokens of TokenMetricsEvents until close
+func (t *quotaTracker) subscribe() *quotaTracker {
+	t.cancel = event.On(func(e TokenMetricsEvent) {
+		t.addTokens(e.Metrics)
+	})
+	return t
+}
+
+func (t *quotaTracker) close() {
+	if t.cancel != nil {
+		t.cancel()
+	}
+}
+
+// restore counts the requests and tokens recorded in store within the
+// current windows, so usage survives restarts and config reloads
+func (t *quotaTracker) restore(store *metricsStore) error {
+	if len(t.quotas) == 0 {
+		return nil
+	}
+	now := t.now()
+	return store.read(now.UTC().Truncate(24*time.Hour), now, func(record metricsRecord) {
+		if record.Type != metricsRecordRequest || record.Metrics == nil || record.Metrics.MirrorOf != "" {
+			return
+		}
+		tm := *record.Metrics
+		t.add(tm.APIKey, quotaModelOf(tm), tm.Timestamp, 1, tm.InputTokens, tm.OutputTokens)
+	})
+}
+
+// rebuild returns a subscribed tracker for the quotas of identities and
+// closes t. Quotas that did not change keep their usage, the usage of the
+// others is restored from store, when it is not nil.
+func (t *quotaTracker) rebuild(identities map[string]config.APIKeyIdentity, store *metricsStore) (*quotaTracker, error) {
+	next := newQuotaTracker(identities)
+	next.now = t.now
+	var err error
+	if store != nil {
+		err = next.restore(store)
+	}
+
+	// subscribed before the usage is copied, so no tokens are missed
+	next.subscribe()
+	t.mu.Lock()
+	next.mu.Lock()
+	for key, quotas := range next.quotas {
+		for i, quota := range quotas {
+			for j, previous := range t.quotas[key] {
+				if reflect.DeepEqual(quota, previous) {
+					next.usage[key][i] = t.usage[key][j]
+					break
+				}
+			}
+		}
+	}
+	next.mu.Unlock()
+	t.mu.Unlock()
+	t.close()
+	return next, err
+}
+
+// quotaModelOf returns the model the quotas of a finished request apply to
+func quotaModelOf(tm TokenMetrics) string {
+	if tm.Split != "" {
+		return tm.Split
+	}
+	return tm.Model
+}
+
+func (t *quotaTracker) addTokens(tm TokenMetrics) {
+	if tm.MirrorOf != "" {
+		return
+	}
+	t.add(tm.APIKey, quotaModelOf(tm), tm.Timestamp, 0, tm.InputTokens, tm.OutputTokens)
+}
+
+// add counts usage at time at towards the quotas of key for model
+func (t *quotaTracker) add(key, model string, at time.Time, requests, inputTokens, outputTokens int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, quota := range t.quotas[key] {
+		if !quota.AppliesTo(model) {
+			continue
+		}
+		usage := t.current(key, i)
+		if at.Before(usage.window) || !at.Before(usage.window.Add(quota.PeriodDuration())) {
+			continue
+		}
+		usage.requests += requests
+		usage.inputTokens += max(inputTokens, 0)
+		usage.outputTokens += max(outputTokens, 0)
+	}
+}
+
+// current returns the usage of quota i of key in the current window, t.mu
+// must be held
+func (t *quotaTracker) current(key string, i int) *quotaUsage {
+	window := t.now().UTC().Truncate(t.quotas[key][i].PeriodDuration())
+	usage := &t.usage[key][i]
+	if !usage.window.Equal(window) {
+		*usage = quotaUsage{window: window}
+	}
+	return usage
+}
+
+// quotaExceededError is returned by allow when a quota is used up
+type quotaExceededError struct {
+	quota      config.QuotaConfig
+	limit      string // requests, input tokens or output tokens
+	retryAfter time.Duration
+}
+
+func (e *quotaExceededError) Error() string {
+	return fmt.Sprintf("quota exceeded: %s per %s", e.limit, e.quota.Period)
+}
+
+// allow counts a request of key for model, unless one of the quotas of the
+// key for model is used up
+func (t *quotaTracker) allow(key, model string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var matching []int
+	for i, quota := range t.quotas[key] {
+		if !quota.AppliesTo(model) {
+			continue
+		}
+		usage := t.current(key, i)
+		var limit string
+		switch {
+		case quota.Requests > 0 && usage.requests >= quota.Requests:
+			limit = strconv.Itoa(quota.Requests) + " requests"
+		case quota.InputTokens > 0 && usage.inputTokens >= quota.InputTokens:
+			limit = strconv.Itoa(quota.InputTokens) + " input tokens"
+		case quota.OutputTokens > 0 && usage.outputTokens >= quota.OutputTokens:
+			limit = strconv.Itoa(quota.OutputTokens) + " output tokens"
+		}
+		if limit != "" {
+			return &quotaExceededError{
+				quota:      quota,
+				limit:      limit,
+				retryAfter: usage.window.Add(quota.PeriodDuration()).Sub(t.now()),
+			}
+		}
+		matching = append(matching, i)
+	}
+	for _, i := range matching {
+		t.usage[key][i].requests++
+	}
+	return nil
+}
+
+type quotaLimits struct {
+	Requests     int `json:"requests"`
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type quotaStatus struct {
+	Models   []string    `json:"models"`
+	Period   string      `json:"period"`
+	Limits   quotaLimits `json:"limits"` // 0 is not enforced
+	Used     quotaLimits `json:"used"`
+	ResetsAt time.Time   `json:"resets_at"`
+}
+
+type apiKeyQuotaStatus struct {
+	Key    string        `json:"key"`
+	Owner  string        `json:"owner,omitempty"`
+	Quotas []quotaStatus `json:"quotas"`
+}
+
+// status returns the usage of the quotas of every key, sorted by key name
+func (t *quotaTracker) status(identities map[string]config.APIKeyIdentity) []apiKeyQuotaStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	keys := make([]string, 0, len(t.quotas))
+	for key := range t.quotas {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := make([]apiKeyQuotaStatus, 0, len(keys))
+	for _, key := range keys {
+		status := apiKeyQuotaStatus{Key: key, Owner: identities[key].Owner}
+		for i, quota := range t.quotas[key] {
+			usage := t.current(key, i)
+			status.Quotas = append(status.Quotas, quotaStatus{
+				Models: quota.Models,
+				Period: quota.Period,
+				Limits: quotaLimits{
+					Requests:     quota.Requests,
+					InputTokens:  quota.InputTokens,
+					OutputTokens: quota.OutputTokens,
+				},
+				Used: quotaLimits{
+					Requests:     usage.requests,
+					InputTokens:  usage.inputTokens,
+					OutputTokens: usage.outputTokens,
+				},
+				ResetsAt: usage.window.Add(quota.PeriodDuration()),
+			})
+		}
+		result = append(result, status)
+	}
+	return result
+}
+
+// quotaModel returns the model the quotas of a request for requestedModel
+// apply to: the model ID for a local model or alias, otherwise the name of
+// the split or peer model
+func (pm *ProxyManager) quotaModel(requestedModel string) string {
+	if modelID, found := pm.config.RealModelName(requestedModel); found {
+		return modelID
+	}
+	return requestedModel
+}
+
+// checkQuota sends a 429 response when a quota of the API key of the request
+// is used up, before the model is loaded
+func (pm *ProxyManager) checkQuota(c *gin.Context, requestedModel string) bool {
+	if apiKeyIdentityOf(c) == nil {
+		return true
+	}
+	key := c.GetString(ginAPIKeyName)
+	err := pm.quotaTracker().allow(key, pm.quotaModel(requestedModel))
+	if err == nil {
+		return true
+	}
+
+	var retryAfter time.Duration
+	if exceeded, ok := err.(*quotaExceededError); ok {
+		retryAfter = exceeded.retryAfter
+	}
+	pm.proxyLogger.Infof("API key %s rejected for model %s: %v", key, requestedModel, err)
+	event.Emit(RequestRejectedEvent{Model: requestedModel, Reason: "quota"})
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	pm.sendErrorResponse(c, http.StatusTooManyRequests, err.Error())
+	return false
+}
+
+// quotaTracker returns the tracker of the quotas of the running config
+func (pm *ProxyManager) quotaTracker() *quotaTracker {
+	pm.accessMu.RLock()
+	defer pm.accessMu.RUnlock()
+	return pm.quotas
+}
+
+func (pm *ProxyManager) apiGetQuotas(c *gin.Context) {
+	// the owners and limits of the same config
+	pm.accessMu.RLock()
+	quotas, identities := pm.quotas, pm.quotaIdentities
+	pm.accessMu.RUnlock()
+	c.JSON(http.StatusOK, quotas.status(identities))
+}
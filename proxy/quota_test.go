@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotaTracker_Allow(t *testing.T) {
+	now := time.Date(2025, 3, 10, 12, 0, 30, 0, time.UTC)
+	tracker := newQuotaTracker(map[string]config.APIKeyIdentity{
+		"batch": {Quotas: []config.QuotaConfig{
+			{Models: []string{"*"}, Period: config.QuotaPeriodMinute, Requests: 2},
+			{Models: []string{"qwen-*"}, Period: config.QuotaPeriodHour, OutputTokens: 100},
+		}},
+	})
+	tracker.now = func() time.Time { return now }
+
+	require.NoError(t, tracker.allow("batch", "llama"))
+	require.NoError(t, tracker.allow("batch", "llama"))
+	err := tracker.allow("batch", "qwen-32b")
+	var exceeded *quotaExceededError
+	require.ErrorAs(t, err, &exceeded)
+	assert.Equal(t, "quota exceeded: 2 requests per minute", err.Error())
+	assert.Equal(t, 30*time.Second, exceeded.retryAfter)
+
+	// keys without quotas are not limited
+	require.NoError(t, tracker.allow("other", "llama"))
+
+	// the next window starts over, tokens only count for matching models
+	now = now.Add(time.Minute)
+	require.NoError(t, tracker.allow("batch", "qwen-32b"))
+	tracker.addTokens(TokenMetrics{Timestamp: now, APIKey: "batch", Model: "llama", OutputTokens: 500})
+	require.NoError(t, tracker.allow("batch", "qwen-32b"))
+	tracker.addTokens(TokenMetrics{Timestamp: now, APIKey: "batch", Model: "qwen-32b", OutputTokens: 100})
+	now = now.Add(time.Minute)
+	err = tracker.allow("batch", "qwen-32b")
+	require.ErrorAs(t, err, &exceeded)
+	assert.Equal(t, "quota exceeded: 100 output tokens per hour", err.Error())
+	require.NoError(t, tracker.allow("batch", "llama"))
+
+	status := tracker.status(nil)
+	require.Len(t, status, 1)
+	assert.Equal(t, 1, status[0].Quotas[0].Used.Requests)
+	assert.Equal(t, 100, status[0].Quotas[1].Used.OutputTokens)
+	assert.Equal(t, time.Date(2025, 3, 10, 13, 0, 0, 0, time.UTC), status[0].Quotas[1].ResetsAt)
+}
+
+func TestQuotaTracker_Restore(t *testing.T) {
+	store, err := openMetricsStore(t.TempDir(), 30, testLogger)
+	require.NoError(t, err)
+	now := time.Date(2025, 3, 10, 12, 30, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+	for _, tm := range []TokenMetrics{
+		{Timestamp: now.Add(-24 * time.Hour), APIKey: "batch", Model: "llama", InputTokens: 1000},
+		{Timestamp: now.Add(-2 * time.Hour), APIKey: "batch", Model: "llama", InputTokens: 10},
+		{Timestamp: now.Add(-10 * time.Minute), APIKey: "batch", Model: "llama", InputTokens: 20},
+		{Timestamp: now.Add(-5 * time.Minute), APIKey: "batch", Model: "llama", InputTokens: 40, MirrorOf: "primary"},
+		{Timestamp: now.Add(-5 * time.Minute), APIKey: "other", Model: "llama", InputTokens: 80},
+	} {
+		store.recordMetrics(tm)
+	}
+
+	tracker := newQuotaTracker(map[string]config.APIKeyIdentity{
+		"batch": {Quotas: []config.QuotaConfig{
+			{Models: []string{"*"}, Period: config.QuotaPeriodHour, InputTokens: 100},
+			{Models: []string{"*"}, Period: config.QuotaPeriodDay, Requests: 100},
+		}},
+	})
+	tracker.now = func() time.Time { return now }
+	require.NoError(t, tracker.restore(store))
+
+	status := tracker.status(nil)
+	require.Len(t, status, 1)
+	assert.Equal(t, quotaLimits{Requests: 1, InputTokens: 20}, status[0].Quotas[0].Used)
+	assert.Equal(t, quotaLimits{Requests: 2, InputTokens: 30}, status[0].Quotas[1].Used)
+}
+
+func TestProxyManager_Quota(t *testing.T) {
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"model1": getTestSimpleResponderConfig("model1"),
+			"model2": getTestSimpleResponderConfig("model2"),
+		},
+		RequiredAPIKeys: []string{"full-key"},
+		APIKeyIdentities: map[string]config.APIKeyIdentity{
+			"batch": {
+				Key:       "batch-key",
+				Owner:     "data team",
+				Models:    []string{"*"},
+				Endpoints: []string{config.APIKeyEndpointInference},
+				Quotas: []config.QuotaConfig{
+					{Models: []string{"model2"}, Period: config.QuotaPeriodDay, Requests: 1},
+					{Models: []string{"*"}, Period: config.QuotaPeriodDay, InputTokens: 1000},
+				},
+			},
+		},
+		LogLevel: "error",
+	})
+	proxy := New(conf)
+	defer proxy.StopProcesses(StopImmediately)
+
+	send := func(model, key string) *TestResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"`+model+`"}`))
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := CreateTestResponseRecorder()
+		proxy.ServeHTTP(w, req)
+		return w
+	}
+
+	require.Equal(t, http.StatusOK, send("model2", "batch-key").Code)
+	require.Equal(t, http.StatusOK, send("model1", "batch-key").Code)
+
+	// rejected without swapping model1 out
+	w := send("model2", "batch-key")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	assert.Equal(t, StateReady, proxy.findGroupByModelName("model1").processes["model1"].CurrentState())
+	assert.Equal(t, StateStopped, proxy.findGroupByModelName("model2").processes["model2"].CurrentState())
+
+	// keys in apiKeys have no quotas
+	require.Equal(t, http.StatusOK, send("model2", "full-key").Code)
+
+	req := httptest.NewRequest("GET", "/api/quotas", nil)
+	req.Header.Set("Authorization", "Bearer full-key")
+	w = CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var status []apiKeyQuotaStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	require.Len(t, status, 1)
+	assert.Equal(t, "batch", status[0].Key)
+	assert.Equal(t, "data team", status[0].Owner)
+	assert.Equal(t, 1, status[0].Quotas[0].Used.Requests)
+	// the simple responder reports 25 input tokens per request
+	require.Eventually(t, func() bool {
+		return proxy.quotaTracker().status(nil)[0].Quotas[1].Used.InputTokens == 50
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, status[0].Quotas[1].Used.Requests)
+
+	// edited quotas apply without a restart, unchanged ones keep their usage
+	batch := conf.APIKeyIdentities["batch"]
+	batch.Owner = "ml team"
+	batch.Quotas = []config.QuotaConfig{
+		{Models: []string{"model2"}, Period: config.QuotaPeriodDay, Requests: 2},
+		batch.Quotas[1],
+	}
+	updated := conf
+	updated.APIKeyIdentities = map[string]config.APIKeyIdentity{"batch": batch}
+	proxy.applyConfigAndSyncProcessGroups(updated)
+
+	require.Equal(t, http.StatusOK, send("model2", "batch-key").Code)
+	status = proxy.quotaTracker().status(nil)
+	assert.Equal(t, 1, status[0].Quotas[0].Used.Requests)
+	assert.Equal(t, 3, status[0].Quotas[1].Used.Requests)
+
+	req = httptest.NewRequest("GET", "/api/quotas", nil)
+	req.Header.Set("Authorization", "Bearer full-key")
+	w = CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, "ml team", status[0].Owner)
+	assert.Equal(t, 2, status[0].Quotas[0].Limits.Requests)
+}
+
+func TestQuotaTracker_Rebuild(t *testing.T) {
+	store, err := openMetricsStore(t.TempDir(), 30, testLogger)
+	require.NoError(t, err)
+	now := time.Date(2025, 3, 10, 12, 30, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+	store.recordMetrics(TokenMetrics{Timestamp: now.Add(-time.Minute), APIKey: "batch", Model: "llama", InputTokens: 10})
+
+	unchanged := config.QuotaConfig{Models: []string{"*"}, Period: config.QuotaPeriodHour, InputTokens: 100}
+	tracker := newQuotaTracker(map[string]config.APIKeyIdentity{
+		"batch": {Quotas: []config.QuotaConfig{unchanged, {Models: []string{"*"}, Period: config.QuotaPeriodDay, Requests: 5}}},
+	}).subscribe()
+	tracker.now = func() time.Time { return now }
+	tracker.add("batch", "llama", now, 1, 30, 0)
+
+	next, err := tracker.rebuild(map[string]config.APIKeyIdentity{
+		"batch": {Quotas: []config.QuotaConfig{{Models: []string{"*"}, Period: config.QuotaPeriodDay, Requests: 10}, unchanged}},
+	}, store)
+	require.NoError(t, err)
+	defer next.close()
+
+	status := next.status(nil)
+	// the changed quota is restored from the store, the unchanged one is kept
+	assert.Equal(t, quotaLimits{Requests: 1, InputTokens: 10}, status[0].Quotas[0].Used)
+	assert.Equal(t, quotaLimits{Requests: 1, InputTokens: 30}, status[0].Quotas[1].Used)
+
+	// without a store the changed quota starts over
+	next, err = next.rebuild(map[string]config.APIKeyIdentity{
+		"batch": {Quotas: []config.QuotaConfig{{Models: []string{"*"}, Period: config.QuotaPeriodDay, Requests: 20}, unchanged}},
+	}, nil)
+	require.NoError(t, err)
+	defer next.close()
+	status = next.status(nil)
+	assert.Equal(t, quotaLimits{}, status[0].Quotas[0].Used)
+	assert.Equal(t, quotaLimits{Requests: 1, InputTokens: 30}, status[0].Quotas[1].Used)
+}
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/mostlygeek/llama-swap/event"
 	"golang.org/x/time/rate"
 )
 
@@ -148,7 +149,12 @@ func (rl *proxyRateLimiter) middleware() gin.HandlerFunc {
 			clientIP = "unknown"
 		}
 
-		if !rl.allow(clientIP) {
+		_, limitSpan := startSpan(c.Request.Context(), "rate limit", spanKindInternal)
+		allowed := rl.allow(clientIP)
+		limitSpan.setAttr("llama_swap.rate_limit.allowed", allowed)
+		limitSpan.end()
+		if !allowed {
+			event.Emit(RequestRejectedEvent{Reason: "rate_limit"})
 			c.Header("Retry-After", "1")
 			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
 				"error": rateLimitExceededMessage,
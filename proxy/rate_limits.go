@@ -0,0 +1,433 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mostlygeek/llama-swap/event"
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// idle buckets that refilled completely are dropped after this long
+	rateLimitBucketTTL = 10 * time.Minute
+
+	// reserved tokens of requests without metrics are kept until then
+	rateLimitReservationTTL = 10 * time.Minute
+)
+
+// tokenBucket refills rate tokens per second up to burst. Tokens can go
+// negative when a reservation turns out too small, later requests wait for
+// the debt to be paid off.
+type tokenBucket struct {
+	rate   float64 // per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(perMinute float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: perMinute / 60, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// wait returns how long until n tokens are available, n is capped at burst
+// so requests larger than the burst pass once the bucket is full
+func (b *tokenBucket) wait(n float64, now time.Time) time.Duration {
+	b.refill(now)
+	deficit := math.Min(n, b.burst) - b.tokens
+	if deficit <= 0 {
+		return 0
+	}
+	return time.Duration(deficit / b.rate * float64(time.Second))
+}
+
+// take removes n tokens, a negative n returns them
+func (b *tokenBucket) take(n float64, now time.Time) {
+	b.refill(now)
+	b.tokens = math.Min(b.burst, b.tokens-n)
+}
+
+// rateLimitRule is a configured rate limit with its buckets by key
+type rateLimitRule struct {
+	config   config.RateLimitConfig
+	clients  []*net.IPNet
+	requests map[string]*tokenBucket
+	tokens   map[string]*tokenBucket
+}
+
+func newRateLimitRule(conf config.RateLimitConfig) *rateLimitRule {
+	rule := &rateLimitRule{
+		config:   conf,
+		requests: make(map[string]*tokenBucket),
+		tokens:   make(map[string]*tokenBucket),
+	}
+	for _, client := range conf.Clients {
+		if cidr, err := config.ParseCIDR(client); err == nil {
+			rule.clients = append(rule.clients, cidr)
+		}
+	}
+	return rule
+}
+
+// rateLimitRequest is what the rules of a request are matched against
+type rateLimitRequest struct {
+	apiKey   string // name of the API key, empty without auth
+	model    string // requested name
+	modelID  string // model the name resolves to, the name when it is not local
+	client   string // address
+	endpoint string // request path
+
+	maxTokens int // max_tokens of the body, 0 when not set
+}
+
+func matchPatterns(patterns []string, values ...string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if matched, _ := path.Match(pattern, value); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *rateLimitRule) matches(req rateLimitRequest) bool {
+	if !matchPatterns(r.config.APIKeys, req.apiKey) ||
+		!matchPatterns(r.config.Models, req.model, req.modelID) ||
+		!matchPatterns(r.config.Endpoints, req.endpoint) {
+		return false
+	}
+	if len(r.clients) == 0 {
+		return true
+	}
+	ip := net.ParseIP(req.client)
+	for _, cidr := range r.clients {
+		if ip != nil && cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// key returns the key of the buckets of the request
+func (r *rateLimitRule) key(req rateLimitRequest) string {
+	parts := make([]string, 0, len(r.config.Per))
+	for _, per := range r.config.Per {
+		switch per {
+		case config.RateLimitPerAPIKey:
+			parts = append(parts, req.apiKey)
+		case config.RateLimitPerClient:
+			parts = append(parts, req.client)
+		case config.RateLimitPerModel:
+			parts = append(parts, req.modelID)
+		}
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// buckets returns the request and token buckets of key, nil for the budgets
+// the rule does not set
+func (r *rateLimitRule) buckets(key string, now time.Time) (requests, tokens *tokenBucket) {
+	if r.config.RequestsPerMinute > 0 {
+		if requests = r.requests[key]; requests == nil {
+			requests = newTokenBucket(r.config.RequestsPerMinute, r.config.Burst, now)
+			r.requests[key] = requests
+		}
+	}
+	if r.config.TokensPerMinute > 0 {
+		if tokens = r.tokens[key]; tokens == nil {
+			tokens = newTokenBucket(r.config.TokensPerMinute, r.config.TokenBurst, now)
+			r.tokens[key] = tokens
+		}
+	}
+	return requests, tokens
+}
+
+// prune drops the buckets that were not used for a while and refilled
+func (r *rateLimitRule) prune(now time.Time) {
+	for _, buckets := range []map[string]*tokenBucket{r.requests, r.tokens} {
+		for key, bucket := range buckets {
+			bucket.refill(now)
+			if now.Sub(bucket.last) > rateLimitBucketTTL && bucket.tokens >= bucket.burst {
+				delete(buckets, key)
+			}
+		}
+	}
+}
+
+// estimate returns the tokens reserved for req by the rule
+func (r *rateLimitRule) estimate(req rateLimitRequest) int {
+	if req.maxTokens > 0 {
+		return req.maxTokens
+	}
+	return r.config.TokenEstimate
+}
+
+// rateLimitReservation are the tokens taken from buckets for a request until
+// its metrics tell how many it generated
+type rateLimitReservation struct {
+	buckets []*tokenBucket
+	tokens  []int // same index as buckets
+	expires time.Time
+}
+
+// rateLimitExceededError is returned by allow when a rule has no budget left
+type rateLimitExceededError struct {
+	rule       string
+	limit      string // requests or tokens
+	retryAfter time.Duration
+}
+
+func (e *rateLimitExceededError) Error() string {
+	return fmt.Sprintf("%s: %s per minute of %s", rateLimitExceededMessage, e.limit, e.rule)
+}
+
+// rateLimits enforces the rateLimits rules. The tokens of a request are
+// estimated from its max_tokens when it is admitted and corrected with the
+// output tokens of its metrics.
+type rateLimits struct {
+	mu       sync.Mutex
+	rules    []*rateLimitRule
+	reserved map[string]*rateLimitReservation // by reservation ID
+	cancel   func()
+
+	now func() time.Time
+}
+
+func newRateLimits(rules []config.RateLimitConfig) *rateLimits {
+	l := &rateLimits{
+		reserved: make(map[string]*rateLimitReservation),
+		now:      time.Now,
+	}
+	l.update(rules)
+	return l
+}
+
+// subscribe reconciles the reserved tokens with TokenMetricsEvents until close
+func (l *rateLimits) subscribe() *rateLimits {
+	l.cancel = event.On(func(e TokenMetricsEvent) {
+		if e.Metrics.MirrorOf == "" {
+			l.reconcile(e.Metrics.reservation, e.Metrics.OutputTokens)
+		}
+	})
+	return l
+}
+
+func (l *rateLimits) close() {
+	if l.cancel != nil {
+		l.cancel()
+	}
+}
+
+// update replaces the rules, the buckets of unchanged rules are kept
+func (l *rateLimits) update(configs []config.RateLimitConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rules := make([]*rateLimitRule, 0, len(configs))
+	for _, conf := range configs {
+		var rule *rateLimitRule
+		for _, existing := range l.rules {
+			if reflect.DeepEqual(existing.config, conf) {
+				rule = existing
+				break
+			}
+		}
+		if rule == nil {
+			rule = newRateLimitRule(conf)
+		}
+		rules = append(rules, rule)
+	}
+	l.rules = rules
+}
+
+// allow takes from the budgets of every rule matching req, unless one of
+// them has not enough left. The tokens taken are reserved under id.
+func (l *rateLimits) allow(id string, req rateLimitRequest) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	var exceeded *rateLimitExceededError
+	var requests []*tokenBucket
+	reservation := &rateLimitReservation{expires: now.Add(rateLimitReservationTTL)}
+	for _, rule := range l.rules {
+		rule.prune(now)
+		if !rule.matches(req) {
+			continue
+		}
+		requestBucket, tokenBucket := rule.buckets(rule.key(req), now)
+		if requestBucket != nil {
+			if wait := requestBucket.wait(1, now); wait > 0 && (exceeded == nil || wait > exceeded.retryAfter) {
+				exceeded = &rateLimitExceededError{rule: rule.config.Name, limit: formatRate(rule.config.RequestsPerMinute) + " requests", retryAfter: wait}
+			}
+			requests = append(requests, requestBucket)
+		}
+		if tokenBucket != nil {
+			estimate := rule.estimate(req)
+			if wait := tokenBucket.wait(float64(estimate), now); wait > 0 && (exceeded == nil || wait > exceeded.retryAfter) {
+				exceeded = &rateLimitExceededError{rule: rule.config.Name, limit: formatRate(rule.config.TokensPerMinute) + " tokens", retryAfter: wait}
+			}
+			reservation.buckets = append(reservation.buckets, tokenBucket)
+			reservation.tokens = append(reservation.tokens, estimate)
+		}
+	}
+	if exceeded != nil {
+		return exceeded
+	}
+
+	for _, bucket := range requests {
+		bucket.take(1, now)
+	}
+	for i, bucket := range reservation.buckets {
+		bucket.take(float64(reservation.tokens[i]), now)
+	}
+	for id, reservation := range l.reserved {
+		if now.After(reservation.expires) {
+			delete(l.reserved, id)
+		}
+	}
+	if len(reservation.buckets) > 0 && id != "" {
+		l.reserved[id] = reservation
+	}
+	return nil
+}
+
+// reconcile corrects the tokens reserved under id to the tokens the request
+// used
+func (l *rateLimits) reconcile(id string, used int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	reservation, found := l.reserved[id]
+	if !found {
+		return
+	}
+	delete(l.reserved, id)
+	now := l.now()
+	for i, bucket := range reservation.buckets {
+		bucket.take(float64(max(used, 0)-reservation.tokens[i]), now)
+	}
+}
+
+// release returns the tokens reserved for a request that was not sent
+func (l *rateLimits) release(id string) {
+	l.reconcile(id, 0)
+}
+
+// rateLimitReservationOf returns the ID the tokens of r are reserved under,
+// empty when it was not admitted by checkRateLimits. It is not the request
+// ID: clients can send the same X-Request-ID with concurrent requests.
+func rateLimitReservationOf(r *http.Request) string {
+	id, _ := r.Context().Value(proxyCtxKey("rateLimitReservation")).(string)
+	return id
+}
+
+func formatRate(perMinute float64) string {
+	return strconv.FormatFloat(perMinute, 'f', -1, 64)
+}
+
+// maxTokensOf returns the tokens a request may generate, 0 when its body
+// does not limit them
+func maxTokensOf(body []byte) int {
+	for _, field := range []string{"max_tokens", "max_completion_tokens", "max_output_tokens", "n_predict"} {
+		if value := gjson.GetBytes(body, field); value.Type == gjson.Number && value.Int() > 0 {
+			return int(value.Int())
+		}
+	}
+	return 0
+}
+
+// checkRateLimits sends a 429 response when a rateLimits rule matching the
+// request has no budget left, before the model is loaded. body is the JSON
+// body the tokens are estimated from, nil for other requests.
+func (pm *ProxyManager) checkRateLimits(c *gin.Context, requestedModel string, body []byte) bool {
+	req := rateLimitRequest{
+		apiKey:    c.GetString(ginAPIKeyName),
+		model:     requestedModel,
+		modelID:   pm.quotaModel(requestedModel),
+		client:    strings.TrimSpace(c.ClientIP()),
+		endpoint:  c.Request.URL.Path,
+		maxTokens: maxTokensOf(body),
+	}
+	reservation := newRequestID()
+	err := pm.rateLimits.allow(reservation, req)
+	if err == nil {
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), proxyCtxKey("rateLimitReservation"), reservation))
+		return true
+	}
+
+	var retryAfter time.Duration
+	if exceeded, ok := err.(*rateLimitExceededError); ok {
+		retryAfter = exceeded.retryAfter
+	}
+	pm.proxyLogger.Infof("Request from %s for model %s rejected: %v", req.client, requestedModel, err)
+	event.Emit(RequestRejectedEvent{Model: requestedModel, Reason: "rate_limit"})
+	c.Header("Retry-After", strconv.Itoa(max(1, int(math.Ceil(retryAfter.Seconds())))))
+	pm.sendErrorResponse(c, http.StatusTooManyRequests, err.Error())
+	return false
+}
+
+// checkAdmission runs the checks of a request for requestedModel before the
+// model is loaded: client access, access of the API key, rate limits, then
+// quotas
+func (pm *ProxyManager) checkAdmission(c *gin.Context, requestedModel string, body []byte) bool {
+	if !pm.checkClientAccess(c, requestedModel) || !pm.checkModelAccess(c, requestedModel) || !pm.checkRateLimits(c, requestedModel, body) {
+		return false
+	}
+	if !pm.checkQuota(c, requestedModel) {
+		pm.releaseAdmission(c)
+		return false
+	}
+	return true
+}
+
+// releaseAdmission returns the tokens checkAdmission reserved for a request
+// that failed before it was sent to the model
+func (pm *ProxyManager) releaseAdmission(c *gin.Context) {
+	pm.rateLimits.release(rateLimitReservationOf(c.Request))
+}
+
+// UpdateAccessRules applies the rateLimits and clientAccess rules of conf
+// without a restart when they are the only change from the running config,
+// returns false otherwise
+func (pm *ProxyManager) UpdateAccessRules(conf config.Config) bool {
+	// the running config has the legacy vLLM commands rewritten, see New
+	conf = normalizeLegacyVLLMConfigCommands(conf)
+	pm.Lock()
+	current := pm.config
+	current.RateLimits = conf.RateLimits
+	current.ClientAccess = conf.ClientAccess
+	if !reflect.DeepEqual(current, conf) {
+		pm.Unlock()
+		return false
+	}
+	pm.config = current
+	pm.Unlock()
+
+	pm.rateLimits.update(conf.RateLimits)
+	pm.clientAccess.update(conf.ClientAccess)
+	pm.proxyLogger.Infof("Applied %d rate limits and %d client access rules", len(conf.RateLimits), len(conf.ClientAccess))
+	return true
+}
@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimits_Requests(t *testing.T) {
+	now := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+	limits := newRateLimits([]config.RateLimitConfig{{
+		Name:              "per client",
+		Clients:           []string{"10.0.0.0/8"},
+		Per:               []string{config.RateLimitPerClient},
+		RequestsPerMinute: 60,
+		Burst:             2,
+	}})
+	limits.now = func() time.Time { return now }
+	client := func(address string) rateLimitRequest {
+		return rateLimitRequest{client: address, model: "llama", modelID: "llama", endpoint: "/v1/chat/completions"}
+	}
+
+	require.NoError(t, limits.allow("1", client("10.0.0.1")))
+	require.NoError(t, limits.allow("2", client("10.0.0.1")))
+	err := limits.allow("3", client("10.0.0.1"))
+	var exceeded *rateLimitExceededError
+	require.ErrorAs(t, err, &exceeded)
+	assert.Equal(t, "rate limit exceeded: 60 requests per minute of per client", err.Error())
+	assert.Equal(t, time.Second, exceeded.retryAfter)
+
+	// every client has its own budget, clients outside the CIDR have none
+	require.NoError(t, limits.allow("4", client("10.0.0.2")))
+	for i := 0; i < 5; i++ {
+		require.NoError(t, limits.allow("5", client("192.168.1.1")))
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	require.ErrorAs(t, limits.allow("6", client("10.0.0.1")), &exceeded)
+	assert.Equal(t, 500*time.Millisecond, exceeded.retryAfter)
+	now = now.Add(500 * time.Millisecond)
+	require.NoError(t, limits.allow("7", client("10.0.0.1")))
+
+	// unchanged rules keep their buckets
+	limits.update([]config.RateLimitConfig{limits.rules[0].config, {Name: "all", RequestsPerMinute: 60, Burst: 10}})
+	require.Error(t, limits.allow("8", client("10.0.0.1")))
+	limits.update([]config.RateLimitConfig{{Name: "per client", RequestsPerMinute: 60, Burst: 3}})
+	require.NoError(t, limits.allow("9", client("10.0.0.1")))
+}
+
+func TestRateLimits_Tokens(t *testing.T) {
+	now := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+	limits := newRateLimits([]config.RateLimitConfig{{
+		Name:            "tokens",
+		Models:          []string{"qwen-*"},
+		TokensPerMinute: 600,
+		TokenBurst:      1000,
+		TokenEstimate:   400,
+	}})
+	limits.now = func() time.Time { return now }
+	req := rateLimitRequest{model: "qwen", modelID: "qwen-32b", endpoint: "/v1/chat/completions"}
+
+	require.NoError(t, limits.allow("a", req))
+	require.NoError(t, limits.allow("b", req))
+	err := limits.allow("c", req)
+	var exceeded *rateLimitExceededError
+	require.ErrorAs(t, err, &exceeded)
+	assert.Equal(t, "rate limit exceeded: 600 tokens per minute of tokens", err.Error())
+	// 200 tokens left, 200 more at 10 per second
+	assert.Equal(t, 20*time.Second, exceeded.retryAfter)
+
+	// a smaller max_tokens fits
+	req.maxTokens = 200
+	require.NoError(t, limits.allow("d", req))
+	req.maxTokens = 0
+
+	// the reservations are corrected with the generated tokens
+	limits.reconcile("a", 100)
+	limits.release("b")
+	require.NoError(t, limits.allow("e", req))
+	assert.InDelta(t, 300, limits.rules[0].tokens[""].tokens, 0.001)
+
+	// a response larger than its reservation puts the budget in debt
+	limits.reconcile("d", 900)
+	require.ErrorAs(t, limits.allow("f", req), &exceeded)
+	assert.Equal(t, 80*time.Second, exceeded.retryAfter)
+
+	// other models are not limited
+	require.NoError(t, limits.allow("g", rateLimitRequest{model: "llama", modelID: "llama"}))
+}
+
+func TestProxyManager_RateLimits(t *testing.T) {
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"model1": getTestSimpleResponderConfig("model1"),
+			"model2": getTestSimpleResponderConfig("model2"),
+		},
+		APIKeyIdentities: map[string]config.APIKeyIdentity{
+			"batch": {Key: "batch-key", Models: []string{"*"}, Endpoints: []string{config.APIKeyEndpointInference}},
+			"chat":  {Key: "chat-key", Models: []string{"*"}, Endpoints: []string{config.APIKeyEndpointInference}},
+		},
+		RateLimits: []config.RateLimitConfig{{
+			Name:              "batch",
+			APIKeys:           []string{"batch"},
+			Per:               []string{config.RateLimitPerModel},
+			RequestsPerMinute: 1,
+			Burst:             1,
+		}},
+		LogLevel: "error",
+	})
+	proxy := New(conf)
+	defer proxy.StopProcesses(StopImmediately)
+
+	send := func(model, key string) *TestResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"`+model+`"}`))
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := CreateTestResponseRecorder()
+		proxy.ServeHTTP(w, req)
+		return w
+	}
+
+	require.Equal(t, http.StatusOK, send("model1", "batch-key").Code)
+	require.Equal(t, http.StatusOK, send("model1", "chat-key").Code)
+
+	// every model has its own budget, other keys are not limited
+	w := send("model2", "batch-key")
+	require.Equal(t, http.StatusOK, w.Code)
+	w = send("model2", "batch-key")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), "1 requests per minute of batch")
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+
+	// rate limits are applied without a restart
+	updated := conf
+	updated.RateLimits = []config.RateLimitConfig{{Name: "batch", APIKeys: []string{"batch"}, RequestsPerMinute: 60, Burst: 5}}
+	require.True(t, proxy.UpdateAccessRules(updated))
+	assert.Equal(t, StateReady, proxy.findGroupByModelName("model2").processes["model2"].CurrentState())
+	require.Equal(t, http.StatusOK, send("model2", "batch-key").Code)
+
+	updated.LogLevel = "debug"
+	assert.False(t, proxy.UpdateAccessRules(updated))
+}
+
+func TestProxyManager_UpdateAccessRulesLegacyVLLM(t *testing.T) {
+	// every reload loads a new config, with the legacy command as written
+	load := func(rateLimits []config.RateLimitConfig) config.Config {
+		return config.AddDefaultGroupToConfig(config.Config{
+			Macros: config.MacroList{{Name: "user_home", Value: "/home/tester"}},
+			Models: map[string]config.ModelConfig{
+				"model-vllm": {
+					Cmd: "bash -lc 'exec /tmp/run-recipe.sh sample --solo --port 6001'",
+					Metadata: map[string]any{
+						recipeMetadataKey: map[string]any{"backend_dir": "/opt/spark-vllm-docker"},
+					},
+				},
+			},
+			RateLimits: rateLimits,
+			LogLevel:   "error",
+		})
+	}
+	proxy := New(load(nil))
+	defer proxy.StopProcesses(StopImmediately)
+	require.NotEqual(t, load(nil).Models["model-vllm"].Cmd, proxy.config.Models["model-vllm"].Cmd)
+
+	rateLimits := []config.RateLimitConfig{{Name: "all", RequestsPerMinute: 60, Burst: 5}}
+	require.True(t, proxy.UpdateAccessRules(load(rateLimits)))
+	assert.Equal(t, rateLimits, proxy.config.RateLimits)
+}
+
+func TestProxyManager_RateLimitReservations(t *testing.T) {
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"model1": getTestSimpleResponderConfig("model1"),
+		},
+		RateLimits: []config.RateLimitConfig{{Name: "tokens", TokensPerMinute: 60, TokenBurst: 1100}},
+		LogLevel:   "error",
+	})
+	proxy := New(conf)
+	defer proxy.StopProcesses(StopImmediately)
+
+	chat := func(model string, maxTokens int, requestID string) *TestResponseRecorder {
+		body := fmt.Sprintf(`{"model":%q,"max_tokens":%d}`, model, maxTokens)
+		req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(body))
+		req.Header.Set(requestIDHeader, requestID)
+		w := CreateTestResponseRecorder()
+		proxy.ServeHTTP(w, req)
+		return w
+	}
+
+	// a request that is never sent gets its tokens back
+	require.Equal(t, http.StatusBadRequest, chat("unknown", 1000, "").Code)
+	assert.Empty(t, proxy.rateLimits.reserved)
+	require.Equal(t, http.StatusOK, chat("model1", 1000, "").Code)
+
+	// concurrent requests with the same X-Request-ID keep their own
+	// reservations
+	admit := func() *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		c.Request.Header.Set(requestIDHeader, "same-id")
+		c.Request, _ = withRequestID(c.Request)
+		require.True(t, proxy.checkRateLimits(c, "model1", []byte(`{"max_tokens":10}`)))
+		return c
+	}
+	first, second := admit(), admit()
+	require.Equal(t, requestIDOf(first.Request), requestIDOf(second.Request))
+	require.NotEqual(t, rateLimitReservationOf(first.Request), rateLimitReservationOf(second.Request))
+	proxy.rateLimits.reconcile(rateLimitReservationOf(first.Request), 10)
+	assert.Contains(t, proxy.rateLimits.reserved, rateLimitReservationOf(second.Request))
+}
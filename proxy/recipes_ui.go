@@ -8,12 +8,15 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"maps"
 	"math"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -33,6 +36,7 @@ const (
 	hfHubPathOverrideFileEnv        = "LLAMA_SWAP_HF_HUB_PATH_OVERRIDE_FILE"
 	hfHubPathEnv                    = "LLAMA_SWAP_HF_HUB_PATH"
 	recipesLocalDirEnv              = "LLAMA_SWAP_LOCAL_RECIPES_DIR"
+	recipesConfigFileEnv            = "LLAMA_SWAP_RECIPES_CONFIG_FILE"
 	trtllmSourceImageOverrideFile   = ".llama-swap-trtllm-source-image"
 	nvidiaSourceImageOverrideFile   = ".llama-swap-nvidia-source-image"
 	llamacppSourceImageOverrideFile = ".llama-swap-llamacpp-source-image"
@@ -935,6 +939,14 @@ func (pm *ProxyManager) apiRunRecipeBackendAction(c *gin.Context) {
 		return
 	}
 
+	// the builds and downloads copy their images or models to the other nodes
+	switch action {
+	case "git_pull", "git_pull_rebase", "pull_trtllm_image", "pull_nvidia_image", "update_nvidia_image":
+		auditNodes(c, dockerActionNodeLabel("", true))
+	default:
+		auditClusterNodes(c)
+	}
+
 	if beginErr := pm.beginRecipeBackendAction(action, backendDir, commandText); beginErr != nil {
 		c.JSON(http.StatusConflict, gin.H{"error": beginErr.Error()})
 		return
@@ -1216,13 +1228,13 @@ func (pm *ProxyManager) buildRecipeUIState() (RecipeUIState, error) {
 		return RecipeUIState{}, err
 	}
 
-	root, err := loadConfigRawMap(configPath)
+	root, err := loadRecipeConfigRawMap(configPath)
 	if err != nil {
 		return RecipeUIState{}, err
 	}
 	removedOrphans := pruneOrphanManagedRecipeModels(root, catalogByID)
 	if len(removedOrphans) > 0 {
-		if err := writeConfigRawMap(configPath, root); err != nil {
+		if err := writeRecipeConfigRawMap(configPath, root); err != nil {
 			return RecipeUIState{}, err
 		}
 		if conf, err := config.LoadConfig(configPath); err == nil {
@@ -1386,7 +1398,7 @@ func (pm *ProxyManager) upsertRecipeModel(parentCtx context.Context, req upsertR
 		tp = 1
 	}
 
-	root, err := loadConfigRawMap(configPath)
+	root, err := loadRecipeConfigRawMap(configPath)
 	if err != nil {
 		return RecipeUIState{}, err
 	}
@@ -1733,7 +1745,7 @@ func (pm *ProxyManager) upsertRecipeModel(parentCtx context.Context, req upsertR
 	groupsMap[groupName] = group
 	root["groups"] = groupsMap
 
-	if err := writeConfigRawMap(configPath, root); err != nil {
+	if err := writeRecipeConfigRawMap(configPath, root); err != nil {
 		return RecipeUIState{}, err
 	}
 
@@ -1749,7 +1761,7 @@ func (pm *ProxyManager) deleteRecipeModel(modelID string) (RecipeUIState, error)
 		return RecipeUIState{}, err
 	}
 
-	root, err := loadConfigRawMap(configPath)
+	root, err := loadRecipeConfigRawMap(configPath)
 	if err != nil {
 		return RecipeUIState{}, err
 	}
@@ -1766,7 +1778,7 @@ func (pm *ProxyManager) deleteRecipeModel(modelID string) (RecipeUIState, error)
 	removeModelFromAllGroups(groupsMap, modelID)
 	root["groups"] = groupsMap
 
-	if err := writeConfigRawMap(configPath, root); err != nil {
+	if err := writeRecipeConfigRawMap(configPath, root); err != nil {
 		return RecipeUIState{}, err
 	}
 
@@ -1838,7 +1850,7 @@ func removeModelEntryFromConfig(root map[string]any, modelID string) bool {
 }
 
 func (pm *ProxyManager) writeRecipeConfigAndApply(configPath string, root map[string]any) error {
-	if err := writeConfigRawMap(configPath, root); err != nil {
+	if err := writeRecipeConfigRawMap(configPath, root); err != nil {
 		return err
 	}
 	if conf, err := config.LoadConfig(configPath); err == nil {
@@ -1954,7 +1966,7 @@ func (pm *ProxyManager) deleteRecipeSource(recipeRef string, purgeManaged bool)
 		return recipeDeleteSourceResponse{}, err
 	}
 
-	root, err := loadConfigRawMap(configPath)
+	root, err := loadRecipeConfigRawMap(configPath)
 	if err != nil {
 		return recipeDeleteSourceResponse{}, err
 	}
@@ -2008,7 +2020,7 @@ func (pm *ProxyManager) deleteRecipeModelCascade(modelID string) (recipeDeleteMo
 		return recipeDeleteModelResponse{}, err
 	}
 
-	root, err := loadConfigRawMap(configPath)
+	root, err := loadRecipeConfigRawMap(configPath)
 	if err != nil {
 		return recipeDeleteModelResponse{}, err
 	}
@@ -2352,7 +2364,7 @@ func (pm *ProxyManager) hfRecipeModelMatches() map[string]recipeBackendHFRecipeM
 		return matches
 	}
 
-	root, err := loadConfigRawMap(configPath)
+	root, err := loadRecipeConfigRawMap(configPath)
 	if err != nil {
 		return matches
 	}
@@ -3816,7 +3828,7 @@ func (pm *ProxyManager) syncManagedModelsWithRecipeDefaultsDetailed(parentCtx co
 	if err != nil {
 		return nil, err
 	}
-	root, err := loadConfigRawMap(configPath)
+	root, err := loadRecipeConfigRawMap(configPath)
 	if err != nil {
 		return nil, err
 	}
@@ -3981,6 +3993,194 @@ func writeRawFileAtomic(path string, raw []byte) error {
 	return os.Rename(tmp, path)
 }
 
+// recipeConfigPath returns the file holding managed recipe models. This is the
+// main config unless LLAMA_SWAP_RECIPES_CONFIG_FILE points at a dedicated
+// include file (relative paths are resolved against the config directory).
+func recipeConfigPath(configPath string) string {
+	v := strings.TrimSpace(os.Getenv(recipesConfigFileEnv))
+	if v == "" {
+		return configPath
+	}
+	v = expandLeadingTilde(v)
+	if !filepath.IsAbs(v) {
+		v = filepath.Join(filepath.Dir(configPath), v)
+	}
+	return filepath.Clean(v)
+}
+
+// RecipeConfigPath returns the file the recipe UI saves models to for the
+// config at configPath, it may not exist yet
+func RecipeConfigPath(configPath string) string {
+	return recipeConfigPath(configPath)
+}
+
+// loadRecipeConfigRawMap loads the raw map of the recipe config file. When it
+// is an include, macros defined in the other config files are merged into the
+// returned map so macro lookups see the full config; writeRecipeConfigRawMap
+// strips them again. A recipe include that does not exist yet reads as empty.
+func loadRecipeConfigRawMap(configPath string) (map[string]any, error) {
+	recipePath := recipeConfigPath(configPath)
+	if recipePath == configPath {
+		return loadConfigRawMap(configPath)
+	}
+
+	root, err := loadConfigRawMap(recipePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		root, err = map[string]any{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	external, err := loadExternalRecipeConfig(configPath, recipePath)
+	if err != nil {
+		return nil, err
+	}
+	if len(external.macros) > 0 {
+		macros := getMap(root, "macros")
+		for name, value := range external.macros {
+			macros[name] = value
+		}
+		root["macros"] = macros
+	}
+	return root, nil
+}
+
+// writeRecipeConfigRawMap writes root back to the recipe config file. When it
+// is an include, the macros of the other config files are stripped again and
+// entries that collide with those files are reported instead of written.
+func writeRecipeConfigRawMap(configPath string, root map[string]any) error {
+	recipePath := recipeConfigPath(configPath)
+	if recipePath == configPath {
+		return writeConfigRawMap(configPath, root)
+	}
+
+	external, err := loadExternalRecipeConfig(configPath, recipePath)
+	if err != nil {
+		return err
+	}
+	previous, err := loadConfigRawMap(recipePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		previous, err = map[string]any{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := external.conflicts(root, previous, recipePath); err != nil {
+		return err
+	}
+
+	out := cloneMap(root)
+	if macros := getMap(root, "macros"); len(macros) > 0 {
+		own := make(map[string]any, len(macros))
+		for name, value := range macros {
+			if _, ok := external.macros[name]; !ok {
+				own[name] = value
+			}
+		}
+		out["macros"] = own
+	}
+	return writeConfigRawMapAs(configPath, recipePath, out)
+}
+
+// externalRecipeConfig is what the config files other than the recipe
+// include define, with the file defining each entry
+type externalRecipeConfig struct {
+	macros     map[string]any
+	macroFiles map[string]string
+	models     map[string]string
+	groups     map[string]string
+	memberOf   map[string]string // group listing each model
+}
+
+// loadExternalRecipeConfig reads every config file other than the recipe
+// include
+func loadExternalRecipeConfig(configPath, recipePath string) (externalRecipeConfig, error) {
+	external := externalRecipeConfig{
+		macros:     map[string]any{},
+		macroFiles: map[string]string{},
+		models:     map[string]string{},
+		groups:     map[string]string{},
+		memberOf:   map[string]string{},
+	}
+	files, err := config.ConfigFiles(configPath)
+	if err != nil {
+		return external, err
+	}
+	absRecipePath, err := filepath.Abs(recipePath)
+	if err != nil {
+		return external, err
+	}
+
+	for _, file := range files {
+		if file == absRecipePath {
+			continue
+		}
+		fileRoot, err := loadConfigRawMap(file)
+		if err != nil {
+			return external, err
+		}
+		for name, value := range getMap(fileRoot, "macros") {
+			external.macros[name] = value
+			external.macroFiles[name] = file
+		}
+		for modelID := range getMap(fileRoot, "models") {
+			external.models[modelID] = file
+		}
+		for groupName, raw := range getMap(fileRoot, "groups") {
+			external.groups[groupName] = file
+			if group, ok := raw.(map[string]any); ok {
+				for _, member := range groupMembers(group) {
+					external.memberOf[member] = groupName
+				}
+			}
+		}
+	}
+	return external, nil
+}
+
+// conflicts returns the entries of root the recipe include at recipePath can
+// not have, because another config file defines them or they would leave a
+// model in a group of another file. previous is the include before the edit.
+// Macros of other files may only be written back unchanged.
+func (e externalRecipeConfig) conflicts(root, previous map[string]any, recipePath string) error {
+	var errs []error
+	macros := getMap(root, "macros")
+	for _, name := range slices.Sorted(maps.Keys(macros)) {
+		if file, found := e.macroFiles[name]; found && !reflect.DeepEqual(macros[name], e.macros[name]) {
+			errs = append(errs, fmt.Errorf("macro %s is defined in %s, change it there instead of in %s", name, file, recipePath))
+		}
+	}
+	rootModels := getMap(root, "models")
+	for _, modelID := range slices.Sorted(maps.Keys(rootModels)) {
+		if file, found := e.models[modelID]; found {
+			errs = append(errs, fmt.Errorf("model %s is already defined in %s", modelID, file))
+		}
+	}
+	for _, groupName := range sortedGroupNames(getMap(root, "groups")) {
+		if file, found := e.groups[groupName]; found {
+			errs = append(errs, fmt.Errorf("group %s is defined in %s, models saved to %s need a group of their own", groupName, file, recipePath))
+			continue
+		}
+		group, _ := getMap(root, "groups")[groupName].(map[string]any)
+		for _, member := range groupMembers(group) {
+			if other, found := e.memberOf[member]; found {
+				errs = append(errs, fmt.Errorf("model %s is a member of group %s in %s, remove it there first", member, other, e.groups[other]))
+			}
+		}
+	}
+	// deleted models must not stay in the groups of other files
+	for _, modelID := range slices.Sorted(maps.Keys(getMap(previous, "models"))) {
+		if _, kept := rootModels[modelID]; kept {
+			continue
+		}
+		if other, found := e.memberOf[modelID]; found {
+			errs = append(errs, fmt.Errorf("model %s is a member of group %s in %s, remove it there first", modelID, other, e.groups[other]))
+		}
+	}
+	return errors.Join(errs...)
+}
+
 func loadConfigRawMap(configPath string) (map[string]any, error) {
 	raw, err := os.ReadFile(configPath)
 	if err != nil {
@@ -3999,23 +4199,47 @@ func loadConfigRawMap(configPath string) (map[string]any, error) {
 }
 
 func writeConfigRawMap(configPath string, root map[string]any) error {
+	return writeConfigRawMapAs(configPath, configPath, root)
+}
+
+// writeConfigRawMapAs renders root into targetPath, which is either the main
+// config or one of its includes, after validating the result as part of the
+// full config loaded from configPath. When targetPath already exists root is
+// merged into its yaml.Node tree, so comments and key order of the settings
+// that did not change are kept.
+func writeConfigRawMapAs(configPath, targetPath string, root map[string]any) error {
 	rendered, err := marshalConfigRawMap(root)
 	if err != nil {
 		return err
 	}
-	loaded, err := config.LoadConfigFromReader(bytes.NewReader(rendered))
+	if existing, err := os.ReadFile(targetPath); err == nil {
+		if merged, ok := mergeConfigRawMap(existing, rendered); ok {
+			rendered = merged
+		}
+	}
+	_, err = writeValidatedConfigFile(configPath, targetPath, rendered)
+	return err
+}
+
+// mergeConfigRawMap merges the rendered map into the existing file contents.
+// It reports false when existing cannot be edited in place.
+func mergeConfigRawMap(existing, rendered []byte) ([]byte, bool) {
+	doc, err := parseConfigDocument(existing)
 	if err != nil {
-		return fmt.Errorf("generated config is invalid: %w", err)
+		return nil, false
 	}
-	if err := validateConfigModelShellCommands(normalizeLegacyVLLMConfigCommands(loaded)); err != nil {
-		return fmt.Errorf("generated config has invalid launcher command: %w", err)
+	updated, err := parseConfigDocument(rendered)
+	if err != nil {
+		return nil, false
 	}
-
-	tmp := configPath + ".tmp"
-	if err := os.WriteFile(tmp, rendered, 0600); err != nil {
-		return err
+	guard := guardYAMLAliases(doc, doc.Content[0])
+	mergeYAMLNode(doc.Content[0], updated.Content[0])
+	guard.restore(false)
+	merged, err := encodeConfigDocument(doc)
+	if err != nil {
+		return nil, false
 	}
-	return os.Rename(tmp, configPath)
+	return restoreBlankLines(existing, merged), true
 }
 
 func validateConfigModelShellCommands(conf config.Config) error {
@@ -4977,6 +5201,20 @@ func ensureVLLMRecipeCommandMacros(root map[string]any, backendDir string, conta
 func ensureRecipeMacros(root map[string]any, configPath string) {
 	macros := getMap(root, "macros")
 
+	// the macros of the other config files are kept as they are, the recipe
+	// include can not change them
+	owned := map[string]any{}
+	if recipePath := recipeConfigPath(configPath); strings.TrimSpace(configPath) != "" && recipePath != configPath {
+		if external, err := loadExternalRecipeConfig(configPath, recipePath); err == nil {
+			owned = external.macros
+		}
+	}
+	set := func(name string, value any) {
+		if _, found := owned[name]; !found {
+			macros[name] = value
+		}
+	}
+
 	if _, ok := macros["user_home"]; !ok {
 		macros["user_home"] = "${env.HOME}"
 	}
@@ -4987,12 +5225,12 @@ func ensureRecipeMacros(root map[string]any, configPath string) {
 		if abs, err := filepath.Abs(llamaRoot); err == nil {
 			llamaRoot = abs
 		}
-		macros["spark_root"] = llamaRoot
+		set("spark_root", llamaRoot)
 		dispatchRunner := filepath.Join(llamaRoot, "run-recipe.sh")
 		if isExecutableFile(dispatchRunner) {
-			macros["recipe_runner"] = dispatchRunner
+			set("recipe_runner", dispatchRunner)
 		}
-		macros["llama_root"] = llamaRoot
+		set("llama_root", llamaRoot)
 	} else {
 		if _, ok := macros["llama_root"]; !ok {
 			macros["llama_root"] = "${user_home}/llama-swap"
@@ -1446,6 +1446,163 @@ func TestProxyManager_UpsertRecipeModel_VLLMLifecycleCreateEditDeleteKeepsConfig
 	}
 }
 
+func TestProxyManager_UpsertRecipeModel_WritesToRecipeInclude(t *testing.T) {
+	pm, cfgPath := newRuntimeCacheTestProxyManager(t, "spark-vllm-docker", "runtime-vllm-include", "vllm")
+	modelID := "runtime-vllm-include-model"
+
+	mainBody, err := os.ReadFile(cfgPath)
+	if err != nil {
+		t.Fatalf("read config: %v", err)
+	}
+	mainBody = append([]byte("include:\n  - conf.d/*.yaml\n"), mainBody...)
+	if err := os.WriteFile(cfgPath, mainBody, 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	t.Setenv(recipesConfigFileEnv, "conf.d/recipes.yaml")
+	includePath := filepath.Join(filepath.Dir(cfgPath), "conf.d", "recipes.yaml")
+
+	if _, err := pm.upsertRecipeModel(context.Background(), upsertRecipeModelRequest{
+		ModelID:        modelID,
+		RecipeRef:      "runtime-vllm-include",
+		Mode:           "cluster",
+		TensorParallel: 2,
+		Nodes:          "192.0.2.10,192.0.2.11",
+	}); err != nil {
+		t.Fatalf("upsertRecipeModel() error: %v", err)
+	}
+
+	mainRoot, err := loadConfigRawMap(cfgPath)
+	if err != nil {
+		t.Fatalf("loadConfigRawMap(main): %v", err)
+	}
+	if len(getMap(mainRoot, "models")) != 0 {
+		t.Fatalf("main config should not receive managed models, got: %v", getMap(mainRoot, "models"))
+	}
+
+	includeRoot, err := loadConfigRawMap(includePath)
+	if err != nil {
+		t.Fatalf("loadConfigRawMap(include): %v", err)
+	}
+	if _, ok := getMap(includeRoot, "models")[modelID]; !ok {
+		t.Fatalf("model %s should be written to %s", modelID, includePath)
+	}
+	includeMacros := getMap(includeRoot, "macros")
+	for _, name := range []string{"user_home", "recipe_runner"} {
+		if _, ok := includeMacros[name]; ok {
+			t.Fatalf("macro %s is defined in the main config and must not be copied into the include", name)
+		}
+	}
+
+	conf, err := config.LoadConfig(cfgPath)
+	if err != nil {
+		t.Fatalf("LoadConfig(%s): %v", cfgPath, err)
+	}
+	if _, ok := conf.Models[modelID]; !ok {
+		t.Fatalf("model %s missing from merged config", modelID)
+	}
+
+	state, err := pm.buildRecipeUIState()
+	if err != nil {
+		t.Fatalf("buildRecipeUIState() error: %v", err)
+	}
+	if len(state.Models) != 1 || state.Models[0].ModelID != modelID {
+		t.Fatalf("unexpected recipe models: %#v", state.Models)
+	}
+
+	if _, err := pm.deleteRecipeModel(modelID); err != nil {
+		t.Fatalf("deleteRecipeModel() error: %v", err)
+	}
+	includeRoot, err = loadConfigRawMap(includePath)
+	if err != nil {
+		t.Fatalf("loadConfigRawMap(include): %v", err)
+	}
+	if _, ok := getMap(includeRoot, "models")[modelID]; ok {
+		t.Fatalf("model %s should be deleted from %s", modelID, includePath)
+	}
+}
+
+func TestProxyManager_UpsertRecipeModel_ReportsIncludeCollisions(t *testing.T) {
+	pm, cfgPath := newRuntimeCacheTestProxyManager(t, "spark-vllm-docker", "runtime-vllm-collide", "vllm")
+	modelID := "runtime-vllm-collide-model"
+	runnerPath := filepath.Join(filepath.Dir(cfgPath), "run-recipe.sh")
+	writeMain := func(sharedMembers string) {
+		t.Helper()
+		body := "" +
+			"include:\n" +
+			"  - conf.d/*.yaml\n" +
+			"models:\n" +
+			"  main-model:\n" +
+			"    cmd: serve\n" +
+			"    proxy: http://127.0.0.1:9999\n" +
+			"groups:\n" +
+			"  shared:\n" +
+			"    members: [" + sharedMembers + "]\n" +
+			"macros:\n" +
+			"  user_home: /home/tester\n" +
+			"  recipe_runner: " + runnerPath + "\n"
+		if err := os.WriteFile(cfgPath, []byte(body), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+	}
+	writeMain("main-model")
+	t.Setenv(recipesConfigFileEnv, "conf.d/recipes.yaml")
+
+	upsert := func(id, group string) error {
+		_, err := pm.upsertRecipeModel(context.Background(), upsertRecipeModelRequest{
+			ModelID:        id,
+			RecipeRef:      "runtime-vllm-collide",
+			Mode:           "cluster",
+			TensorParallel: 2,
+			Nodes:          "192.0.2.10,192.0.2.11",
+			Group:          group,
+		})
+		return err
+	}
+
+	// groups and models of the main config can not be reused
+	if err := upsert(modelID, "shared"); err == nil || !strings.Contains(err.Error(), "group shared is defined in "+cfgPath) {
+		t.Fatalf("expected group collision error, got: %v", err)
+	}
+	if err := upsert("main-model", ""); err == nil || !strings.Contains(err.Error(), "model main-model is already defined in "+cfgPath) {
+		t.Fatalf("expected model collision error, got: %v", err)
+	}
+	if err := upsert(modelID, ""); err != nil {
+		t.Fatalf("upsertRecipeModel() error: %v", err)
+	}
+
+	// edits to the macros of the main config are not dropped silently
+	root, err := loadRecipeConfigRawMap(cfgPath)
+	if err != nil {
+		t.Fatalf("loadRecipeConfigRawMap: %v", err)
+	}
+	getMap(root, "macros")["user_home"] = "/home/other"
+	if err := writeRecipeConfigRawMap(cfgPath, root); err == nil || !strings.Contains(err.Error(), "macro user_home is defined in "+cfgPath) {
+		t.Fatalf("expected macro collision error, got: %v", err)
+	}
+
+	// a model listed in a group of the main config can not be regrouped or
+	// deleted from the include alone
+	writeMain("main-model, " + modelID)
+	for name, err := range map[string]error{
+		"upsert": upsert(modelID, ""),
+		"delete": func() error { _, err := pm.deleteRecipeModel(modelID); return err }(),
+	} {
+		if err == nil || !strings.Contains(err.Error(), "model "+modelID+" is a member of group shared in "+cfgPath) {
+			t.Fatalf("%s: expected group member error, got: %v", name, err)
+		}
+	}
+}
+
+func TestWriteRecipeConfigRawMap_RejectsIncludeNotReferenced(t *testing.T) {
+	_, cfgPath := newRuntimeCacheTestProxyManager(t, "spark-vllm-docker", "runtime-vllm-unreferenced", "vllm")
+	t.Setenv(recipesConfigFileEnv, "recipes.yaml")
+
+	err := writeRecipeConfigRawMap(cfgPath, map[string]any{"models": map[string]any{}})
+	if err == nil || !strings.Contains(err.Error(), "is not included from") {
+		t.Fatalf("expected not included error, got: %v", err)
+	}
+}
+
 func TestRecipeModelAPI_LifecycleMaintainsDRYCommands(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
@@ -1982,3 +2139,43 @@ func assertBashLCShellValid(t *testing.T, cmd string, label string) {
 		t.Fatalf("%s has invalid shell quoting: %v\ncmd=%s\nout=%s", label, err, cmd, strings.TrimSpace(string(out)))
 	}
 }
+
+func TestWriteConfigRawMap_KeepsComments(t *testing.T) {
+	cfgPath := filepath.Join(t.TempDir(), "config.yaml")
+	initial := "" +
+		"# hand written config\n" +
+		"macros:\n" +
+		"  port: 9001 # first port\n" +
+		"\n" +
+		"models:\n" +
+		"  # tuned by hand\n" +
+		"  m1:\n" +
+		"    proxy: http://127.0.0.1:${port}\n" +
+		"    cmd: serve m1\n"
+	if err := os.WriteFile(cfgPath, []byte(initial), 0o644); err != nil {
+		t.Fatalf("write initial config: %v", err)
+	}
+
+	root, err := loadConfigRawMap(cfgPath)
+	if err != nil {
+		t.Fatalf("loadConfigRawMap: %v", err)
+	}
+	models := getMap(root, "models")
+	models["m2"] = map[string]any{"cmd": "serve m2", "proxy": "http://127.0.0.1:9002"}
+	root["models"] = models
+	if err := writeConfigRawMap(cfgPath, root); err != nil {
+		t.Fatalf("writeConfigRawMap: %v", err)
+	}
+
+	raw, err := os.ReadFile(cfgPath)
+	if err != nil {
+		t.Fatalf("read config: %v", err)
+	}
+	want := initial + "" +
+		"  m2:\n" +
+		"    cmd: serve m2\n" +
+		"    proxy: http://127.0.0.1:9002\n"
+	if string(raw) != want {
+		t.Fatalf("unexpected config:\n%s\nwant:\n%s", raw, want)
+	}
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+
+	// longest X-Request-ID of a client that is kept, longer ones are replaced
+	maxRequestIDLength = 128
+)
+
+// newRequestID returns a random request ID of 32 hex characters
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID reports whether id of a client can be used as request ID.
+// Only characters that are safe in log lines and headers are allowed.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("-_.:/+=@", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestID assigns r its request ID: the X-Request-ID of the client when
+// valid, otherwise a new one. The header is set on r so it is forwarded to
+// upstreams and peers.
+func withRequestID(r *http.Request) (*http.Request, string) {
+	id := strings.TrimSpace(r.Header.Get(requestIDHeader))
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	r.Header.Set(requestIDHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), proxyCtxKey("requestID"), id)), id
+}
+
+// requestIDOf returns the request ID of r, empty for internal requests
+func requestIDOf(r *http.Request) string {
+	id, _ := r.Context().Value(proxyCtxKey("requestID")).(string)
+	return id
+}
+
+// apiGetRequest finds the metrics and captures of a request by its ID. With
+// the metrics or capture store enabled its whole retention is searched,
+// otherwise what is kept in memory.
+func (pm *ProxyManager) apiGetRequest(c *gin.Context) {
+	id := c.Param("id")
+	if !validRequestID(id) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request ID"})
+		return
+	}
+
+	var metrics []TokenMetrics
+	if pm.metricsStore != nil {
+		err := pm.metricsStore.read(time.Time{}, time.Now().Add(time.Hour), func(record metricsRecord) {
+			if record.Type == metricsRecordRequest && record.Metrics != nil && record.Metrics.RequestID == id {
+				metrics = append(metrics, *record.Metrics)
+			}
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read metrics store: " + err.Error()})
+			return
+		}
+	}
+	// in memory metrics carry the IDs of their captures
+	inMemory := slices.DeleteFunc(pm.metricsMonitor.getMetrics(), func(tm TokenMetrics) bool {
+		return tm.RequestID != id
+	})
+	if pm.metricsStore == nil {
+		metrics = inMemory
+	}
+
+	captures := []ReqRespCapture{}
+	if store := pm.metricsMonitor.captureStore; store != nil {
+		stored, err := store.findByRequestID(id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read capture store: " + err.Error()})
+			return
+		}
+		captures = append(captures, stored...)
+	} else {
+		for _, tm := range inMemory {
+			if !tm.HasCapture {
+				continue
+			}
+			if capture := pm.metricsMonitor.getCaptureByID(tm.ID); capture != nil {
+				captures = append(captures, *capture)
+			}
+		}
+	}
+
+	if len(metrics) == 0 && len(captures) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "request not found"})
+		return
+	}
+	if metrics == nil {
+		metrics = []TokenMetrics{}
+	}
+	c.JSON(http.StatusOK, gin.H{"request_id": id, "metrics": metrics, "captures": newCaptureViews(captures)})
+}
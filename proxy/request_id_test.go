@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidRequestID(t *testing.T) {
+	assert.True(t, validRequestID("client-123"))
+	assert.True(t, validRequestID("9f3c1e2a-7b1d-4c8e-9a51-2f0d6c3b8e47"))
+	assert.True(t, validRequestID(newRequestID()))
+	assert.Len(t, newRequestID(), 32)
+
+	assert.False(t, validRequestID(""))
+	assert.False(t, validRequestID("has space"))
+	assert.False(t, validRequestID("quote\""))
+	assert.False(t, validRequestID("line\nbreak"))
+	assert.False(t, validRequestID(strings.Repeat("a", maxRequestIDLength+1)))
+}
+
+func TestProxyManager_RequestID(t *testing.T) {
+	var peerRequestID string
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peerRequestID = r.Header.Get(requestIDHeader)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"usage":{"prompt_tokens":1,"completion_tokens":1}}`))
+	}))
+	defer peer.Close()
+	peerURL, _ := url.Parse(peer.URL)
+
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"request-id-model": getTestSimpleResponderConfig("request-id-model"),
+		},
+		Peers: map[string]config.PeerConfig{
+			"peer1": {Proxy: peer.URL, ProxyURL: peerURL, Models: []string{"peer-model"}},
+		},
+		CaptureBuffer: 5,
+		LogLevel:      "info",
+	})
+	proxy := New(conf)
+	defer proxy.StopProcesses(StopImmediately)
+
+	// the ID of the client is kept
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"request-id-model"}`))
+	req.Header.Set(requestIDHeader, "client-123")
+	w := CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "client-123", w.Header().Get(requestIDHeader))
+	assert.Contains(t, string(proxy.proxyLogger.GetHistory()), "Request client-123 ")
+
+	// an invalid ID is replaced, the new one is forwarded to peers
+	req = httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"peer-model"}`))
+	req.Header.Set(requestIDHeader, "not valid")
+	w = CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	generated := w.Header().Get(requestIDHeader)
+	assert.Len(t, generated, 32)
+	assert.Equal(t, generated, peerRequestID)
+
+	var found struct {
+		RequestID string           `json:"request_id"`
+		Metrics   []TokenMetrics   `json:"metrics"`
+		Captures  []ReqRespCapture `json:"captures"`
+	}
+	require.Eventually(t, func() bool {
+		req := httptest.NewRequest("GET", "/api/requests/client-123", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		return w.Code == http.StatusOK && json.Unmarshal(w.Body.Bytes(), &found) == nil
+	}, time.Second, 10*time.Millisecond)
+	require.Len(t, found.Metrics, 1)
+	assert.Equal(t, "client-123", found.Metrics[0].RequestID)
+	assert.Equal(t, "request-id-model", found.Metrics[0].Model)
+	require.Len(t, found.Captures, 1)
+	assert.Equal(t, "client-123", found.Captures[0].RequestID)
+	assert.Equal(t, "client-123", found.Captures[0].ReqHeaders["X-Request-Id"])
+
+	req = httptest.NewRequest("GET", "/api/requests/"+generated, nil)
+	w = CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &found))
+	require.Len(t, found.Metrics, 1)
+	assert.Equal(t, "peer-model", found.Metrics[0].Model)
+
+	req = httptest.NewRequest("GET", "/api/requests/unknown-id", nil)
+	w = CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestProxyManager_RequestIDFromStore(t *testing.T) {
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"request-id-store": getTestSimpleResponderConfig("request-id-store"),
+		},
+		MetricsStore: config.MetricsStoreConfig{Path: t.TempDir(), RetentionDays: 30},
+		LogLevel:     "error",
+	})
+	proxy := New(conf)
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"request-id-store"}`))
+	req.Header.Set(requestIDHeader, "stored-request")
+	w := CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	proxy.StopProcesses(StopImmediately)
+	proxy.Shutdown()
+
+	// a new ProxyManager, as after a restart, finds it in the store
+	proxy = New(conf)
+	defer proxy.Shutdown()
+	req = httptest.NewRequest("GET", "/api/requests/stored-request", nil)
+	w = CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var found struct {
+		Metrics []TokenMetrics `json:"metrics"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &found))
+	require.Len(t, found.Metrics, 1)
+	assert.Equal(t, "request-id-store", found.Metrics[0].Model)
+}
@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mostlygeek/llama-swap/proxy/config"
+)
+
+// splitRouter assigns the requests for the virtual models of the splits in
+// the configuration to their variants
+type splitRouter struct {
+	splits map[string]config.SplitConfig
+
+	// requests assigned to each variant, by split name
+	requests map[string][]*atomic.Int64
+}
+
+func newSplitRouter(splits map[string]config.SplitConfig) *splitRouter {
+	router := &splitRouter{
+		splits:   splits,
+		requests: make(map[string][]*atomic.Int64, len(splits)),
+	}
+	for name, split := range splits {
+		counters := make([]*atomic.Int64, len(split.Variants))
+		for i := range counters {
+			counters[i] = &atomic.Int64{}
+		}
+		router.requests[name] = counters
+	}
+	return router
+}
+
+// rebuild returns the router of splits, the assigned requests of the splits
+// that did not change are kept
+func (s *splitRouter) rebuild(splits map[string]config.SplitConfig) *splitRouter {
+	router := newSplitRouter(splits)
+	for name, split := range splits {
+		if old, found := s.splits[name]; found && reflect.DeepEqual(old, split) {
+			router.requests[name] = s.requests[name]
+		}
+	}
+	return router
+}
+
+// splitRouter returns the router of the running config
+func (pm *ProxyManager) splitRouter() *splitRouter {
+	pm.accessMu.RLock()
+	defer pm.accessMu.RUnlock()
+	return pm.splits
+}
+
+// assign returns the variant model for a request for the split name. A
+// sticky client is always assigned the same variant while the weights do
+// not change. clientIP is the address of the client resolved with the
+// trusted proxies. It returns false when name is not a split.
+func (s *splitRouter) assign(name string, r *http.Request, clientIP string) (string, bool) {
+	split, found := s.splits[name]
+	if !found {
+		return "", false
+	}
+	total := 0
+	for _, variant := range split.Variants {
+		total += variant.Weight
+	}
+	if total <= 0 {
+		return "", false
+	}
+
+	var pick int
+	if key := stickyKey(split, r, clientIP); key != "" {
+		hash := fnv.New64a()
+		hash.Write([]byte(name + "\x00" + key))
+		pick = int(hash.Sum64() % uint64(total))
+	} else {
+		pick = rand.IntN(total)
+	}
+
+	for i, variant := range split.Variants {
+		if pick < variant.Weight {
+			s.requests[name][i].Add(1)
+			return variant.Model, true
+		}
+		pick -= variant.Weight
+	}
+	return "", false
+}
+
+// stickyKey identifies the client of r for the split, empty when requests
+// are assigned at random
+func stickyKey(split config.SplitConfig, r *http.Request, clientIP string) string {
+	switch split.StickyBy {
+	case config.SplitStickyAPIKey:
+		if key, _ := r.Context().Value(proxyCtxKey("apiKey")).(string); key != "" {
+			return key
+		}
+		return clientIP
+	case config.SplitStickyHeader:
+		return strings.TrimSpace(r.Header.Get(split.StickyHeader))
+	}
+	return ""
+}
+
+type splitVariantStatus struct {
+	Model    string  `json:"model"`
+	Weight   int     `json:"weight"`
+	Share    float64 `json:"share"`    // of the requests, from the weights
+	Requests int64   `json:"requests"` // assigned since llama-swap started
+}
+
+type splitStatus struct {
+	StickyBy     string               `json:"stickyBy"`
+	StickyHeader string               `json:"stickyHeader,omitempty"`
+	Variants     []splitVariantStatus `json:"variants"`
+}
+
+// status returns the configuration and the assigned requests of the split
+// name, nil when it is not a split
+func (s *splitRouter) status(name string) *splitStatus {
+	split, found := s.splits[name]
+	if !found {
+		return nil
+	}
+	total := 0
+	for _, variant := range split.Variants {
+		total += variant.Weight
+	}
+	status := &splitStatus{
+		StickyBy: split.StickyBy,
+		Variants: make([]splitVariantStatus, len(split.Variants)),
+	}
+	if split.StickyBy == config.SplitStickyHeader {
+		status.StickyHeader = split.StickyHeader
+	}
+	for i, variant := range split.Variants {
+		status.Variants[i] = splitVariantStatus{
+			Model:    variant.Model,
+			Weight:   variant.Weight,
+			Requests: s.requests[name][i].Load(),
+		}
+		if total > 0 {
+			status.Variants[i].Share = float64(variant.Weight) / float64(total)
+		}
+	}
+	return status
+}
+
+// names returns the sorted names of the splits
+func (s *splitRouter) names() []string {
+	names := make([]string, 0, len(s.splits))
+	for name := range s.splits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// variants returns the models of the variants of the split name, nil when
+// it is not a split
+func (s *splitRouter) variants(name string) []string {
+	split, found := s.splits[name]
+	if !found {
+		return nil
+	}
+	models := make([]string, len(split.Variants))
+	for i, variant := range split.Variants {
+		models[i] = variant.Model
+	}
+	return models
+}
+
+// splitOf returns the split that assigned the request to its model, empty
+// for requests for other models
+func splitOf(r *http.Request) string {
+	name, _ := r.Context().Value(proxyCtxKey("split")).(string)
+	return name
+}
@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+)
+
+func TestSplitRouter_Assign(t *testing.T) {
+	router := newSplitRouter(map[string]config.SplitConfig{
+		"by-key": {
+			StickyBy: config.SplitStickyAPIKey,
+			Variants: []config.SplitVariant{{Model: "a", Weight: 3}, {Model: "b", Weight: 1}, {Model: "never", Weight: 0}},
+		},
+		"by-header": {
+			StickyBy:     config.SplitStickyHeader,
+			StickyHeader: "X-User",
+			Variants:     []config.SplitVariant{{Model: "a", Weight: 1}, {Model: "b", Weight: 1}},
+		},
+	})
+
+	_, found := router.assign("unknown", httptest.NewRequest("POST", "/", nil), "10.0.0.1")
+	assert.False(t, found)
+
+	// clients keep their variant and the weights decide the shares
+	assigned := map[string]int{}
+	for i := 0; i < 400; i++ {
+		req := httptest.NewRequest("POST", "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), proxyCtxKey("apiKey"), fmt.Sprintf("key-%d", i)))
+		first, found := router.assign("by-key", req, "10.0.0.1")
+		require.True(t, found)
+		again, _ := router.assign("by-key", req, "10.0.0.1")
+		assert.Equal(t, first, again)
+		assigned[first]++
+	}
+	assert.Zero(t, assigned["never"])
+	assert.InDelta(t, 300, assigned["a"], 50)
+	assert.InDelta(t, 100, assigned["b"], 50)
+
+	// without an API key the client address is used
+	assigned = map[string]int{}
+	for i := 0; i < 100; i++ {
+		req := httptest.NewRequest("POST", "/", nil)
+		clientIP := fmt.Sprintf("10.0.1.%d", i)
+		first, _ := router.assign("by-key", req, clientIP)
+		again, _ := router.assign("by-key", req, clientIP)
+		assert.Equal(t, first, again)
+		assigned[first]++
+	}
+	assert.Greater(t, assigned["b"], 5)
+
+	// header values are sticky too
+	assigned = map[string]int{}
+	for i := 0; i < 100; i++ {
+		req := httptest.NewRequest("POST", "/", nil)
+		req.Header.Set("X-User", fmt.Sprintf("user-%d", i))
+		first, _ := router.assign("by-header", req, "10.0.0.1")
+		again, _ := router.assign("by-header", req, "10.0.0.1")
+		assert.Equal(t, first, again)
+		assigned[first]++
+	}
+	assert.Greater(t, assigned["a"], 20)
+	assert.Greater(t, assigned["b"], 20)
+
+	status := router.status("by-key")
+	require.NotNil(t, status)
+	assert.Equal(t, config.SplitStickyAPIKey, status.StickyBy)
+	assert.Equal(t, 0.75, status.Variants[0].Share)
+	assert.Equal(t, int64(1000), status.Variants[0].Requests+status.Variants[1].Requests)
+	assert.Equal(t, "X-User", router.status("by-header").StickyHeader)
+	assert.Nil(t, router.status("unknown"))
+}
+
+func TestProxyManager_Split(t *testing.T) {
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"variant-a": getTestSimpleResponderConfig("variant-a"),
+			"variant-b": getTestSimpleResponderConfig("variant-b"),
+		},
+		Groups: map[string]config.GroupConfig{
+			"both": {Swap: false, Members: []string{"variant-a", "variant-b"}},
+		},
+		Splits: map[string]config.SplitConfig{
+			"ab-test": {
+				StickyBy:     config.SplitStickyHeader,
+				StickyHeader: "X-User",
+				Variants:     []config.SplitVariant{{Model: "variant-a", Weight: 1}, {Model: "variant-b", Weight: 1}},
+			},
+		},
+		CaptureBuffer: 20,
+		LogLevel:      "error",
+	})
+	proxy := New(conf)
+	defer proxy.StopProcesses(StopImmediately)
+
+	responses := map[string]string{}
+	for i := 0; i < 10; i++ {
+		user := fmt.Sprintf("user-%d", i%5)
+		req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"ab-test","messages":[]}`))
+		req.Header.Set("X-User", user)
+		w := CreateTestResponseRecorder()
+		proxy.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		// the variant is asked for by name and a user stays on it
+		variant := gjson.Get(w.Body.String(), "responseMessage").String()
+		assert.Equal(t, variant, gjson.Get(gjson.Get(w.Body.String(), "request_body").String(), "model").String())
+		if previous, found := responses[user]; found {
+			assert.Equal(t, previous, variant)
+		}
+		responses[user] = variant
+	}
+
+	metrics := proxy.metricsMonitor.getMetrics()
+	require.Len(t, metrics, 10)
+	for _, tm := range metrics {
+		assert.Equal(t, "ab-test", tm.Split)
+		assert.Contains(t, []string{"variant-a", "variant-b"}, tm.Model)
+		capture := proxy.metricsMonitor.getCaptureByID(tm.ID)
+		require.NotNil(t, capture)
+		assert.Equal(t, "ab-test", capture.Split)
+	}
+
+	// requests for a variant by name are not tagged
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"variant-a","messages":[]}`))
+	w := CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	metrics = proxy.metricsMonitor.getMetrics()
+	assert.Empty(t, metrics[len(metrics)-1].Split)
+
+	// the split is listed with its state
+	req = httptest.NewRequest("GET", "/v1/models", nil)
+	w = CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var listed *gjson.Result
+	for _, record := range gjson.Get(w.Body.String(), "data").Array() {
+		if record.Get("id").String() == "ab-test" {
+			listed = &record
+		}
+	}
+	require.NotNil(t, listed)
+	assert.Equal(t, "header", listed.Get("meta.llamaswap.split.stickyBy").String())
+	assert.Equal(t, "variant-a", listed.Get("meta.llamaswap.split.variants.0.model").String())
+	assert.Equal(t, 0.5, listed.Get("meta.llamaswap.split.variants.0.share").Float())
+	assert.Equal(t, int64(10), listed.Get("meta.llamaswap.split.variants.0.requests").Int()+listed.Get("meta.llamaswap.split.variants.1.requests").Int())
+
+	var split *Model
+	for _, model := range proxy.getModelStatus() {
+		if model.Id == "ab-test" {
+			split = &model
+		}
+	}
+	require.NotNil(t, split)
+	require.NotNil(t, split.Split)
+	data, err := json.Marshal(split.Split)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"stickyHeader":"X-User"`)
+}
+
+func TestProxyManager_SplitStickyClient(t *testing.T) {
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"variant-a": getTestSimpleResponderConfig("variant-a"),
+			"variant-b": getTestSimpleResponderConfig("variant-b"),
+		},
+		Groups: map[string]config.GroupConfig{
+			"both": {Swap: false, Members: []string{"variant-a", "variant-b"}},
+		},
+		Splits: map[string]config.SplitConfig{
+			"ab-test": {
+				StickyBy: config.SplitStickyAPIKey,
+				Variants: []config.SplitVariant{{Model: "variant-a", Weight: 1}, {Model: "variant-b", Weight: 1}},
+			},
+		},
+		TrustedProxies: []string{"10.0.0.1/32"},
+		LogLevel:       "error",
+	})
+	proxy := New(conf)
+	defer proxy.StopProcesses(StopImmediately)
+
+	send := func(model, client string) string {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"`+model+`","messages":[]}`))
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", client)
+		w := CreateTestResponseRecorder()
+		proxy.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		return gjson.Get(w.Body.String(), "responseMessage").String()
+	}
+
+	// behind the trusted proxy each client keeps its own variant
+	assigned := map[string]int{}
+	for i := 0; i < 20; i++ {
+		client := fmt.Sprintf("192.168.1.%d", i)
+		variant := send("ab-test", client)
+		assert.Equal(t, variant, send("ab-test", client))
+		assigned[variant]++
+	}
+	assert.Len(t, assigned, 2)
+
+	// edited splits apply without a restart
+	updated := conf
+	updated.Splits = map[string]config.SplitConfig{
+		"ab-test": {
+			StickyBy: config.SplitStickyAPIKey,
+			Variants: []config.SplitVariant{{Model: "variant-a", Weight: 0}, {Model: "variant-b", Weight: 1}},
+		},
+		"b-only": {Variants: []config.SplitVariant{{Model: "variant-b", Weight: 1}}},
+	}
+	proxy.applyConfigAndSyncProcessGroups(updated)
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, "variant-b", send("ab-test", fmt.Sprintf("192.168.1.%d", i)))
+	}
+	assert.Equal(t, "variant-b", send("b-only", "192.168.1.1"))
+	require.NotNil(t, proxy.splitRouter().status("ab-test"))
+	assert.Equal(t, int64(5), proxy.splitRouter().status("ab-test").Variants[1].Requests)
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mostlygeek/llama-swap/event"
+)
+
+// residencyPollInterval is how often a request waiting for the residency of
+// a model to end checks again
+const residencyPollInterval = 100 * time.Millisecond
+
+// residencyError is returned when a swap would have to wait longer than
+// maxSwapWait for the minimum residency of a loaded model to end
+type residencyError struct {
+	Group      string
+	Model      string // the resident model
+	RetryAfter time.Duration
+}
+
+func (e *residencyError) Error() string {
+	return fmt.Sprintf("model %s of group %s must stay loaded, retry in %s", e.Model, e.Group, e.RetryAfter.Round(time.Second))
+}
+
+// residentModel returns a ready model of pg, other than exceptModelID, that
+// can not be unloaded yet because of minResidency or minResidencyRequests.
+// remaining is how long until its minResidency ends, 0 when only the request
+// count keeps it loaded.
+func (pg *ProcessGroup) residentModel(exceptModelID string) (modelID string, remaining time.Duration) {
+	if pg.minResidency <= 0 && pg.minResidencyRequests <= 0 {
+		return "", 0
+	}
+	for id, process := range pg.processes {
+		if id == exceptModelID || process.CurrentState() != StateReady {
+			continue
+		}
+		if pg.minResidencyRequests > 0 && process.requestsSinceReady.Load() >= pg.minResidencyRequests {
+			continue
+		}
+		var left time.Duration
+		if pg.minResidency > 0 {
+			left = pg.minResidency - time.Since(time.Unix(0, process.readySince.Load()))
+			if left <= 0 {
+				continue
+			}
+		}
+		return id, left
+	}
+	return "", 0
+}
+
+// waitForResidency waits until no model of pg other than modelID is kept
+// loaded by the minimum residency of the group. It gives up with a
+// residencyError after maxSwapWait, or right away when the residency
+// certainly outlasts it.
+func (pg *ProcessGroup) waitForResidency(ctx context.Context, modelID string) error {
+	deadline := time.Now().Add(pg.maxSwapWait)
+	var waitSpan *span // only when there is a wait
+	defer func() { waitSpan.end() }()
+	waiting := false
+	for {
+		resident, remaining := pg.residentModel(modelID)
+		if resident == "" {
+			return nil
+		}
+
+		left := time.Until(deadline)
+		if left <= 0 || (pg.minResidencyRequests <= 0 && remaining > left) {
+			event.Emit(RequestRejectedEvent{Model: modelID, Reason: "residency"})
+			err := &residencyError{Group: pg.id, Model: resident, RetryAfter: max(remaining, time.Second)}
+			waitSpan.setError(err)
+			return err
+		}
+		if !waiting {
+			pg.proxyLogger.Debugf("<%s> Waiting for the residency of %s in group %s to end", modelID, resident, pg.id)
+			waiting = true
+			_, waitSpan = startSpan(ctx, "wait for residency", spanKindInternal)
+			waitSpan.setAttr("llama_swap.group", pg.id)
+			waitSpan.setAttr("llama_swap.model", resident)
+		}
+
+		wait := min(left, residencyPollInterval)
+		if remaining > 0 && remaining < wait {
+			wait = remaining
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// sendResidencyError answers 503 with a Retry-After header when err is a
+// residencyError and reports whether it did
+func (pm *ProxyManager) sendResidencyError(c *gin.Context, err error) bool {
+	var residencyErr *residencyError
+	if !errors.As(err, &residencyErr) {
+		return false
+	}
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(residencyErr.RetryAfter.Seconds()))))
+	pm.sendErrorResponse(c, http.StatusServiceUnavailable, err.Error())
+	pm.proxyLogger.Infof("Rejected request: %v", err)
+	return true
+}
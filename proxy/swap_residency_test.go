@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func residencyTestConfig(group config.GroupConfig) config.Config {
+	group.Swap = true
+	group.Exclusive = true
+	group.Members = []string{"resident1", "resident2"}
+	return config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"resident1": getTestSimpleResponderConfig("resident1"),
+			"resident2": getTestSimpleResponderConfig("resident2"),
+		},
+		Groups: map[string]config.GroupConfig{"G1": group},
+	})
+}
+
+func proxyResidencyRequest(pg *ProcessGroup, modelID string) (*httptest.ResponseRecorder, error) {
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	w := httptest.NewRecorder()
+	return w, pg.ProxyRequest(modelID, w, req)
+}
+
+func TestProcessGroup_MinResidencyRequests(t *testing.T) {
+	pg := NewProcessGroup("G1", residencyTestConfig(config.GroupConfig{MinResidencyRequests: 2, MaxSwapWait: 10}), testLogger, testLogger)
+	defer pg.StopProcesses(StopImmediately)
+
+	w, err := proxyResidencyRequest(pg, "resident1")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	swapped := make(chan error, 1)
+	go func() {
+		w, err := proxyResidencyRequest(pg, "resident2")
+		if err == nil && w.Code != http.StatusOK {
+			err = errors.New(w.Body.String())
+		}
+		swapped <- err
+	}()
+
+	// resident1 has only served one request, the swap has to wait
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, StateReady, pg.processes["resident1"].CurrentState())
+	assert.Equal(t, StateStopped, pg.processes["resident2"].CurrentState())
+
+	// the waiting swap does not block requests to the resident model
+	w, err = proxyResidencyRequest(pg, "resident1")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	select {
+	case err := <-swapped:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("swap did not happen after the residency ended")
+	}
+	assert.Equal(t, StateStopped, pg.processes["resident1"].CurrentState())
+	assert.Equal(t, StateReady, pg.processes["resident2"].CurrentState())
+}
+
+func TestProcessGroup_MinResidencyRejects(t *testing.T) {
+	pg := NewProcessGroup("G1", residencyTestConfig(config.GroupConfig{MinResidency: 60, MaxSwapWait: 1}), testLogger, testLogger)
+	defer pg.StopProcesses(StopImmediately)
+
+	_, err := proxyResidencyRequest(pg, "resident1")
+	require.NoError(t, err)
+
+	// the residency outlasts maxSwapWait so there is no point in waiting
+	begin := time.Now()
+	_, err = proxyResidencyRequest(pg, "resident2")
+	assert.Less(t, time.Since(begin), time.Second)
+	var residencyErr *residencyError
+	require.ErrorAs(t, err, &residencyErr)
+	assert.Equal(t, "resident1", residencyErr.Model)
+	assert.Greater(t, residencyErr.RetryAfter, 55*time.Second)
+	assert.Equal(t, StateReady, pg.processes["resident1"].CurrentState())
+
+	// requests to the resident model are not affected
+	w, err := proxyResidencyRequest(pg, "resident1")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestProxyManager_MinResidencyAcrossGroups(t *testing.T) {
+	conf := residencyTestConfig(config.GroupConfig{MinResidency: 60, MaxSwapWait: 1})
+	conf.Models["resident3"] = getTestSimpleResponderConfig("resident3")
+	conf = config.AddDefaultGroupToConfig(conf)
+	conf.LogLevel = "error"
+
+	proxy := New(conf)
+	defer proxy.StopProcesses(StopImmediately)
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"resident1"}`))
+	w := CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// the default group is exclusive too, it has to wait for resident1
+	req = httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"resident3"}`))
+	req.Header.Set("Accept", "application/json")
+	w = CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), "resident1")
+
+	assert.Equal(t, StateReady, proxy.processGroups["G1"].processes["resident1"].CurrentState())
+	assert.Equal(t, StateStopped, proxy.processGroups[config.DEFAULT_GROUP_ID].processes["resident3"].CurrentState())
+}
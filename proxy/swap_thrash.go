@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mostlygeek/llama-swap/event"
+	"github.com/mostlygeek/llama-swap/proxy/config"
+)
+
+// swapThrashDetector counts the swaps unloading models of each group and
+// emits a SwapThrashEvent when a group has more than its thrashThreshold
+// within its thrashWindow. It warns once per crossing and again only after
+// the rate dropped back to the threshold.
+type swapThrashDetector struct {
+	mu     sync.Mutex
+	groups map[string]config.GroupConfig // groups with a thrashThreshold
+	swaps  map[string][]time.Time        // within the window, oldest first
+	warned map[string]bool
+	logger *LogMonitor
+	cancel context.CancelFunc
+
+	now func() time.Time
+}
+
+func newSwapThrashDetector(groups map[string]config.GroupConfig, logger *LogMonitor) *swapThrashDetector {
+	d := &swapThrashDetector{
+		groups: make(map[string]config.GroupConfig),
+		swaps:  make(map[string][]time.Time),
+		warned: make(map[string]bool),
+		logger: logger,
+		now:    time.Now,
+	}
+	for groupID, group := range groups {
+		if group.ThrashThreshold > 0 {
+			d.groups[groupID] = group
+		}
+	}
+	return d
+}
+
+// subscribe counts ModelSwapEvents until close
+func (d *swapThrashDetector) subscribe() *swapThrashDetector {
+	d.cancel = event.On(d.onModelSwap)
+	return d
+}
+
+func (d *swapThrashDetector) close() {
+	if d.cancel != nil {
+		d.cancel()
+	}
+}
+
+func (d *swapThrashDetector) onModelSwap(e ModelSwapEvent) {
+	group, ok := d.groups[e.GroupID]
+	if !ok {
+		return
+	}
+	window := time.Duration(group.ThrashWindow) * time.Second
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	swaps := d.swaps[e.GroupID]
+	expired := 0
+	for expired < len(swaps) && now.Sub(swaps[expired]) >= window {
+		expired++
+	}
+	swaps = append(swaps[expired:], now)
+	d.swaps[e.GroupID] = swaps
+
+	if len(swaps) <= group.ThrashThreshold {
+		d.warned[e.GroupID] = false
+		return
+	}
+	if d.warned[e.GroupID] {
+		return
+	}
+	d.warned[e.GroupID] = true
+	d.logger.Warnf("Group %s is thrashing: %d swaps in the last %s, consider minResidency or a group that keeps both models loaded", e.GroupID, len(swaps), window)
+	event.Emit(SwapThrashEvent{GroupID: e.GroupID, Swaps: len(swaps), Window: window})
+}
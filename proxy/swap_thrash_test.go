@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mostlygeek/llama-swap/event"
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSwapThrashDetector(t *testing.T) {
+	var mu sync.Mutex
+	var thrashes []SwapThrashEvent
+	cancel := event.On(func(e SwapThrashEvent) {
+		if e.GroupID == "thrash" {
+			mu.Lock()
+			thrashes = append(thrashes, e)
+			mu.Unlock()
+		}
+	})
+	defer cancel()
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(thrashes)
+	}
+
+	d := newSwapThrashDetector(map[string]config.GroupConfig{
+		"thrash": {ThrashThreshold: 3, ThrashWindow: 60},
+		"calm":   {ThrashWindow: 60},
+	}, testLogger)
+	now := time.Now()
+	d.now = func() time.Time { return now }
+	swap := func(group string, after time.Duration) {
+		now = now.Add(after)
+		d.onModelSwap(ModelSwapEvent{GroupID: group, FromModel: "a", ToModel: "b"})
+	}
+
+	// groups without a threshold are not tracked
+	for range 10 {
+		swap("calm", time.Second)
+	}
+	assert.Empty(t, d.swaps["calm"])
+
+	for range 3 {
+		swap("thrash", 10*time.Second)
+	}
+	swap("thrash", 10*time.Second)
+	require.Eventually(t, func() bool { return count() == 1 }, time.Second, 10*time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, SwapThrashEvent{GroupID: "thrash", Swaps: 4, Window: time.Minute}, thrashes[0])
+	mu.Unlock()
+
+	// still above the threshold, warned once only
+	swap("thrash", 10*time.Second)
+
+	// old swaps leave the window and the detector is armed again
+	swap("thrash", 2*time.Minute)
+	for range 3 {
+		swap("thrash", time.Second)
+	}
+	require.Eventually(t, func() bool { return count() == 2 }, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 2, count())
+}
@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// tlsReloadDelay is how long the reloader waits for more changes to the
+// files before it loads them, a rotation often writes the cert and key apart
+const tlsReloadDelay = time.Second
+
+// TLSOptions are the files of the HTTPS server
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+
+	// PEM bundle of the CAs client certificates are verified against, empty
+	// to not ask clients for a certificate
+	ClientCAFile string
+
+	// accept clients without a certificate, they need another credential.
+	// Certificates that are sent are verified either way.
+	ClientCertOptional bool
+}
+
+// TLSReloader serves the certificate and client CAs of TLSOptions to the
+// HTTPS server and loads them again when the files change, so they can be
+// rotated without a restart
+type TLSReloader struct {
+	options TLSOptions
+	logger  *LogMonitor
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+
+	watcher *fsnotify.Watcher
+	timer   *time.Timer
+}
+
+// NewTLSReloader loads the files of options, it fails when they are not valid
+func NewTLSReloader(options TLSOptions, logger *LogMonitor) (*TLSReloader, error) {
+	r := &TLSReloader{options: options, logger: logger}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the files, the ones loaded before are kept when one of them
+// is not valid
+func (r *TLSReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.options.CertFile, r.options.KeyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.options.ClientCAFile != "" {
+		data, err := os.ReadFile(r.options.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("loading TLS client CAs: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			return fmt.Errorf("loading TLS client CAs: no certificates in %s", r.options.ClientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.mu.Unlock()
+	return nil
+}
+
+// Config returns the tls.Config of the server, it always uses the files
+// loaded last
+func (r *TLSReloader) Config() *tls.Config {
+	conf := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.cert, nil
+		},
+	}
+	if r.options.ClientCAFile == "" {
+		return conf
+	}
+
+	conf.ClientAuth = tls.RequireAndVerifyClientCert
+	if r.options.ClientCertOptional {
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	// the client CAs can only be replaced with the config of a connection
+	base := conf.Clone()
+	conf.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		connConf := base.Clone()
+		connConf.ClientCAs = r.clientCAs
+		return connConf, nil
+	}
+	return conf
+}
+
+// Watch reloads the files when they change until Close. The directories of
+// the files are watched, so files replaced by a rename, e.g. by certbot or a
+// Kubernetes secret, are picked up as well.
+func (r *TLSReloader) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	watched := make(map[string]bool)
+	dirs := make(map[string]bool)
+	for _, file := range []string{r.options.CertFile, r.options.KeyFile, r.options.ClientCAFile} {
+		if file == "" {
+			continue
+		}
+		absFile, err := filepath.Abs(file)
+		if err != nil {
+			watcher.Close()
+			return err
+		}
+		watched[absFile] = true
+		dir := filepath.Dir(absFile)
+		if dirs[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return fmt.Errorf("watching %s: %w", dir, err)
+		}
+		dirs[dir] = true
+	}
+	r.watcher = watcher
+
+	go func() {
+		for {
+			select {
+			case changeEvent, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				// ..data is swapped when a Kubernetes secret changes
+				if watched[changeEvent.Name] || filepath.Base(changeEvent.Name) == "..data" {
+					r.scheduleReload()
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				r.logger.Warnf("TLS file watcher error: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (r *TLSReloader) scheduleReload() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.timer = time.AfterFunc(tlsReloadDelay, func() {
+		if err := r.Reload(); err != nil {
+			r.logger.Errorf("Keeping the current TLS certificate: %v", err)
+			return
+		}
+		r.logger.Infof("Reloaded TLS certificate %s", r.options.CertFile)
+	})
+}
+
+// Close stops watching the files
+func (r *TLSReloader) Close() error {
+	r.mu.Lock()
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.mu.Unlock()
+	if r.watcher == nil {
+		return nil
+	}
+	return r.watcher.Close()
+}
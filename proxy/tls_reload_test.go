@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+)
+
+// testCert is a certificate with its key, signed by parent or self-signed
+// when parent is nil
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, commonName string, parent *testCert, configure func(*x509.Certificate)) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+	if configure != nil {
+		configure(template)
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write writes the certificate and key as PEM files to dir
+func (c *testCert) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestTLSReloader_Reload(t *testing.T) {
+	dir := t.TempDir()
+	first := newTestCert(t, "first", nil, nil)
+	certFile, keyFile := first.write(t, dir, "server")
+
+	reloader, err := NewTLSReloader(TLSOptions{CertFile: certFile, KeyFile: keyFile}, testLogger)
+	require.NoError(t, err)
+	defer reloader.Close()
+	conf := reloader.Config()
+	assert.Equal(t, tls.NoClientCert, conf.ClientAuth)
+
+	served := func() string {
+		cert, err := conf.GetCertificate(&tls.ClientHelloInfo{})
+		require.NoError(t, err)
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		require.NoError(t, err)
+		return parsed.Subject.CommonName
+	}
+	assert.Equal(t, "first", served())
+
+	// a broken file keeps the current certificate
+	require.NoError(t, os.WriteFile(keyFile, []byte("not a key"), 0600))
+	assert.Error(t, reloader.Reload())
+	assert.Equal(t, "first", served())
+
+	// changed files are picked up by the watcher
+	require.NoError(t, reloader.Watch())
+	newTestCert(t, "second", nil, nil).write(t, dir, "server")
+	assert.Eventually(t, func() bool {
+		return served() == "second"
+	}, 5*time.Second, 50*time.Millisecond)
+
+	_, err = NewTLSReloader(TLSOptions{CertFile: certFile, KeyFile: filepath.Join(dir, "missing.key")}, testLogger)
+	assert.Error(t, err)
+	_, err = NewTLSReloader(TLSOptions{CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile}, testLogger)
+	assert.ErrorContains(t, err, "no certificates")
+}
+
+func TestProxyManager_ClientCertIdentity(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "test ca", nil, nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	server := newTestCert(t, "localhost", ca, func(c *x509.Certificate) {
+		c.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	})
+	certFile, keyFile := server.write(t, dir, "server")
+
+	ciClient := newTestCert(t, "runner-1", ca, func(c *x509.Certificate) {
+		c.DNSNames = []string{"runner-1.ci.example.com"}
+	})
+	otherClient := newTestCert(t, "laptop", ca, nil)
+	untrustedClient := newTestCert(t, "runner-2", newTestCert(t, "other ca", nil, nil), func(c *x509.Certificate) {
+		c.DNSNames = []string{"runner-2.ci.example.com"}
+	})
+
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		APIKeyIdentities: map[string]config.APIKeyIdentity{
+			"ci":     {ClientCerts: []string{"*.ci.example.com"}, Models: []string{"*"}, Endpoints: []string{config.APIKeyEndpointInference}},
+			"viewer": {Key: "viewer-key", Models: []string{"*"}, Endpoints: []string{config.APIKeyEndpointReadOnly}},
+		},
+		LogLevel: "error",
+	})
+	proxy := New(conf)
+	defer proxy.StopProcesses(StopImmediately)
+
+	reloader, err := NewTLSReloader(TLSOptions{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, ClientCertOptional: true}, testLogger)
+	require.NoError(t, err)
+	defer reloader.Close()
+	srv := httptest.NewUnstartedServer(proxy)
+	srv.TLS = reloader.Config()
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(path, key string, clientCert *testCert) (int, error) {
+		tlsConf := &tls.Config{RootCAs: roots}
+		if clientCert != nil {
+			// sent even when it is not signed by one of the CAs of the server
+			tlsConf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				cert := clientCert.tlsCertificate()
+				return &cert, nil
+			}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConf}}
+		req, err := http.NewRequest("GET", srv.URL+path, nil)
+		require.NoError(t, err)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+	status := func(path, key string, clientCert *testCert) int {
+		code, err := get(path, key, clientCert)
+		require.NoError(t, err)
+		return code
+	}
+
+	// the certificate is the credential of the ci key, with its endpoints
+	assert.Equal(t, http.StatusOK, status("/v1/models", "", ciClient))
+	assert.Equal(t, http.StatusForbidden, status("/api/version", "", ciClient))
+	assert.Equal(t, http.StatusUnauthorized, status("/v1/models", "", otherClient))
+	assert.Equal(t, http.StatusUnauthorized, status("/v1/models", "", nil))
+
+	// an API key wins over the certificate
+	assert.Equal(t, http.StatusOK, status("/api/version", "viewer-key", ciClient))
+	assert.Equal(t, http.StatusUnauthorized, status("/v1/models", "wrong-key", ciClient))
+
+	// certificates of other CAs are refused during the handshake
+	_, err = get("/v1/models", "", untrustedClient)
+	assert.Error(t, err)
+
+	// without ClientCertOptional a certificate is required
+	required, err := NewTLSReloader(TLSOptions{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile}, testLogger)
+	require.NoError(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, required.Config().ClientAuth)
+}
+
+func TestProxyManager_ClientCertIdentityFollowsConfig(t *testing.T) {
+	ca := newTestCert(t, "test ca", nil, nil)
+	runner := newTestCert(t, "runner-1", ca, func(c *x509.Certificate) {
+		c.DNSNames = []string{"runner-1.ci.example.com"}
+	})
+
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"variant-a": getTestSimpleResponderConfig("variant-a"),
+			"variant-b": getTestSimpleResponderConfig("variant-b"),
+		},
+		Groups: map[string]config.GroupConfig{
+			"both": {Swap: false, Members: []string{"variant-a", "variant-b"}},
+		},
+		Splits: map[string]config.SplitConfig{
+			"ab-test": {
+				StickyBy: config.SplitStickyAPIKey,
+				Variants: []config.SplitVariant{{Model: "variant-a", Weight: 1}, {Model: "variant-b", Weight: 1}},
+			},
+		},
+		APIKeyIdentities: map[string]config.APIKeyIdentity{
+			"ci": {ClientCerts: []string{"*.ci.example.com"}, Models: []string{"*"}, Endpoints: []string{config.APIKeyEndpointInference}},
+		},
+		LogLevel: "error",
+	})
+	proxy := New(conf)
+	defer proxy.StopProcesses(StopImmediately)
+
+	// the verified chain is set by the TLS server, see TestProxyManager_ClientCertIdentity
+	newRequest := func(remoteAddr string) *http.Request {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"ab-test","messages":[]}`))
+		req.RemoteAddr = remoteAddr
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{runner.cert, ca.cert}}}
+		return req
+	}
+	send := func(remoteAddr string) *TestResponseRecorder {
+		w := CreateTestResponseRecorder()
+		proxy.ServeHTTP(w, newRequest(remoteAddr))
+		return w
+	}
+
+	// the identity name is the sticky key and the key of the metrics, so
+	// the client keeps its variant from any address
+	keyed := httptest.NewRequest("POST", "/", nil)
+	keyed = keyed.WithContext(context.WithValue(keyed.Context(), proxyCtxKey("apiKey"), "ci"))
+	want, _ := newSplitRouter(conf.Splits).assign("ab-test", keyed, "")
+	for i := 0; i < 5; i++ {
+		w := send(fmt.Sprintf("10.0.0.%d:1234", i))
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, want, gjson.Get(w.Body.String(), "responseMessage").String())
+	}
+	metrics := proxy.metricsMonitor.getMetrics()
+	require.NotEmpty(t, metrics)
+	assert.Equal(t, "ci", metrics[len(metrics)-1].APIKey)
+
+	// edited clientCerts apply to new requests
+	require.NotNil(t, proxy.findClientCert(newRequest("10.0.0.1:1234")))
+	updated := conf
+	updated.APIKeyIdentities = map[string]config.APIKeyIdentity{
+		"ci": {ClientCerts: []string{"*.build.example.com"}, Models: []string{"*"}, Endpoints: []string{config.APIKeyEndpointInference}},
+	}
+	proxy.applyConfigAndSyncProcessGroups(updated)
+	assert.Nil(t, proxy.findClientCert(newRequest("10.0.0.1:1234")))
+	assert.Equal(t, http.StatusUnauthorized, send("10.0.0.1:1234").Code)
+}
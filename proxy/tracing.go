@@ -0,0 +1,435 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mostlygeek/llama-swap/proxy/config"
+)
+
+// OpenTelemetry span kinds and status codes, as numbered by OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	spanStatusError = 2
+)
+
+const (
+	traceExportBatch    = 256             // spans per export
+	traceExportInterval = 2 * time.Second // longest a span waits to be exported
+	traceExportQueueMax = 4096            // spans beyond this are dropped while the collector is slow
+	traceExportTimeout  = 10 * time.Second
+
+	traceparentHeader = "traceparent"
+)
+
+// tracer records spans and exports them to an OpenTelemetry collector with
+// OTLP/HTTP in its JSON encoding.
+//
+// Spans are exported in batches from timers rather than a goroutine owned
+// by the ProxyManager, so requests finishing on a ProxyManager that was
+// replaced by a config reload are still exported.
+type tracer struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	sampleRatio float64
+	client      *http.Client
+	logger      *LogMonitor
+
+	mu        sync.Mutex
+	queue     []*span
+	scheduled bool // a flush is scheduled
+	dropped   int
+}
+
+// newTracer returns nil when tracing.endpoint is not set
+func newTracer(conf config.TracingConfig, logger *LogMonitor) *tracer {
+	endpoint := strings.TrimSpace(conf.Endpoint)
+	if endpoint == "" {
+		return nil
+	}
+	if u, err := url.Parse(endpoint); err == nil && (u.Path == "" || u.Path == "/") {
+		u.Path = "/v1/traces"
+		endpoint = u.String()
+	}
+	return &tracer{
+		endpoint:    endpoint,
+		headers:     conf.Headers,
+		serviceName: conf.ServiceName,
+		sampleRatio: conf.SampleRatio,
+		client:      &http.Client{Timeout: traceExportTimeout},
+		logger:      logger,
+	}
+}
+
+// span is one timed operation of a trace. All methods do nothing on a nil
+// span, which is what startSpan returns for requests that are not traced.
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte // zero for a root span
+	sampled  bool
+	name     string
+	kind     int
+	start    time.Time
+
+	mu            sync.Mutex
+	finished      time.Time
+	attrs         map[string]any
+	events        []spanEvent
+	statusCode    int
+	statusMessage string
+}
+
+type spanEvent struct {
+	time  time.Time
+	name  string
+	attrs map[string]any
+}
+
+// startRequestSpan starts the root span of an incoming request. It continues
+// the trace of a valid traceparent header and follows its sampled flag,
+// otherwise a new trace is sampled with sampleRatio.
+func (t *tracer) startRequestSpan(r *http.Request, name string) (*http.Request, *span) {
+	if t == nil {
+		return r, nil
+	}
+	s := &span{tracer: t, name: name, kind: spanKindServer, start: time.Now(), attrs: map[string]any{}}
+	if traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get(traceparentHeader)); ok {
+		s.traceID, s.parentID, s.sampled = traceID, parentID, sampled
+	} else {
+		rand.Read(s.traceID[:])
+		s.sampled = t.sample()
+	}
+	rand.Read(s.spanID[:])
+	return r.WithContext(context.WithValue(r.Context(), proxyCtxKey("span"), s)), s
+}
+
+func (t *tracer) sample() bool {
+	if t.sampleRatio >= 1 {
+		return true
+	}
+	if t.sampleRatio <= 0 {
+		return false
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+	return err == nil && float64(n.Int64())/math.MaxInt64 < t.sampleRatio
+}
+
+// spanFromContext returns the current span of ctx, nil when not traced
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(proxyCtxKey("span")).(*span)
+	return s
+}
+
+// startSpan starts a child of the current span of ctx. It returns ctx and a
+// nil span when ctx is not traced.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	parent := spanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := &span{
+		tracer:   parent.tracer,
+		traceID:  parent.traceID,
+		parentID: parent.spanID,
+		sampled:  parent.sampled,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+		attrs:    map[string]any{},
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, proxyCtxKey("span"), s), s
+}
+
+// setAttr sets an attribute, value is a string, bool, int, int64 or float64
+func (s *span) setAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs[key] = value
+}
+
+// addEvent records something that happened during the span
+func (s *span) addEvent(name string, attrs map[string]any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, spanEvent{time: time.Now(), name: name, attrs: attrs})
+}
+
+// setError marks the span as failed with err, a nil err is ignored
+func (s *span) setError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statusCode = spanStatusError
+	s.statusMessage = err.Error()
+}
+
+// end finishes the span and queues it for export. Only the first call counts.
+func (s *span) end() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.finished.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.finished = time.Now()
+	s.mu.Unlock()
+	if s.sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+// traceparent is the W3C trace context header value that makes s the parent
+// of the spans of the receiver
+func (s *span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-" + flags
+}
+
+// injectTraceparent sets the traceparent header for the current span of ctx.
+// When ctx is not traced a traceparent of the client is passed on as is.
+func injectTraceparent(ctx context.Context, header http.Header) {
+	if s := spanFromContext(ctx); s != nil {
+		header.Set(traceparentHeader, s.traceparent())
+	}
+}
+
+// parseTraceparent reads a version 00 W3C traceparent header
+func parseTraceparent(value string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags&1 == 1, true
+}
+
+func (t *tracer) enqueue(s *span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.queue) >= traceExportQueueMax {
+		t.dropped++
+		return
+	}
+	t.queue = append(t.queue, s)
+	switch {
+	case len(t.queue) >= traceExportBatch:
+		go t.flush()
+	case !t.scheduled:
+		t.scheduled = true
+		time.AfterFunc(traceExportInterval, t.flush)
+	}
+}
+
+// flush exports the queued spans
+func (t *tracer) flush() {
+	t.mu.Lock()
+	spans := t.queue
+	dropped := t.dropped
+	t.queue = nil
+	t.dropped = 0
+	t.scheduled = false
+	t.mu.Unlock()
+
+	if dropped > 0 {
+		t.logger.Warnf("tracing: dropped %d spans, the collector is not keeping up", dropped)
+	}
+	for len(spans) > 0 {
+		n := min(len(spans), traceExportBatch)
+		if err := t.export(spans[:n]); err != nil {
+			t.logger.Warnf("tracing: failed to export %d spans: %v", n, err)
+		}
+		spans = spans[n:]
+	}
+}
+
+// close exports the queued spans. Spans that end later are still exported.
+func (t *tracer) close() {
+	if t != nil {
+		t.flush()
+	}
+}
+
+func (t *tracer) export(spans []*span) error {
+	body, err := json.Marshal(t.otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// The OTLP/JSON encoding of an ExportTraceServiceRequest. IDs are hex
+// strings and 64 bit integers are decimal strings.
+type (
+	otlpTraceRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Events            []otlpEvent    `json:"events,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpEvent struct {
+		TimeUnixNano string         `json:"timeUnixNano"`
+		Name         string         `json:"name"`
+		Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+)
+
+func (t *tracer) otlpRequest(spans []*span) otlpTraceRequest {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.finished.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attrs),
+			Status:            otlpStatus{Code: s.statusCode, Message: s.statusMessage},
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for _, e := range s.events {
+			o.Events = append(o.Events, otlpEvent{
+				TimeUnixNano: strconv.FormatInt(e.time.UnixNano(), 10),
+				Name:         e.name,
+				Attributes:   otlpAttributes(e.attrs),
+			})
+		}
+		s.mu.Unlock()
+		encoded = append(encoded, o)
+	}
+	return otlpTraceRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes(map[string]any{"service.name": t.serviceName})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "llama-swap"}, Spans: encoded}},
+	}}}
+}
+
+// otlpAttributes encodes attrs sorted by key
+func otlpAttributes(attrs map[string]any) []otlpKeyValue {
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	encoded := make([]otlpKeyValue, 0, len(keys))
+	for _, key := range keys {
+		var value otlpValue
+		switch v := attrs[key].(type) {
+		case string:
+			value.StringValue = &v
+		case bool:
+			value.BoolValue = &v
+		case int:
+			i := strconv.Itoa(v)
+			value.IntValue = &i
+		case int64:
+			i := strconv.FormatInt(v, 10)
+			value.IntValue = &i
+		case float64:
+			value.DoubleValue = &v
+		default:
+			s := fmt.Sprint(v)
+			value.StringValue = &s
+		}
+		encoded = append(encoded, otlpKeyValue{Key: key, Value: value})
+	}
+	return encoded
+}
@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCollector stands in for an OpenTelemetry collector
+type testCollector struct {
+	*httptest.Server
+	mu    sync.Mutex
+	spans []otlpSpan
+	paths []string
+}
+
+func newTestCollector(t *testing.T) *testCollector {
+	collector := &testCollector{}
+	collector.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpTraceRequest
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("Content-Type") != "application/json" || json.Unmarshal(body, &req) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		collector.mu.Lock()
+		defer collector.mu.Unlock()
+		collector.paths = append(collector.paths, r.URL.Path+" "+r.Header.Get("X-Collector-Token"))
+		for _, resourceSpans := range req.ResourceSpans {
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				collector.spans = append(collector.spans, scopeSpans.Spans...)
+			}
+		}
+	}))
+	t.Cleanup(collector.Close)
+	return collector
+}
+
+// byName returns the received spans by name
+func (c *testCollector) byName() map[string]otlpSpan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	spans := make(map[string]otlpSpan)
+	for _, s := range c.spans {
+		spans[s.Name] = s
+	}
+	return spans
+}
+
+func TestParseTraceparent(t *testing.T) {
+	traceID, parentID, sampled, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.True(t, ok)
+	assert.True(t, sampled)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", hex.EncodeToString(traceID[:]))
+	assert.Equal(t, "00f067aa0ba902b7", hex.EncodeToString(parentID[:]))
+
+	_, _, sampled, ok = parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	assert.True(t, ok)
+	assert.False(t, sampled)
+
+	for _, invalid := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz",
+	} {
+		_, _, _, ok := parseTraceparent(invalid)
+		assert.False(t, ok, invalid)
+	}
+}
+
+func TestSpan_NilIsNoop(t *testing.T) {
+	ctx, s := startSpan(context.Background(), "untraced", spanKindInternal)
+	assert.Nil(t, s)
+	assert.Nil(t, spanFromContext(ctx))
+	s.setAttr("key", "value")
+	s.addEvent("event", nil)
+	s.setError(errors.New("failed"))
+	s.end()
+
+	header := http.Header{}
+	header.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	injectTraceparent(ctx, header)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", header.Get(traceparentHeader))
+
+	var nilTracer *tracer
+	r := httptest.NewRequest("GET", "/", nil)
+	r2, root := nilTracer.startRequestSpan(r, "GET /")
+	assert.Nil(t, root)
+	assert.Same(t, r, r2)
+	nilTracer.close()
+}
+
+func TestTracer_SampleRatio(t *testing.T) {
+	collector := newTestCollector(t)
+	tr := newTracer(config.TracingConfig{Endpoint: collector.URL, SampleRatio: 0}, testLogger)
+
+	// a new trace is not sampled
+	_, root := tr.startRequestSpan(httptest.NewRequest("GET", "/", nil), "GET /")
+	assert.False(t, root.sampled)
+	assert.Equal(t, "00", root.traceparent()[53:])
+	root.end()
+
+	// the sampled flag of the client wins
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r, root = tr.startRequestSpan(r, "GET /")
+	_, child := startSpan(r.Context(), "child", spanKindInternal)
+	assert.True(t, child.sampled)
+	child.end()
+	root.end()
+
+	tr.close()
+	spans := collector.byName()
+	assert.Len(t, spans, 2)
+	assert.Contains(t, spans, "child")
+}
+
+func TestProxyManager_Tracing(t *testing.T) {
+	collector := newTestCollector(t)
+
+	var peerTraceparent string
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peerTraceparent = r.Header.Get(traceparentHeader)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"usage":{"prompt_tokens":1,"completion_tokens":1}}`))
+	}))
+	defer peer.Close()
+	peerURL, _ := url.Parse(peer.URL)
+
+	conf := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"traced-model": getTestSimpleResponderConfig("traced-model"),
+		},
+		Peers: map[string]config.PeerConfig{
+			"peer1": {Proxy: peer.URL, ProxyURL: peerURL, Models: []string{"peer-model"}},
+		},
+		Tracing: config.TracingConfig{
+			Endpoint:    collector.URL,
+			ServiceName: "llama-swap-test",
+			SampleRatio: 1,
+			Headers:     map[string]string{"X-Collector-Token": "secret"},
+		},
+		LogLevel: "error",
+	})
+
+	proxy := New(conf)
+	defer proxy.StopProcesses(StopImmediately)
+
+	const clientTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"traced-model"}`))
+	req.Header.Set(traceparentHeader, "00-"+clientTraceID+"-00f067aa0ba902b7-01")
+	w := CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	req = httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"peer-model"}`))
+	w = CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	proxy.tracer.close()
+	spans := collector.byName()
+
+	root, ok := spans["POST /v1/chat/completions"]
+	require.True(t, ok, "root span missing: %v", spans)
+	assert.Equal(t, spanKindServer, root.Kind)
+
+	local := []string{"swap process group", "start traced-model", "spawn", "warmup", "upstream traced-model"}
+	for _, name := range local {
+		s, ok := spans[name]
+		require.True(t, ok, "span %q missing", name)
+		assert.Equal(t, clientTraceID, s.TraceID, name)
+	}
+	assert.Equal(t, spans["start traced-model"].SpanID, spans["spawn"].ParentSpanID)
+	assert.Equal(t, spans["start traced-model"].SpanID, spans["warmup"].ParentSpanID)
+	assert.Equal(t, spanKindClient, spans["upstream traced-model"].Kind)
+
+	// the peer received the trace context of its span
+	peerSpan, ok := spans["peer peer-model"]
+	require.True(t, ok)
+	assert.Equal(t, "00-"+peerSpan.TraceID+"-"+peerSpan.SpanID+"-01", peerTraceparent)
+
+	collector.mu.Lock()
+	assert.Contains(t, collector.paths, "/v1/traces secret")
+	collector.mu.Unlock()
+}
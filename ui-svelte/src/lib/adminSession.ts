@@ -0,0 +1,70 @@
+import { writable } from "svelte/store";
+import type { AdminSession } from "./types";
+
+const CSRF_COOKIE = "llama_swap_csrf";
+const CSRF_HEADER = "X-CSRF-Token";
+const SAFE_METHODS = ["GET", "HEAD", "OPTIONS"];
+
+export const adminSession = writable<AdminSession | null>(null);
+
+function csrfToken(): string {
+  const prefix = `${CSRF_COOKIE}=`;
+  const cookie = document.cookie.split("; ").find((part) => part.startsWith(prefix));
+  return cookie ? decodeURIComponent(cookie.substring(prefix.length)) : "";
+}
+
+function redirectToLogin(loginURL: string): void {
+  const next = window.location.pathname + window.location.search + window.location.hash;
+  window.location.assign(`${loginURL}?next=${encodeURIComponent(next)}`);
+}
+
+// installAdminFetch wraps window.fetch so requests from the UI carry the CSRF
+// token of the session and a signed out user is sent to the sign in page
+export function installAdminFetch(): void {
+  const originalFetch = window.fetch.bind(window);
+
+  window.fetch = async (input: RequestInfo | URL, init?: RequestInit): Promise<Response> => {
+    const target = input instanceof Request ? input.url : input.toString();
+    const method = init?.method ?? (input instanceof Request ? input.method : "GET");
+    const sameOrigin = new URL(target, window.location.href).origin === window.location.origin;
+
+    if (sameOrigin && !SAFE_METHODS.includes(method.toUpperCase())) {
+      const token = csrfToken();
+      if (token) {
+        const headers = new Headers(init?.headers ?? (input instanceof Request ? input.headers : undefined));
+        headers.set(CSRF_HEADER, token);
+        init = { ...init, headers };
+      }
+    }
+
+    const response = await originalFetch(input, init);
+    const loginURL = response.headers.get("X-Login-URL");
+    if (sameOrigin && response.status === 401 && loginURL) {
+      redirectToLogin(loginURL);
+    }
+    return response;
+  };
+}
+
+export async function loadAdminSession(): Promise<void> {
+  try {
+    const response = await fetch("/auth/session");
+    if (!response.ok) {
+      adminSession.set(null);
+      return;
+    }
+    const data: AdminSession = await response.json();
+    adminSession.set(data.enabled ? data : null);
+  } catch (error) {
+    console.error("Failed to load session:", error);
+  }
+}
+
+export async function signOut(): Promise<void> {
+  const response = await fetch("/auth/logout", { method: "POST" });
+  if (!response.ok) {
+    throw new Error(`Sign out failed: ${response.status}`);
+  }
+  adminSession.set(null);
+  window.location.assign("/auth/login");
+}
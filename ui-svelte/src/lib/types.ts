@@ -13,6 +13,18 @@ export interface Model {
   recipeRef?: string;
   mode?: "solo" | "cluster";
   tensorParallel?: number;
+  split?: SplitStatus;
+}
+
+export interface SplitStatus {
+  stickyBy: "apiKey" | "header" | "none";
+  stickyHeader?: string;
+  variants: {
+    model: string;
+    weight: number;
+    share: number;
+    requests: number;
+  }[];
 }
 
 export interface Metrics {
@@ -25,16 +37,56 @@ export interface Metrics {
   prompt_per_second: number;
   tokens_per_second: number;
   duration_ms: number;
+  ttft_ms: number;
+  itl_mean_ms: number;
+  itl_p95_ms: number;
+  wait_ms: number;
   has_capture: boolean;
+  endpoint: string;
+  api_key?: string;
+  request_id?: string;
+  mirror_of?: string;
+  split?: string;
+  status_code?: number;
+  error?: string;
 }
 
 export interface ReqRespCapture {
   id: number;
+  request_id?: string;
+  timestamp: string;
+  model: string;
+  status: number;
+  duration_ms: number;
+  replay_of?: string;
+  mirror_of?: string;
+  split?: string;
+  req_method: string;
   req_path: string;
+  req_query?: string;
   req_headers: Record<string, string>;
   req_body: string; // base64 encoded bytes
   resp_headers: Record<string, string>;
   resp_body: string; // base64 encoded bytes
+  chunks?: StreamChunk[]; // events of a streamed response
+  assembled?: AssembledMessage; // final message of a streamed response
+}
+
+export interface StreamChunk {
+  offset_ms: number; // since the request was received
+  event?: string;
+  data: unknown;
+}
+
+export interface AssembledMessage {
+  role: string;
+  content: string;
+  reasoning_content?: string;
+  tool_calls?: {
+    id: string;
+    type: string;
+    function: { name: string; arguments: string };
+  }[];
 }
 
 export interface LogData {
@@ -43,16 +95,43 @@ export interface LogData {
 }
 
 export interface APIEventEnvelope {
-  type: "modelStatus" | "logData" | "metrics";
+  type: "modelStatus" | "logData" | "metrics" | "audit";
   data: string;
 }
 
+export interface AuditEntry {
+  id: string;
+  timestamp: string;
+  user?: string;
+  role?: string;
+  api_key?: string;
+  client: string;
+  method: string;
+  route: string;
+  path: string;
+  payload?: unknown;
+  nodes?: string[];
+  status: number;
+  result: "ok" | "error";
+  error?: string;
+  duration_ms: number;
+}
+
 export interface VersionInfo {
   build_date: string;
   commit: string;
   version: string;
 }
 
+export interface AdminSession {
+  enabled: boolean;
+  user?: string;
+  role?: "viewer" | "operator" | "admin";
+  method?: "password" | "oidc";
+  expires_at?: string;
+  csrf_token?: string;
+}
+
 export type ScreenWidth = "xs" | "sm" | "md" | "lg" | "xl" | "2xl";
 
 export type BenchyJobStatus = "scheduled" | "running" | "done" | "error" | "canceled";
@@ -2,6 +2,10 @@ import "./index.css";
 import "highlight.js/styles/github-dark.css";
 import App from "./App.svelte";
 import { mount } from "svelte";
+import { installAdminFetch, loadAdminSession } from "./lib/adminSession";
+
+installAdminFetch();
+loadAdminSession();
 
 const app = mount(App, {
   target: document.getElementById("app")!,
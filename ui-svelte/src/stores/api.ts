@@ -26,16 +26,19 @@ import type {
   ConfigEditorState,
   ClusterStatusState,
   ClusterDGXUpdateResponse,
+  AuditEntry,
 } from "../lib/types";
 import { connectionState } from "./theme";
 
 const LOG_LENGTH_LIMIT = 1024 * 100; /* 100KB of log data */
+const AUDIT_ENTRIES_LIMIT = 200;
 
 // Stores
 export const models = writable<Model[]>([]);
 export const proxyLogs = writable<string>("");
 export const upstreamLogs = writable<string>("");
 export const metrics = writable<Metrics[]>([]);
+export const auditEntries = writable<AuditEntry[]>([]);
 export const versionInfo = writable<VersionInfo>({
   build_date: "unknown",
   commit: "unknown",
@@ -75,6 +78,7 @@ export function enableAPIEvents(enabled: boolean): void {
       metrics.set([]);
       retryCount = 0;
       connectionState.set("connected");
+      listAuditEntries(AUDIT_ENTRIES_LIMIT).then((entries) => auditEntries.set(entries));
     };
 
     apiEventSource.onmessage = (e: MessageEvent) => {
@@ -109,6 +113,12 @@ export function enableAPIEvents(enabled: boolean): void {
             metrics.update((prevMetrics) => [...newMetrics, ...prevMetrics]);
             break;
           }
+
+          case "audit": {
+            const entry = JSON.parse(message.data) as AuditEntry;
+            auditEntries.update((prev) => [entry, ...prev].slice(0, AUDIT_ENTRIES_LIMIT));
+            break;
+          }
         }
       } catch (err) {
         console.error(e.data, err);
@@ -143,6 +153,21 @@ connectionState.subscribe(async (status) => {
   }
 });
 
+// listAuditEntries returns the newest administrative actions first
+export async function listAuditEntries(limit: number): Promise<AuditEntry[]> {
+  try {
+    const response = await fetch(`/api/audit?limit=${limit}`);
+    if (!response.ok) {
+      throw new Error(`HTTP error! status: ${response.status}`);
+    }
+    const data = await response.json();
+    return data.entries || [];
+  } catch (error) {
+    console.error("Failed to fetch audit entries:", error);
+    return [];
+  }
+}
+
 export async function listModels(): Promise<Model[]> {
   try {
     const response = await fetch("/api/models/");